@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/datasegment"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// aggregatePiece is the data segment piece of an aggregate: the pieces of the
+// aggregated contents and of the root block of the aggregate dag laid out with
+// a segment index. The piece commitment record of the aggregate dag stays the
+// piece of its car. Deals made with the http transfer type are made on the
+// data segment piece, the provider downloads it laid out from /piece.
+// Graphsync transfers can only send the car of the dag.
+type aggregatePiece struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	Content   uint      `gorm:"uniqueIndex" json:"content"`
+	// Data is the root of the aggregate dag
+	Data  util.DbCID `gorm:"index" json:"data"`
+	Piece util.DbCID `json:"piece"`
+	// Size is the padded size of the piece
+	Size uint64 `json:"size"`
+}
+
+// aggregateSegment is where a content sits in the data segment piece of the
+// aggregate it is in, with the proof of it. The segment of the root block of
+// the aggregate dag has the aggregate as content.
+type aggregateSegment struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Aggregate uint `gorm:"index"`
+	Content   uint `gorm:"uniqueIndex"`
+	Piece     util.DbCID
+	Offset    uint64
+	Size      uint64
+	// Proof is the json encoded datasegment.InclusionProof
+	Proof string
+}
+
+// maxAggregateSize is the largest data segment piece made, the size of the
+// sectors most providers seal
+const maxAggregateSize = 32 << 30
+
+// aggregateSizeLimit is the largest padded size of the data segment piece of a
+// staging zone: the smallest piece its max size fits in, or the piece size of
+// its policy, and never more than a sector
+func aggregateSizeLimit(pol config.StagingPolicy) uint64 {
+	if pol.MaxSize <= 0 {
+		return maxAggregateSize
+	}
+
+	padded := uint64(pol.MaxSize) + uint64(pol.MaxSize+126)/127
+	limit := uint64(datasegment.MinPieceSize)
+	for limit < padded && limit < maxAggregateSize {
+		limit <<= 1
+	}
+
+	if pol.PieceSize > 0 && uint64(pol.PieceSize) < limit {
+		limit = uint64(pol.PieceSize)
+	}
+	return limit
+}
+
+// segmentItem is a piece laid out in a data segment aggregate
+type segmentItem struct {
+	content uint
+	piece   cid.Cid
+	seg     datasegment.Piece
+}
+
+// sortSegmentItems puts the biggest pieces first so alignment leaves no gaps
+func sortSegmentItems(items []segmentItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].seg.Size != items[j].seg.Size {
+			return items[i].seg.Size > items[j].seg.Size
+		}
+		return items[i].content < items[j].content
+	})
+}
+
+func segmentPieces(items []segmentItem) []datasegment.Piece {
+	pieces := make([]datasegment.Piece, len(items))
+	for i, it := range items {
+		pieces[i] = it.seg
+	}
+	return pieces
+}
+
+// segmentItems returns the pieces of the contents of an aggregate, biggest
+// first. It returns ErrWaitForRemoteCompute until the piece commitments of
+// contents on shuttles are computed.
+func (cm *ContentManager) segmentItems(ctx context.Context, conts []Content) ([]segmentItem, error) {
+	var waiting bool
+	items := make([]segmentItem, 0, len(conts))
+	for _, c := range conts {
+		pc, _, size, err := cm.getPieceCommitment(ctx, c.Cid.CID, cm.Blockstore)
+		if err != nil {
+			if xerrors.Is(err, ErrWaitForRemoteCompute) {
+				// get all the computations going before waiting
+				waiting = true
+				continue
+			}
+			return nil, fmt.Errorf("failed to get piece commitment of content %d: %w", c.ID, err)
+		}
+
+		n, err := datasegment.NodeFromCID(pc)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, segmentItem{
+			content: c.ID,
+			piece:   pc,
+			seg:     datasegment.Piece{CommP: n, Size: uint64(size.Padded())},
+		})
+	}
+
+	if waiting {
+		return nil, ErrWaitForRemoteCompute
+	}
+
+	sortSegmentItems(items)
+	return items, nil
+}
+
+// fitSegments splits items, biggest first, into the ones that fit in an
+// aggregate of at most limit bytes and the rest. The first item is always
+// taken so that every aggregate holds something.
+func fitSegments(items []segmentItem, limit uint64) ([]segmentItem, []segmentItem) {
+	var fit, rest []segmentItem
+	for i, it := range items {
+		if i > 0 {
+			size, err := datasegment.DealSize(segmentPieces(append(fit, it)))
+			if err != nil || size > limit {
+				rest = append(rest, it)
+				continue
+			}
+		}
+		fit = append(fit, it)
+	}
+	return fit, rest
+}
+
+// rootSegment is the piece of the car of the root block of the aggregate dag
+// alone, the blocks below it are in the pieces of the aggregated contents
+func rootSegment(ctx context.Context, aggr uint, root *merkledag.ProtoNode) (segmentItem, error) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	if err := bs.Put(ctx, root); err != nil {
+		return segmentItem{}, err
+	}
+
+	calc := new(commp.Calc)
+	if err := piecetransfer.WriteRootCar(ctx, bs, root.Cid(), calc); err != nil {
+		return segmentItem{}, err
+	}
+
+	digest, size, err := calc.Digest()
+	if err != nil {
+		return segmentItem{}, err
+	}
+
+	var n datasegment.Node
+	copy(n[:], digest)
+	pc, err := n.CID()
+	if err != nil {
+		return segmentItem{}, err
+	}
+
+	return segmentItem{
+		content: aggr,
+		piece:   pc,
+		seg:     datasegment.Piece{CommP: n, Size: size},
+	}, nil
+}
+
+// buildSegmentAggregate lays out the pieces of the contents of an aggregate
+// and of the root of its dag, and stores the inclusion proof of each of them
+func (cm *ContentManager) buildSegmentAggregate(ctx context.Context, aggr uint, root *merkledag.ProtoNode, items []segmentItem) (*aggregatePiece, error) {
+	rs, err := rootSegment(ctx, aggr, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute piece of aggregate root: %w", err)
+	}
+
+	items = append(append([]segmentItem{}, items...), rs)
+	sortSegmentItems(items)
+
+	pieces := segmentPieces(items)
+	dealSize, err := datasegment.DealSize(pieces)
+	if err != nil {
+		return nil, err
+	}
+
+	agg, err := datasegment.NewAggregate(dealSize, pieces)
+	if err != nil {
+		return nil, err
+	}
+
+	aggCid, err := agg.CommP().CID()
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]aggregateSegment, len(items))
+	for i, it := range items {
+		proof, err := agg.ProofForPiece(i)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(proof)
+		if err != nil {
+			return nil, err
+		}
+
+		segs[i] = aggregateSegment{
+			Aggregate: aggr,
+			Content:   it.content,
+			Piece:     util.DbCID{CID: it.piece},
+			Offset:    agg.Index[i].Offset,
+			Size:      agg.Index[i].Size,
+			Proof:     string(b),
+		}
+	}
+
+	ap := &aggregatePiece{
+		Content: aggr,
+		Data:    util.DbCID{CID: root.Cid()},
+		Piece:   util.DbCID{CID: aggCid},
+		Size:    dealSize,
+	}
+
+	if err := cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := removeSegmentAggregate(tx, aggr); err != nil {
+			return err
+		}
+
+		if err := tx.Create(ap).Error; err != nil {
+			return err
+		}
+		return tx.CreateInBatches(segs, 500).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Infow("built data segment aggregate", "content", aggr, "piece", aggCid, "size", dealSize, "segments", len(segs))
+	return ap, nil
+}
+
+// planSegmentAggregate picks the contents of a staging zone whose data segment
+// aggregate, root included, fits in the size limit of the zone. It returns
+// ErrWaitForRemoteCompute until the piece commitments of contents on shuttles
+// are computed.
+func (cm *ContentManager) planSegmentAggregate(ctx context.Context, b *contentStagingZone) (fit []segmentItem, rest []Content, err error) {
+	items, err := cm.segmentItems(ctx, b.Contents)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limit := aggregateSizeLimit(b.Policy)
+	fit, over := fitSegments(items, limit)
+
+	// the root links every content, leave the smallest ones to the next
+	// zone until it fits too
+	for len(fit) > 1 {
+		conts := contentsOfSegments(b.Contents, fit)
+		dir, err := cm.createAggregate(ctx, conts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rs, err := rootSegment(ctx, b.ContID, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		all := append(append([]segmentItem{}, fit...), rs)
+		sortSegmentItems(all)
+		size, err := datasegment.DealSize(segmentPieces(all))
+		if err == nil && size <= limit {
+			break
+		}
+
+		over = append(over, fit[len(fit)-1])
+		fit = fit[:len(fit)-1]
+	}
+	return fit, contentsOfSegments(b.Contents, over), nil
+}
+
+func contentsOfSegments(conts []Content, items []segmentItem) []Content {
+	in := make(map[uint]bool, len(items))
+	for _, it := range items {
+		in[it.content] = true
+	}
+
+	var out []Content
+	for _, c := range conts {
+		if in[c.ID] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// segmentPieceFor returns the data segment piece deals for data are made on,
+// nil when data is not an aggregate laid out as one or deals are made on the
+// car of data
+func (cm *ContentManager) segmentPieceFor(data cid.Cid) (*aggregatePiece, error) {
+	if cm.DealTransfer != config.DealTransferHttp {
+		return nil, nil
+	}
+
+	var aps []aggregatePiece
+	if err := cm.DB.Find(&aps, "data = ?", data.Bytes()).Error; err != nil {
+		return nil, err
+	}
+	if len(aps) == 0 {
+		return nil, nil
+	}
+	return &aps[0], nil
+}
+
+// getDealPieceCommitment returns the piece commitment deals for data are made
+// on, the data segment piece of an aggregate when there is one to make them on
+func (cm *ContentManager) getDealPieceCommitment(ctx context.Context, data cid.Cid, bs blockstore.Blockstore) (cid.Cid, uint64, abi.UnpaddedPieceSize, error) {
+	ap, err := cm.segmentPieceFor(data)
+	if err != nil {
+		return cid.Undef, 0, 0, err
+	}
+	if ap == nil {
+		return cm.getPieceCommitment(ctx, data, bs)
+	}
+
+	// the provider gets the unpadded bytes of the piece
+	size := datasegment.UnpaddedSize(ap.Size)
+	return ap.Piece.CID, size, abi.UnpaddedPieceSize(size), nil
+}
+
+// isDealPiece returns whether piece is the piece of the car of data or the
+// data segment piece of it, deals made with either transfer type are kept
+// when it is changed
+func (cm *ContentManager) isDealPiece(data cid.Cid, piece cid.Cid) (bool, error) {
+	pcr, err := cm.lookupPieceCommRecord(data)
+	if err != nil {
+		return false, err
+	}
+	if pcr != nil && pcr.Piece.CID == piece {
+		return true, nil
+	}
+
+	var count int64
+	if err := cm.DB.Model(aggregatePiece{}).Where("data = ? and piece = ?", data.Bytes(), util.DbCID{CID: piece}).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// errSegmentAggregatePush is returned for deals with miners that only take
+// graphsync pushes, which cannot send the data segment layout of an aggregate
+var errSegmentAggregatePush = fmt.Errorf("miner only supports push transfers, which cannot send a data segment aggregate")
+
+// segmentsForPayload returns the segments of the data segment piece deals for
+// payload are made on, nil when they are made on the car of payload
+func (cm *ContentManager) segmentsForPayload(payload cid.Cid) ([]piecetransfer.Segment, error) {
+	ap, err := cm.segmentPieceFor(payload)
+	if err != nil || ap == nil {
+		return nil, err
+	}
+
+	type segmentRow struct {
+		Content   uint
+		Cid       util.DbCID
+		Piece     util.DbCID
+		SegOffset uint64
+		Size      uint64
+	}
+
+	var rows []segmentRow
+	if err := cm.DB.Model(aggregateSegment{}).
+		Joins("left join contents on contents.id = aggregate_segments.content").
+		Where("aggregate_segments.aggregate = ?", ap.Content).
+		Select("aggregate_segments.content as content, contents.cid as cid, aggregate_segments.piece as piece, aggregate_segments.offset as seg_offset, aggregate_segments.size as size").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("data segment piece %s of aggregate %d has no segments", ap.Piece.CID, ap.Content)
+	}
+
+	// the layout is the order of the segments in the piece
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].SegOffset < rows[j].SegOffset
+	})
+
+	segs := make([]piecetransfer.Segment, len(rows))
+	for i, r := range rows {
+		segs[i] = piecetransfer.Segment{
+			Payload:  r.Cid.CID,
+			Piece:    r.Piece.CID,
+			Size:     r.Size,
+			RootOnly: r.Content == ap.Content,
+		}
+	}
+	return segs, nil
+}
+
+func removeSegmentAggregate(tx *gorm.DB, aggr uint) error {
+	if err := tx.Where("aggregate = ?", aggr).Delete(&aggregateSegment{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("content = ?", aggr).Delete(&aggregatePiece{}).Error
+}
+
+type aggregateInclusion struct {
+	Content        uint                        `json:"content"`
+	Aggregate      uint                        `json:"aggregate"`
+	Piece          util.DbCID                  `json:"piece"`
+	Offset         uint64                      `json:"offset"`
+	Size           uint64                      `json:"size"`
+	AggregatePiece util.DbCID                  `json:"aggregatePiece"`
+	AggregateSize  uint64                      `json:"aggregateSize"`
+	Proof          *datasegment.InclusionProof `json:"proof"`
+}
+
+// getAggregateInclusion returns the proof that a content is in the data
+// segment piece of its aggregate
+func (s *Server) getAggregateInclusion(cont Content) (*aggregateInclusion, error) {
+	var seg aggregateSegment
+	if err := s.DB.First(&seg, "content = ? and aggregate = ?", cont.ID, cont.AggregatedIn).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_PROOF_NOT_FOUND,
+				Details: fmt.Sprintf("content %d has no inclusion proof in aggregate %d", cont.ID, cont.AggregatedIn),
+			}
+		}
+		return nil, err
+	}
+
+	var ap aggregatePiece
+	if err := s.DB.First(&ap, "content = ?", seg.Aggregate).Error; err != nil {
+		return nil, err
+	}
+
+	var proof datasegment.InclusionProof
+	if err := json.Unmarshal([]byte(seg.Proof), &proof); err != nil {
+		return nil, fmt.Errorf("invalid inclusion proof of content %d: %w", cont.ID, err)
+	}
+
+	return &aggregateInclusion{
+		Content:        cont.ID,
+		Aggregate:      seg.Aggregate,
+		Piece:          seg.Piece,
+		Offset:         seg.Offset,
+		Size:           seg.Size,
+		AggregatePiece: ap.Piece,
+		AggregateSize:  ap.Size,
+		Proof:          &proof,
+	}, nil
+}
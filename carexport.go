@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// handleExportCar godoc
+// @Summary      Export content as a CAR
+// @Description  This endpoint streams the DAG of a content as a CAR file. The export can be scoped to a unixfs sub-path, limited to a depth, or restricted by a dag-json encoded IPLD selector. Offloaded content is retrieved before it is exported, and requests for content held by a shuttle are redirected to it.
+// @Tags         content
+// @Produce      application/vnd.ipld.car
+// @Param        content   path   int     true   "Content ID"
+// @Param        version   query  int     false  "CAR version, 1 (default) or 2"
+// @Param        path      query  string  false  "Sub-path of the DAG to export"
+// @Param        depth     query  int     false  "Maximum depth of links to follow"
+// @Param        selector  query  string  false  "dag-json encoded IPLD selector"
+// @Router       /content/export/{content} [get]
+func (s *Server) handleExportCar(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	var cont Content
+	if err := s.DB.First(&cont, "id = ? and active", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if err := s.isContentOwner(u, cont, util.OrgRoleViewer); err != nil {
+		return err
+	}
+
+	export, err := util.ParseCarExport(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.refreshOffloadedContent(ctx, &cont); err != nil {
+		return err
+	}
+
+	if cont.Location != util.ContentLocationLocal {
+		redir, err := s.shuttleExportURL(&cont)
+		if err != nil {
+			return err
+		}
+
+		if q := c.Request().URL.RawQuery; q != "" {
+			redir += "?" + q
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, redir)
+	}
+
+	bs := s.Node.Blockstore
+	root, err := export.Root(ctx, bs, cont.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, export.ContentType())
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.car\"", root))
+	resp.Header().Set("X-Ipfs-Roots", root.String())
+
+	if export.IsFull() && export.Version == 1 {
+		// the objects tracked for the content are exactly the blocks of a
+		// full export, so its size is known up front
+		size, err := s.carSizeForContent(ctx, &cont)
+		if err != nil {
+			log.Warnf("failed to calculate car size for content %d: %s", cont.ID, err)
+		} else {
+			resp.Header().Set(echo.HeaderContentLength, strconv.FormatUint(size, 10))
+		}
+	}
+
+	resp.WriteHeader(http.StatusOK)
+
+	// once the response has started all we can do about errors is cut it short
+	if err := export.Write(ctx, bs, root, resp); err != nil {
+		log.Errorf("failed to export car for content %d: %s", cont.ID, err)
+	}
+	return nil
+}
+
+// refreshOffloadedContent retrieves content that was offloaded, or had some
+// of its objects offloaded, so that it can be read from the blockstore again
+func (s *Server) refreshOffloadedContent(ctx context.Context, cont *Content) error {
+	offloaded, err := s.CM.contentIsOffloaded(cont)
+	if err != nil {
+		return err
+	}
+
+	if !offloaded {
+		return nil
+	}
+
+	if err := s.CM.RefreshContent(ctx, cont.ID); err != nil {
+		return xerrors.Errorf("failed to retrieve offloaded content %d: %w", cont.ID, err)
+	}
+
+	return s.DB.First(cont, "id = ?", cont.ID).Error
+}
+
+func (s *Server) shuttleExportURL(cont *Content) (string, error) {
+	if !s.CM.shuttleIsOnline(cont.Location) {
+		return "", &util.HttpError{
+			Code:    http.StatusServiceUnavailable,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content %d is stored on shuttle %s, which is offline", cont.ID, cont.Location),
+		}
+	}
+
+	var shuttle Shuttle
+	if err := s.DB.First(&shuttle, "handle = ?", cont.Location).Error; err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("https://%s/content/export/%d", shuttle.Host, cont.ID), nil
+}
+
+func (s *Server) carSizeForContent(ctx context.Context, cont *Content) (uint64, error) {
+	var objects []Object
+	if err := s.DB.Find(&objects, "id in (select object from obj_refs where content = ?)", cont.ID).Error; err != nil {
+		return 0, err
+	}
+
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("no objects tracked for content %d", cont.ID)
+	}
+
+	os := make([]util.Object, len(objects))
+	for i, o := range objects {
+		os[i] = util.Object{Size: uint64(o.Size), Cid: o.Cid.CID}
+	}
+
+	return util.CalculateCarSize(cont.Cid.CID, os)
+}
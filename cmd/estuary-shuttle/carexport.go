@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// handleExportCar godoc
+// @Summary      Export content as a CAR
+// @Description  This endpoint streams the DAG of a content pinned on this shuttle as a CAR file. The export can be scoped to a unixfs sub-path, limited to a depth, or restricted by a dag-json encoded IPLD selector.
+// @Tags         content
+// @Produce      application/vnd.ipld.car
+// @Param        content   path   int     true   "Content ID"
+// @Param        version   query  int     false  "CAR version, 1 (default) or 2"
+// @Param        path      query  string  false  "Sub-path of the DAG to export"
+// @Param        depth     query  int     false  "Maximum depth of links to follow"
+// @Param        selector  query  string  false  "dag-json encoded IPLD selector"
+// @Router       /content/export/{content} [get]
+func (s *Shuttle) handleExportCar(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ? and active", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) is not pinned on this shuttle", contID),
+			}
+		}
+		return err
+	}
+
+	// organization memberships are only known to the primary node, so only
+	// the user that pinned the content can export it from here
+	if pin.UserID != u.ID && u.Perms < util.PermLevelAdmin {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "user is not owner of specified content",
+		}
+	}
+
+	export, err := util.ParseCarExport(c)
+	if err != nil {
+		return err
+	}
+
+	bs := s.Node.Blockstore
+	root, err := export.Root(ctx, bs, pin.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, export.ContentType())
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.car\"", root))
+	resp.Header().Set("X-Ipfs-Roots", root.String())
+
+	if export.IsFull() && export.Version == 1 {
+		// the objects tracked for the pin are exactly the blocks of a full
+		// export, so its size is known up front
+		size, err := s.carSizeForPin(ctx, &pin)
+		if err != nil {
+			log.Warnf("failed to calculate car size for content %d: %s", pin.Content, err)
+		} else {
+			resp.Header().Set(echo.HeaderContentLength, strconv.FormatUint(size, 10))
+		}
+	}
+
+	resp.WriteHeader(http.StatusOK)
+
+	// once the response has started all we can do about errors is cut it short
+	if err := export.Write(ctx, bs, root, resp); err != nil {
+		log.Errorf("failed to export car for content %d: %s", pin.Content, err)
+	}
+	return nil
+}
+
+func (s *Shuttle) carSizeForPin(ctx context.Context, pin *Pin) (uint64, error) {
+	var objects []Object
+	if err := s.DB.Find(&objects, "id in (select object from obj_refs where pin = ?)", pin.ID).Error; err != nil {
+		return 0, err
+	}
+
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("no objects tracked for content %d", pin.Content)
+	}
+
+	os := make([]util.Object, len(objects))
+	for i, o := range objects {
+		os[i] = util.Object{Size: uint64(o.Size), Cid: o.Cid.CID}
+	}
+
+	return util.CalculateCarSize(pin.Cid.CID, os)
+}
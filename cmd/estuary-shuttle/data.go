@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/estuary/util/resumable"
 	"gorm.io/gorm"
 )
 
@@ -58,6 +60,8 @@ func setupDatabase(dbval string) (*gorm.DB, error) {
 	db.AutoMigrate(&Pin{})
 	db.AutoMigrate(&Object{})
 	db.AutoMigrate(&ObjRef{})
+	db.AutoMigrate(&resumable.Upload{})
+	db.AutoMigrate(&piecetransfer.PieceTransfer{})
 
 	return db, nil
 }
@@ -10,10 +10,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,7 +24,11 @@ import (
 
 	"github.com/application-research/estuary/config"
 	estumetrics "github.com/application-research/estuary/metrics"
+	"github.com/application-research/estuary/util/bandwidth"
 	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/estuary/util/resumable"
+	"github.com/application-research/estuary/util/transferwatch"
 	"github.com/application-research/filclient/retrievehelper"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/mitchellh/go-homedir"
@@ -64,7 +70,6 @@ import (
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-metrics-interface"
 	uio "github.com/ipfs/go-unixfs/io"
-	car "github.com/ipld/go-car"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
@@ -148,6 +153,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Hostname = cctx.String("host")
 		case "disable-local-content-adding":
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
+		case "upload-expiry":
+			cfg.Content.UploadExpiry = cctx.Duration("upload-expiry")
 		case "jaeger-tracing":
 			cfg.Jaeger.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -172,6 +179,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Dev = cctx.Bool("dev")
 		case "no-reload-pin-queue":
 			cfg.NoReloadPinQueue = cctx.Bool("no-reload-pin-queue")
+		case "max-transfer-bandwidth":
+			cfg.MaxTransferBandwidth = cctx.Int64("max-transfer-bandwidth")
 		default:
 		}
 	}
@@ -290,6 +299,11 @@ func main() {
 			Usage: "disallow new content ingestion on this node",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.DurationFlag{
+			Name:  "upload-expiry",
+			Usage: "how long resumable uploads are kept without receiving any data",
+			Value: cfg.Content.UploadExpiry,
+		},
 		&cli.BoolFlag{
 			Name:  "no-reload-pin-queue",
 			Usage: "disable reloading pin queue on shuttle start",
@@ -341,6 +355,11 @@ func main() {
 			Usage: "sets the bitswap target message size",
 			Value: cfg.Node.Bitswap.TargetMessageSize,
 		},
+		&cli.Int64Flag{
+			Name:  "max-transfer-bandwidth",
+			Usage: "bytes per second shared by the transfers served by this shuttle, 0 means no limit",
+			Value: cfg.MaxTransferBandwidth,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -410,7 +429,11 @@ func main() {
 		}
 
 		rhost := routed.Wrap(nd.Host, nd.FilDht)
-		filc, err := filclient.NewClient(rhost, api, nd.Wallet, defaddr, nd.Blockstore, nd.Datastore, cfg.DataDir)
+		// the cap is shared by the http transfers and, through the blockstore
+		// it reads from, the graphsync transfers of the filclient
+		bw := bandwidth.NewLimiter(cfg.MaxTransferBandwidth)
+
+		filc, err := filclient.NewClient(rhost, api, nd.Wallet, defaddr, bw.Blockstore(nd.Blockstore), nd.Datastore, cfg.DataDir)
 		if err != nil {
 			return err
 		}
@@ -471,6 +494,9 @@ func main() {
 			DB:          db,
 			Filc:        filc,
 			StagingMgr:  sbm,
+			Uploads:     resumable.NewManager(db, sbm, cfg.Content.UploadExpiry),
+			Bandwidth:   bw,
+			Pieces:      piecetransfer.NewServer(db, nd.Blockstore, bw),
 			Private:     cfg.Private,
 			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
 
@@ -497,7 +523,11 @@ func main() {
 			MaxActivePerUser: 30,
 		})
 
+		s.Transfers = transferwatch.New(cfg.TransferSupervisor, s.restartStalledTransfer, s.onTransferSupervisorEvent)
+
 		go s.PinMgr.Run(100)
+		go s.Uploads.Run(context.Background(), time.Hour)
+		go s.Transfers.Run(context.Background())
 
 		if !cfg.NoReloadPinQueue {
 			if err := s.refreshPinQueue(); err != nil {
@@ -515,8 +545,10 @@ func main() {
 				return
 			}
 
+			cst := filclient.ChannelStateConv(st)
+			s.Transfers.Update(chid, trk.dbid, trk.miner, cst)
+
 			if trk.last == nil || trk.last.Status != st.Status() {
-				cst := filclient.ChannelStateConv(st)
 				trk.last = cst
 
 				log.Infof("event(%d) message: %s", event.Code, event.Message)
@@ -533,8 +565,11 @@ func main() {
 			return err
 		}
 
-		// Subscribe to data transfer events from Boost
-		_, err = s.Filc.Libp2pTransferMgr.Subscribe(func(dbid uint, st filclient.ChannelState) {
+		// Subscribe to data transfer events from Boost, and from the http
+		// transfers of the piece server
+		onTransferState := func(dbid uint, st filclient.ChannelState) {
+			s.Transfers.Update(st.TransferID, dbid, address.Undef, &st)
+
 			if st.Status == datatransfer.Requested {
 				go func() {
 					if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
@@ -567,7 +602,9 @@ func main() {
 					State:    &st,
 				})
 			}()
-		})
+		}
+		s.Pieces.Subscribe(onTransferState)
+		_, err = s.Filc.Libp2pTransferMgr.Subscribe(onTransferState)
 		if err != nil {
 			return fmt.Errorf("subscribing to libp2p transfer manager: %w", err)
 		}
@@ -729,6 +766,10 @@ type Shuttle struct {
 	PinMgr     *pinner.PinManager
 	Filc       *filclient.FilClient
 	StagingMgr *stagingbs.StagingBSMgr
+	Uploads    *resumable.Manager
+	Pieces     *piecetransfer.Server
+	Transfers  *transferwatch.Supervisor
+	Bandwidth  *bandwidth.Limiter
 
 	gwayHandler *gateway.GatewayHandler
 
@@ -772,8 +813,9 @@ func (d *Shuttle) isInflight(c cid.Cid) bool {
 }
 
 type chanTrack struct {
-	dbid uint
-	last *filclient.ChannelState
+	dbid  uint
+	miner address.Address
+	last  *filclient.ChannelState
 }
 
 func (d *Shuttle) RunRpcConnection() error {
@@ -899,6 +941,9 @@ type User struct {
 	AuthToken       string `json:"-"` // this struct shouldnt ever be serialized, but just in case...
 	StorageDisabled bool
 	AuthExpiry      time.Time
+	Scopes          util.Scopes
+	Quota           *util.QuotaStatus
+	Replication     int
 
 	Flags int
 }
@@ -923,6 +968,19 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 		}
 	}
 
+	usr, err := d.fetchUser(token)
+	if err != nil {
+		return nil, err
+	}
+
+	d.authCache.Add(token, usr)
+
+	return usr, nil
+}
+
+// fetchUser looks up the user of token on the primary node, along with their
+// current quota usage
+func (d *Shuttle) fetchUser(token string) (*User, error) {
 	scheme := "https"
 	if d.dev {
 		scheme = "http"
@@ -960,16 +1018,16 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 		Perms:           out.Perms,
 		AuthToken:       token,
 		AuthExpiry:      out.AuthExpiry,
+		Scopes:          out.Scopes,
 		StorageDisabled: out.Settings.ContentAddingDisabled,
+		Quota:           out.Quota,
+		Replication:     out.Settings.Replication,
 		Flags:           out.Settings.Flags,
 	}
-
-	d.authCache.Add(token, usr)
-
 	return usr, nil
 }
 
-func (d *Shuttle) AuthRequired(level int) echo.MiddlewareFunc {
+func (d *Shuttle) AuthRequired(level int, scopes ...string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			auth, err := util.ExtractAuth(c)
@@ -982,6 +1040,11 @@ func (d *Shuttle) AuthRequired(level int) echo.MiddlewareFunc {
 				return err
 			}
 
+			if err := util.CheckScopes(u.Scopes, level, scopes...); err != nil {
+				log.Warnw("api key scopes not sufficient", "user", u.ID, "scopes", u.Scopes, "required", scopes)
+				return err
+			}
+
 			if u.Perms >= level {
 				c.Set("user", u)
 				return next(c)
@@ -1025,22 +1088,31 @@ func (s *Shuttle) ServeAPI() error {
 	e.GET("/net/addrs", s.handleGetNetAddress)
 	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUser))
 
-	e.GET("/gw/:path", func(e echo.Context) error {
-		p := "/" + e.Param("path")
+	gw := func(e echo.Context) error {
+		p := "/" + e.Param("*")
 
 		req := e.Request().Clone(e.Request().Context())
 		req.URL.Path = p
 
 		s.gwayHandler.ServeHTTP(e.Response().Writer, req)
 		return nil
-	})
+	}
+	e.GET("/gw/*", gw)
+	e.HEAD("/gw/*", gw)
+
+	e.GET("/piece/:commp", s.handleGetPiece)
+	e.HEAD("/piece/:commp", s.handleGetPiece)
 
 	content := e.Group("/content")
-	content.Use(s.AuthRequired(util.PermLevelUpload))
-	content.POST("/add", withUser(s.handleAdd))
-	content.POST("/add-car", withUser(s.handleAddCar))
-	content.GET("/read/:cont", withUser(s.handleReadContent))
-	content.POST("/importdeal", withUser(s.handleImportDeal))
+	content.POST("/add", withUser(s.handleAdd), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.POST("/add-car", withUser(s.handleAddCar), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.GET("/read/:cont", withUser(s.handleReadContent), s.AuthRequired(util.PermLevelUpload, util.ScopeContentRead))
+	content.GET("/export/:content", withUser(s.handleExportCar), s.AuthRequired(util.PermLevelUser, util.ScopeContentRead))
+	content.POST("/importdeal", withUser(s.handleImportDeal), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.POST("/uploads", withUser(s.handleCreateUpload), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.HEAD("/uploads/:upload", withUser(s.handleGetUploadStatus), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.PATCH("/uploads/:upload", withUser(s.handlePatchUpload), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
+	content.DELETE("/uploads/:upload", withUser(s.handleDeleteUpload), s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
 	//content.POST("/add-ipfs", withUser(d.handleAddIpfs))
 
 	admin := e.Group("/admin")
@@ -1159,6 +1231,10 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := u.Quota.Check(mpf.Size, u.Replication); err != nil {
+		return err
+	}
+
 	fname := mpf.Filename
 	fi, err := mpf.Open()
 	if err != nil {
@@ -1171,6 +1247,12 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		CollectionPath: c.QueryParam("colpath"),
 	}
 
+	if cic.CollectionID != "" {
+		if err := u.Scopes.CheckCollection(cic.CollectionID, util.ScopeActionWrite); err != nil {
+			return err
+		}
+	}
+
 	bsid, bs, err := s.StagingMgr.AllocNew()
 	if err != nil {
 		return err
@@ -1192,7 +1274,18 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		return err
 	}
 
-	contid, err := s.createContent(ctx, u, nd.Cid(), fname, cic)
+	// the quota was checked against usage from when the upload started, which
+	// concurrent uploads may have moved on since, so check again before adding
+	fresh, err := s.fetchUser(u.AuthToken)
+	if err != nil {
+		return err
+	}
+
+	if err := fresh.Quota.Check(mpf.Size, fresh.Replication); err != nil {
+		return err
+	}
+
+	contid, err := s.createContent(ctx, u, nd.Cid(), fname, cic, c.QueryParam("org"))
 	if err != nil {
 		return err
 	}
@@ -1257,9 +1350,12 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 
 // handleAddCar godoc
 // @Summary      Upload content via a car file
-// @Description  This endpoint uploads content via a car file
+// @Description  This endpoint uploads content via a CARv1 or CARv2 file, creating a content for each of its roots. The car is rejected if any block is missing, does not match its cid, or is not reachable from a root.
 // @Tags         content
 // @Produce      json
+// @Param        filename  query  string  false  "Filename, only used for cars with a single root"
+// @Param        coluuid   query  string  false  "Collection UUID"
+// @Param        colpath   query  string  false  "Collection path"
 // @Router       /content/add-car [post]
 func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
@@ -1272,6 +1368,16 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		}
 	}
 
+	// the car size is only known upfront if the client sent a content length
+	var carSize int64
+	if c.Request().ContentLength > 0 {
+		carSize = c.Request().ContentLength
+	}
+
+	if err := u.Quota.Check(carSize, u.Replication); err != nil {
+		return err
+	}
+
 	// if splitting is disabled and uploaded content size is greater than content size limit
 	// reject the upload, as it will only get stuck and deals will never be made for it
 	// if !u.FlagSplitContent() {
@@ -1307,73 +1413,108 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		}()
 	}()
 
-	defer c.Request().Body.Close()
-	header, err := s.loadCar(ctx, bs, c.Request().Body)
+	carPath, err := s.StagingMgr.CarPath(bsid)
 	if err != nil {
 		return err
 	}
 
-	if len(header.Roots) != 1 {
-		// if someone wants this feature, let me know
-		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
+	defer c.Request().Body.Close()
+	imp, err := s.loadCar(ctx, bs, c.Request().Body, carPath)
+	if err != nil {
+		return err
 	}
+	defer imp.Close()
 
-	// TODO: how to specify filename?
-	fname := header.Roots[0].String()
-	if qpname := c.QueryParam("filename"); qpname != "" {
-		fname = qpname
+	if err := imp.Verify(ctx); err != nil {
+		return err
 	}
 
-	bserv := blockservice.New(bs, nil)
-	dserv := merkledag.NewDAGService(bserv)
-
-	root := header.Roots[0]
-
-	contid, err := s.createContent(ctx, u, root, fname, util.ContentInCollection{
-		CollectionID:   c.QueryParam("coluuid"),
-		CollectionPath: c.QueryParam("colpath"),
-	})
+	// the quota was checked with a size of zero if the content length was
+	// unknown, and against usage that may be stale, so check again now that
+	// the size is known and before anything is added
+	fresh, err := s.fetchUser(u.AuthToken)
 	if err != nil {
 		return err
 	}
 
-	pin := &Pin{
-		Content: contid,
-		Cid:     util.DbCID{CID: root},
-		UserID:  u.ID,
-
-		Active:  false,
-		Pinning: true,
+	if err := fresh.Quota.Check(imp.Size, fresh.Replication); err != nil {
+		return err
 	}
 
-	if err := s.DB.Create(pin).Error; err != nil {
-		return err
+	// colpath is the directory each root is added to, unless it does not end
+	// in / and there is a single root, then it includes the filename
+	colpath := c.QueryParam("colpath")
+	if len(imp.Roots) > 1 && colpath != "" && !strings.HasSuffix(colpath, "/") {
+		colpath += "/"
 	}
 
-	if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, root, func(int64) {}); err != nil {
-		return xerrors.Errorf("encountered problem computing object references: %w", err)
+	bserv := blockservice.New(imp.Blockstore, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	var added []*util.ContentAddResponse
+	for _, root := range imp.Roots {
+		// TODO: how to specify filename?
+		fname := root.String()
+		if qpname := c.QueryParam("filename"); qpname != "" && len(imp.Roots) == 1 {
+			fname = qpname
+		}
+
+		path := colpath
+		if strings.HasSuffix(colpath, "/") {
+			path = colpath + fname
+		}
+
+		contid, err := s.createContent(ctx, u, root, fname, util.ContentInCollection{
+			CollectionID:   c.QueryParam("coluuid"),
+			CollectionPath: path,
+		}, c.QueryParam("org"))
+		if err != nil {
+			return err
+		}
+
+		pin := &Pin{
+			Content: contid,
+			Cid:     util.DbCID{CID: root},
+			UserID:  u.ID,
+
+			Active:  false,
+			Pinning: true,
+		}
+
+		if err := s.DB.Create(pin).Error; err != nil {
+			return err
+		}
+
+		if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, imp.Blockstore, root, func(int64) {}); err != nil {
+			return xerrors.Errorf("encountered problem computing object references: %w", err)
+		}
+
+		added = append(added, &util.ContentAddResponse{
+			Cid:       root.String(),
+			EstuaryId: contid,
+			Providers: s.addrsForShuttle(),
+		})
 	}
 
-	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+	if err := s.dumpBlockstoreTo(ctx, imp.Blockstore, s.Node.Blockstore); err != nil {
 		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
 
-	if err := s.Provide(ctx, root); err != nil {
-		log.Warn(err)
+	for _, root := range imp.Roots {
+		if err := s.Provide(ctx, root); err != nil {
+			log.Warn(err)
+		}
 	}
 
-	return c.JSON(http.StatusOK, &util.ContentAddResponse{
-		Cid:       root.String(),
-		EstuaryId: contid,
-		Providers: s.addrsForShuttle(),
-	})
+	return c.JSON(http.StatusOK, map[string]interface{}{"content": added[0], "contents": added})
 }
 
-func (s *Shuttle) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader) (*car.CarHeader, error) {
+// loadCar reads an uploaded CARv1 or CARv2, see util.LoadCar
+func (s *Shuttle) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader, spool string) (*util.CarImport, error) {
 	_, span := s.Tracer.Start(ctx, "loadCar")
 	defer span.End()
 
-	return car.LoadCar(ctx, bs, r)
+	return util.LoadCar(ctx, bs, r, spool)
 }
 
 func (s *Shuttle) addrsForShuttle() []string {
@@ -1384,7 +1525,9 @@ func (s *Shuttle) addrsForShuttle() []string {
 	return out
 }
 
-func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, fname string, cic util.ContentInCollection) (uint, error) {
+// createContent registers new content with the primary node, attributing it
+// to the organization with uuid org if it is set.
+func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, fname string, cic util.ContentInCollection, org string) (uint, error) {
 	log.Debugf("createContent> cid: %v, filename: %s, collection: %+v", root, fname, cic)
 
 	data, err := json.Marshal(util.ContentCreateBody{
@@ -1402,7 +1545,12 @@ func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, fnam
 		scheme = "http"
 	}
 
-	req, err := http.NewRequest("POST", scheme+"://"+s.estuaryHost+"/content/create", bytes.NewReader(data))
+	endpoint := scheme + "://" + s.estuaryHost + "/content/create"
+	if org != "" {
+		endpoint += "?org=" + url.QueryEscape(org)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(data))
 	if err != nil {
 		return 0, err
 	}
@@ -1770,6 +1918,11 @@ func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 
 	upd.PinQueueSize = s.PinMgr.PinQueueSize()
 
+	bw := s.Bandwidth.Usage()
+	upd.MaxTransferBandwidth = bw.Limit
+	upd.TransferBandwidth = bw.Rate
+	upd.ActiveTransfers = bw.Streams
+
 	var st unix.Statfs_t
 	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
 		log.Errorf("failed to get blockstore disk usage: %s", err)
@@ -1791,6 +1944,18 @@ func (s *Shuttle) handleHealth(c echo.Context) error {
 	})
 }
 
+// handleGetPiece godoc
+// @Summary      Download the piece of a deal
+// @Description  This endpoint serves the car of the data of a deal made with the http transfer type to the provider of the deal. The auth token of the transfer goes in a basic authorization header as the password. Range requests are supported so that downloads can be resumed.
+// @Tags         deals
+// @Produce      application/vnd.ipld.car
+// @Param        commp path string true "Piece CID of the deal"
+// @Router       /piece/{commp} [get]
+func (s *Shuttle) handleGetPiece(c echo.Context) error {
+	s.Pieces.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
 // handleGetNetAddress godoc
 // @Summary      Net Addrs
 // @Description  This endpoint is used to get net addrs
@@ -2064,6 +2229,7 @@ func (s *Shuttle) handleGetViewer(c echo.Context, u *User) error {
 		ID:       u.ID,
 		Username: u.Username,
 		Perms:    u.Perms,
+		Scopes:   u.Scopes,
 	})
 }
 
@@ -2121,20 +2287,6 @@ func (s *Shuttle) handleListAllTransfers(c echo.Context) error {
 	return c.JSON(http.StatusOK, transfers)
 }
 
-func (s *Shuttle) handleMinerTransferDiagnostics(c echo.Context) error {
-	m, err := address.NewFromString(c.Param("miner"))
-	if err != nil {
-		return err
-	}
-
-	minerTransferDiagnostics, err := s.Filc.MinerTransferDiagnostics(c.Request().Context(), m)
-	if err != nil {
-		return err
-	}
-
-	return c.JSON(http.StatusOK, minerTransferDiagnostics)
-}
-
 type garbageCheckBody struct {
 	Contents []uint `json:"contents"`
 }
@@ -2242,7 +2394,7 @@ func (s *Shuttle) handleImportDeal(c echo.Context, u *User) error {
 		break
 	}
 
-	contid, err := s.createContent(ctx, u, cc, body.Name, body.ContentInCollection)
+	contid, err := s.createContent(ctx, u, cc, body.Name, body.ContentInCollection, c.QueryParam("org"))
 	if err != nil {
 		return err
 	}
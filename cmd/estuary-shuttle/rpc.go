@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/estuary/util"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	blocks "github.com/ipfs/go-block-format"
@@ -46,6 +50,8 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 		return d.handleRpcStartTransfer(ctx, cmd.Params.StartTransfer)
 	case drpc.CMD_PrepareForDataRequest:
 		return d.handleRpcPrepareForDataRequest(ctx, cmd.Params.PrepareForDataRequest)
+	case drpc.CMD_PrepareForHttpTransfer:
+		return d.handleRpcPrepareForHttpTransfer(ctx, cmd.Params.PrepareForHttpTransfer)
 	case drpc.CMD_CleanupPreparedRequest:
 		return d.handleRpcCleanupPreparedRequest(ctx, cmd.Params.CleanupPreparedRequest)
 	case drpc.CMD_ReqTxStatus:
@@ -378,12 +384,13 @@ func (d *Shuttle) handleRpcAggregateContent(ctx context.Context, cmd *drpc.Aggre
 	return nil
 }
 
-func (s *Shuttle) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint) {
+func (s *Shuttle) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint, miner address.Address) {
 	s.tcLk.Lock()
 	defer s.tcLk.Unlock()
 
 	s.trackingChannels[chanid.String()] = &chanTrack{
-		dbid: dealdbid,
+		dbid:  dealdbid,
+		miner: miner,
 	}
 }
 
@@ -404,14 +411,48 @@ func (s *Shuttle) handleRpcPrepareForDataRequest(ctx context.Context, cmd *drpc.
 	return nil
 }
 
+func (s *Shuttle) handleRpcPrepareForHttpTransfer(ctx context.Context, cmd *drpc.PrepareForHttpTransfer) error {
+	ctx, span := s.Tracer.Start(ctx, "handleRpcPrepareForHttpTransfer", trace.WithAttributes(
+		attribute.Int64("dealDbID", int64(cmd.DealDBID)),
+		attribute.String("pieceCID", cmd.PieceCid.String()),
+		attribute.String("payloadCID", cmd.PayloadCid.String()),
+		attribute.Int64("size", int64(cmd.Size)),
+	))
+	defer span.End()
+
+	segs := make([]piecetransfer.Segment, len(cmd.Segments))
+	for i, sg := range cmd.Segments {
+		segs[i] = piecetransfer.Segment{
+			Payload:  sg.PayloadCid,
+			Piece:    sg.PieceCid,
+			Size:     sg.Size,
+			RootOnly: sg.RootOnly,
+		}
+	}
+
+	// Let the provider download the piece from the piece endpoint
+	if err := s.Pieces.Prepare(cmd.DealDBID, cmd.AuthToken, cmd.PieceCid, cmd.PayloadCid, cmd.Size, segs); err != nil {
+		return fmt.Errorf("preparing for http transfer: %w", err)
+	}
+	return nil
+}
+
 func (s *Shuttle) handleRpcCleanupPreparedRequest(ctx context.Context, cmd *drpc.CleanupPreparedRequest) error {
 	ctx, span := s.Tracer.Start(ctx, "handleRpcCleanupPreparedRequest", trace.WithAttributes(
 		attribute.Int64("dealDbID", int64(cmd.DealDBID)),
 	))
 	defer span.End()
 
+	removed, err := s.Pieces.Cleanup(cmd.DealDBID, cmd.AuthToken)
+	if err != nil {
+		return fmt.Errorf("cleaning up prepared http transfer: %w", err)
+	}
+	if removed {
+		return nil
+	}
+
 	// Tell server to clean up auth token and cancel any running transfer
-	err := s.Filc.Libp2pTransferMgr.CleanupPreparedRequest(ctx, cmd.DealDBID, cmd.AuthToken)
+	err = s.Filc.Libp2pTransferMgr.CleanupPreparedRequest(ctx, cmd.DealDBID, cmd.AuthToken)
 	if err != nil {
 		return fmt.Errorf("cleaning up prepared request: %w", err)
 	}
@@ -441,7 +482,7 @@ func (d *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *drpc.StartTra
 			return
 		}
 
-		d.trackTransfer(chanid, cmd.DealDBID)
+		d.trackTransfer(chanid, cmd.DealDBID, cmd.Miner)
 
 		if err := d.sendRpcMessage(ctx, &drpc.Message{
 			Op: drpc.OP_TransferStarted,
@@ -485,11 +526,21 @@ func (s *Shuttle) handleRpcReqTxStatus(ctx context.Context, req *drpc.ReqTxStatu
 
 	go func() {
 		ctx := context.TODO()
-		st, err := s.Filc.TransferStatusByID(ctx, req.ChanID)
+		var st *filclient.ChannelState
+		var err error
+		if strings.HasPrefix(req.ChanID, piecetransfer.TransferIDPrefix) {
+			st, err = s.Pieces.TransferStatus(req.DealDBID)
+		} else {
+			st, err = s.Filc.TransferStatusByID(ctx, req.ChanID)
+		}
 		if err != nil {
 			log.Errorf("failed to get requested transfer status: %s", err)
 			return
 		}
+		if st == nil {
+			log.Warnf("no transfer found for requested transfer status: %s", req.ChanID)
+			return
+		}
 
 		s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
 			Chanid: req.ChanID,
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util/transferwatch"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
+)
+
+// restartStalledTransfer restarts a stalled legacy push transfer, providers
+// restart the transfers they pull themselves
+func (s *Shuttle) restartStalledTransfer(ctx context.Context, ch transferwatch.Channel) error {
+	chanid, err := filclient.ChannelIDFromString(ch.ID)
+	if err != nil {
+		return fmt.Errorf("%w: %s is pulled by the provider", transferwatch.ErrNotRestartable, ch.ID)
+	}
+	return s.Filc.RestartTransfer(ctx, chanid)
+}
+
+// onTransferSupervisorEvent reports stalls to the primary node, which keeps
+// the stats of the miners and fails the deals of transfers given up on
+func (s *Shuttle) onTransferSupervisorEvent(ch transferwatch.Channel, ev transferwatch.Event) {
+	go func() {
+		if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
+			Op: drpc.OP_TransferStalled,
+			Params: drpc.MsgParams{
+				TransferStalled: &drpc.TransferStalled{
+					Chanid:   ch.ID,
+					DealDBID: ch.DealDBID,
+					Event:    string(ev),
+					Restarts: ch.Restarts,
+					Sent:     ch.Sent,
+				},
+			},
+		}); err != nil {
+			log.Errorf("failed to notify estuary primary node about stalled transfer: %s", err)
+		}
+	}()
+}
+
+type minerTransferDiagnostics struct {
+	*filclient.MinerTransferDiagnostics
+	Stalled []transferwatch.Channel `json:"stalled"`
+}
+
+func (s *Shuttle) handleMinerTransferDiagnostics(c echo.Context) error {
+	m, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	diag, err := s.Filc.MinerTransferDiagnostics(c.Request().Context(), m)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &minerTransferDiagnostics{
+		MinerTransferDiagnostics: diag,
+		Stalled:                  s.Transfers.Stalled(m),
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/resumable"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// handleCreateUpload godoc
+// @Summary      Create a resumable upload
+// @Description  This endpoint is used to start a resumable (tus) upload. The Upload-Metadata header may set the filename, coluuid and colpath of the content, the data is then sent with PATCH requests to the returned location.
+// @Tags         content
+// @Produce      json
+// @Param        Upload-Length    header  int     true   "Total size of the upload in bytes"
+// @Param        Upload-Metadata  header  string  false  "tus upload metadata"
+// @Param        org              query   string  false  "Organization UUID"
+// @Router       /content/uploads [post]
+func (s *Shuttle) handleCreateUpload(c echo.Context, u *User) error {
+	if u.StorageDisabled || s.disableLocalAdding {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: "uploading content to this node is not allowed at the moment",
+		}
+	}
+
+	length, err := resumable.ParseLength(c.Request().Header.Get(resumable.HeaderUploadLength))
+	if err != nil {
+		return err
+	}
+
+	md, err := resumable.ParseMetadata(c.Request().Header.Get(resumable.HeaderUploadMetadata))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if org := c.QueryParam("org"); org != "" {
+		md["org"] = org
+	}
+
+	// if splitting is disabled and uploaded content size is greater than content size limit
+	// reject the upload, as it will only get stuck and deals will never be made for it
+	if !u.FlagSplitContent() && length > util.DefaultContentSizeLimit {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("content size %d bytes, is over upload size limit of %d bytes, and content splitting is not enabled, please reduce the content size", length, util.DefaultContentSizeLimit),
+		}
+	}
+
+	if err := u.Quota.Check(length, u.Replication); err != nil {
+		return err
+	}
+
+	if coluuid := md["coluuid"]; coluuid != "" {
+		if err := u.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+			return err
+		}
+	}
+
+	up, err := s.Uploads.Create(u.ID, length, md)
+	if err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	c.Response().Header().Set("Location", "/content/uploads/"+up.UUID)
+	return c.JSON(http.StatusCreated, up)
+}
+
+// handleGetUploadStatus godoc
+// @Summary      Get the status of a resumable upload
+// @Description  This endpoint returns the current offset of a resumable upload in the Upload-Offset header.
+// @Tags         content
+// @Param        upload  path  string  true  "Upload UUID"
+// @Router       /content/uploads/{upload} [head]
+func (s *Shuttle) handleGetUploadStatus(c echo.Context, u *User) error {
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	return c.NoContent(http.StatusOK)
+}
+
+// handlePatchUpload godoc
+// @Summary      Send data for a resumable upload
+// @Description  This endpoint appends data to a resumable upload, starting at the offset given in the Upload-Offset header. Once all data has been received the content is added and returned.
+// @Tags         content
+// @Produce      json
+// @Accept       application/offset+octet-stream
+// @Param        upload         path    string  true  "Upload UUID"
+// @Param        Upload-Offset  header  int     true  "Offset the data starts at"
+// @Router       /content/uploads/{upload} [patch]
+func (s *Shuttle) handlePatchUpload(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if ct := c.Request().Header.Get(echo.HeaderContentType); ct != resumable.ContentTypeOffsetOctetStream {
+		return &util.HttpError{
+			Code:    http.StatusUnsupportedMediaType,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content type must be %s", resumable.ContentTypeOffsetOctetStream),
+		}
+	}
+
+	offset, err := resumable.ParseOffset(c.Request().Header.Get(resumable.HeaderUploadOffset))
+	if err != nil {
+		return err
+	}
+
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	defer c.Request().Body.Close()
+	if err := s.Uploads.Write(ctx, up, offset, c.Request().Body); err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	if !up.Complete() {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	var root cid.Cid
+	var contid uint
+	if err := s.Uploads.Finish(ctx, up, func(r io.Reader, bs blockstore.Blockstore) error {
+		root, contid, err = s.importUpload(ctx, u, up, r, bs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := s.Provide(ctx, root); err != nil {
+		log.Warnf("failed to provide: %+v", err)
+	}
+
+	return c.JSON(http.StatusOK, &util.ContentAddResponse{
+		Cid:       root.String(),
+		EstuaryId: contid,
+		Providers: s.addrsForShuttle(),
+	})
+}
+
+// importUpload goes through the same steps as handleAdd for the data of a
+// completed upload
+func (s *Shuttle) importUpload(ctx context.Context, u *User, up *resumable.Upload, r io.Reader, bs blockstore.Blockstore) (cid.Cid, uint, error) {
+	bserv := blockservice.New(bs, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	nd, err := s.importFile(ctx, dserv, r)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	// the quota was only checked against the usage when the upload was
+	// created, other uploads may have finished since
+	fresh, err := s.fetchUser(u.AuthToken)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := fresh.Quota.Check(up.Length, fresh.Replication); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	fname := up.Metadata["filename"]
+	if fname == "" {
+		fname = up.UUID
+	}
+
+	cic := util.ContentInCollection{
+		CollectionID:   up.Metadata["coluuid"],
+		CollectionPath: up.Metadata["colpath"],
+	}
+
+	contid, err := s.createContent(ctx, u, nd.Cid(), fname, cic, up.Metadata["org"])
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	pin := &Pin{
+		Content: contid,
+		Cid:     util.DbCID{CID: nd.Cid()},
+		UserID:  u.ID,
+
+		Active:  false,
+		Pinning: true,
+	}
+
+	if err := s.DB.Create(pin).Error; err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, nd.Cid(), func(int64) {}); err != nil {
+		return cid.Undef, 0, xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return cid.Undef, 0, xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+	return nd.Cid(), contid, nil
+}
+
+// handleDeleteUpload godoc
+// @Summary      Abort a resumable upload
+// @Description  This endpoint aborts a resumable upload and discards the data received so far.
+// @Tags         content
+// @Param        upload  path  string  true  "Upload UUID"
+// @Router       /content/uploads/{upload} [delete]
+func (s *Shuttle) handleDeleteUpload(c echo.Context, u *User) error {
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Uploads.Delete(up); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(resumable.HeaderTusResumable, resumable.TusVersion)
+	return c.NoContent(http.StatusNoContent)
+}
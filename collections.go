@@ -1,6 +1,12 @@
 package main
 
-import "time"
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
 
 type Collection struct {
 	ID        uint      `gorm:"primarykey" json:"-"`
@@ -11,6 +17,7 @@ type Collection struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	UserID      uint   `json:"userId"`
+	OrgID       uint   `json:"orgId" gorm:"default:0"`
 	CID         string `json:"cid"`
 }
 
@@ -20,4 +27,72 @@ type CollectionRef struct {
 	Collection uint    `gorm:"index:,option:CONCURRENTLY; not null"`
 	Content    uint    `gorm:"index:,option:CONCURRENTLY;not null"`
 	Path       *string `gorm:"not null"`
+	// Name overrides the name of the content as the file name when the ref
+	// was moved or renamed, in which case Path holds the full file path
+	Name string `gorm:"default:''"`
+}
+
+// CollectionDir is a directory that was created explicitly in a collection,
+// so that it exists even when it holds no files
+type CollectionDir struct {
+	ID         uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	Collection uint   `gorm:"index;not null"`
+	Path       string `gorm:"not null"`
+}
+
+// collectionFile is the content a collection ref puts in a collection
+type collectionFile struct {
+	Content
+	RefID   uint    `gorm:"column:ref_id"`
+	RefPath *string `gorm:"column:ref_path"`
+	RefName string  `gorm:"column:ref_name"`
+}
+
+// FilePath returns the path of the file in the collection
+func (cf *collectionFile) FilePath() string {
+	name := cf.RefName
+	if name == "" {
+		name = cf.Name
+	}
+	if name == "" {
+		name = cf.Cid.CID.String()
+	}
+
+	var p string
+	if cf.RefPath != nil {
+		p = *cf.RefPath
+	}
+	return util.CollectionFilePath(p, name)
+}
+
+// loadCollectionTree builds the directory tree of a collection from its refs
+// and directories, and returns it along with the files in it keyed by ref id
+func loadCollectionTree(db *gorm.DB, col *Collection) (*util.CollectionTree, map[uint]*collectionFile, error) {
+	var files []*collectionFile
+	if err := db.Model(CollectionRef{}).
+		Where("collection = ?", col.ID).
+		Joins("left join contents on contents.id = collection_refs.content").
+		Select("contents.*, collection_refs.id as ref_id, collection_refs.path as ref_path, collection_refs.name as ref_name").
+		Scan(&files).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var dirs []CollectionDir
+	if err := db.Find(&dirs, "collection = ?", col.ID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	tree := util.NewCollectionTree()
+	byRef := make(map[uint]*collectionFile)
+	for _, f := range files {
+		tree.AddFile(f.FilePath(), f.RefID)
+		byRef[f.RefID] = f
+	}
+
+	for _, d := range dirs {
+		tree.AddDir(filepath.Clean(d.Path))
+	}
+
+	return tree, byRef, nil
 }
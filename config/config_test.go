@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
@@ -114,3 +115,99 @@ func TestShuttleJSONRoundtrip(t *testing.T) {
 	load(&config2, path)
 	assert.Equal(config, &config2)
 }
+
+func TestMinerPolicyValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(MinerPolicy{}.IsZero())
+	assert.NoError(MinerPolicy{}.Validate())
+	assert.NoError(MinerPolicy{Strategy: MinerStrategyCheapest, OwnerDiverse: true}.Validate())
+	assert.Error(MinerPolicy{Strategy: "fastest"}.Validate())
+	assert.False(MinerPolicy{Regions: []string{"EU"}}.IsZero())
+}
+
+func TestWalletsValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Wallets{}.Validate())
+	assert.NoError(Wallets{Policy: WalletPolicyPerUser, Addresses: []string{"f01234", "f05678"}}.Validate())
+	assert.Error(Wallets{Policy: "random"}.Validate())
+	assert.Error(Wallets{Addresses: []string{"not-an-address"}}.Validate())
+	assert.Error(Wallets{Addresses: []string{"f01234", "f01234"}}.Validate())
+}
+
+func TestDealTransferValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(NewEstuary("test-version").Deal.Transfer.Validate())
+	assert.NoError(DealTransfer(DealTransferHttp).Validate())
+	assert.Error(DealTransfer("graphsync").Validate())
+}
+
+func TestFundsMonitorValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(NewEstuary("test-version").FundsMonitor.Validate())
+	assert.Error(FundsMonitor{Enabled: true}.Validate())
+	assert.Error(FundsMonitor{DatacapFloor: -1}.Validate())
+	assert.NoError(FundsMonitor{Notifier: Notifier{Type: NotifierWebhook, WebhookURL: "https://example.com/alerts"}}.Validate())
+	assert.Error(FundsMonitor{Notifier: Notifier{Type: NotifierWebhook, WebhookURL: "example.com"}}.Validate())
+	assert.Error(FundsMonitor{Notifier: Notifier{Type: NotifierSMTP, SMTP: SMTP{Host: "mail"}}}.Validate())
+	assert.Error(FundsMonitor{Notifier: Notifier{Type: "pager"}}.Validate())
+}
+
+func TestTransferSupervisorValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(NewEstuary("test-version").TransferSupervisor.Validate())
+	assert.NoError(NewShuttle("test-version").TransferSupervisor.Validate())
+	assert.NoError(TransferSupervisor{}.Validate())
+	assert.Error(TransferSupervisor{Enabled: true, StallTimeout: time.Minute}.Validate())
+
+	ts := DefaultTransferSupervisor()
+	ts.MaxRestartBackoff = ts.RestartBackoff / 2
+	assert.Error(ts.Validate())
+
+	ts = DefaultTransferSupervisor()
+	ts.MaxRestarts = -1
+	assert.Error(ts.Validate())
+}
+
+func TestTransferLimitsValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(NewEstuary("test-version").TransferLimits.Validate())
+	assert.NoError(TransferLimits{MaxConcurrentPerMiner: 4, MaxProposalsPerMinerPerDay: 100, MaxBandwidth: 100 << 20}.Validate())
+	assert.Error(TransferLimits{MaxConcurrentPerMiner: -1}.Validate())
+	assert.Error(TransferLimits{MaxBandwidth: -1}.Validate())
+}
+
+func TestStagingPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	def := DefaultStagingPolicy()
+	assert.NoError(def.Validate())
+
+	pol := def.Resolve()
+	assert.Equal(int64(15341086310), pol.MaxSize)
+	assert.Equal(pol.MaxSize-(1<<30), pol.MinSize)
+
+	// a bigger piece size moves the zone sizes along
+	big := def.Merge(StagingPolicy{PieceSize: 32 << 30}).Resolve()
+	assert.Equal(int64(30682172620), big.MaxSize)
+	assert.Equal(def.MaxItems, big.MaxItems)
+
+	off := def.Merge(StagingPolicy{Disabled: true})
+	assert.True(off.Disabled)
+	assert.Equal(def.PieceSize, off.PieceSize)
+
+	assert.Error(StagingPolicy{PieceSize: 3 << 30}.Validate())
+	assert.Error(StagingPolicy{MinSize: 2 << 30, MaxSize: 1 << 30}.Validate())
+	assert.Error(StagingPolicy{PieceSize: 1 << 30, MaxSize: 1 << 30}.Validate())
+	assert.Error(StagingPolicy{IndividualDealThreshold: 2 << 30, MaxSize: 1 << 30}.Validate())
+	assert.Error(def.Merge(StagingPolicy{PieceSize: 1 << 30}).Resolve().Validate())
+	assert.NoError(pol.Validate())
+	assert.True(StagingPolicy{}.IsZero())
+
+	// content that does not fit in a staging zone gets deals of its own, even
+	// with overrides stored before the threshold was checked against max size
+	small := pol.Merge(StagingPolicy{IndividualDealThreshold: 1 << 30, MaxSize: 1 << 20})
+	assert.True(small.Aggregates(1 << 20))
+	assert.False(small.Aggregates(1<<20 + 1))
+	assert.False(pol.Aggregates(pol.IndividualDealThreshold))
+	assert.False(off.Resolve().Aggregates(1))
+}
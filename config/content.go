@@ -1,6 +1,10 @@
 package config
 
+import "time"
+
 type Content struct {
-	DisableLocalAdding  bool `json:"disable_local_adding"`
-	DisableGlobalAdding bool `json:"disable_global_adding"` // not valid for shuttle
+	DisableLocalAdding  bool          `json:"disable_local_adding"`
+	DisableGlobalAdding bool          `json:"disable_global_adding"` // not valid for shuttle
+	UploadExpiry        time.Duration `json:"upload_expiry"`         // how long resumable uploads may go without receiving data
+	CheckWorkers        int           `json:"check_workers"`         // number of workers checking content for storage, not valid for shuttle
 }
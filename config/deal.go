@@ -1,7 +1,116 @@
 package config
 
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+)
+
 type Deal struct {
-	FailOnTransferFailure bool `json:"fail_on_transfer_failure"`
-	Disable               bool `json:"disable"`
-	Verified              bool `json:"verified"`
+	FailOnTransferFailure bool        `json:"fail_on_transfer_failure"`
+	Disable               bool        `json:"disable"`
+	Verified              bool        `json:"verified"`
+	MinerPolicy           MinerPolicy `json:"miner_policy"`
+	// RenewalLookahead is how many epochs before the end of a deal a new
+	// deal is made to replace it, zero disables renewals
+	RenewalLookahead int64 `json:"renewal_lookahead"`
+	// Wallets are the client addresses deals are made from
+	Wallets Wallets `json:"wallets"`
+	// Transfer is how providers speaking the boost deal protocol get the
+	// data of deals
+	Transfer DealTransfer `json:"transfer,omitempty"`
+}
+
+const (
+	DealTransferLibp2p = "libp2p"
+	DealTransferHttp   = "http"
+)
+
+// DealTransfer is either "libp2p", the provider pulls the data over libp2p
+// from the node or shuttle holding it, or "http", the provider downloads the
+// piece from the /piece endpoint of the node or shuttle
+type DealTransfer string
+
+func (dt DealTransfer) Validate() error {
+	switch dt {
+	case "", DealTransferLibp2p, DealTransferHttp:
+	default:
+		return fmt.Errorf("unknown deal transfer type %q", dt)
+	}
+	return nil
+}
+
+const (
+	MinerStrategyDefault  = "default"
+	MinerStrategyCheapest = "cheapest"
+)
+
+// MinerPolicy configures how the miners deals are made with are selected.
+// The filters are applied first, then the remaining miners are ordered by
+// the strategy.
+type MinerPolicy struct {
+	// Strategy is either "default", a mix of random and top ranked miners,
+	// or "cheapest", lowest cached ask price first
+	Strategy string `json:"strategy,omitempty"`
+	// Regions restricts deals to miners located in one of the regions
+	Regions []string `json:"regions,omitempty"`
+	// OwnerDiverse allows at most one miner per owner
+	OwnerDiverse bool `json:"owner_diverse,omitempty"`
+	// AllowList restricts deals to the listed miner addresses
+	AllowList []string `json:"allow_list,omitempty"`
+}
+
+func (mp MinerPolicy) IsZero() bool {
+	return mp.Strategy == "" && len(mp.Regions) == 0 && !mp.OwnerDiverse && len(mp.AllowList) == 0
+}
+
+func (mp MinerPolicy) Validate() error {
+	switch mp.Strategy {
+	case "", MinerStrategyDefault, MinerStrategyCheapest:
+	default:
+		return fmt.Errorf("unknown miner selection strategy %q", mp.Strategy)
+	}
+	return nil
+}
+
+const (
+	WalletPolicyRoundRobin  = "round-robin"
+	WalletPolicyMostDatacap = "most-datacap"
+	WalletPolicyPerUser     = "per-user"
+)
+
+// Wallets configures the client addresses deals are made from, each with its
+// own market escrow and verified client datacap. The default address of the
+// node wallet is always one of them.
+type Wallets struct {
+	// Addresses are the other client addresses, their keys must be in the
+	// node wallet
+	Addresses []string `json:"addresses,omitempty"`
+	// Policy is how deals are assigned to a wallet: "round-robin",
+	// "most-datacap", the wallet with the most datacap or, for unverified
+	// deals, the most available escrow, or "per-user", the wallet assigned to
+	// the user of the content
+	Policy string `json:"policy,omitempty"`
+}
+
+func (w Wallets) Validate() error {
+	switch w.Policy {
+	case "", WalletPolicyRoundRobin, WalletPolicyMostDatacap, WalletPolicyPerUser:
+	default:
+		return fmt.Errorf("unknown wallet policy %q", w.Policy)
+	}
+
+	seen := make(map[address.Address]bool)
+	for _, a := range w.Addresses {
+		addr, err := address.NewFromString(a)
+		if err != nil {
+			return fmt.Errorf("invalid wallet address %q: %w", a, err)
+		}
+
+		if seen[addr] {
+			return fmt.Errorf("wallet address %s is listed twice", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 
@@ -9,25 +10,30 @@ import (
 )
 
 type Estuary struct {
-	AppVersion             string    `json:"app_version"`
-	DatabaseConnString     string    `json:"database_conn_string"`
-	StagingDataDir         string    `json:"staging_data_dir"`
-	ServerCacheDir         string    `json:"server_cache_dir"`
-	DataDir                string    `json:"data_dir"`
-	ApiListen              string    `json:"api_listen"`
-	EnableAutoRetrieve     bool      `json:"enable_autoretrieve"`
-	LightstepToken         string    `json:"lightstep_token"`
-	Hostname               string    `json:"hostname"`
-	Node                   Node      `json:"node"`
-	Jaeger                 Jaeger    `json:"jaeger"`
-	Deal                   Deal      `json:"deal"`
-	Content                Content   `json:"content"`
-	LowMem                 bool      `json:"low_mem"`
-	DisableFilecoinStorage bool      `json:"disable_filecoin_storage"`
-	Replication            int       `json:"replication"`
-	Logging                Logging   `json:"logging"`
-	FilClient              FilClient `json:"fil_client"`
-	ShuttleMessageHandlers int       `json:"shuttle_message_Handlers"`
+	AppVersion             string             `json:"app_version"`
+	DatabaseConnString     string             `json:"database_conn_string"`
+	StagingDataDir         string             `json:"staging_data_dir"`
+	ServerCacheDir         string             `json:"server_cache_dir"`
+	DataDir                string             `json:"data_dir"`
+	ApiListen              string             `json:"api_listen"`
+	EnableAutoRetrieve     bool               `json:"enable_autoretrieve"`
+	LightstepToken         string             `json:"lightstep_token"`
+	Hostname               string             `json:"hostname"`
+	Node                   Node               `json:"node"`
+	Jaeger                 Jaeger             `json:"jaeger"`
+	Deal                   Deal               `json:"deal"`
+	Content                Content            `json:"content"`
+	LowMem                 bool               `json:"low_mem"`
+	DisableFilecoinStorage bool               `json:"disable_filecoin_storage"`
+	Replication            int                `json:"replication"`
+	Logging                Logging            `json:"logging"`
+	FilClient              FilClient          `json:"fil_client"`
+	ShuttleMessageHandlers int                `json:"shuttle_message_Handlers"`
+	Simulation             Simulation         `json:"simulation"`
+	StagingZone            StagingPolicy      `json:"staging_zone"`
+	FundsMonitor           FundsMonitor       `json:"funds_monitor"`
+	TransferSupervisor     TransferSupervisor `json:"transfer_supervisor"`
+	TransferLimits         TransferLimits     `json:"transfer_limits"`
 }
 
 func (cfg *Estuary) Load(filename string) error {
@@ -71,11 +77,44 @@ func NewEstuary(appVersion string) *Estuary {
 			Disable:               false,
 			FailOnTransferFailure: false,
 			Verified:              true,
+			RenewalLookahead:      2880 * 42,
+			Wallets: Wallets{
+				Policy: WalletPolicyRoundRobin,
+			},
+			Transfer: DealTransferLibp2p,
 		},
 
 		Content: Content{
 			DisableLocalAdding:  false,
 			DisableGlobalAdding: false,
+			UploadExpiry:        time.Hour * 24,
+			CheckWorkers:        8,
+		},
+
+		StagingZone: DefaultStagingPolicy(),
+
+		FundsMonitor: FundsMonitor{
+			Enabled:          false,
+			Interval:         time.Minute * 10,
+			AutoTopUp:        false,
+			MaxTopUp:         "10",
+			MinWalletBalance: "1",
+			AlertRepeat:      time.Hour * 24,
+			Notifier: Notifier{
+				Type: NotifierLog,
+			},
+		},
+
+		TransferSupervisor: DefaultTransferSupervisor(),
+
+		Simulation: Simulation{
+			Enabled:       false,
+			EpochDuration: time.Second,
+			Providers:     5,
+			Throughput:    64 << 20,
+			PublishDelay:  10,
+			SealDelay:     60,
+			RejectRate:    0,
 		},
 
 		Jaeger: Jaeger{
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	NotifierLog     = "log"
+	NotifierWebhook = "webhook"
+	NotifierSMTP    = "smtp"
+)
+
+// FundsMonitor configures the background checks of the market escrow,
+// balance and datacap of the wallets against the deals still to be made.
+// Amounts of FIL are strings like "0.5" or "2 FIL".
+type FundsMonitor struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+	// AutoTopUp moves funds from the balance of a wallet to its market
+	// escrow when the available escrow does not cover the projected deals
+	AutoTopUp bool `json:"auto_top_up"`
+	// MaxTopUp is the most FIL added to the escrow of a wallet at once
+	MaxTopUp string `json:"max_top_up"`
+	// MinWalletBalance is the FIL top ups leave in a wallet for gas
+	MinWalletBalance string `json:"min_wallet_balance"`
+	// EscrowFloor pauses deal making from a wallet when its available escrow
+	// is below it, empty disables the floor
+	EscrowFloor string `json:"escrow_floor,omitempty"`
+	// DatacapFloor pauses verified deal making from a wallet when its datacap
+	// is below it, in bytes, zero disables the floor
+	DatacapFloor int64 `json:"datacap_floor,omitempty"`
+	// AlertRepeat is how often an alert still in effect is sent again
+	AlertRepeat time.Duration `json:"alert_repeat"`
+	Notifier    Notifier      `json:"notifier"`
+}
+
+// Notifier is where funds alerts are sent to
+type Notifier struct {
+	// Type is "log", "webhook" or "smtp"
+	Type       string `json:"type"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+	SMTP       SMTP   `json:"smtp"`
+}
+
+type SMTP struct {
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+func (fm FundsMonitor) Validate() error {
+	if fm.Enabled && fm.Interval <= 0 {
+		return fmt.Errorf("funds monitor interval must be positive")
+	}
+
+	if fm.DatacapFloor < 0 {
+		return fmt.Errorf("datacap floor must not be negative")
+	}
+	return fm.Notifier.Validate()
+}
+
+func (n Notifier) Validate() error {
+	switch n.Type {
+	case "", NotifierLog:
+	case NotifierWebhook:
+		u, err := url.Parse(n.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("notifier webhook url %q must be an http(s) url", n.WebhookURL)
+		}
+	case NotifierSMTP:
+		if n.SMTP.Host == "" || n.SMTP.From == "" || len(n.SMTP.To) == 0 {
+			return fmt.Errorf("smtp notifier needs a host, a sender and recipients")
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %q", n.Type)
+	}
+	return nil
+}
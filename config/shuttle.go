@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 )
@@ -16,21 +17,26 @@ type EstuaryRemote struct {
 }
 
 type Shuttle struct {
-	AppVersion         string        `json:"app_version"`
-	DatabaseConnString string        `json:"database_conn_string"`
-	StagingDataDir     string        `json:"staging_data_dir"`
-	DataDir            string        `json:"data_dir"`
-	ApiListen          string        `json:"api_listen"`
-	Hostname           string        `json:"hostname"`
-	Private            bool          `json:"private"`
-	Dev                bool          `json:"dev"`
-	NoReloadPinQueue   bool          `json:"no_reload_pin_queue"`
-	Node               Node          `json:"node"`
-	Jaeger             Jaeger        `json:"jaeger"`
-	Content            Content       `json:"content"`
-	Logging            Logging       `json:"logging"`
-	EstuaryRemote      EstuaryRemote `json:"estuary_remote"`
-	FilClient          FilClient     `json:"fil_client"`
+	AppVersion         string             `json:"app_version"`
+	DatabaseConnString string             `json:"database_conn_string"`
+	StagingDataDir     string             `json:"staging_data_dir"`
+	DataDir            string             `json:"data_dir"`
+	ApiListen          string             `json:"api_listen"`
+	Hostname           string             `json:"hostname"`
+	Private            bool               `json:"private"`
+	Dev                bool               `json:"dev"`
+	NoReloadPinQueue   bool               `json:"no_reload_pin_queue"`
+	Node               Node               `json:"node"`
+	Jaeger             Jaeger             `json:"jaeger"`
+	Content            Content            `json:"content"`
+	Logging            Logging            `json:"logging"`
+	EstuaryRemote      EstuaryRemote      `json:"estuary_remote"`
+	FilClient          FilClient          `json:"fil_client"`
+	TransferSupervisor TransferSupervisor `json:"transfer_supervisor"`
+	// MaxTransferBandwidth is the bytes per second the transfers served by
+	// the shuttle share evenly, zero means no limit. Graphsync transfers
+	// count as a single transfer.
+	MaxTransferBandwidth int64 `json:"max_transfer_bandwidth"`
 }
 
 func (cfg *Shuttle) Load(filename string) error {
@@ -50,7 +56,10 @@ func (cfg *Shuttle) Validate() error {
 	if cfg.EstuaryRemote.Handle == "" {
 		return errors.New("no handle configured or specified on command line")
 	}
-	return nil
+	if cfg.MaxTransferBandwidth < 0 {
+		return errors.New("max transfer bandwidth must not be negative")
+	}
+	return cfg.TransferSupervisor.Validate()
 }
 
 func (cfg *Shuttle) SetRequiredOptions() error {
@@ -82,8 +91,11 @@ func NewShuttle(appVersion string) *Shuttle {
 
 		Content: Content{
 			DisableLocalAdding: false,
+			UploadExpiry:       time.Hour * 24,
 		},
 
+		TransferSupervisor: DefaultTransferSupervisor(),
+
 		Jaeger: Jaeger{
 			EnableTracing: false,
 			ProviderUrl:   "http://localhost:14268/api/traces",
@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// Simulation replaces the chain and the storage providers with in-process
+// fakes, so that deals can be made without a lotus gateway or real miners
+type Simulation struct {
+	Enabled bool `json:"enabled"`
+	// EpochDuration is how long an epoch of the simulated chain lasts
+	EpochDuration time.Duration `json:"epoch_duration"`
+	// Providers is the number of simulated storage providers
+	Providers int `json:"providers"`
+	// Throughput is how many bytes a provider pulls per epoch
+	Throughput int64 `json:"throughput"`
+	// PublishDelay is how many epochs after receiving the data a provider
+	// publishes a deal
+	PublishDelay int64 `json:"publish_delay"`
+	// SealDelay is how many epochs after publishing a deal a provider seals it
+	SealDelay int64 `json:"seal_delay"`
+	// RejectRate is the fraction of proposals the providers reject
+	RejectRate float64 `json:"reject_rate"`
+}
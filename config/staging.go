@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// StagingPolicy configures how content too small for deals of its own is
+// aggregated in staging zones. In per-user overrides, zero fields keep the
+// value of the global policy.
+type StagingPolicy struct {
+	// Disabled makes deals for all content individually
+	Disabled bool `json:"disabled,omitempty"`
+	// IndividualDealThreshold is the size from which content gets deals of
+	// its own instead of being aggregated
+	IndividualDealThreshold int64 `json:"individual_deal_threshold,omitempty"`
+	// PieceSize is the padded size of the pieces staging zones are filled
+	// for, MinSize and MaxSize are derived from it when they are not set
+	PieceSize int64 `json:"piece_size,omitempty"`
+	// MinSize is the size from which a staging zone is aggregated right away
+	MinSize int64 `json:"min_size,omitempty"`
+	// MaxSize is the most content a staging zone holds
+	MaxSize int64 `json:"max_size,omitempty"`
+	// MaxItems is the most items a staging zone holds
+	MaxItems int `json:"max_items,omitempty"`
+	// MinDealSize is the size a staging zone needs to reach before it is
+	// aggregated at all
+	MinDealSize int64 `json:"min_deal_size,omitempty"`
+	// MaxLifetime is how long a staging zone stays open before it is
+	// aggregated
+	MaxLifetime time.Duration `json:"max_lifetime,omitempty"`
+	// KeepAlive is how long a staging zone stays open at least after content
+	// was last added to it
+	KeepAlive time.Duration `json:"keep_alive,omitempty"`
+	// MaxContentAge is the longest content waits in a staging zone
+	MaxContentAge time.Duration `json:"max_content_age,omitempty"`
+}
+
+func (sp StagingPolicy) IsZero() bool {
+	return sp == StagingPolicy{}
+}
+
+func (sp StagingPolicy) Validate() error {
+	if sp.PieceSize != 0 && (sp.PieceSize < 256 || sp.PieceSize&(sp.PieceSize-1) != 0) {
+		return fmt.Errorf("piece size %d is not a power of two of at least 256", sp.PieceSize)
+	}
+
+	if sp.IndividualDealThreshold < 0 || sp.MinSize < 0 || sp.MaxSize < 0 || sp.MinDealSize < 0 || sp.MaxItems < 0 {
+		return fmt.Errorf("staging zone sizes and limits cannot be negative")
+	}
+
+	if sp.MaxLifetime < 0 || sp.KeepAlive < 0 || sp.MaxContentAge < 0 {
+		return fmt.Errorf("staging zone durations cannot be negative")
+	}
+
+	if sp.MinSize != 0 && sp.MaxSize != 0 && sp.MinSize > sp.MaxSize {
+		return fmt.Errorf("staging zone min size %d is larger than max size %d", sp.MinSize, sp.MaxSize)
+	}
+
+	if sp.IndividualDealThreshold != 0 && sp.MaxSize != 0 && sp.IndividualDealThreshold > sp.MaxSize {
+		return fmt.Errorf("individual deal threshold %d is larger than staging zone max size %d", sp.IndividualDealThreshold, sp.MaxSize)
+	}
+
+	if sp.PieceSize != 0 && sp.MaxSize > unpaddedSize(sp.PieceSize) {
+		return fmt.Errorf("staging zone max size %d does not fit in a %d byte piece", sp.MaxSize, sp.PieceSize)
+	}
+	return nil
+}
+
+// Aggregates reports whether content of the given size is aggregated in a
+// staging zone rather than getting deals of its own, content that does not fit
+// in a staging zone never is
+func (sp StagingPolicy) Aggregates(size int64) bool {
+	return !sp.Disabled && size < sp.IndividualDealThreshold && size <= sp.MaxSize
+}
+
+// Merge returns the policy with the non zero fields of ov applied. Setting
+// the piece size in ov also resets the zone sizes it does not set.
+func (sp StagingPolicy) Merge(ov StagingPolicy) StagingPolicy {
+	out := sp
+	if ov.Disabled {
+		out.Disabled = true
+	}
+	if ov.IndividualDealThreshold != 0 {
+		out.IndividualDealThreshold = ov.IndividualDealThreshold
+	}
+	if ov.PieceSize != 0 {
+		out.PieceSize = ov.PieceSize
+		out.MinSize = ov.MinSize
+		out.MaxSize = ov.MaxSize
+	}
+	if ov.MinSize != 0 {
+		out.MinSize = ov.MinSize
+	}
+	if ov.MaxSize != 0 {
+		out.MaxSize = ov.MaxSize
+	}
+	if ov.MaxItems != 0 {
+		out.MaxItems = ov.MaxItems
+	}
+	if ov.MinDealSize != 0 {
+		out.MinDealSize = ov.MinDealSize
+	}
+	if ov.MaxLifetime != 0 {
+		out.MaxLifetime = ov.MaxLifetime
+	}
+	if ov.KeepAlive != 0 {
+		out.KeepAlive = ov.KeepAlive
+	}
+	if ov.MaxContentAge != 0 {
+		out.MaxContentAge = ov.MaxContentAge
+	}
+	return out
+}
+
+// Resolve fills in the zone sizes derived from the piece size: 90% of the
+// unpadded piece to leave room for the car file overhead, and aggregating
+// from a GiB less than that
+func (sp StagingPolicy) Resolve() StagingPolicy {
+	if sp.MaxSize == 0 && sp.PieceSize != 0 {
+		sp.MaxSize = unpaddedSize(sp.PieceSize) * 9 / 10
+	}
+
+	if sp.MinSize == 0 {
+		sp.MinSize = sp.MaxSize - (1 << 30)
+		if sp.MinSize < sp.MaxSize/2 {
+			sp.MinSize = sp.MaxSize / 2
+		}
+	}
+	return sp
+}
+
+func unpaddedSize(padded int64) int64 {
+	return padded - padded/128
+}
+
+// DefaultStagingPolicy aggregates content under ~3.6 GiB into 16 GiB pieces
+func DefaultStagingPolicy() StagingPolicy {
+	return StagingPolicy{
+		IndividualDealThreshold: unpaddedSize(4<<30) * 9 / 10,
+		PieceSize:               16 << 30,
+		MaxItems:                10000,
+		MinDealSize:             256 << 20,
+		MaxLifetime:             time.Hour * 8,
+		KeepAlive:               time.Minute * 40,
+		MaxContentAge:           time.Hour * 24 * 7,
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransferSupervisor configures the detection of data transfers that stopped
+// making progress. Stalled transfers are restarted with an exponential
+// backoff and their deals are failed after MaxRestarts attempts.
+type TransferSupervisor struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+	// StallTimeout is how long a transfer may go without sending any bytes
+	// before it is considered stalled
+	StallTimeout time.Duration `json:"stall_timeout"`
+	// RestartBackoff is the wait before the second restart of a transfer, it
+	// doubles with every further restart up to MaxRestartBackoff
+	RestartBackoff    time.Duration `json:"restart_backoff"`
+	MaxRestartBackoff time.Duration `json:"max_restart_backoff"`
+	MaxRestarts       int           `json:"max_restarts"`
+}
+
+func DefaultTransferSupervisor() TransferSupervisor {
+	return TransferSupervisor{
+		Enabled:           true,
+		Interval:          time.Minute,
+		StallTimeout:      time.Minute * 20,
+		RestartBackoff:    time.Minute * 5,
+		MaxRestartBackoff: time.Hour,
+		MaxRestarts:       5,
+	}
+}
+
+func (ts TransferSupervisor) Validate() error {
+	if !ts.Enabled {
+		return nil
+	}
+
+	if ts.Interval <= 0 {
+		return fmt.Errorf("transfer supervisor interval must be positive")
+	}
+
+	if ts.StallTimeout <= 0 {
+		return fmt.Errorf("transfer stall timeout must be positive")
+	}
+
+	if ts.RestartBackoff < 0 || ts.MaxRestartBackoff < ts.RestartBackoff {
+		return fmt.Errorf("transfer restart backoff must not be negative nor above the max restart backoff")
+	}
+
+	if ts.MaxRestarts < 0 {
+		return fmt.Errorf("max transfer restarts must not be negative")
+	}
+	return nil
+}
+
+// TransferLimits caps the load that deals put on miners and on the bandwidth
+// of the node, zero means no limit. Deals with a miner at one of its limits
+// are deferred to a later check of their content instead of failing.
+type TransferLimits struct {
+	// MaxConcurrentPerMiner is the most deals whose data is still being
+	// transferred that a miner may have at once
+	MaxConcurrentPerMiner int `json:"max_concurrent_per_miner"`
+	// MaxProposalsPerMinerPerDay is the most deals proposed to a miner in
+	// any 24 hours
+	MaxProposalsPerMinerPerDay int `json:"max_proposals_per_miner_per_day"`
+	// MaxBandwidth is the bytes per second the transfers served by the node
+	// share evenly, shuttles have their own setting. Graphsync transfers
+	// count as a single transfer.
+	MaxBandwidth int64 `json:"max_bandwidth"`
+}
+
+func (tl TransferLimits) Validate() error {
+	if tl.MaxConcurrentPerMiner < 0 || tl.MaxProposalsPerMinerPerDay < 0 || tl.MaxBandwidth < 0 {
+		return fmt.Errorf("transfer limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-metrics-interface"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how long a worker may hold a job before other workers may take it over
+	contentJobLease = 30 * time.Minute
+	// how often idle workers look for due jobs when nothing was scheduled
+	contentJobPollInterval = 5 * time.Second
+	// failed checks are retried after contentJobRetryBase, doubling with each
+	// further failure up to contentJobRetryMax
+	contentJobRetryBase = 5 * time.Minute
+	contentJobRetryMax  = 6 * time.Hour
+)
+
+// contentCheckIdle is passed to the done callback of ensureStorage when the
+// content is not to be checked again until something else queues it
+const contentCheckIdle time.Duration = -1
+
+// contentCheckJob is the persisted schedule of the checks the content watcher
+// runs for a piece of content. A job that is not scheduled waits for
+// something else, like aggregation, to queue the content again.
+type contentCheckJob struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Content   uint      `gorm:"uniqueIndex" json:"content"`
+	Scheduled bool      `gorm:"index" json:"scheduled"`
+	NextCheck time.Time `gorm:"index" json:"nextCheck"`
+	// Reason is why the job was last scheduled
+	Reason string `json:"reason"`
+	// due jobs with a higher priority run first
+	Priority int  `json:"priority"`
+	Paused   bool `json:"paused"`
+
+	// Attempts counts the checks that failed in a row
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	LastRunAt time.Time `json:"lastRunAt"`
+
+	LeaseUntil time.Time `json:"leaseUntil"`
+	// Version changes whenever the job is claimed or rescheduled, so that a
+	// worker finishing a check does not override a schedule made while it
+	// ran, nor the lease of a worker that took over the job
+	Version uint `json:"-"`
+}
+
+func (j *contentCheckJob) State() string {
+	switch {
+	case j.Paused:
+		return "paused"
+	case j.LeaseUntil.After(time.Now()):
+		return "running"
+	case j.Scheduled:
+		return "scheduled"
+	default:
+		return "idle"
+	}
+}
+
+// contentQueue hands out the content check jobs to the watcher workers
+type contentQueue struct {
+	db   *gorm.DB
+	wake chan struct{}
+
+	sizeMetr metrics.Gauge
+}
+
+func newContentQueue(db *gorm.DB) *contentQueue {
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+	return &contentQueue{
+		db:       db,
+		wake:     make(chan struct{}, 1),
+		sizeMetr: metrics.NewCtx(metCtx, "queue_size", "number of scheduled items in the replicator queue").Gauge(),
+	}
+}
+
+func (q *contentQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule makes sure content is checked within wait. A job that is already
+// scheduled to run sooner keeps its schedule.
+func (q *contentQueue) schedule(content uint, wait time.Duration, reason string) error {
+	at := time.Now().Add(wait)
+
+	for i := 0; i < 2; i++ {
+		res := q.db.Model(contentCheckJob{}).
+			Where("content = ? and (not scheduled or next_check > ?)", content, at).
+			Updates(map[string]interface{}{
+				"scheduled":  true,
+				"next_check": at,
+				"reason":     reason,
+				"version":    gorm.Expr("version + 1"),
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected > 0 {
+			q.notify()
+			return nil
+		}
+
+		res = q.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&contentCheckJob{
+			Content:   content,
+			Scheduled: true,
+			NextCheck: at,
+			Reason:    reason,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected > 0 {
+			q.notify()
+			return nil
+		}
+
+		// the job exists, either it is already scheduled soon enough or it
+		// was created concurrently, in which case updating it again settles it
+		var existing contentCheckJob
+		if err := q.db.First(&existing, "content = ?", content).Error; err != nil {
+			return err
+		}
+
+		if existing.Scheduled && !existing.NextCheck.After(at) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// claim takes the next due job, if there is one, for contentJobLease
+func (q *contentQueue) claim() (*contentCheckJob, error) {
+	now := time.Now()
+
+	var cands []contentCheckJob
+	if err := q.db.Where("scheduled and not paused and next_check <= ? and lease_until < ?", now, now).
+		Order("priority desc, next_check").
+		Limit(10).
+		Find(&cands).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range cands {
+		job := &cands[i]
+		res := q.db.Model(contentCheckJob{}).
+			Where("id = ? and version = ? and lease_until < ?", job.ID, job.Version, now).
+			Updates(map[string]interface{}{
+				"lease_until": now.Add(contentJobLease),
+				"last_run_at": now,
+				"version":     gorm.Expr("version + 1"),
+			})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		// another worker got to it first
+		if res.RowsAffected == 0 {
+			continue
+		}
+
+		job.LeaseUntil = now.Add(contentJobLease)
+		job.LastRunAt = now
+		job.Version++
+		return job, nil
+	}
+	return nil, nil
+}
+
+// finish schedules the next check of a job that ran successfully
+func (q *contentQueue) finish(job *contentCheckJob, wait time.Duration) error {
+	return q.release(job, map[string]interface{}{
+		"scheduled":  true,
+		"next_check": time.Now().Add(wait),
+		"reason":     "check completed",
+		"attempts":   0,
+		"last_error": "",
+	})
+}
+
+// idle marks a job that ran successfully without asking for another check
+func (q *contentQueue) idle(job *contentCheckJob) error {
+	return q.release(job, map[string]interface{}{
+		"scheduled":  false,
+		"reason":     "waiting to be queued again",
+		"attempts":   0,
+		"last_error": "",
+	})
+}
+
+// fail records the error of a job and retries it with backoff
+func (q *contentQueue) fail(job *contentCheckJob, cerr error) error {
+	attempts := job.Attempts + 1
+	backoff := contentJobRetryBase
+	for i := 1; i < attempts && backoff < contentJobRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > contentJobRetryMax {
+		backoff = contentJobRetryMax
+	}
+
+	return q.release(job, map[string]interface{}{
+		"scheduled":  true,
+		"next_check": time.Now().Add(backoff),
+		"reason":     fmt.Sprintf("retry %d after error", attempts),
+		"attempts":   attempts,
+		"last_error": cerr.Error(),
+	})
+}
+
+// release gives up the lease on job, updating it with cols. A job that was
+// rescheduled or taken over by another worker since it was claimed is left
+// as it is.
+func (q *contentQueue) release(job *contentCheckJob, cols map[string]interface{}) error {
+	cols["lease_until"] = time.Time{}
+	cols["version"] = gorm.Expr("version + 1")
+
+	res := q.db.Model(contentCheckJob{}).Where("id = ? and version = ?", job.ID, job.Version).Updates(cols)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		log.Debugw("content check job changed while it ran", "content", job.Content)
+	}
+	return nil
+}
+
+// recover releases the jobs that were running when the process stopped, and
+// schedules the idle jobs of content that is not in an aggregate, in case
+// whatever was going to queue them again did not get to it
+func (q *contentQueue) recover() error {
+	if err := q.db.Model(contentCheckJob{}).
+		Where("lease_until > ?", time.Time{}).
+		UpdateColumn("lease_until", time.Time{}).Error; err != nil {
+		return err
+	}
+
+	return q.db.Model(contentCheckJob{}).
+		Where("not scheduled and content in (?)",
+			q.db.Model(Content{}).Select("id").Where("active AND NOT aggregated_in > 0")).
+		Updates(map[string]interface{}{
+			"scheduled":  true,
+			"next_check": time.Now(),
+			"reason":     "queued at startup",
+			"version":    gorm.Expr("version + 1"),
+		}).Error
+}
+
+func (q *contentQueue) isEmpty() (bool, error) {
+	var count int64
+	if err := q.db.Model(contentCheckJob{}).Limit(1).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+func (q *contentQueue) updateMetrics() {
+	var count int64
+	if err := q.db.Model(contentCheckJob{}).Where("scheduled").Count(&count).Error; err != nil {
+		log.Errorf("failed to count scheduled content checks: %s", err)
+		return
+	}
+	q.sizeMetr.Set(float64(count))
+}
+
+// queueChecks moves the content sent to ToCheck into the persisted queue
+func (cm *ContentManager) queueChecks(ctx context.Context) {
+	for {
+		select {
+		case c := <-cm.ToCheck:
+			if err := cm.jobs.schedule(c, 0, "queued"); err != nil {
+				log.Errorf("failed to queue content %d for checking: %s", c, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runContentChecks pulls due jobs from the queue and checks their content
+// until ctx is done
+func (cm *ContentManager) runContentChecks(ctx context.Context) {
+	timer := time.NewTimer(contentJobPollInterval)
+	defer timer.Stop()
+
+	for {
+		job, err := cm.jobs.claim()
+		if err != nil {
+			log.Errorf("failed to claim content check job: %s", err)
+		}
+
+		if job != nil {
+			cm.runContentCheck(ctx, job)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(contentJobPollInterval)
+
+		select {
+		case <-cm.jobs.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) runContentCheck(ctx context.Context, job *contentCheckJob) {
+	var content Content
+	if err := cm.DB.First(&content, "id = ?", job.Content).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			// the content was removed, there is nothing left to check
+			if err := cm.DB.Delete(job).Error; err != nil {
+				log.Errorf("failed to delete check job of removed content %d: %s", job.Content, err)
+			}
+			return
+		}
+
+		log.Errorf("finding content %d in database: %s", job.Content, err)
+		if err := cm.jobs.fail(job, err); err != nil {
+			log.Errorf("failed to update check job of content %d: %s", job.Content, err)
+		}
+		return
+	}
+
+	log.Infof("checking content: %d", content.ID)
+
+	// ensureStorage may call done after it returns, once the work it
+	// started in the background is over. The job stays leased until then.
+	err := cm.ensureStorage(ctx, content, func(dur time.Duration) {
+		if dur == contentCheckIdle {
+			if err := cm.jobs.idle(job); err != nil {
+				log.Errorf("failed to update check job of content %d: %s", content.ID, err)
+			}
+			return
+		}
+
+		if err := cm.jobs.finish(job, dur); err != nil {
+			log.Errorf("failed to schedule next check of content %d: %s", content.ID, err)
+		}
+	})
+	if err != nil {
+		log.Errorf("failed to ensure replication of content %d: %s", content.ID, err)
+		if err := cm.jobs.fail(job, err); err != nil {
+			log.Errorf("failed to update check job of content %d: %s", content.ID, err)
+		}
+	}
+}
+
+func (s *Server) getContentJob(c echo.Context) (*contentCheckJob, error) {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("content")),
+		}
+	}
+
+	var job contentCheckJob
+	if err := s.DB.First(&job, "content = ?", cont).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("no check job for content %d", cont),
+			}
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+type contentJobResponse struct {
+	contentCheckJob
+	State string `json:"state"`
+}
+
+func newContentJobResponse(job *contentCheckJob) contentJobResponse {
+	return contentJobResponse{contentCheckJob: *job, State: job.State()}
+}
+
+// handleAdminListContentJobs godoc
+// @Summary      List content check jobs
+// @Description  This endpoint lists the jobs of the content watcher in the order they are due. The state parameter filters by scheduled, paused, idle or failing jobs.
+// @Tags         admin
+// @Produce      json
+// @Param        state   query  string  false  "scheduled, paused, idle or failing"
+// @Param        limit   query  int     false  "Max number of jobs, defaults to 100"
+// @Param        offset  query  int     false  "Offset"
+// @Success      200     {array}  contentJobResponse
+// @Router       /admin/cm/jobs [get]
+func (s *Server) handleAdminListContentJobs(c echo.Context) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid limit %q", l),
+			}
+		}
+		limit = n
+	}
+
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+
+	q := s.DB.Model(contentCheckJob{}).Order("next_check").Limit(limit).Offset(offset)
+	switch state := c.QueryParam("state"); state {
+	case "":
+	case "scheduled":
+		q = q.Where("scheduled and not paused")
+	case "paused":
+		q = q.Where("paused")
+	case "idle":
+		q = q.Where("not scheduled and not paused")
+	case "failing":
+		q = q.Where("attempts > 0")
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("unknown job state %q", state),
+		}
+	}
+
+	var jobs []*contentCheckJob
+	if err := q.Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	out := make([]contentJobResponse, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, newContentJobResponse(j))
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAdminGetContentJob godoc
+// @Summary      Get the check job of a content
+// @Description  This endpoint returns when the content watcher checks the content next, and how its previous checks went.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200      {object}  contentJobResponse
+// @Router       /admin/cm/jobs/{content} [get]
+func (s *Server) handleAdminGetContentJob(c echo.Context) error {
+	job, err := s.getContentJob(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newContentJobResponse(job))
+}
+
+type contentJobPriorityBody struct {
+	Priority int `json:"priority"`
+}
+
+// handleAdminSetContentJobPriority godoc
+// @Summary      Reprioritize a content check job
+// @Description  This endpoint sets the priority of a content check job. Of the jobs that are due, the ones with higher priority run first.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int                     true  "Content ID"
+// @Param        body     body  contentJobPriorityBody  true  "Priority"
+// @Success      200      {object}  contentJobResponse
+// @Router       /admin/cm/jobs/{content}/priority [put]
+func (s *Server) handleAdminSetContentJobPriority(c echo.Context) error {
+	job, err := s.getContentJob(c)
+	if err != nil {
+		return err
+	}
+
+	var body contentJobPriorityBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(job).UpdateColumn("priority", body.Priority).Error; err != nil {
+		return err
+	}
+	job.Priority = body.Priority
+	return c.JSON(http.StatusOK, newContentJobResponse(job))
+}
+
+// handleAdminPauseContentJob godoc
+// @Summary      Pause a content check job
+// @Description  This endpoint stops the content watcher from checking a content until the job is resumed or forced to run.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200      {object}  contentJobResponse
+// @Router       /admin/cm/jobs/{content}/pause [post]
+func (s *Server) handleAdminPauseContentJob(c echo.Context) error {
+	return s.setContentJobPaused(c, true)
+}
+
+// handleAdminResumeContentJob godoc
+// @Summary      Resume a content check job
+// @Description  This endpoint lets the content watcher check a paused content again, on its previous schedule.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200      {object}  contentJobResponse
+// @Router       /admin/cm/jobs/{content}/resume [post]
+func (s *Server) handleAdminResumeContentJob(c echo.Context) error {
+	return s.setContentJobPaused(c, false)
+}
+
+func (s *Server) setContentJobPaused(c echo.Context, paused bool) error {
+	job, err := s.getContentJob(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(job).UpdateColumn("paused", paused).Error; err != nil {
+		return err
+	}
+	job.Paused = paused
+
+	if !paused {
+		s.CM.jobs.notify()
+	}
+	return c.JSON(http.StatusOK, newContentJobResponse(job))
+}
+
+// handleAdminRunContentJob godoc
+// @Summary      Force a content check job to run
+// @Description  This endpoint schedules a content to be checked right away, resuming its job if it was paused. The content does not need to have a job yet.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200      {object}  contentJobResponse
+// @Router       /admin/cm/jobs/{content}/run [post]
+func (s *Server) handleAdminRunContentJob(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("content")),
+		}
+	}
+
+	if _, err := s.CM.getContent(uint(cont)); err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content %d does not exist", cont),
+			}
+		}
+		return err
+	}
+
+	if err := s.CM.jobs.schedule(uint(cont), 0, "forced by admin"); err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(contentCheckJob{}).Where("content = ?", cont).UpdateColumn("paused", false).Error; err != nil {
+		return err
+	}
+	s.CM.jobs.notify()
+
+	job, err := s.getContentJob(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newContentJobResponse(job))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// contentStateTransition records a change of state of a content
+type contentStateTransition struct {
+	ID        uint              `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Content   uint              `gorm:"index" json:"content"`
+	From      util.ContentState `json:"from"`
+	To        util.ContentState `json:"to"`
+	Reason    string            `json:"reason"`
+}
+
+// contentStateColumns returns the flag columns that are kept in sync with
+// each state, so that queries on them keep working
+func contentStateColumns(s util.ContentState) map[string]interface{} {
+	switch s {
+	case util.ContentStatePinning:
+		return map[string]interface{}{"active": false, "pinning": true, "failed": false}
+	case util.ContentStateReceiving:
+		return map[string]interface{}{"active": false, "pinning": false, "failed": false}
+	case util.ContentStateStaging:
+		return map[string]interface{}{"active": false, "pinning": true}
+	case util.ContentStateActive:
+		return map[string]interface{}{"active": true, "pinning": false, "failed": false, "offloaded": false}
+	case util.ContentStateAggregated:
+		return map[string]interface{}{"active": true, "pinning": false, "offloaded": false}
+	case util.ContentStateSplit:
+		return map[string]interface{}{"active": false, "dag_split": true}
+	case util.ContentStateOffloaded:
+		return map[string]interface{}{"offloaded": true}
+	case util.ContentStateReplaced:
+		return map[string]interface{}{"replace": true}
+	case util.ContentStateFailed:
+		return map[string]interface{}{"active": false, "pinning": false, "failed": true}
+	case util.ContentStateRetired:
+		return map[string]interface{}{"active": false, "pinning": false}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// transitionContent moves content to state to, along with updating cols.
+// Illegal transitions are rejected and the content is left as it was.
+func transitionContent(db *gorm.DB, cont uint, to util.ContentState, reason string, cols map[string]interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return transitionContentTx(tx, cont, to, reason, cols)
+	})
+}
+
+func transitionContentTx(tx *gorm.DB, cont uint, to util.ContentState, reason string, cols map[string]interface{}) error {
+	var c Content
+	if err := tx.Select("id", "state").First(&c, "id = ?", cont).Error; err != nil {
+		return err
+	}
+
+	if err := c.State.CheckTransition(to); err != nil {
+		return fmt.Errorf("content %d: %w", cont, err)
+	}
+
+	upd := contentStateColumns(to)
+	for k, v := range cols {
+		upd[k] = v
+	}
+	upd["state"] = to
+
+	res := tx.Model(Content{}).Where("id = ? and state = ?", cont, c.State).UpdateColumns(upd)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("content %d changed state while moving it to %q", cont, to)
+	}
+
+	if c.State == to {
+		return nil
+	}
+
+	return tx.Create(&contentStateTransition{
+		Content: cont,
+		From:    c.State,
+		To:      to,
+		Reason:  reason,
+	}).Error
+}
+
+// removeContentRecord moves content to the removed state and deletes it
+func removeContentRecord(db *gorm.DB, cont uint, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionContentTx(tx, cont, util.ContentStateRemoved, reason, nil); err != nil {
+			return err
+		}
+		return tx.Delete(&Content{}, cont).Error
+	})
+}
+
+// restoredContentState is the state content goes back to once its data is
+// stored again
+func restoredContentState(c *Content) util.ContentState {
+	if c.AggregatedIn > 0 {
+		return util.ContentStateAggregated
+	}
+	return util.ContentStateActive
+}
+
+// migrateContentStates sets the state of the content that was created before
+// content had one from its flags
+func migrateContentStates(db *gorm.DB) error {
+	var batch []Content
+	return db.Unscoped().Where("state = ''").FindInBatches(&batch, 1000, func(tx *gorm.DB, n int) error {
+		byState := make(map[util.ContentState][]uint)
+		for _, c := range batch {
+			s := util.ContentStateFromFlags(util.ContentFlags{
+				Active:       c.Active,
+				Pinning:      c.Pinning,
+				Failed:       c.Failed,
+				Offloaded:    c.Offloaded,
+				Aggregate:    c.Aggregate,
+				AggregatedIn: c.AggregatedIn,
+				DagSplit:     c.DagSplit,
+				SplitFrom:    c.SplitFrom,
+				Replace:      c.Replace,
+				Deleted:      c.DeletedAt.Valid,
+			})
+			byState[s] = append(byState[s], c.ID)
+		}
+
+		for s, ids := range byState {
+			if err := db.Unscoped().Model(Content{}).Where("id in ?", ids).UpdateColumn("state", s).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// handleAdminGetContentStates godoc
+// @Summary      Get the state history of a content
+// @Description  This endpoint returns the current state of a content and every change of state recorded for it, oldest first.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200      {object}  map[string]interface{}
+// @Router       /admin/cm/states/{content} [get]
+func (s *Server) handleAdminGetContentStates(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("content")),
+		}
+	}
+
+	var content Content
+	if err := s.DB.Unscoped().First(&content, "id = ?", cont).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content %d does not exist", cont),
+			}
+		}
+		return err
+	}
+
+	var history []contentStateTransition
+	if err := s.DB.Order("id").Find(&history, "content = ?", cont).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"content": content.ID,
+		"state":   content.State,
+		"history": history,
+	})
+}
@@ -241,6 +241,7 @@ type User struct {
 	Flags int
 
 	StorageDisabled bool
+	Quota           util.UserQuota `gorm:"embedded;embeddedPrefix:quota_"`
 }
 
 func NewUsersQuery(db *gorm.DB) *UsersQuery {
@@ -312,6 +313,7 @@ type AuthToken struct {
 	gorm.Model
 	Token  string `gorm:"unique"`
 	User   UserID
+	Scopes util.Scopes
 	Expiry time.Time
 }
 
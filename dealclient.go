@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/application-research/estuary/sim"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/filclient"
+	smtypes "github.com/filecoin-project/boost/storagemarket/types"
+	"github.com/filecoin-project/boost/transport/httptransport"
+	boosttypes "github.com/filecoin-project/boost/transport/types"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// dealClient is what the content manager and the handlers need to make and
+// track deals. It is filclient in production and the simulated client when
+// running with --simulate.
+type dealClient interface {
+	ClientAddress() address.Address
+	SetPieceCommFunc(pcf filclient.GetPieceCommFunc)
+	Balance(ctx context.Context) (*filclient.Balance, error)
+	LockMarketFunds(ctx context.Context, amt types.FIL) (*filclient.LockFundsResp, error)
+
+	GetAsk(ctx context.Context, maddr address.Address) (*network.AskResponse, error)
+	GetMinerVersion(ctx context.Context, maddr address.Address) (string, error)
+	DealProtocolForMiner(ctx context.Context, maddr address.Address) (protocol.ID, error)
+	MakeDeal(ctx context.Context, maddr address.Address, data cid.Cid, price types.BigInt, minSize abi.PaddedPieceSize, duration abi.ChainEpoch, verified bool) (*network.Proposal, error)
+	SendProposalV110(ctx context.Context, netprop network.Proposal, propCid cid.Cid) (bool, error)
+	SendProposalV120(ctx context.Context, dbid uint, netprop network.Proposal, dealUUID uuid.UUID, announce multiaddr.Multiaddr, authToken string) (bool, error)
+	SendProposalV120Http(ctx context.Context, dbid uint, netprop network.Proposal, dealUUID uuid.UUID, pieceURL string, authToken string) (bool, error)
+	PrepareForDataRequest(ctx context.Context, id uint, authToken string, proposalCid cid.Cid, payloadCid cid.Cid, size uint64) error
+	CleanupPreparedRequest(ctx context.Context, dbid uint, authToken string) error
+	DealStatus(ctx context.Context, maddr address.Address, propCid cid.Cid, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, error)
+	CheckChainDeal(ctx context.Context, dealid abi.DealID) (bool, *api.MarketDeal, error)
+
+	StartDataTransfer(ctx context.Context, maddr address.Address, propCid cid.Cid, dataCid cid.Cid) (*datatransfer.ChannelID, error)
+	RestartTransfer(ctx context.Context, chanid *datatransfer.ChannelID) error
+	TransferStatus(ctx context.Context, chanid *datatransfer.ChannelID) (*filclient.ChannelState, error)
+	TransferStatusByID(ctx context.Context, id string) (*filclient.ChannelState, error)
+	TransferStatusForContent(ctx context.Context, content cid.Cid, maddr address.Address) (*filclient.ChannelState, error)
+	TransfersInProgress(ctx context.Context) (map[string]*filclient.ChannelState, error)
+	MinerTransferDiagnostics(ctx context.Context, maddr address.Address) (*filclient.MinerTransferDiagnostics, error)
+	CheckOngoingTransfer(ctx context.Context, maddr address.Address, st *filclient.ChannelState) error
+
+	RetrievalQuery(ctx context.Context, maddr address.Address, pcid cid.Cid) (*retrievalmarket.QueryResponse, error)
+	RetrieveContent(ctx context.Context, maddr address.Address, proposal *retrievalmarket.DealProposal) (*filclient.RetrievalStats, error)
+}
+
+var (
+	_ dealClient = (*filClient)(nil)
+	_ dealClient = (*sim.Client)(nil)
+)
+
+// filClient adds the bits of the dealClient interface that filclient only
+// exposes through its fields
+type filClient struct {
+	*filclient.FilClient
+
+	// host is the libp2p host filclient was created with
+	host host.Host
+}
+
+func (fc *filClient) ClientAddress() address.Address {
+	return fc.ClientAddr
+}
+
+// withClientAddress returns a client making deals from another address of the
+// wallet. It shares the transfer and retrieval machinery of fc, only what is
+// signed as the client changes.
+func (fc *filClient) withClientAddress(addr address.Address) *filClient {
+	cp := *fc.FilClient
+	cp.ClientAddr = addr
+	return &filClient{FilClient: &cp, host: fc.host}
+}
+
+func (fc *filClient) PrepareForDataRequest(ctx context.Context, id uint, authToken string, proposalCid cid.Cid, payloadCid cid.Cid, size uint64) error {
+	return fc.Libp2pTransferMgr.PrepareForDataRequest(ctx, id, authToken, proposalCid, payloadCid, size)
+}
+
+func (fc *filClient) CleanupPreparedRequest(ctx context.Context, dbid uint, authToken string) error {
+	return fc.Libp2pTransferMgr.CleanupPreparedRequest(ctx, dbid, authToken)
+}
+
+// SendProposalV120Http proposes a deal whose data the provider downloads from
+// pieceURL with the http transfer type. filclient only proposes deals with
+// the libp2p transfer type.
+func (fc *filClient) SendProposalV120Http(ctx context.Context, dbid uint, netprop network.Proposal, dealUUID uuid.UUID, pieceURL string, authToken string) (bool, error) {
+	pid, err := fc.ConnectToMiner(ctx, netprop.DealProposal.Proposal.Provider)
+	if err != nil {
+		return false, fmt.Errorf("connecting to miner: %w", err)
+	}
+
+	s, err := fc.host.NewStream(ctx, pid, filclient.DealProtocolv120)
+	if err != nil {
+		return false, fmt.Errorf("opening stream to miner: %w", err)
+	}
+	defer s.Close()
+
+	transferParams, err := json.Marshal(boosttypes.HttpRequest{
+		URL: pieceURL,
+		Headers: map[string]string{
+			"Authorization": httptransport.BasicAuthHeader("", authToken),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("marshalling deal transfer params: %w", err)
+	}
+
+	params := smtypes.DealParams{
+		DealUUID:           dealUUID,
+		ClientDealProposal: *netprop.DealProposal,
+		DealDataRoot:       netprop.Piece.Root,
+		Transfer: smtypes.Transfer{
+			Type:     piecetransfer.TransferType,
+			ClientID: fmt.Sprintf("%d", dbid),
+			Params:   transferParams,
+			Size:     netprop.Piece.RawBlockSize,
+		},
+	}
+
+	if dline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dline) //nolint:errcheck
+	}
+
+	if err := cborutil.WriteCborRPC(s, &params); err != nil {
+		return false, fmt.Errorf("send proposal rpc: failed to send request: %w", err)
+	}
+
+	var resp smtypes.DealResponse
+	if err := cborutil.ReadCborRPC(s, &resp); err != nil {
+		return false, fmt.Errorf("send proposal rpc: failed to read response: %w", err)
+	}
+
+	if !resp.Accepted {
+		return true, fmt.Errorf("deal proposal rejected: %s", resp.Message)
+	}
+	return false, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-padreader"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+type dealPlanBody struct {
+	// Content is the content to plan deals for, Size is used when it is not
+	// set
+	Content uint  `json:"content"`
+	Size    int64 `json:"size"`
+
+	// Replication, DurationBlks and Verified default to what deal making
+	// uses, Replication is capped to it
+	Replication  int   `json:"replication"`
+	DurationBlks int64 `json:"durationBlks"`
+	Verified     *bool `json:"verified"`
+}
+
+type plannedDeal struct {
+	Miner address.Address  `json:"miner"`
+	Ask   *minerStorageAsk `json:"ask"`
+	// DealSize is the piece size padded to the minimum piece size of the
+	// miner
+	DealSize       abi.PaddedPieceSize `json:"dealSize"`
+	Cost           abi.TokenAmount     `json:"cost"`
+	UnverifiedCost abi.TokenAmount     `json:"unverifiedCost"`
+	VerifiedCost   abi.TokenAmount     `json:"verifiedCost"`
+}
+
+type skippedMiner struct {
+	Miner  address.Address `json:"miner"`
+	Reason string          `json:"reason"`
+}
+
+// datacapImpact is what the planned deals take from the datacap of the
+// wallet pool
+type datacapImpact struct {
+	Available abi.StoragePower `json:"available"`
+	// LargestInAWallet bounds the size of a single deal
+	LargestInAWallet abi.StoragePower `json:"largestInAWallet"`
+	Required         abi.StoragePower `json:"required"`
+	Remaining        abi.StoragePower `json:"remaining"`
+	Enough           bool             `json:"enough"`
+}
+
+type dealPlan struct {
+	Content   uint                `json:"content,omitempty"`
+	Size      int64               `json:"size"`
+	PieceSize abi.PaddedPieceSize `json:"pieceSize"`
+
+	// Storage is what deal making does with the content, for a size it is
+	// what happens to a new content of that size
+	Storage *storageCheck `json:"storage"`
+
+	// DealCount is how many more deals would be made
+	DealCount    int            `json:"dealCount"`
+	Verified     bool           `json:"verified"`
+	DurationBlks abi.ChainEpoch `json:"durationBlks"`
+	Duration     string         `json:"duration"`
+
+	Deals   []plannedDeal  `json:"deals"`
+	Skipped []skippedMiner `json:"skipped"`
+
+	TotalCost    abi.TokenAmount `json:"totalAttoFil"`
+	TotalCostStr string          `json:"totalFil"`
+	Datacap      *datacapImpact  `json:"datacap,omitempty"`
+}
+
+// planPlacement is what checkStorage decides for a new content of the given
+// size: split it, stage it for aggregation or make deals for it
+func (cm *ContentManager) planPlacement(user User, size int64) (*storageCheck, error) {
+	sc := &storageCheck{
+		Status:      storageNeedsDeals,
+		Replication: cm.Replication,
+		Verified:    cm.VerifiedDeal,
+	}
+
+	if size > cm.contentSizeLimit {
+		sc.Status = storageNeedsSplit
+		if !user.FlagSplitContent() {
+			sc.Explanation = fmt.Sprintf("content is over the size limit of %d bytes and splitting is not enabled for the user", cm.contentSizeLimit)
+		} else {
+			sc.Explanation = fmt.Sprintf("content is over the size limit of %d bytes and gets split into smaller contents", cm.contentSizeLimit)
+		}
+		return sc, nil
+	}
+
+	stagingPolicy, err := cm.stagingPolicyFor(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if stagingPolicy.Aggregates(size) {
+		sc.Status = storageNeedsStaging
+		sc.Explanation = fmt.Sprintf("content is smaller than %d bytes and gets aggregated with other content", stagingPolicy.IndividualDealThreshold)
+		return sc, nil
+	}
+
+	sc.Explanation = "content gets deals of its own"
+	return sc, nil
+}
+
+// getsOwnDeals is false for content that is split or aggregated instead of
+// getting deals of its own, its plan has no deals and Storage explains why
+func getsOwnDeals(sc *storageCheck) bool {
+	switch sc.Status {
+	case storageNeedsSplit, storageSplitRoot, storageNeedsStaging, storageStaged, storageAggregated:
+		return false
+	}
+	return true
+}
+
+// planDeals runs miner selection for a piece of the given size the way
+// makeDealsForContent does, using cached asks, and prices the deals it would
+// propose. Nothing is sent to the miners and no failures are recorded.
+func (cm *ContentManager) planDeals(ctx context.Context, plan *dealPlan, cont Content, count int, exclude map[address.Address]bool) error {
+	ctx, span := cm.tracer.Start(ctx, "planDeals")
+	defer span.End()
+
+	plan.TotalCost = abi.NewTokenAmount(0)
+	if count <= 0 {
+		return nil
+	}
+
+	minerpool, err := cm.pickMiners(ctx, cont, count*2, plan.PieceSize, exclude, plan.Verified)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range minerpool {
+		if len(plan.Deals) >= count {
+			break
+		}
+
+		ask, err := cm.getAsk(ctx, m, time.Minute*30)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, skippedMiner{Miner: m, Reason: fmt.Sprintf("failed to get ask: %s", err)})
+			continue
+		}
+
+		price, err := ask.GetPrice()
+		if err != nil {
+			return err
+		}
+
+		verifiedPrice, err := ask.GetVerifiedPrice()
+		if err != nil {
+			return err
+		}
+
+		dealPrice := *price
+		if plan.Verified {
+			dealPrice = *verifiedPrice
+		}
+
+		if cm.priceIsTooHigh(dealPrice, plan.Verified) {
+			plan.Skipped = append(plan.Skipped, skippedMiner{
+				Miner:  m,
+				Reason: fmt.Sprintf("miners price is too high: %s (verified = %v)", types.FIL(dealPrice), plan.Verified),
+			})
+			continue
+		}
+
+		dealSize := plan.PieceSize
+		if dealSize < ask.MinPieceSize {
+			dealSize = ask.MinPieceSize
+		}
+
+		cost, err := filclient.ComputePrice(*price, dealSize, plan.DurationBlks)
+		if err != nil {
+			return err
+		}
+
+		verifiedCost, err := filclient.ComputePrice(*verifiedPrice, dealSize, plan.DurationBlks)
+		if err != nil {
+			return err
+		}
+
+		pd := plannedDeal{
+			Miner:          m,
+			Ask:            ask,
+			DealSize:       dealSize,
+			Cost:           *cost,
+			UnverifiedCost: *cost,
+			VerifiedCost:   *verifiedCost,
+		}
+		if plan.Verified {
+			pd.Cost = *verifiedCost
+		}
+
+		plan.Deals = append(plan.Deals, pd)
+		plan.TotalCost = types.BigAdd(plan.TotalCost, pd.Cost)
+	}
+
+	if !plan.Verified {
+		return nil
+	}
+
+	// datacap is spent on the whole deal size of every deal
+	required := big.Zero()
+	for _, d := range plan.Deals {
+		required = big.Add(required, big.NewIntUnsigned(uint64(d.DealSize)))
+	}
+
+	largest, total, err := cm.Wallets.datacap(ctx)
+	if err != nil {
+		return err
+	}
+
+	remaining := big.Sub(total, required)
+	plan.Datacap = &datacapImpact{
+		Available:        total,
+		LargestInAWallet: largest,
+		Required:         required,
+		Remaining:        remaining,
+		Enough:           remaining.GreaterThanEqual(big.Zero()) && largest.GreaterThanEqual(big.NewIntUnsigned(uint64(plan.PieceSize))),
+	}
+	return nil
+}
+
+// handlePlanDeals godoc
+// @Summary      Preview the deals that would be made
+// @Description  This endpoint runs miner selection for a content or a size and returns the miners deals would be proposed to, with their asks, the verified and unverified cost of each deal and the datacap they would use. The replication is capped to the configured one. Content that would be split or aggregated gets no deals of its own, its plan has a deal count of 0 and the storage field explains what happens to it instead. No deal proposals are sent.
+// @Tags         deals
+// @Produce      json
+// @Param body body main.dealPlanBody true "The content or size to plan deals for"
+// @Success      200  {object}  dealPlan
+// @Router       /deals/plan [post]
+func (s *Server) handlePlanDeals(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	var body dealPlanBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.Content == 0 && body.Size <= 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "either a content or a positive size must be specified",
+		}
+	}
+
+	if body.Replication < 0 || body.DurationBlks < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "replication and duration must not be negative",
+		}
+	}
+
+	plan := &dealPlan{
+		DurationBlks: dealDuration,
+	}
+	if body.DurationBlks > 0 {
+		plan.DurationBlks = abi.ChainEpoch(body.DurationBlks)
+	}
+	plan.Duration = (time.Second * 30 * time.Duration(plan.DurationBlks)).String()
+
+	var cont Content
+	var exclude map[address.Address]bool
+	count := body.Replication
+
+	if body.Content > 0 {
+		content, err := s.CM.getContent(body.Content)
+		if err != nil {
+			if xerrors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Reason:  util.ERR_CONTENT_NOT_FOUND,
+					Details: fmt.Sprintf("content with ID(%d) was not found", body.Content),
+				}
+			}
+			return err
+		}
+
+		if err := s.isContentOwner(u, *content, util.OrgRoleViewer); err != nil {
+			return err
+		}
+
+		sc, err := s.CM.checkStorage(ctx, *content, countRecordedDeals)
+		if err != nil {
+			return err
+		}
+
+		cont = *content
+		exclude = sc.minersAlready
+		plan.Content = content.ID
+		plan.Size = content.Size
+		plan.Storage = sc
+		plan.Verified = sc.Verified
+
+		needed := sc.Replication - sc.goodDeals()
+		if needed < 0 {
+			needed = 0
+		}
+		if count == 0 || count > needed {
+			count = needed
+		}
+		if !getsOwnDeals(sc) {
+			count = 0
+		}
+
+		ap, err := s.CM.segmentPieceFor(content.Cid.CID)
+		if err != nil {
+			return err
+		}
+
+		pcr, err := s.CM.lookupPieceCommRecord(content.Cid.CID)
+		if err != nil {
+			return err
+		}
+
+		if ap != nil {
+			plan.PieceSize = abi.PaddedPieceSize(ap.Size)
+		} else if pcr != nil {
+			plan.PieceSize = pcr.Size.Padded()
+		}
+	} else {
+		sc, err := s.CM.planPlacement(*u, body.Size)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 || count > sc.Replication {
+			count = sc.Replication
+		}
+		if !getsOwnDeals(sc) {
+			count = 0
+		}
+
+		cont = Content{UserID: u.ID, Size: body.Size, Replication: count}
+		plan.Size = body.Size
+		plan.Storage = sc
+		plan.Verified = sc.Verified
+	}
+
+	if body.Verified != nil {
+		plan.Verified = *body.Verified
+	}
+	if plan.PieceSize == 0 {
+		// the piece commitment is not known yet, estimate from the size
+		plan.PieceSize = padreader.PaddedSize(uint64(plan.Size)).Padded()
+	}
+	plan.DealCount = count
+
+	if err := s.CM.planDeals(ctx, plan, cont, count, exclude); err != nil {
+		return err
+	}
+
+	plan.TotalCostStr = types.FIL(plan.TotalCost).String()
+	return c.JSON(http.StatusOK, plan)
+}
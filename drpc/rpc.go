@@ -39,6 +39,7 @@ type CmdParams struct {
 	AggregateContent       *AggregateContent       `json:",omitempty"`
 	StartTransfer          *StartTransfer          `json:",omitempty"`
 	PrepareForDataRequest  *PrepareForDataRequest  `json:",omitempty"`
+	PrepareForHttpTransfer *PrepareForHttpTransfer `json:",omitempty"`
 	CleanupPreparedRequest *CleanupPreparedRequest `json:",omitempty"`
 	ReqTxStatus            *ReqTxStatus            `json:",omitempty"`
 	SplitContent           *SplitContent           `json:",omitempty"`
@@ -99,6 +100,28 @@ type PrepareForDataRequest struct {
 	Size        uint64
 }
 
+const CMD_PrepareForHttpTransfer = "PrepareForHttpTransfer"
+
+// PrepareForHttpTransfer lets the provider of a deal download its piece from
+// the /piece endpoint of the shuttle
+type PrepareForHttpTransfer struct {
+	DealDBID   uint
+	AuthToken  string
+	PieceCid   cid.Cid
+	PayloadCid cid.Cid
+	Size       uint64
+	// Segments is the layout of the piece when it is a data segment
+	// aggregate of the cars of their payloads
+	Segments []PieceSegment
+}
+
+type PieceSegment struct {
+	PayloadCid cid.Cid
+	PieceCid   cid.Cid
+	Size       uint64
+	RootOnly   bool
+}
+
 const CMD_CleanupPreparedRequest = "CleanupPreparedRequest"
 
 type CleanupPreparedRequest struct {
@@ -172,6 +195,7 @@ type MsgParams struct {
 	ShuttleUpdate   *ShuttleUpdate   `json:",omitempty"`
 	GarbageCheck    *GarbageCheck    `json:",omitempty"`
 	SplitComplete   *SplitComplete   `json:",omitempty"`
+	TransferStalled *TransferStalled `json:",omitempty"`
 }
 
 const OP_UpdatePinStatus = "UpdatePinStatus"
@@ -223,6 +247,19 @@ type TransferStatus struct {
 	Message string
 }
 
+const OP_TransferStalled = "TransferStalled"
+
+// TransferStalled reports a stall, restart, recovery or failure of a
+// transfer noticed by the transfer supervisor of a shuttle
+type TransferStalled struct {
+	Chanid   string
+	DealDBID uint
+
+	Event    string
+	Restarts int
+	Sent     uint64
+}
+
 const OP_ShuttleUpdate = "ShuttleUpdate"
 
 type ShuttleUpdate struct {
@@ -230,6 +267,11 @@ type ShuttleUpdate struct {
 	BlockstoreFree uint64
 	NumPins        int64
 	PinQueueSize   int
+
+	// bandwidth of the transfers served by the shuttle, in bytes per second
+	MaxTransferBandwidth int64
+	TransferBandwidth    int64
+	ActiveTransfers      int
 }
 
 const OP_GarbageCheck = "GarbageCheck"
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/labstack/echo/v4"
+)
+
+// Events only sent on the event stream, they change too often to be useful as
+// webhooks
+const (
+	eventPinPinning     = "pin.pinning"
+	eventTransferStatus = "transfer.status"
+)
+
+const (
+	// number of recent events kept per user to resume streams from
+	eventHistorySize = 1000
+	// how long events are kept to resume streams from
+	eventHistoryTTL = time.Hour
+	// number of events buffered per subscriber before it is dropped
+	eventSubscriberBuffer = 256
+
+	eventKeepaliveInterval = time.Second * 30
+)
+
+type streamEvent struct {
+	ID    uint64
+	Event string
+	Data  []byte
+	At    time.Time
+}
+
+// eventRing holds the most recent events of a user, up to eventHistorySize
+type eventRing struct {
+	buf  []*streamEvent
+	next int
+}
+
+func (r *eventRing) push(ev *streamEvent) {
+	if len(r.buf) < eventHistorySize {
+		r.buf = append(r.buf, ev)
+		return
+	}
+	r.buf[r.next] = ev
+	r.next = (r.next + 1) % len(r.buf)
+}
+
+// each calls fn with the events in the order they were pushed
+func (r *eventRing) each(fn func(ev *streamEvent)) {
+	for i := range r.buf {
+		fn(r.buf[(r.next+i)%len(r.buf)])
+	}
+}
+
+func (r *eventRing) newest() *streamEvent {
+	return r.buf[(r.next+len(r.buf)-1)%len(r.buf)]
+}
+
+type eventSubscriber struct {
+	ch chan *streamEvent
+}
+
+// eventBus fans out lifecycle events to the event streams of their user. A
+// short history is kept per user so that a client reconnecting with the id of
+// the last event it saw does not miss anything in between. The history lives
+// in memory only, so it does not survive a restart, and is dropped once it is
+// older than eventHistoryTTL.
+type eventBus struct {
+	lk        sync.Mutex
+	lastID    uint64
+	history   map[uint]*eventRing
+	lastSweep time.Time
+	subs      map[uint]map[*eventSubscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		// event ids keep increasing across restarts so clients never mistake
+		// new events for ones they have already seen
+		lastID:  uint64(time.Now().UnixNano()),
+		history: make(map[uint]*eventRing),
+		subs:    make(map[uint]map[*eventSubscriber]struct{}),
+	}
+}
+
+func (eb *eventBus) publish(user uint, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("failed to marshal %s event: %s", event, err)
+		return
+	}
+
+	eb.lk.Lock()
+	defer eb.lk.Unlock()
+
+	eb.lastID++
+	ev := &streamEvent{
+		ID:    eb.lastID,
+		Event: event,
+		Data:  data,
+		At:    time.Now(),
+	}
+
+	hist, ok := eb.history[user]
+	if !ok {
+		hist = &eventRing{}
+		eb.history[user] = hist
+	}
+	hist.push(ev)
+
+	if ev.At.Sub(eb.lastSweep) > eventHistoryTTL {
+		eb.sweep(ev.At)
+	}
+
+	for sub := range eb.subs[user] {
+		select {
+		case sub.ch <- ev:
+		default:
+			// the client cant keep up, drop it. it can reconnect and resume
+			// from the last event it received.
+			close(sub.ch)
+			delete(eb.subs[user], sub)
+		}
+	}
+}
+
+// sweep drops the history of users that have not had an event within
+// eventHistoryTTL
+func (eb *eventBus) sweep(now time.Time) {
+	for user, hist := range eb.history {
+		if now.Sub(hist.newest().At) > eventHistoryTTL {
+			delete(eb.history, user)
+		}
+	}
+	eb.lastSweep = now
+}
+
+// subscribe registers a new subscriber for user's events, returning the
+// events after lastID that are still in the history
+func (eb *eventBus) subscribe(user uint, lastID uint64) ([]*streamEvent, *eventSubscriber) {
+	eb.lk.Lock()
+	defer eb.lk.Unlock()
+
+	var backlog []*streamEvent
+	if hist, ok := eb.history[user]; ok && lastID > 0 {
+		now := time.Now()
+		hist.each(func(ev *streamEvent) {
+			if ev.ID > lastID && now.Sub(ev.At) <= eventHistoryTTL {
+				backlog = append(backlog, ev)
+			}
+		})
+	}
+
+	sub := &eventSubscriber{
+		ch: make(chan *streamEvent, eventSubscriberBuffer),
+	}
+
+	if eb.subs[user] == nil {
+		eb.subs[user] = make(map[*eventSubscriber]struct{})
+	}
+	eb.subs[user][sub] = struct{}{}
+
+	return backlog, sub
+}
+
+func (eb *eventBus) unsubscribe(user uint, sub *eventSubscriber) {
+	eb.lk.Lock()
+	defer eb.lk.Unlock()
+
+	if _, ok := eb.subs[user][sub]; !ok {
+		// already dropped
+		return
+	}
+
+	delete(eb.subs[user], sub)
+	if len(eb.subs[user]) == 0 {
+		delete(eb.subs, user)
+	}
+	close(sub.ch)
+}
+
+// notifyUser sends ev to the event stream and the webhooks of user
+func (cm *ContentManager) notifyUser(user uint, ev *lifecycleEvent) {
+	if user == 0 {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	cm.events.publish(user, ev.Event, ev)
+	cm.webhooks.emit(user, ev)
+}
+
+// notifyTransferStatus publishes a data transfer update reported by a shuttle
+// to the event stream of the deals owner
+func (cm *ContentManager) notifyTransferStatus(d *contentDeal, st *filclient.ChannelState) {
+	if st == nil || d.UserID == 0 {
+		return
+	}
+
+	cm.events.publish(d.UserID, eventTransferStatus, &lifecycleEvent{
+		Event:    eventTransferStatus,
+		Time:     time.Now(),
+		Content:  d.Content,
+		Deal:     d.ID,
+		DealID:   d.DealID,
+		Miner:    d.Miner,
+		Message:  st.Message,
+		Transfer: st,
+	})
+}
+
+func writeStreamEvent(w http.ResponseWriter, ev *streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Event, ev.Data)
+	return err
+}
+
+// handleUserEvents godoc
+// @Summary      Stream user events
+// @Description  This endpoint streams the lifecycle events (pin status, aggregation, deal and transfer status) of the users content as server-sent events. Clients can resume a stream by sending the id of the last event they received in the Last-Event-ID header or the lastEventId query parameter.
+// @Tags         User
+// @Produce      text/event-stream
+// @Param        Last-Event-ID  header  string  false  "Id of the last event received"
+// @Param        lastEventId    query   string  false  "Id of the last event received"
+// @Router       /user/events [get]
+func (s *Server) handleUserEvents(c echo.Context, u *User) error {
+	lastIDStr := c.Request().Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		// EventSource cant set headers on the first connection
+		lastIDStr = c.QueryParam("lastEventId")
+	}
+
+	var lastID uint64
+	if lastIDStr != "" {
+		id, err := strconv.ParseUint(lastIDStr, 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid last event id: %q", lastIDStr),
+			}
+		}
+		lastID = id
+	}
+
+	backlog, sub := s.CM.events.subscribe(u.ID, lastID)
+	defer s.CM.events.unsubscribe(u.ID, sub)
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	for _, ev := range backlog {
+		if err := writeStreamEvent(resp, ev); err != nil {
+			return nil
+		}
+	}
+	resp.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return nil
+			}
+
+			if err := writeStreamEvent(resp, ev); err != nil {
+				return nil
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(resp, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+		resp.Flush()
+	}
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-padreader"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/labstack/echo/v4"
+)
+
+// a top up takes a while to land on chain, the escrow is not topped up again
+// in the meantime
+const fundsTopUpCooldown = time.Hour
+
+const fundsNotifyTimeout = time.Second * 15
+
+// alerts are sent in the background, at most fundsAlertQueueSize of them can
+// be waiting to be sent
+const fundsAlertQueueSize = 64
+
+const (
+	// content alerts that were not raised again for fundsContentAlertTTL are
+	// dropped, the content was likely removed
+	fundsContentAlertTTL = time.Hour * 48
+	// at most fundsMaxContentAlerts content alerts are kept in effect
+	fundsMaxContentAlerts = 1000
+)
+
+const (
+	alertLevelWarning  = "warning"
+	alertLevelInfo     = "info"
+	alertLevelResolved = "resolved"
+)
+
+const (
+	alertEscrowLow      = "escrow-low"
+	alertDatacapLow     = "datacap-low"
+	alertBalanceLow     = "balance-low"
+	alertTopUpFailed    = "top-up-failed"
+	alertEscrowToppedUp = "escrow-topped-up"
+	alertPoolEscrow     = "pool-escrow-short"
+	alertPoolDatacap    = "pool-datacap-short"
+	// alertContentDatacap is raised per content too big for the datacap of
+	// any one wallet, a deal can not be split across wallets
+	alertContentDatacap = "content-datacap-short"
+)
+
+// fundsAlert tells admins a wallet or the whole pool is running low on funds
+// or datacap, that it no longer is, or what the monitor did about it
+type fundsAlert struct {
+	Kind    string    `json:"kind"`
+	Level   string    `json:"level"`
+	Wallet  string    `json:"wallet,omitempty"`
+	Content uint      `json:"content,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+
+	// lastRaised is when the alert was last raised, even if it was not sent
+	// again then
+	lastRaised time.Time
+}
+
+func (a *fundsAlert) String() string {
+	if a.Wallet != "" {
+		return fmt.Sprintf("[%s] %s (wallet %s): %s", a.Level, a.Kind, a.Wallet, a.Message)
+	}
+	if a.Content != 0 {
+		return fmt.Sprintf("[%s] %s (content %d): %s", a.Level, a.Kind, a.Content, a.Message)
+	}
+	return fmt.Sprintf("[%s] %s: %s", a.Level, a.Kind, a.Message)
+}
+
+// fundsNotifier delivers funds alerts to admins
+type fundsNotifier interface {
+	Notify(ctx context.Context, a *fundsAlert) error
+}
+
+func newFundsNotifier(cfg config.Notifier) fundsNotifier {
+	switch cfg.Type {
+	case config.NotifierWebhook:
+		return &webhookNotifier{
+			url:    cfg.WebhookURL,
+			client: &http.Client{Timeout: fundsNotifyTimeout},
+		}
+	case config.NotifierSMTP:
+		return &smtpNotifier{cfg: cfg.SMTP}
+	default:
+		return logNotifier{}
+	}
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, a *fundsAlert) error {
+	if a.Level == alertLevelWarning {
+		log.Warnw("funds alert", "kind", a.Kind, "wallet", a.Wallet, "content", a.Content, "message", a.Message)
+	} else {
+		log.Infow("funds alert", "kind", a.Kind, "level", a.Level, "wallet", a.Wallet, "content", a.Content, "message", a.Message)
+	}
+	return nil
+}
+
+// webhookNotifier posts alerts as json to an admin endpoint
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *webhookNotifier) Notify(ctx context.Context, a *fundsAlert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert endpoint responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// smtpNotifier mails alerts to admins
+type smtpNotifier struct {
+	cfg config.SMTP
+}
+
+func (sn *smtpNotifier) Notify(ctx context.Context, a *fundsAlert) error {
+	port := sn.cfg.Port
+	if port == 0 {
+		port = 587
+	}
+
+	var auth smtp.Auth
+	if sn.cfg.Username != "" {
+		auth = smtp.PlainAuth("", sn.cfg.Username, sn.cfg.Password, sn.cfg.Host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: estuary %s %s\r\n\r\n%s\r\n",
+		sn.cfg.From, strings.Join(sn.cfg.To, ", "), a.Level, a.Kind, a)
+
+	addr := net.JoinHostPort(sn.cfg.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, sn.cfg.From, sn.cfg.To, []byte(msg))
+}
+
+// fundsMonitor keeps the wallets funded for the deals still to be made, and
+// alerts admins when it can not
+type fundsMonitor struct {
+	cfg              config.FundsMonitor
+	maxTopUp         abi.TokenAmount
+	minWalletBalance abi.TokenAmount
+	escrowFloor      abi.TokenAmount
+	notifier         fundsNotifier
+
+	lk sync.Mutex
+	// alerts are the alerts in effect by kind and wallet or content
+	alerts        map[string]*fundsAlert
+	contentAlerts int
+	lastTopUp     map[address.Address]time.Time
+
+	outbox chan *fundsAlert
+}
+
+func parseFILOrZero(s string) (abi.TokenAmount, error) {
+	if s == "" {
+		return big.Zero(), nil
+	}
+
+	fil, err := types.ParseFIL(s)
+	if err != nil {
+		return big.Zero(), err
+	}
+	return abi.TokenAmount(fil), nil
+}
+
+func newFundsMonitor(cfg config.FundsMonitor) (*fundsMonitor, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	maxTopUp, err := parseFILOrZero(cfg.MaxTopUp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max top up: %w", err)
+	}
+
+	minWalletBalance, err := parseFILOrZero(cfg.MinWalletBalance)
+	if err != nil {
+		return nil, fmt.Errorf("invalid min wallet balance: %w", err)
+	}
+
+	escrowFloor, err := parseFILOrZero(cfg.EscrowFloor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid escrow floor: %w", err)
+	}
+
+	return &fundsMonitor{
+		cfg:              cfg,
+		maxTopUp:         maxTopUp,
+		minWalletBalance: minWalletBalance,
+		escrowFloor:      escrowFloor,
+		notifier:         newFundsNotifier(cfg.Notifier),
+		alerts:           make(map[string]*fundsAlert),
+		lastTopUp:        make(map[address.Address]time.Time),
+		outbox:           make(chan *fundsAlert, fundsAlertQueueSize),
+	}, nil
+}
+
+func alertKey(kind string, wallet address.Address) string {
+	if wallet == address.Undef {
+		return kind
+	}
+	return kind + "/" + wallet.String()
+}
+
+func contentAlertKey(kind string, content uint) string {
+	return fmt.Sprintf("%s/content/%d", kind, content)
+}
+
+// notify queues a to be sent by sendAlerts. Alerts are raised from the deal
+// making path, which must not wait on the notifier.
+func (fm *fundsMonitor) notify(a *fundsAlert) {
+	select {
+	case fm.outbox <- a:
+	default:
+		log.Errorw("funds alert queue is full, dropping alert", "alert", a.String())
+	}
+}
+
+// sendAlerts sends the queued alerts until ctx is cancelled
+func (fm *fundsMonitor) sendAlerts(ctx context.Context) {
+	for {
+		select {
+		case a := <-fm.outbox:
+			nctx, cancel := context.WithTimeout(ctx, fundsNotifyTimeout)
+			if err := fm.notifier.Notify(nctx, a); err != nil {
+				log.Errorw("failed to send funds alert", "alert", a.String(), "err", err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// raise sends an alert unless the same one was sent less than AlertRepeat ago
+func (fm *fundsMonitor) raise(ctx context.Context, kind string, wallet address.Address, format string, args ...interface{}) {
+	a := &fundsAlert{
+		Kind:    kind,
+		Level:   alertLevelWarning,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	}
+	if wallet != address.Undef {
+		a.Wallet = wallet.String()
+	}
+
+	fm.raiseAlert(ctx, alertKey(kind, wallet), a)
+}
+
+// raiseContent tells admins about a content that can not be stored, the
+// alert is only resolved by checks of that content
+func (fm *fundsMonitor) raiseContent(ctx context.Context, kind string, content uint, format string, args ...interface{}) {
+	fm.raiseAlert(ctx, contentAlertKey(kind, content), &fundsAlert{
+		Kind:    kind,
+		Level:   alertLevelWarning,
+		Content: content,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	})
+}
+
+func (fm *fundsMonitor) raiseAlert(ctx context.Context, key string, a *fundsAlert) {
+	a.lastRaised = a.Time
+
+	fm.lk.Lock()
+	prev, ok := fm.alerts[key]
+	if ok && time.Since(prev.Time) < fm.cfg.AlertRepeat {
+		prev.lastRaised = a.Time
+		fm.lk.Unlock()
+		return
+	}
+
+	if !ok && a.Content != 0 {
+		if fm.contentAlerts >= fundsMaxContentAlerts {
+			fm.expireContentAlerts()
+		}
+		if fm.contentAlerts >= fundsMaxContentAlerts {
+			fm.lk.Unlock()
+			log.Warnw("too many content funds alerts in effect, not raising another", "alert", a.String())
+			return
+		}
+		fm.contentAlerts++
+	}
+	fm.alerts[key] = a
+	fm.lk.Unlock()
+
+	fm.notify(a)
+}
+
+// expireContentAlerts drops the content alerts that were not raised again
+// within fundsContentAlertTTL, fm.lk must be held
+func (fm *fundsMonitor) expireContentAlerts() {
+	for key, a := range fm.alerts {
+		if a.Content != 0 && time.Since(a.lastRaised) > fundsContentAlertTTL {
+			delete(fm.alerts, key)
+			fm.contentAlerts--
+		}
+	}
+}
+
+// resolve tells admins an alert in effect no longer is
+func (fm *fundsMonitor) resolve(ctx context.Context, kind string, wallet address.Address) {
+	fm.resolveAlert(ctx, alertKey(kind, wallet))
+}
+
+func (fm *fundsMonitor) resolveContent(ctx context.Context, kind string, content uint) {
+	fm.resolveAlert(ctx, contentAlertKey(kind, content))
+}
+
+func (fm *fundsMonitor) resolveAlert(ctx context.Context, key string) {
+	fm.lk.Lock()
+	prev, ok := fm.alerts[key]
+	if ok {
+		delete(fm.alerts, key)
+		if prev.Content != 0 {
+			fm.contentAlerts--
+		}
+	}
+	fm.lk.Unlock()
+
+	if !ok {
+		return
+	}
+
+	fm.notify(&fundsAlert{
+		Kind:    prev.Kind,
+		Level:   alertLevelResolved,
+		Wallet:  prev.Wallet,
+		Content: prev.Content,
+		Message: "no longer the case: " + prev.Message,
+		Time:    time.Now(),
+	})
+}
+
+func (fm *fundsMonitor) activeAlerts() []fundsAlert {
+	fm.lk.Lock()
+	defer fm.lk.Unlock()
+
+	fm.expireContentAlerts()
+
+	out := make([]fundsAlert, 0, len(fm.alerts))
+	for _, a := range fm.alerts {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+	return out
+}
+
+// fundsDemand is what the deals still to be made for the contents in the
+// queue need
+type fundsDemand struct {
+	Contents int `json:"contents"`
+	Deals    int `json:"deals"`
+	// Bytes is the padded size of the deals, the datacap verified deals use
+	Bytes abi.StoragePower `json:"bytes"`
+	// Escrow is the cost of the deals at the median cached ask price
+	Escrow abi.TokenAmount `json:"escrow"`
+}
+
+// projectedDemand adds up the deals the contents that are not stored with
+// enough deals yet still need
+func (cm *ContentManager) projectedDemand(ctx context.Context) (*fundsDemand, error) {
+	var rows []struct {
+		Size        int64
+		Replication int
+		Deals       int
+	}
+	if err := cm.DB.Model(&Content{}).
+		Select("contents.size, contents.replication, count(content_deals.id) as deals").
+		Joins("left join content_deals on content_deals.content = contents.id and not content_deals.failed").
+		Where("contents.active and contents.aggregated_in = 0 and not contents.offloaded and not (contents.dag_split and contents.split_from = 0)").
+		Group("contents.id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	demand := &fundsDemand{
+		Bytes:  big.Zero(),
+		Escrow: big.Zero(),
+	}
+	for _, r := range rows {
+		repl := cm.Replication
+		if r.Replication > 0 {
+			repl = r.Replication
+		}
+
+		missing := repl - r.Deals
+		if missing <= 0 {
+			continue
+		}
+
+		size := padreader.PaddedSize(uint64(r.Size)).Padded()
+		demand.Contents++
+		demand.Deals += missing
+		demand.Bytes = big.Add(demand.Bytes, big.Mul(big.NewInt(int64(missing)), big.NewIntUnsigned(uint64(size))))
+	}
+
+	price, err := cm.medianAskPrice(cm.VerifiedDeal)
+	if err != nil {
+		return nil, err
+	}
+
+	cost, err := filclient.ComputePrice(price, abi.PaddedPieceSize(demand.Bytes.Uint64()), dealDuration)
+	if err != nil {
+		return nil, err
+	}
+	demand.Escrow = *cost
+	return demand, nil
+}
+
+func (cm *ContentManager) medianAskPrice(verified bool) (abi.TokenAmount, error) {
+	var asks []minerStorageAsk
+	if err := cm.DB.Find(&asks).Error; err != nil {
+		return big.Zero(), err
+	}
+
+	prices := make([]abi.TokenAmount, 0, len(asks))
+	for _, ask := range asks {
+		p, err := ask.GetPrice()
+		if verified {
+			p, err = ask.GetVerifiedPrice()
+		}
+		if err != nil {
+			continue
+		}
+		prices = append(prices, *p)
+	}
+
+	if len(prices) == 0 {
+		return big.Zero(), nil
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].LessThan(prices[j])
+	})
+	return prices[len(prices)/2], nil
+}
+
+// runFundsMonitor periodically checks the funds of the wallets
+func (cm *ContentManager) runFundsMonitor(ctx context.Context) {
+	// content alerts are raised by deal making even if the monitor is off
+	go cm.funds.sendAlerts(ctx)
+
+	if !cm.funds.cfg.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(cm.funds.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.checkFunds(ctx); err != nil {
+			log.Errorf("failed to check wallet funds: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkFunds tops up the escrow of the wallets for their share of the
+// projected deals, pauses the wallets below a floor and alerts admins of
+// what needs their attention
+func (cm *ContentManager) checkFunds(ctx context.Context) error {
+	fm := cm.funds
+
+	demand, err := cm.projectedDemand(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the policies spread deals over the wallets, so each is expected to
+	// make its share of them
+	addrs := cm.Wallets.addrs
+	n := big.NewInt(int64(len(addrs)))
+	escrowShare := big.Div(demand.Escrow, n)
+
+	poolEscrow := big.Zero()
+	poolDatacap := big.Zero()
+	for _, addr := range addrs {
+		bl, err := cm.Wallets.balanceNoOlderThan(ctx, addr, 0)
+		if err != nil {
+			return err
+		}
+
+		available := abi.TokenAmount(bl.MarketAvailable)
+		poolEscrow = big.Add(poolEscrow, available)
+		poolDatacap = big.Add(poolDatacap, datacapOf(bl))
+
+		if fm.cfg.AutoTopUp {
+			cm.topUpEscrow(ctx, addr, bl, big.Add(escrowShare, fm.escrowFloor))
+		}
+
+		var reasons []string
+		if !fm.escrowFloor.IsZero() && available.LessThan(fm.escrowFloor) {
+			reasons = append(reasons, fmt.Sprintf("available escrow %s is below the floor of %s", types.FIL(available), types.FIL(fm.escrowFloor)))
+			fm.raise(ctx, alertEscrowLow, addr, "deal making is paused, available escrow %s is below the floor of %s", types.FIL(available), types.FIL(fm.escrowFloor))
+		} else {
+			fm.resolve(ctx, alertEscrowLow, addr)
+		}
+
+		floor := big.NewInt(fm.cfg.DatacapFloor)
+		if cm.VerifiedDeal && fm.cfg.DatacapFloor > 0 && datacapOf(bl).LessThan(floor) {
+			reasons = append(reasons, fmt.Sprintf("datacap %s is below the floor of %s", datacapOf(bl), floor))
+			fm.raise(ctx, alertDatacapLow, addr, "deal making is paused, datacap %s is below the floor of %s bytes", datacapOf(bl), floor)
+		} else {
+			fm.resolve(ctx, alertDatacapLow, addr)
+		}
+
+		cm.Wallets.setPaused(addr, strings.Join(reasons, "; "))
+	}
+
+	if poolEscrow.LessThan(demand.Escrow) && !fm.cfg.AutoTopUp {
+		fm.raise(ctx, alertPoolEscrow, address.Undef, "available escrow %s does not cover the %d deals still to be made, estimated at %s", types.FIL(poolEscrow), demand.Deals, types.FIL(demand.Escrow))
+	} else {
+		fm.resolve(ctx, alertPoolEscrow, address.Undef)
+	}
+
+	if cm.VerifiedDeal && poolDatacap.LessThan(demand.Bytes) {
+		fm.raise(ctx, alertPoolDatacap, address.Undef, "datacap %s does not cover the %d deals still to be made, %s bytes", poolDatacap, demand.Deals, demand.Bytes)
+	} else {
+		fm.resolve(ctx, alertPoolDatacap, address.Undef)
+	}
+	return nil
+}
+
+// topUpEscrow adds what the escrow of a wallet lacks to reach target, within
+// the configured bounds
+func (cm *ContentManager) topUpEscrow(ctx context.Context, addr address.Address, bl *filclient.Balance, target abi.TokenAmount) {
+	fm := cm.funds
+
+	available := abi.TokenAmount(bl.MarketAvailable)
+	if !available.LessThan(target) {
+		return
+	}
+
+	fm.lk.Lock()
+	last := fm.lastTopUp[addr]
+	fm.lk.Unlock()
+	if time.Since(last) < fundsTopUpCooldown {
+		return
+	}
+
+	amt := big.Sub(target, available)
+	if !fm.maxTopUp.IsZero() && amt.GreaterThan(fm.maxTopUp) {
+		amt = fm.maxTopUp
+	}
+
+	spendable := big.Sub(abi.TokenAmount(bl.Balance), fm.minWalletBalance)
+	if spendable.LessThan(amt) {
+		amt = spendable
+	}
+
+	if amt.LessThanEqual(big.Zero()) {
+		fm.raise(ctx, alertBalanceLow, addr, "escrow needs %s more but the wallet balance is %s, and %s is kept for gas", types.FIL(big.Sub(target, available)), bl.Balance, types.FIL(fm.minWalletBalance))
+		return
+	}
+	fm.resolve(ctx, alertBalanceLow, addr)
+
+	fc, err := cm.Wallets.clientFor(addr.String())
+	if err != nil {
+		log.Errorf("failed to top up escrow of wallet %s: %s", addr, err)
+		return
+	}
+
+	resp, err := fc.LockMarketFunds(ctx, types.FIL(amt))
+	if err != nil {
+		fm.raise(ctx, alertTopUpFailed, addr, "failed to add %s to the escrow: %s", types.FIL(amt), err)
+		return
+	}
+	fm.resolve(ctx, alertTopUpFailed, addr)
+
+	fm.lk.Lock()
+	fm.lastTopUp[addr] = time.Now()
+	fm.lk.Unlock()
+
+	log.Infow("topped up market escrow", "wallet", addr, "amount", types.FIL(amt), "msg", resp.MsgCid)
+	fm.notify(&fundsAlert{
+		Kind:    alertEscrowToppedUp,
+		Level:   alertLevelInfo,
+		Wallet:  addr.String(),
+		Message: fmt.Sprintf("added %s to the escrow in message %s", types.FIL(amt), resp.MsgCid),
+		Time:    time.Now(),
+	})
+}
+
+type walletFunds struct {
+	*filclient.Balance
+	Paused    string     `json:"paused,omitempty"`
+	LastTopUp *time.Time `json:"lastTopUp,omitempty"`
+}
+
+type fundsReport struct {
+	Monitoring bool          `json:"monitoring"`
+	AutoTopUp  bool          `json:"autoTopUp"`
+	Demand     *fundsDemand  `json:"demand"`
+	Wallets    []walletFunds `json:"wallets"`
+	Alerts     []fundsAlert  `json:"alerts"`
+}
+
+// handleAdminGetFunds godoc
+// @Summary      Get the funds of the wallets against the projected deals
+// @Description  This endpoint returns the balance, escrow and datacap of every wallet, whether deal making from it is paused, what the deals still to be made need and the funds alerts in effect.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  fundsReport
+// @Router       /admin/funds [get]
+func (s *Server) handleAdminGetFunds(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	demand, err := s.CM.projectedDemand(ctx)
+	if err != nil {
+		return err
+	}
+
+	bls, err := s.CM.Wallets.Balances(ctx)
+	if err != nil {
+		return err
+	}
+
+	fm := s.CM.funds
+	report := &fundsReport{
+		Monitoring: fm.cfg.Enabled,
+		AutoTopUp:  fm.cfg.AutoTopUp,
+		Demand:     demand,
+		Alerts:     fm.activeAlerts(),
+	}
+
+	for i, bl := range bls {
+		addr := s.CM.Wallets.addrs[i]
+		wf := walletFunds{
+			Balance: bl,
+			Paused:  s.CM.Wallets.pausedReason(addr),
+		}
+
+		fm.lk.Lock()
+		if last, ok := fm.lastTopUp[addr]; ok {
+			wf.LastTopUp = &last
+		}
+		fm.lk.Unlock()
+
+		report.Wallets = append(report.Wallets, wf)
+	}
+	return c.JSON(http.StatusOK, report)
+}
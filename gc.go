@@ -78,7 +78,7 @@ func (cm *ContentManager) removeContent(ctx context.Context, contID uint, now bo
 	cm.contentLk.Lock()
 	defer cm.contentLk.Unlock()
 
-	if err := cm.DB.Delete(&Content{}, contID).Error; err != nil {
+	if err := removeContentRecord(cm.DB, contID, "garbage collected"); err != nil {
 		return fmt.Errorf("failed to delete content from db: %w", err)
 	}
 
@@ -156,7 +156,7 @@ func (cm *ContentManager) unpinContent(ctx context.Context, contid uint) error {
 		return err
 	}
 
-	if err := cm.DB.Delete(&Content{ID: pin.ID}).Error; err != nil {
+	if err := removeContentRecord(cm.DB, pin.ID, "unpinned"); err != nil {
 		return err
 	}
 
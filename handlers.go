@@ -49,9 +49,7 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
-	"github.com/ipld/go-car"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -132,7 +130,11 @@ func (s *Server) ServeAPI() error {
 
 	e.GET("/retrieval-candidates/:cid", s.handleGetRetrievalCandidates)
 
-	e.GET("/gw/:path", s.handleGateway)
+	e.GET("/gw/*", s.handleGateway)
+	e.HEAD("/gw/*", s.handleGateway)
+
+	e.GET("/piece/:commp", s.handleGetPiece)
+	e.HEAD("/piece/:commp", s.handleGetPiece)
 
 	user := e.Group("/user")
 	user.Use(s.AuthRequired(util.PermLevelUser))
@@ -144,6 +146,11 @@ func (s *Server) ServeAPI() error {
 	user.PUT("/password", withUser(s.handleUserChangePassword))
 	user.PUT("/address", withUser(s.handleUserChangeAddress))
 	user.GET("/stats", withUser(s.handleGetUserStats))
+	user.GET("/events", withUser(s.handleUserEvents))
+	user.GET("/webhooks", withUser(s.handleListWebhooks))
+	user.POST("/webhooks", withUser(s.handleCreateWebhook))
+	user.DELETE("/webhooks/:webhook", withUser(s.handleDeleteWebhook))
+	user.GET("/webhooks/:webhook/deliveries", withUser(s.handleGetWebhookDeliveries))
 
 	userMiner := user.Group("/miner")
 	userMiner.POST("/claim", withUser(s.handleUserClaimMiner))
@@ -153,13 +160,17 @@ func (s *Server) ServeAPI() error {
 	userMiner.PUT("/set-info/:miner", withUser(s.handleMinersSetInfo))
 
 	contmeta := e.Group("/content")
-	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload))
+	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload, util.ScopeContentAdd))
 	uploads.POST("/add", withUser(s.handleAdd))
 	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs))
 	uploads.POST("/add-car", withUser(s.handleAddCar))
 	uploads.POST("/create", withUser(s.handleCreateContent))
+	uploads.POST("/uploads", withUser(s.handleCreateUpload))
+	uploads.HEAD("/uploads/:upload", withUser(s.handleGetUploadStatus))
+	uploads.PATCH("/uploads/:upload", withUser(s.handlePatchUpload))
+	uploads.DELETE("/uploads/:upload", withUser(s.handleDeleteUpload))
 
-	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser))
+	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser, util.ScopeContentRead))
 	content.GET("/by-cid/:cid", s.handleGetContentByCid)
 	content.GET("/stats", withUser(s.handleStats))
 	content.GET("/ensure-replication/:datacid", s.handleEnsureReplication)
@@ -167,50 +178,70 @@ func (s *Server) ServeAPI() error {
 	content.GET("/list", withUser(s.handleListContent))
 	content.GET("/deals", withUser(s.handleListContentWithDeals))
 	content.GET("/failures/:content", withUser(s.handleGetContentFailures))
+	content.GET("/diagnose/:content", withUser(s.handleDiagnoseContent))
 	content.GET("/bw-usage/:content", withUser(s.handleGetContentBandwidth))
 	content.GET("/staging-zones", withUser(s.handleGetStagingZoneForUser))
 	content.GET("/aggregated/:content", withUser(s.handleGetAggregatedForContent))
 	content.GET("/all-deals", withUser(s.handleGetAllDealsForUser))
+	content.GET("/export/:content", withUser(s.handleExportCar))
 
 	// TODO: the commented out routes here are still fairly useful, but maybe
 	// need to have some sort of 'super user' permission level in order to use
 	// them? Can easily cause harm using them
 	deals := e.Group("/deals")
-	deals.Use(s.AuthRequired(util.PermLevelUser))
+	deals.Use(s.AuthRequired(util.PermLevelUser, util.ScopeDealsRead))
 	deals.GET("/status/:deal", withUser(s.handleGetDealStatus))
 	deals.GET("/status-by-proposal/:propcid", withUser(s.handleGetDealStatusByPropCid))
 	deals.GET("/query/:miner", s.handleQueryAsk)
-	deals.POST("/make/:miner", withUser(s.handleMakeDeal))
+	deals.POST("/make/:miner", withUser(s.handleMakeDeal), requireScope(util.ScopeDealsWrite))
 	//deals.POST("/transfer/start/:miner/:propcid/:datacid", s.handleTransferStart)
 	deals.GET("/transfer/status/:id", s.handleTransferStatusByID)
 	deals.POST("/transfer/status", s.handleTransferStatus)
 	deals.GET("/transfer/in-progress", s.handleTransferInProgress)
 	deals.GET("/status/:miner/:propcid", s.handleDealStatus)
 	deals.POST("/estimate", s.handleEstimateDealCost)
+	deals.POST("/plan", withUser(s.handlePlanDeals))
 	deals.GET("/proposal/:propcid", s.handleGetProposal)
 	deals.GET("/info/:dealid", s.handleGetDealInfo)
 	deals.GET("/failures", withUser(s.handleStorageFailures))
+	deals.GET("/expiring", withUser(s.handleGetExpiringDeals))
 
 	cols := e.Group("/collections")
-	cols.Use(s.AuthRequired(util.PermLevelUser))
+	cols.Use(s.AuthRequired(util.PermLevelUser, util.ScopeCollectionsRead))
 	cols.GET("/list", withUser(s.handleListCollections))
-	cols.DELETE("/:coluuid", withUser(s.handleDeleteCollection))
-	cols.POST("/create", withUser(s.handleCreateCollection))
-	cols.POST("/add-content", withUser(s.handleAddContentsToCollection))
+	cols.DELETE("/:coluuid", withUser(s.handleDeleteCollection), requireScope(util.ScopeCollectionsWrite))
+	cols.POST("/create", withUser(s.handleCreateCollection), requireScope(util.ScopeCollectionsWrite))
+	cols.POST("/add-content", withUser(s.handleAddContentsToCollection), requireScope(util.ScopeCollectionsWrite))
 	cols.GET("/content", withUser(s.handleGetCollectionContents))
-	cols.POST("/:coluuid/commit", withUser(s.handleCommitCollection))
+	cols.POST("/:coluuid/commit", withUser(s.handleCommitCollection), requireScope(util.ScopeCollectionsWrite))
+	cols.GET("/fs/list", withUser(s.handleColfsList))
+	cols.GET("/:coluuid/miner-policy", withUser(s.handleGetCollectionMinerPolicy))
+	cols.PUT("/:coluuid/miner-policy", withUser(s.handleSetCollectionMinerPolicy), requireScope(util.ScopeCollectionsWrite))
 
-	colfs := cols.Group("/fs")
+	colfs := cols.Group("/fs", requireScope(util.ScopeCollectionsWrite))
 	colfs.POST("/add", withUser(s.handleColfsAdd))
+	colfs.POST("/mkdir", withUser(s.handleColfsMkdir))
+	colfs.POST("/move", withUser(s.handleColfsMove))
+	colfs.DELETE("/rm", withUser(s.handleColfsRemove))
+
+	orgs := e.Group("/orgs")
+	orgs.Use(s.AuthRequired(util.PermLevelUser))
+	orgs.POST("/create", withUser(s.handleCreateOrg))
+	orgs.GET("/list", withUser(s.handleListOrgs))
+	orgs.GET("/:orguuid/members", withUser(s.handleGetOrgMembers))
+	orgs.POST("/:orguuid/members", withUser(s.handleAddOrgMember))
+	orgs.PUT("/:orguuid/members/:user", withUser(s.handleUpdateOrgMember))
+	orgs.DELETE("/:orguuid/members/:user", withUser(s.handleRemoveOrgMember))
+	orgs.GET("/:orguuid/stats", withUser(s.handleGetOrgStats))
 
 	pinning := e.Group("/pinning")
 	pinning.Use(openApiMiddleware)
-	pinning.Use(s.AuthRequired(util.PermLevelUser))
+	pinning.Use(s.AuthRequired(util.PermLevelUser, util.ScopePinsRead))
 	pinning.GET("/pins", withUser(s.handleListPins))
-	pinning.POST("/pins", withUser(s.handleAddPin))
+	pinning.POST("/pins", withUser(s.handleAddPin), requireScope(util.ScopePinsWrite))
 	pinning.GET("/pins/:pinid", withUser(s.handleGetPin))
-	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin))
-	pinning.DELETE("/pins/:pinid", withUser(s.handleDeletePin))
+	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin), requireScope(util.ScopePinsWrite))
+	pinning.DELETE("/pins/:pinid", withUser(s.handleDeletePin), requireScope(util.ScopePinsWrite))
 
 	// explicitly public, for now
 	public := e.Group("/public")
@@ -239,6 +270,7 @@ func (s *Server) ServeAPI() error {
 	admin.Use(s.AuthRequired(util.PermLevelAdmin))
 	admin.GET("/balance", s.handleAdminBalance)
 	admin.POST("/add-escrow/:amt", s.handleAdminAddEscrow)
+	admin.GET("/funds", s.handleAdminGetFunds)
 	admin.GET("/dealstats", s.handleDealStats)
 	admin.GET("/disk-info", s.handleDiskSpaceCheck)
 	admin.GET("/stats", s.handleAdminStats)
@@ -270,7 +302,15 @@ func (s *Server) ServeAPI() error {
 	admin.POST("/cm/dealmaking", s.handleSetDealMaking)
 	admin.POST("/cm/break-aggregate/:content", s.handleAdminBreakAggregate)
 	admin.POST("/cm/transfer/restart/:chanid", s.handleTransferRestart)
+	admin.GET("/cm/transfer-limits", s.handleAdminGetTransferLimits)
 	admin.POST("/cm/repinall/:shuttle", s.handleShuttleRepinAll)
+	admin.GET("/cm/states/:content", s.handleAdminGetContentStates)
+	admin.GET("/cm/jobs", s.handleAdminListContentJobs)
+	admin.GET("/cm/jobs/:content", s.handleAdminGetContentJob)
+	admin.PUT("/cm/jobs/:content/priority", s.handleAdminSetContentJobPriority)
+	admin.POST("/cm/jobs/:content/pause", s.handleAdminPauseContentJob)
+	admin.POST("/cm/jobs/:content/resume", s.handleAdminResumeContentJob)
+	admin.POST("/cm/jobs/:content/run", s.handleAdminRunContentJob)
 
 	//	peering
 	adminPeering := admin.Group("/peering")
@@ -295,6 +335,14 @@ func (s *Server) ServeAPI() error {
 
 	users := admin.Group("/users")
 	users.GET("", s.handleAdminGetUsers)
+	users.GET("/:userid/quota", s.handleAdminGetUserQuota)
+	users.PUT("/:userid/quota", s.handleAdminSetUserQuota)
+	users.GET("/:userid/miner-policy", s.handleAdminGetUserMinerPolicy)
+	users.PUT("/:userid/miner-policy", s.handleAdminSetUserMinerPolicy)
+	users.GET("/:userid/staging-policy", s.handleAdminGetUserStagingPolicy)
+	users.PUT("/:userid/staging-policy", s.handleAdminSetUserStagingPolicy)
+	users.GET("/:userid/wallet", s.handleAdminGetUserWallet)
+	users.PUT("/:userid/wallet", s.handleAdminSetUserWallet)
 
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
@@ -404,8 +452,13 @@ func (s *Server) handleStats(c echo.Context, u *User) error {
 		}
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
 	var contents []Content
-	if err := s.DB.Limit(limit).Offset(offset).Order("created_at desc").Find(&contents, "user_id = ? and active", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(owner.filter).Limit(limit).Offset(offset).Order("created_at desc").Find(&contents, "active").Error; err != nil {
 		return err
 	}
 
@@ -622,6 +675,15 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 		return err
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkUserQuota(ctx, u, 0, s.CM.Replication); err != nil {
+		return err
+	}
+
 	filename := params.Filename
 	if filename == "" {
 		filename = params.Root
@@ -629,8 +691,16 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 
 	var cols []*CollectionRef
 	if params.CollectionID != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", params.CollectionID, u.ID).Error; err != nil {
+		if err := u.authToken.Scopes.CheckCollection(params.CollectionID, util.ScopeActionWrite); err != nil {
+			return err
+		}
+
+		srchCol, err := s.getCollectionForUser(params.CollectionID, u, util.OrgRoleUploader)
+		if err != nil {
+			return err
+		}
+
+		if err := owner.checkCollection(srchCol); err != nil {
 			return err
 		}
 
@@ -678,7 +748,7 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 
 	if c.QueryParam("ignore-dupes") == "true" {
 		var count int64
-		if err := s.DB.Model(Content{}).Where("cid = ? and user_id = ?", rcid.Bytes(), u.ID).Count(&count).Error; err != nil {
+		if err := s.DB.Model(Content{}).Scopes(owner.filter).Where("cid = ?", rcid.Bytes()).Count(&count).Error; err != nil {
 			return err
 		}
 		if count > 0 {
@@ -687,7 +757,7 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 	}
 
 	makeDeal := true
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, rcid, filename, cols, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, owner.OrgID(), rcid, filename, cols, origins, 0, nil, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -696,11 +766,13 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 
 // handleAddCar godoc
 // @Summary      Add Car object
-// @Description  This endpoint is used to add a car object to the network. The object can be a file or a directory.
+// @Description  This endpoint is used to add a car object to the network. The object can be a file or a directory. Both CARv1 and CARv2 files are accepted, and a content is created for each of their roots. The car is rejected if any block is missing, does not match its cid, or is not reachable from a root.
 // @Tags         content
 // @Produce      json
 // @Param        body body string true "Car"
-// @Param 		 filename query string false "Filename"
+// @Param 		 filename query string false "Filename, only used for cars with a single root"
+// @Param 		 coluuid query string false "Collection UUID"
+// @Param 		 colpath query string false "Collection path"
 // @Param 		 commp query string false "Commp"
 // @Param 		 size query string false "Size"
 // @Router       /content/add-car [post]
@@ -714,6 +786,21 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 		return s.redirectContentAdding(c, u)
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	// the car size is only known upfront if the client sent a content length
+	var carSize int64
+	if c.Request().ContentLength > 0 {
+		carSize = c.Request().ContentLength
+	}
+
+	if err := s.checkUserQuota(ctx, u, carSize, s.CM.Replication); err != nil {
+		return err
+	}
+
 	// if splitting is disabled and uploaded content size is greater than content size limit
 	// reject the upload, as it will only get stuck and deals will never be made for it
 	// if !u.FlagSplitContent() {
@@ -736,6 +823,34 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	// 	c.Request().Body = ioutil.NopCloser(bdWriter)
 	// }
 
+	var col *Collection
+	colpath := "/"
+	if coluuid := c.QueryParam("coluuid"); coluuid != "" {
+		if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+			return err
+		}
+
+		srchCol, err := s.getCollectionForUser(coluuid, u, util.OrgRoleUploader)
+		if err != nil {
+			return err
+		}
+
+		if err := owner.checkCollection(srchCol); err != nil {
+			return err
+		}
+		col = srchCol
+
+		// colpath is the directory each root is added to, unless it does not
+		// end in / and there is a single root, then it includes the filename
+		if cp := c.QueryParam("colpath"); cp != "" {
+			sp, err := sanitizePath(cp)
+			if err != nil {
+				return err
+			}
+			colpath = sp
+		}
+	}
+
 	bsid, sbs, err := s.StagingMgr.AllocNew()
 	if err != nil {
 		return err
@@ -749,61 +864,121 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 		}()
 	}()
 
+	carPath, err := s.StagingMgr.CarPath(bsid)
+	if err != nil {
+		return err
+	}
+
 	defer c.Request().Body.Close()
-	header, err := s.loadCar(ctx, sbs, c.Request().Body)
+	imp, err := s.loadCar(ctx, sbs, c.Request().Body, carPath)
 	if err != nil {
 		return err
 	}
+	defer imp.Close()
+
+	if err := imp.Verify(ctx); err != nil {
+		return err
+	}
 
-	if len(header.Roots) != 1 {
-		// if someone wants this feature, let me know
-		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
+	// the quota was checked with a size of zero if the content length was
+	// unknown, and other uploads may have been added since
+	if err := s.checkUserQuota(ctx, u, imp.Size, s.CM.Replication); err != nil {
+		return err
+	}
+
+	if len(imp.Roots) > 1 && !strings.HasSuffix(colpath, "/") {
+		colpath += "/"
 	}
-	rootCID := header.Roots[0]
 
+	roots := imp.Roots
 	if c.QueryParam("ignore-dupes") == "true" {
-		isDup, err := s.isDupCIDContent(c, rootCID, u)
-		if err != nil || isDup {
-			return err
+		roots = roots[:0:0]
+		for _, root := range imp.Roots {
+			isDup, err := s.isDupCIDContent(c, root, owner)
+			if err != nil {
+				return err
+			}
+			if !isDup {
+				roots = append(roots, root)
+			}
 		}
-	}
 
-	// TODO: how to specify filename?
-	filename := rootCID.String()
-	if qpname := c.QueryParam("filename"); qpname != "" {
-		filename = qpname
+		if len(roots) == 0 {
+			return nil
+		}
 	}
 
-	bserv := blockservice.New(sbs, nil)
+	bserv := blockservice.New(imp.Blockstore, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	cont, err := s.CM.addDatabaseTracking(ctx, u, dserv, rootCID, filename, s.CM.Replication)
-	if err != nil {
+	conts := make([]*Content, 0, len(roots))
+	for _, root := range roots {
+		// TODO: how to specify filename?
+		filename := root.String()
+		if len(imp.Roots) == 1 {
+			if qpname := c.QueryParam("filename"); qpname != "" {
+				filename = qpname
+			} else if col != nil && !strings.HasSuffix(colpath, "/") {
+				// a colpath without trailing slash is the full path of the file
+				filename = filepath.Base(colpath)
+			}
+		}
+
+		cont, err := s.CM.addDatabaseTracking(ctx, owner, dserv, root, filename, s.CM.Replication)
+		if err != nil {
+			return err
+		}
+
+		if col != nil {
+			path := colpath + filename
+			if !strings.HasSuffix(colpath, "/") {
+				path = colpath
+			}
+
+			if err := s.DB.Create(&CollectionRef{
+				Collection: col.ID,
+				Content:    cont.ID,
+				Path:       &path,
+			}).Error; err != nil {
+				log.Errorf("failed to add content to requested collection: %s", err)
+			}
+		}
+
+		conts = append(conts, cont)
+	}
+
+	// a car with many roots, or uploads racing with this one, may still have
+	// taken the user over their quota
+	if err := s.checkAddedWithinQuota(ctx, u, conts); err != nil {
 		return err
 	}
 
-	if err := s.dumpBlockstoreTo(ctx, sbs, s.Node.Blockstore); err != nil {
+	if err := s.dumpBlockstoreTo(ctx, imp.Blockstore, s.Node.Blockstore); err != nil {
 		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
 
-	go func() {
-		// TODO: we should probably have a queue to throw these in instead of putting them out in goroutines...
-		s.CM.ToCheck <- cont.ID
-	}()
+	for _, cont := range conts {
+		cont := cont
+		go func() {
+			// TODO: we should probably have a queue to throw these in instead of putting them out in goroutines...
+			s.CM.ToCheck <- cont.ID
+		}()
 
-	go func() {
-		if err := s.Node.Provider.Provide(rootCID); err != nil {
-			log.Warnf("failed to announce providers: %s", err)
-		}
-	}()
-	return c.JSON(http.StatusOK, map[string]interface{}{"content": cont})
+		go func() {
+			if err := s.Node.Provider.Provide(cont.Cid.CID); err != nil {
+				log.Warnf("failed to announce providers: %s", err)
+			}
+		}()
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"content": conts[0], "contents": conts})
 }
 
-func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader) (*car.CarHeader, error) {
+// loadCar reads an uploaded CARv1 or CARv2, see util.LoadCar
+func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader, spool string) (*util.CarImport, error) {
 	_, span := s.tracer.Start(ctx, "loadCar")
 	defer span.End()
 
-	return car.LoadCar(ctx, bs, r)
+	return util.LoadCar(ctx, bs, r, spool)
 }
 
 // handleAdd godoc
@@ -828,6 +1003,11 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		return s.redirectContentAdding(c, u)
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		return err
@@ -872,15 +1052,27 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := s.checkUserQuota(ctx, u, mpf.Size, replication); err != nil {
+		return err
+	}
+
 	coluuid := c.QueryParam("coluuid")
 	var col *Collection
 	if coluuid != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", coluuid, u.ID).Error; err != nil {
+		if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+			return err
+		}
+
+		srchCol, err := s.getCollectionForUser(coluuid, u, util.OrgRoleUploader)
+		if err != nil {
+			return err
+		}
+
+		if err := owner.checkCollection(srchCol); err != nil {
 			return err
 		}
 
-		col = &srchCol
+		col = srchCol
 	}
 
 	defaultPath := "/"
@@ -916,13 +1108,13 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	}
 
 	if c.QueryParam("ignore-dupes") == "true" {
-		isDup, err := s.isDupCIDContent(c, nd.Cid(), u)
+		isDup, err := s.isDupCIDContent(c, nd.Cid(), owner)
 		if err != nil || isDup {
 			return err
 		}
 	}
 
-	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, nd.Cid(), filename, replication)
+	content, err := s.CM.addDatabaseTracking(ctx, owner, dserv, nd.Cid(), filename, replication)
 	if err != nil {
 		return xerrors.Errorf("encountered problem computing object references: %w", err)
 	}
@@ -1096,7 +1288,7 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 	return cm.addObjectsToDatabase(ctx, cont, dserv, root, objects, util.ContentLocationLocal)
 }
 
-func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dserv ipld.NodeGetter, root cid.Cid, filename string, replication int) (*Content, error) {
+func (cm *ContentManager) addDatabaseTracking(ctx context.Context, owner *contentOwner, dserv ipld.NodeGetter, root cid.Cid, filename string, replication int) (*Content, error) {
 	ctx, span := cm.tracer.Start(ctx, "computeObjRefs")
 	defer span.End()
 
@@ -1105,7 +1297,9 @@ func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dser
 		Name:        filename,
 		Active:      false,
 		Pinning:     true,
-		UserID:      u.ID,
+		State:       util.ContentStatePinning,
+		UserID:      owner.UserID,
+		OrgID:       owner.OrgID(),
 		Replication: replication,
 		Location:    util.ContentLocationLocal,
 	}
@@ -1189,8 +1383,13 @@ func (s *Server) handleEnsureReplication(c echo.Context) error {
 // @Success 	200 {array} string
 // @Router       /content/list [get]
 func (s *Server) handleListContent(c echo.Context, u *User) error {
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
 	var contents []Content
-	if err := s.DB.Find(&contents, "active and user_id = ?", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(owner.filter).Find(&contents, "active").Error; err != nil {
 		return err
 	}
 
@@ -1230,8 +1429,13 @@ func (s *Server) handleListContentWithDeals(c echo.Context, u *User) error {
 		offset = o
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
 	var contents []Content
-	if err := s.DB.Limit(limit).Offset(offset).Order("id desc").Find(&contents, "active and user_id = ? and not aggregated_in > 0", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(owner.filter).Limit(limit).Offset(offset).Order("id desc").Find(&contents, "active and not aggregated_in > 0").Error; err != nil {
 		return err
 	}
 
@@ -1285,7 +1489,7 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleViewer); err != nil {
 		return err
 	}
 
@@ -1553,7 +1757,7 @@ type dealRequest struct {
 
 // handleMakeDeal godoc
 // @Summary      Make Deal
-// @Description  This endpoint makes a deal for a given content and miner
+// @Description  This endpoint makes a deal for a given content and miner. It responds with 429 when the miner is at its transfer limits.
 // @Tags         deals
 // @Produce      json
 // @Param miner path string true "Miner"
@@ -1586,6 +1790,13 @@ func (s *Server) handleMakeDeal(c echo.Context, u *User) error {
 
 	id, err := s.CM.makeDealWithMiner(ctx, cont, addr, true)
 	if err != nil {
+		if xerrors.Is(err, errTransferLimit) {
+			return &util.HttpError{
+				Code:    http.StatusTooManyRequests,
+				Reason:  util.ERR_TRANSFER_LIMIT_REACHED,
+				Details: err.Error(),
+			}
+		}
 		return err
 	}
 
@@ -1640,20 +1851,6 @@ func (s *Server) handleTransferInProgress(c echo.Context) error {
 	return c.JSON(http.StatusOK, transfers)
 }
 
-func (s *Server) handleMinerTransferDiagnostics(c echo.Context) error {
-	m, err := address.NewFromString(c.Param("miner"))
-	if err != nil {
-		return err
-	}
-
-	minerTransferDiagnostics, err := s.FilClient.MinerTransferDiagnostics(c.Request().Context(), m)
-	if err != nil {
-		return err
-	}
-
-	return c.JSON(http.StatusOK, minerTransferDiagnostics)
-}
-
 func parseChanID(chanid string) (*datatransfer.ChannelID, error) {
 	parts := strings.Split(chanid, "-")
 	if len(parts) != 3 {
@@ -1782,7 +1979,7 @@ func (s *Server) handleDealStatus(c echo.Context) error {
 		}
 		dealUUID = &parsed
 	}
-	status, err := s.FilClient.DealStatus(ctx, addr, propCid, dealUUID)
+	status, err := s.CM.dealStatus(ctx, d, addr, dealUUID)
 	if err != nil {
 		return xerrors.Errorf("getting deal status: %w", err)
 	}
@@ -1871,29 +2068,6 @@ func (s *Server) handleAdminCreateInvite(c echo.Context, u *User) error {
 	})
 }
 
-func (s *Server) handleAdminBalance(c echo.Context) error {
-	balance, err := s.FilClient.Balance(c.Request().Context())
-	if err != nil {
-		return err
-	}
-
-	return c.JSON(http.StatusOK, balance)
-}
-
-func (s *Server) handleAdminAddEscrow(c echo.Context) error {
-	amt, err := types.ParseFIL(c.Param("amt"))
-	if err != nil {
-		return err
-	}
-
-	resp, err := s.FilClient.LockMarketFunds(context.TODO(), amt)
-	if err != nil {
-		return err
-	}
-
-	return c.JSON(http.StatusOK, resp)
-}
-
 type adminStatsResponse struct {
 	TotalDealAttempted   int64 `json:"totalDealsAttempted"`
 	TotalDealsSuccessful int64 `json:"totalDealsSuccessful"`
@@ -2215,7 +2389,7 @@ func (s *Server) handleDealStats(c echo.Context) error {
 			}
 			dealUUID = &parsed
 		}
-		st, err := s.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+		st, err := s.CM.dealStatus(ctx, d, maddr, dealUUID)
 		if err != nil {
 			log.Errorf("checking deal status failed (%s): %s", maddr, err)
 			continue
@@ -2413,6 +2587,9 @@ type minerStatsResp struct {
 	SuspendedReason string          `json:"suspendedReason"`
 
 	ChainInfo *minerChainInfo `json:"chainInfo"`
+
+	Reputation   *util.ReputationScore `json:"reputation,omitempty"`
+	ScoreHistory []minerScoreSnapshot  `json:"scoreHistory,omitempty"`
 }
 
 type minerChainInfo struct {
@@ -2425,7 +2602,7 @@ type minerChainInfo struct {
 
 // handleGetMinerStats godoc
 // @Summary      Get miner stats
-// @Description  This endpoint returns miner stats
+// @Description  This endpoint returns miner stats, including the current reputation score of the miner and its recent score snapshots
 // @Tags         public,miner
 // @Produce      json
 // @Param miner path string false "Filter by miner"
@@ -2481,6 +2658,24 @@ func (s *Server) handleGetMinerStats(c echo.Context) error {
 		return err
 	}
 
+	_, sml, err := s.CM.sortedMinerList()
+	if err != nil {
+		return err
+	}
+
+	var reputation *util.ReputationScore
+	for _, st := range sml {
+		if st.Miner == maddr {
+			reputation = &st.Reputation
+			break
+		}
+	}
+
+	var history []minerScoreSnapshot
+	if err := s.DB.Order("created_at desc").Limit(120).Find(&history, "miner = ?", maddr.String()).Error; err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, &minerStatsResp{
 		Miner:           maddr,
 		UsedByEstuary:   true,
@@ -2491,6 +2686,8 @@ func (s *Server) handleGetMinerStats(c echo.Context) error {
 		Name:            m.Name,
 		Version:         m.Version,
 		ChainInfo:       &ci,
+		Reputation:      reputation,
+		ScoreHistory:    history,
 	})
 }
 
@@ -2564,7 +2761,7 @@ func (s *Server) handleGetContentBandwidth(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleViewer); err != nil {
 		return err
 	}
 
@@ -2585,7 +2782,7 @@ func (s *Server) handleGetContentBandwidth(c echo.Context, u *User) error {
 
 // handleGetAggregatedForContent godoc
 // @Summary      Get aggregated content stats
-// @Description  This endpoint returns aggregated content stats
+// @Description  This endpoint returns the contents aggregated in an aggregate. For a content that was aggregated, it returns the proof that its piece is included in the data segment piece of its aggregate.
 // @Tags         content
 // @Produce      json
 // @Param content path string true "Content ID"
@@ -2602,10 +2799,18 @@ func (s *Server) handleGetAggregatedForContent(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleViewer); err != nil {
 		return err
 	}
 
+	if content.AggregatedIn > 0 {
+		incl, err := s.getAggregateInclusion(content)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, incl)
+	}
+
 	var sub []Content
 	if err := s.DB.Find(&sub, "aggregated_in = ?", contID).Error; err != nil {
 		return err
@@ -2627,6 +2832,15 @@ func (s *Server) handleGetContentFailures(c echo.Context, u *User) error {
 		return err
 	}
 
+	var content Content
+	if err := s.DB.First(&content, "id = ?", cont).Error; err != nil {
+		return err
+	}
+
+	if err := s.isContentOwner(u, content, util.OrgRoleViewer); err != nil {
+		return err
+	}
+
 	var errs []dfeRecord
 	if err := s.DB.Find(&errs, "content = ?", cont).Error; err != nil {
 		return err
@@ -2802,7 +3016,10 @@ func (s *Server) checkTokenAuth(token string) (*User, error) {
 	return &user, nil
 }
 
-func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
+// AuthRequired checks that the request carries a valid api key for a user
+// with at least the given permission level. Keys that do not have full access
+// must additionally hold one of the given scopes.
+func (s *Server) AuthRequired(level int, scopes ...string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 
@@ -2824,14 +3041,9 @@ func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
 
 			span.SetAttributes(attribute.Int("user", int(u.ID)))
 
-			if u.authToken.UploadOnly && level >= util.PermLevelUser {
-				log.Warnw("api key is upload only", "user", u.ID, "perm", u.Perm, "required", level)
-
-				return &util.HttpError{
-					Code:    http.StatusForbidden,
-					Reason:  util.ERR_NOT_AUTHORIZED,
-					Details: "api key is upload only",
-				}
+			if err := util.CheckScopes(u.authToken.Scopes, level, scopes...); err != nil {
+				log.Warnw("api key scopes not sufficient", "user", u.ID, "scopes", u.authToken.Scopes, "required", scopes)
+				return err
 			}
 
 			if u.Perm >= level {
@@ -2850,6 +3062,32 @@ func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
 	}
 }
 
+// requireScope narrows down the scopes accepted by a group's AuthRequired for a
+// single route, e.g. write routes in a group that otherwise only needs read.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u, ok := c.Get("user").(*User)
+			if !ok {
+				return &util.HttpError{
+					Code:    http.StatusUnauthorized,
+					Reason:  util.ERR_INVALID_AUTH,
+					Details: "endpoint not called with proper authentication",
+				}
+			}
+
+			if !u.authToken.Scopes.Allows(scope) {
+				return &util.HttpError{
+					Code:    http.StatusForbidden,
+					Reason:  util.ERR_NOT_AUTHORIZED,
+					Details: fmt.Sprintf("api key requires the %q scope for this endpoint", scope),
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
 type registerBody struct {
 	Username     string `json:"username"`
 	PasswordHash string `json:"passwordHash"`
@@ -2914,6 +3152,7 @@ func (s *Server) handleRegisterUser(c echo.Context) error {
 		Token:  "EST" + uuid.New().String() + "ARY",
 		User:   newUser.ID,
 		Expiry: time.Now().Add(time.Hour * 24 * 7),
+		Scopes: util.Scopes{util.ScopeAll},
 	}
 
 	if err := s.DB.Create(authToken).Error; err != nil {
@@ -3023,6 +3262,8 @@ func (s *Server) handleUserChangeAddress(c echo.Context, u *User) error {
 type userStatsResponse struct {
 	TotalSize int64 `json:"totalSize"`
 	NumPins   int64 `json:"numPins"`
+
+	Quota *util.QuotaStatus `json:"quota,omitempty"`
 }
 
 // handleGetUserStats godoc
@@ -3041,31 +3282,30 @@ func (s *Server) handleGetUserStats(c echo.Context, u *User) error {
 		return err
 	}
 
+	quota, err := s.getUserQuotaStatus(c.Request().Context(), u)
+	if err != nil {
+		return err
+	}
+	stats.Quota = quota
+
 	return c.JSON(http.StatusOK, stats)
 }
 
 func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []string) (*AuthToken, error) {
-	if len(perms) > 1 {
-		return nil, fmt.Errorf("invalid perms")
-	}
-
-	var uploadOnly bool
-	if len(perms) == 1 {
-		switch perms[0] {
-		case "all":
-			uploadOnly = false
-		case "upload":
-			uploadOnly = true
-		default:
-			return nil, fmt.Errorf("invalid perm: %q", perms[0])
+	scopes, err := util.ParseScopes(perms)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
 		}
 	}
 
 	authToken := &AuthToken{
-		Token:      "EST" + uuid.New().String() + "ARY",
-		User:       user.ID,
-		Expiry:     expiry,
-		UploadOnly: uploadOnly,
+		Token:  "EST" + uuid.New().String() + "ARY",
+		User:   user.ID,
+		Expiry: expiry,
+		Scopes: scopes,
 	}
 
 	if err := s.DB.Create(authToken).Error; err != nil {
@@ -3081,6 +3321,21 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 		return err
 	}
 
+	quota, err := s.getUserQuotaStatus(c.Request().Context(), u)
+	if err != nil {
+		return err
+	}
+
+	stagingPolicy, err := s.CM.stagingPolicyFor(u.ID)
+	if err != nil {
+		return err
+	}
+
+	stagingThreshold := stagingPolicy.IndividualDealThreshold
+	if stagingPolicy.Disabled {
+		stagingThreshold = 0
+	}
+
 	return c.JSON(http.StatusOK, &util.ViewerResponse{
 		ID:       u.ID,
 		Username: u.Username,
@@ -3091,14 +3346,16 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 			Replication:           s.CM.Replication,
 			Verified:              s.CM.VerifiedDeal,
 			DealDuration:          dealDuration,
-			MaxStagingWait:        maxStagingZoneLifetime,
-			FileStagingThreshold:  int64(individualDealThreshold),
+			MaxStagingWait:        stagingPolicy.MaxLifetime,
+			FileStagingThreshold:  stagingThreshold,
 			ContentAddingDisabled: s.CM.contentAddingDisabled || u.StorageDisabled,
 			DealMakingDisabled:    s.CM.dealMakingDisabled(),
 			UploadEndpoints:       uep,
 			Flags:                 u.Flags,
 		},
 		AuthExpiry: u.authToken.Expiry,
+		Scopes:     u.authToken.Scopes,
+		Quota:      quota,
 	})
 }
 
@@ -3147,11 +3404,7 @@ func (s *Server) getPreferredUploadEndpoints(u *User) ([]string, error) {
 
 	var out []string
 	for _, sh := range shuttles {
-		host := "https://" + sh.Host
-		if strings.HasPrefix(sh.Host, "http://") || strings.HasPrefix(sh.Host, "https://") {
-			host = sh.Host
-		}
-		out = append(out, host+"/content/add")
+		out = append(out, shuttleURL(sh.Host)+"/content/add")
 	}
 	if !s.CM.localContentAddingDisabled {
 		out = append(out, s.CM.hostname+"/content/add")
@@ -3167,8 +3420,9 @@ func (s *Server) handleHealth(c echo.Context) error {
 }
 
 type getApiKeysResp struct {
-	Token  string    `json:"token"`
-	Expiry time.Time `json:"expiry"`
+	Token  string      `json:"token"`
+	Expiry time.Time   `json:"expiry"`
+	Scopes util.Scopes `json:"scopes"`
 }
 
 // handleUserRevokeApiKey godoc
@@ -3190,9 +3444,11 @@ func (s *Server) handleUserRevokeApiKey(c echo.Context, u *User) error {
 
 // handleUserCreateApiKey godoc
 // @Summary      Create API keys for a user
-// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features.
+// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features. Keys can be limited to a comma separated list of scopes (e.g. content:add,content:read,pins:write,deals:read or collections:<uuid>:write), by default a key has full access.
 // @Tags         User
 // @Produce      json
+// @Param        expiry  query  string  false  "Expiration - Expiry of the key, as a duration (e.g. 720h) or false for no expiry"
+// @Param        perms   query  string  false  "Scopes - comma separated list of scopes granted to the key"
 // @Success      200  {object}  getApiKeysResp
 // @Failure      400  {object}  util.HttpError
 // @Failure      404  {object}  util.HttpError
@@ -3225,6 +3481,7 @@ func (s *Server) handleUserCreateApiKey(c echo.Context, u *User) error {
 	return c.JSON(http.StatusOK, &getApiKeysResp{
 		Token:  authToken.Token,
 		Expiry: authToken.Expiry,
+		Scopes: authToken.Scopes,
 	})
 }
 
@@ -3249,6 +3506,7 @@ func (s *Server) handleUserGetApiKeys(c echo.Context, u *User) error {
 		out = append(out, getApiKeysResp{
 			Token:  k.Token,
 			Expiry: k.Expiry,
+			Scopes: k.Scopes,
 		})
 	}
 
@@ -3272,16 +3530,27 @@ type createCollectionBody struct {
 // @Failure      500  {object}  util.HttpError
 // @Router       /collections/create [post]
 func (s *Server) handleCreateCollection(c echo.Context, u *User) error {
+	// keys restricted to specific collections cannot create new ones
+	if err := u.authToken.Scopes.CheckCollection("", util.ScopeActionWrite); err != nil {
+		return err
+	}
+
 	var body createCollectionBody
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
 	col := &Collection{
 		UUID:        uuid.New().String(),
 		Name:        body.Name,
 		Description: body.Description,
 		UserID:      u.ID,
+		OrgID:       owner.OrgID(),
 	}
 
 	if err := s.DB.Create(col).Error; err != nil {
@@ -3303,12 +3572,25 @@ func (s *Server) handleCreateCollection(c echo.Context, u *User) error {
 // @Failure      500  {object}  util.HttpError
 // @Router       /collections/list [get]
 func (s *Server) handleListCollections(c echo.Context, u *User) error {
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
 	var cols []Collection
-	if err := s.DB.Find(&cols, "user_id = ?", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(owner.filter).Find(&cols).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, cols)
+	// keys restricted to specific collections only get to see those
+	out := []Collection{}
+	for _, col := range cols {
+		if u.authToken.Scopes.AllowsCollection(col.UUID, util.ScopeActionRead) {
+			out = append(out, col)
+		}
+	}
+
+	return c.JSON(http.StatusOK, out)
 }
 
 type addContentToCollectionParams struct {
@@ -3340,13 +3622,20 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 		return fmt.Errorf("too many cids specified: %d (max 128)", len(params.Cids))
 	}
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", params.CollectionID, u.ID).Error; err != nil {
-		return fmt.Errorf("no collection found by that uuid for your user: %w", err)
+	if err := u.authToken.Scopes.CheckCollection(params.CollectionID, util.ScopeActionWrite); err != nil {
+		return err
+	}
+
+	col, err := s.getCollectionForUser(params.CollectionID, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
 	}
 
+	// only content with the same owner as the collection can be added to it
+	owner := ownerOf(col.UserID, col.OrgID)
+
 	var contents []Content
-	if err := s.DB.Find(&contents, "id in ? and user_id = ?", params.Contents, u.ID).Error; err != nil {
+	if err := s.DB.Scopes(owner.filter).Find(&contents, "id in ?", params.Contents).Error; err != nil {
 		return err
 	}
 
@@ -3357,7 +3646,7 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 		}
 
 		var cont Content
-		if err := s.DB.First(&cont, "cid = ? and user_id = ?", util.DbCID{CID: cc}, u.ID).Error; err != nil {
+		if err := s.DB.Scopes(owner.filter).First(&cont, "cid = ?", util.DbCID{CID: cc}).Error; err != nil {
 			return fmt.Errorf("failed to find content by given cid %s: %w", cc, err)
 		}
 
@@ -3393,18 +3682,17 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 // @Router       /collections/{coluuid}/commit [post]
 func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 	colid := c.Param("coluuid")
+	if err := u.authToken.Scopes.CheckCollection(colid, util.ScopeActionWrite); err != nil {
+		return err
+	}
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", colid, u.ID).Error; err != nil {
+	col, err := s.getCollectionForUser(colid, u, util.OrgRoleUploader)
+	if err != nil {
 		return err
 	}
 
-	contents := []ContentWithPath{}
-	if err := s.DB.Model(CollectionRef{}).
-		Where("collection = ?", col.ID).
-		Joins("left join contents on contents.id = collection_refs.content").
-		Select("contents.*, collection_refs.path").
-		Scan(&contents).Error; err != nil {
+	tree, files, err := loadCollectionTree(s.DB, col)
+	if err != nil {
 		return err
 	}
 
@@ -3433,24 +3721,19 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 	bserv := blockservice.New(s.Node.Blockstore, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	// create DAG respecting directory structure
-	collectionNode := unixfs.EmptyDirNode()
-	for _, c := range contents {
-		dirs, err := util.DirsFromPath(c.Path, c.Name)
-		if err != nil {
-			return err
+	// create DAG respecting directory structure, empty directories included
+	links := make(map[uint]*ipld.Link)
+	for ref, f := range files {
+		links[ref] = &ipld.Link{
+			Size: uint64(f.Size),
+			Cid:  f.Cid.CID,
 		}
+	}
 
-		lastDirNode, err := util.EnsurePathIsLinked(dirs, collectionNode, dserv)
-		if err != nil {
-			return err
-		}
-		lastDirNode.AddRawLink(c.Name, &ipld.Link{
-			Size: uint64(c.Size),
-			Cid:  c.Cid.CID,
-		})
+	collectionNode, err := tree.Build(c.Request().Context(), dserv, links)
+	if err != nil {
+		return err
 	}
-	dserv.Add(context.Background(), collectionNode) // add new CID to local blockstore
 
 	// update DB with new collection CID
 	col.CID = collectionNode.Cid().String()
@@ -3461,7 +3744,7 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 	makeDeal := false
 
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, col.OrgID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -3480,8 +3763,12 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 func (s *Server) handleGetCollectionContents(c echo.Context, u *User) error {
 	coluuid := c.QueryParam("coluuid")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", coluuid, u.ID).Error; err != nil {
+	if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionRead); err != nil {
+		return err
+	}
+
+	col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleViewer)
+	if err != nil {
 		return err
 	}
 
@@ -3592,23 +3879,16 @@ func (s *Server) handleGetCollectionContents(c echo.Context, u *User) error {
 // @Router       /collections/{coluuid} [delete]
 func (s *Server) handleDeleteCollection(c echo.Context, u *User) error {
 	coluuid := c.Param("coluuid")
-
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_CONTENT_NOT_FOUND,
-				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
-			}
-		}
+	if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+		return err
 	}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+	col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleAdmin)
+	if err != nil {
 		return err
 	}
 
-	if err := s.DB.Delete(&col).Error; err != nil {
+	if err := s.DB.Delete(col).Error; err != nil {
 		return err
 	}
 	return c.NoContent(http.StatusOK)
@@ -3688,6 +3968,91 @@ func (s *Server) handleAdminGetUsers(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
+func (s *Server) getUserByParam(c echo.Context) (*User, error) {
+	uid, err := strconv.Atoi(c.Param("userid"))
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid user id: %q", c.Param("userid")),
+		}
+	}
+
+	var user User
+	if err := s.DB.First(&user, "id = ?", uid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_USER_NOT_FOUND,
+				Details: fmt.Sprintf("user %d not found", uid),
+			}
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// handleAdminGetUserQuota godoc
+// @Summary      Get a users quota
+// @Description  This endpoint is used to get the storage quota of a user along with their current usage.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int  true  "User ID"
+// @Success      200     {object}  util.QuotaStatus
+// @Router       /admin/users/{userid}/quota [get]
+func (s *Server) handleAdminGetUserQuota(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	quota, err := s.getUserQuotaStatus(c.Request().Context(), user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, quota)
+}
+
+// handleAdminSetUserQuota godoc
+// @Summary      Set a users quota
+// @Description  This endpoint is used to set the storage quota of a user. A limit of zero means unlimited.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int             true  "User ID"
+// @Param        body    body      util.UserQuota  true  "Quota"
+// @Success      200     {object}  util.QuotaStatus
+// @Router       /admin/users/{userid}/quota [put]
+func (s *Server) handleAdminSetUserQuota(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	var quota util.UserQuota
+	if err := c.Bind(&quota); err != nil {
+		return err
+	}
+
+	if err := quota.Validate(); err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"quota_max_bytes":      quota.MaxBytes,
+		"quota_max_objects":    quota.MaxObjects,
+		"quota_max_deal_bytes": quota.MaxDealBytes,
+	}).Error; err != nil {
+		return err
+	}
+	user.Quota = quota
+
+	status, err := s.getUserQuotaStatus(c.Request().Context(), user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
 type publicStatsResponse struct {
 	TotalStorage       sql.NullInt64 `json:"totalStorage"`
 	TotalFilesStored   sql.NullInt64 `json:"totalFiles"`
@@ -3783,11 +4148,19 @@ func (s *Server) handleGetBucketDiag(c echo.Context) error {
 
 // handleGetStagingZoneForUser godoc
 // @Summary      Get staging zone for user
-// @Description  This endpoint is used to get staging zone for user.
+// @Description  This endpoint is used to get staging zone for user. Each zone includes the staging policy it was opened with.
 // @Tags         content
 // @Produce      json
 // @Router       /content/staging-zones [get]
 func (s *Server) handleGetStagingZoneForUser(c echo.Context, u *User) error {
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	if owner.Org != nil {
+		return c.JSON(http.StatusOK, s.CM.getStagingZonesForOrg(c.Request().Context(), owner.Org.ID))
+	}
 	return c.JSON(http.StatusOK, s.CM.getStagingZonesForUser(c.Request().Context(), u.ID))
 }
 
@@ -4029,9 +4402,21 @@ func (s *Server) handleGetAllDealsForUser(c echo.Context, u *User) error {
 
 	all := (c.QueryParam("all") != "")
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	q := s.DB.Model(contentDeal{})
+	if owner.Org != nil {
+		q = q.Where("content_deals.org_id = ?", owner.Org.ID)
+	} else {
+		q = q.Where("content_deals.user_id = ? AND content_deals.org_id = 0", u.ID)
+	}
+
 	var deals []dealQuery
-	if err := s.DB.Model(contentDeal{}).
-		Where("deal_id > 0 AND (? OR (on_chain_at >= ? AND on_chain_at <= ?)) AND user_id = ?", all, begin, begin.Add(duration), u.ID).
+	if err := q.
+		Where("deal_id > 0 AND (? OR (on_chain_at >= ? AND on_chain_at <= ?))", all, begin, begin.Add(duration)).
 		Joins("left join contents on content_deals.content = contents.id").
 		Select("deal_id, contents.id as contentid, cid, aggregate").
 		Scan(&deals).Error; err != nil {
@@ -4631,20 +5016,30 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		return err
 	}
 
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
 	if c.QueryParam("ignore-dupes") == "true" {
-		isDup, err := s.isDupCIDContent(c, rootCID, u)
+		isDup, err := s.isDupCIDContent(c, rootCID, owner)
 		if err != nil || isDup {
 			return err
 		}
 	}
 
-	var col Collection
+	var col *Collection
 	if req.CollectionID != "" {
-		if err := s.DB.First(&col, "uuid = ?", req.CollectionID).Error; err != nil {
+		if err := u.authToken.Scopes.CheckCollection(req.CollectionID, util.ScopeActionWrite); err != nil {
+			return err
+		}
+
+		col, err = s.getCollectionForUser(req.CollectionID, u, util.OrgRoleUploader)
+		if err != nil {
 			return err
 		}
 
-		if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		if err := owner.checkCollection(col); err != nil {
 			return err
 		}
 	}
@@ -4654,7 +5049,9 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		Name:        req.Name,
 		Active:      false,
 		Pinning:     false,
+		State:       util.ContentStateReceiving,
 		UserID:      u.ID,
+		OrgID:       owner.OrgID(),
 		Replication: s.CM.Replication,
 		Location:    req.Location,
 	}
@@ -4922,15 +5319,24 @@ func (s *Server) handleAdminBreakAggregate(c echo.Context) error {
 		})
 	}
 
-	if err := s.DB.Model(Content{}).Where("aggregated_in = ?", aggr).UpdateColumns(map[string]interface{}{
-		"aggregated_in": 0,
-	}).Error; err != nil {
+	for _, child := range children {
+		to := child.State
+		if to == util.ContentStateAggregated {
+			to = util.ContentStateActive
+		}
+
+		if err := transitionContent(s.DB, child.ID, to, fmt.Sprintf("aggregate %d broken up", aggr), map[string]interface{}{
+			"aggregated_in": 0,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := transitionContent(s.DB, uint(aggr), util.ContentStateRetired, "broken up", nil); err != nil {
 		return err
 	}
 
-	if err := s.DB.Model(Content{}).Where("id = ?", aggr).UpdateColumns(map[string]interface{}{
-		"active": false,
-	}).Error; err != nil {
+	if err := removeSegmentAggregate(s.DB, uint(aggr)); err != nil {
 		return err
 	}
 
@@ -4949,7 +5355,7 @@ type publicNodeInfo struct {
 // @Router       /public/info [get]
 func (s *Server) handleGetPublicNodeInfo(c echo.Context) error {
 	return c.JSON(http.StatusOK, &publicNodeInfo{
-		PrimaryAddress: s.FilClient.ClientAddr,
+		PrimaryAddress: s.FilClient.ClientAddress(),
 	})
 }
 
@@ -5027,6 +5433,7 @@ func (s *Server) handleShuttleCreateContent(c echo.Context) error {
 		Name:        req.Name,
 		Active:      false,
 		Pinning:     false,
+		State:       util.ContentStateReceiving,
 		UserID:      req.User,
 		Replication: s.CM.Replication,
 		Location:    req.Location,
@@ -5034,6 +5441,13 @@ func (s *Server) handleShuttleCreateContent(c echo.Context) error {
 	if req.DagSplitRoot != 0 {
 		content.DagSplit = true
 		content.SplitFrom = req.DagSplitRoot
+
+		// pieces of a split dag belong to the same organization as its root
+		var splitRoot Content
+		if err := s.DB.First(&splitRoot, "id = ?", req.DagSplitRoot).Error; err != nil {
+			return err
+		}
+		content.OrgID = splitRoot.OrgID
 	}
 
 	if err := s.DB.Create(content).Error; err != nil {
@@ -5187,12 +5601,12 @@ func (s *Server) handleColfsAdd(c echo.Context, u *User) error {
 	contid := c.QueryParam("content")
 	npath := c.QueryParam("path")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+	if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
 		return err
 	}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+	col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleUploader)
+	if err != nil {
 		return err
 	}
 
@@ -5201,7 +5615,11 @@ func (s *Server) handleColfsAdd(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleUploader); err != nil {
+		return err
+	}
+
+	if err := ownerOf(content.UserID, content.OrgID).checkCollection(col); err != nil {
 		return err
 	}
 
@@ -5214,12 +5632,330 @@ func (s *Server) handleColfsAdd(c echo.Context, u *User) error {
 		path = &p
 	}
 
+	tree, _, err := loadCollectionTree(s.DB, col)
+	if err != nil {
+		return err
+	}
+
+	fpath := util.CollectionFilePath(npath, content.Name)
+	if content.Name == "" {
+		fpath = util.CollectionFilePath(npath, content.Cid.CID.String())
+	}
+
+	if err := tree.CheckFree(fpath); err != nil {
+		return err
+	}
+
 	if err := s.DB.Create(&CollectionRef{Collection: col.ID, Content: content.ID, Path: path}).Error; err != nil {
 		return errors.Wrap(err, "failed to add content to requested collection")
 	}
 	return c.JSON(http.StatusOK, map[string]string{})
 }
 
+// collectionPathParam reads an absolute path in a collection from the query
+// parameter name
+func collectionPathParam(c echo.Context, name string) (string, error) {
+	p, err := sanitizePath(c.QueryParam(name))
+	if err != nil {
+		return "", &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid %s: %s", name, err),
+		}
+	}
+	return filepath.Clean(p), nil
+}
+
+// collectionForFs checks that the user can access the collection of a
+// collection filesystem request, and loads its directory tree
+func (s *Server) collectionForFs(c echo.Context, u *User, action string, role string) (*Collection, *util.CollectionTree, map[uint]*collectionFile, error) {
+	coluuid := c.QueryParam("coluuid")
+	if err := u.authToken.Scopes.CheckCollection(coluuid, action); err != nil {
+		return nil, nil, nil, err
+	}
+
+	col, err := s.getCollectionForUser(coluuid, u, role)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tree, files, err := loadCollectionTree(s.DB, col)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return col, tree, files, nil
+}
+
+// keepParentDir creates the parent directory of p explicitly, so that it is
+// not dropped from the tree when p is moved or removed from it
+func keepParentDir(tx *gorm.DB, col *Collection, p string) error {
+	parent := filepath.Dir(p)
+	if parent == "/" {
+		return nil
+	}
+
+	var count int64
+	if err := tx.Model(CollectionDir{}).Where("collection = ? and path = ?", col.ID, parent).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+	return tx.Create(&CollectionDir{Collection: col.ID, Path: parent}).Error
+}
+
+// handleColfsList godoc
+// @Summary      List a directory of a collection
+// @Description  This endpoint lists the files and directories in a directory of a collection
+// @Tags         collections
+// @Param        coluuid query string true "Collection ID"
+// @Param        dir query string false "Directory, defaults to /"
+// @Produce      json
+// @Success      200  {array}  collectionListResponse
+// @Router       /collections/fs/list [get]
+func (s *Server) handleColfsList(c echo.Context, u *User) error {
+	_, tree, files, err := s.collectionForFs(c, u, util.ScopeActionRead, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	dir := "/"
+	if c.QueryParam("dir") != "" {
+		dir, err = collectionPathParam(c, "dir")
+		if err != nil {
+			return err
+		}
+	}
+
+	ents, err := tree.List(dir)
+	if err != nil {
+		return err
+	}
+
+	out := make([]collectionListResponse, 0, len(ents))
+	for _, e := range ents {
+		if e.Dir {
+			out = append(out, collectionListResponse{
+				Name: e.Name,
+				Type: Dir,
+			})
+			continue
+		}
+
+		f := files[e.Refs[0]]
+		contentType := CidType(File)
+		if f.Type == util.Directory {
+			contentType = Dir
+		}
+
+		out = append(out, collectionListResponse{
+			Name:   e.Name,
+			Type:   contentType,
+			Size:   f.Size,
+			ContID: f.ID,
+			Cid:    &util.DbCID{CID: f.Cid.CID},
+		})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleColfsMkdir godoc
+// @Summary      Create a directory in a collection
+// @Description  This endpoint creates an empty directory in a collection, along with any missing parent directories
+// @Tags         collections
+// @Param        coluuid query string true "Collection ID"
+// @Param        dir query string true "Directory to create"
+// @Produce      json
+// @Router       /collections/fs/mkdir [post]
+func (s *Server) handleColfsMkdir(c echo.Context, u *User) error {
+	col, tree, _, err := s.collectionForFs(c, u, util.ScopeActionWrite, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	dir, err := collectionPathParam(c, "dir")
+	if err != nil {
+		return err
+	}
+
+	if err := tree.CheckFree(dir); err != nil {
+		return err
+	}
+
+	if err := s.DB.Create(&CollectionDir{Collection: col.ID, Path: dir}).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"path": dir})
+}
+
+// handleColfsMove godoc
+// @Summary      Move or rename a path in a collection
+// @Description  This endpoint moves a file or directory of a collection to a path that does not exist yet. Missing parent directories of the destination are created.
+// @Tags         collections
+// @Param        coluuid query string true "Collection ID"
+// @Param        from query string true "Path to move"
+// @Param        to query string true "Destination path"
+// @Produce      json
+// @Router       /collections/fs/move [post]
+func (s *Server) handleColfsMove(c echo.Context, u *User) error {
+	col, tree, _, err := s.collectionForFs(c, u, util.ScopeActionWrite, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	from, err := collectionPathParam(c, "from")
+	if err != nil {
+		return err
+	}
+
+	to, err := collectionPathParam(c, "to")
+	if err != nil {
+		return err
+	}
+
+	if from == "/" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "cannot move the root of a collection",
+		}
+	}
+
+	if !tree.Exists(from) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_PATH_NOT_FOUND,
+			Details: fmt.Sprintf("path %q does not exist", from),
+		}
+	}
+
+	if tree.IsDir(from) && util.IsUnderPath(to, from) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("cannot move %q into itself", from),
+		}
+	}
+
+	if err := tree.CheckFree(to); err != nil {
+		return err
+	}
+
+	dirs, files := tree.Under(from)
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		for _, f := range files {
+			np := to + strings.TrimPrefix(f, from)
+			if err := tx.Model(CollectionRef{}).
+				Where("id in ?", tree.FileRefs(f)).
+				Updates(map[string]interface{}{
+					"path": np,
+					"name": filepath.Base(np),
+				}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, d := range dirs {
+			if err := tx.Model(CollectionDir{}).
+				Where("collection = ? and path = ?", col.ID, d).
+				UpdateColumn("path", to+strings.TrimPrefix(d, from)).Error; err != nil {
+				return err
+			}
+		}
+
+		// an empty directory has to exist explicitly to be moved
+		if len(files) == 0 && len(dirs) > 0 {
+			var count int64
+			if err := tx.Model(CollectionDir{}).Where("collection = ? and path = ?", col.ID, to).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				if err := tx.Create(&CollectionDir{Collection: col.ID, Path: to}).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return keepParentDir(tx, col, from)
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"path": to})
+}
+
+// handleColfsRemove godoc
+// @Summary      Remove a path from a collection
+// @Description  This endpoint removes a file or directory from a collection. The content it refers to stays pinned.
+// @Tags         collections
+// @Param        coluuid query string true "Collection ID"
+// @Param        path query string true "Path to remove"
+// @Param        recursive query bool false "Remove non-empty directories"
+// @Produce      json
+// @Router       /collections/fs/rm [delete]
+func (s *Server) handleColfsRemove(c echo.Context, u *User) error {
+	col, tree, _, err := s.collectionForFs(c, u, util.ScopeActionWrite, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	p, err := collectionPathParam(c, "path")
+	if err != nil {
+		return err
+	}
+
+	if p == "/" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "cannot remove the root of a collection",
+		}
+	}
+
+	if !tree.Exists(p) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_PATH_NOT_FOUND,
+			Details: fmt.Sprintf("path %q does not exist", p),
+		}
+	}
+
+	dirs, files := tree.Under(p)
+	if tree.IsDir(p) && (len(dirs) > 1 || len(files) > 0) && c.QueryParam("recursive") != "true" {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_PATH_CONFLICT,
+			Details: fmt.Sprintf("directory %q is not empty", p),
+		}
+	}
+
+	var refs []uint
+	for _, f := range files {
+		refs = append(refs, tree.FileRefs(f)...)
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if len(refs) > 0 {
+			if err := tx.Where("id in ?", refs).Delete(&CollectionRef{}).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(dirs) > 0 {
+			if err := tx.Where("collection = ? and path in ?", col.ID, dirs).Delete(&CollectionDir{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return keepParentDir(tx, col, p)
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
 func (s *Server) handleRunGc(c echo.Context) error {
 	if err := s.CM.GarbageCollect(c.Request().Context()); err != nil {
 		return err
@@ -5229,7 +5965,7 @@ func (s *Server) handleRunGc(c echo.Context) error {
 }
 
 func (s *Server) handleGateway(c echo.Context) error {
-	npath := "/" + c.Param("path")
+	npath := "/" + c.Param("*")
 	proto, cc, segs, err := gateway.ParsePath(npath)
 	if err != nil {
 		return err
@@ -5248,6 +5984,11 @@ func (s *Server) handleGateway(c echo.Context) error {
 		s.gwayHandler.ServeHTTP(c.Response().Writer, req)
 		return nil
 	}
+
+	// keep the requested response format when sending the client elsewhere
+	if q := c.Request().URL.RawQuery; q != "" {
+		redir += "?" + q
+	}
 	return c.Redirect(307, redir)
 }
 
@@ -5282,9 +6023,9 @@ func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (
 	return fmt.Sprintf("https://%s/gw/%s/%s/%s", shuttle.Host, proto, cc, strings.Join(segs, "/")), nil
 }
 
-func (s *Server) isDupCIDContent(c echo.Context, rootCID cid.Cid, u *User) (bool, error) {
+func (s *Server) isDupCIDContent(c echo.Context, rootCID cid.Cid, owner *contentOwner) (bool, error) {
 	var count int64
-	if err := s.DB.Model(Content{}).Where("cid = ? and user_id = ?", rootCID.Bytes(), u.ID).Count(&count).Error; err != nil {
+	if err := s.DB.Model(Content{}).Scopes(owner.filter).Where("cid = ?", rootCID.Bytes()).Count(&count).Error; err != nil {
 		return false, err
 	}
 	if count > 0 {
@@ -5330,3 +6071,104 @@ func (s *Server) getShuttleConfig(hostname string, authToken string) (interface{
 func (s *Server) isContentAddingDisabled(u *User) bool {
 	return s.CM.contentAddingDisabled || u.StorageDisabled
 }
+
+// getUserUsage returns how much of each quota a user currently consumes.
+// Content that is still being pinned counts towards the object quota so that
+// a burst of pin requests cannot get around it.
+func (cm *ContentManager) getUserUsage(ctx context.Context, uid uint) (util.QuotaUsage, error) {
+	var usage util.QuotaUsage
+	if err := cm.DB.WithContext(ctx).Raw(`SELECT
+						COALESCE(SUM(CASE WHEN aggregated_in = 0 THEN size ELSE 0 END), 0) as bytes,
+						COUNT(CASE WHEN NOT aggregate THEN 1 END) as objects,
+						COALESCE(SUM(CASE WHEN aggregated_in = 0 THEN size * replication ELSE 0 END), 0) as deal_bytes
+						FROM contents where user_id = ? AND (active OR pinning)`,
+		uid).Scan(&usage).Error; err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+func (s *Server) getUserQuotaStatus(ctx context.Context, u *User) (*util.QuotaStatus, error) {
+	usage, err := s.CM.getUserUsage(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &util.QuotaStatus{
+		Quota: u.Quota,
+		Usage: usage,
+	}, nil
+}
+
+// checkAddedWithinQuota removes the contents that were just added if they
+// took the user over their quota, and returns the ERR_QUOTA_EXCEEDED error
+func (s *Server) checkAddedWithinQuota(ctx context.Context, u *User, conts []*Content) error {
+	ids := make([]uint, 0, len(conts))
+	for _, cont := range conts {
+		ids = append(ids, cont.ID)
+	}
+	return s.CM.removeOverQuota(ctx, u.ID, u.Quota, ids)
+}
+
+// removeOverQuota removes the given contents if the user is now over their
+// quota, and returns the ERR_QUOTA_EXCEEDED error
+func (cm *ContentManager) removeOverQuota(ctx context.Context, uid uint, quota util.UserQuota, conts []uint) error {
+	if quota.IsUnlimited() {
+		return nil
+	}
+
+	usage, err := cm.getUserUsage(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	qerr := quota.CheckUsage(usage)
+	if qerr == nil {
+		return nil
+	}
+
+	for _, id := range conts {
+		if err := cm.DB.Where("content = ?", id).Delete(&CollectionRef{}).Error; err != nil {
+			return err
+		}
+
+		if err := cm.unpinContent(ctx, id); err != nil {
+			return xerrors.Errorf("failed to remove content %d over quota: %w", id, err)
+		}
+	}
+	return qerr
+}
+
+// checkPinnedWithinQuota removes a pin whose size was only known once it
+// finished, if it took its owner over their quota
+func (cm *ContentManager) checkPinnedWithinQuota(ctx context.Context, contID uint) error {
+	var cont Content
+	if err := cm.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		return err
+	}
+
+	var u User
+	if err := cm.DB.First(&u, "id = ?", cont.UserID).Error; err != nil {
+		return err
+	}
+
+	err := cm.removeOverQuota(ctx, u.ID, u.Quota, []uint{cont.ID})
+	if herr, ok := err.(*util.HttpError); ok {
+		cm.notifyContentEvent(util.EventPinFailed, &cont, herr.Details)
+	}
+	return err
+}
+
+// checkUserQuota returns an ERR_QUOTA_EXCEEDED error if the user cannot add
+// another object of the given size (zero if not known yet)
+func (s *Server) checkUserQuota(ctx context.Context, u *User, size int64, replication int) error {
+	if u.Quota.IsUnlimited() {
+		return nil
+	}
+
+	usage, err := s.CM.getUserUsage(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	return u.Quota.Check(usage, size, replication)
+}
@@ -20,9 +20,13 @@ import (
 	"github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/node"
 	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/sim"
 	"github.com/application-research/estuary/stagingbs"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bandwidth"
 	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/estuary/util/resumable"
 	"github.com/application-research/filclient"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
@@ -37,12 +41,14 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/xerrors"
 
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/lotus/api"
 	lcli "github.com/filecoin-project/lotus/cli"
 	cli "github.com/urfave/cli/v2"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
@@ -69,6 +75,7 @@ type Content struct {
 	Cid         util.DbCID       `json:"cid"`
 	Name        string           `json:"name"`
 	UserID      uint             `json:"userId" gorm:"index"`
+	OrgID       uint             `json:"orgId" gorm:"index;default:0"`
 	Description string           `json:"description"`
 	Size        int64            `json:"size"`
 	Type        util.ContentType `json:"type"`
@@ -76,8 +83,10 @@ type Content struct {
 	Offloaded   bool             `json:"offloaded"`
 	Replication int              `json:"replication"`
 
-	// TODO: shift most of the 'state' booleans in here into a single state
-	// field, should make reasoning about things much simpler
+	// State is where the content is in its lifecycle. It only changes through
+	// transitionContent, which keeps the flags below in sync with it.
+	State util.ContentState `json:"state" gorm:"index;default:''"`
+
 	AggregatedIn uint `json:"aggregatedIn" gorm:"index:,option:CONCURRENTLY"`
 	Aggregate    bool `json:"aggregate"`
 
@@ -236,6 +245,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Replication = cctx.Int("replication")
 		case "lowmem":
 			cfg.LowMem = cctx.Bool("lowmem")
+		case "simulate":
+			cfg.Simulation.Enabled = cctx.Bool("simulate")
 		case "no-storage-cron":
 			cfg.DisableFilecoinStorage = cctx.Bool("no-storage-cron")
 		case "disable-deal-making":
@@ -244,10 +255,24 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Deal.Verified = cctx.Bool("verified-deal")
 		case "fail-deals-on-transfer-failure":
 			cfg.Deal.FailOnTransferFailure = cctx.Bool("fail-deals-on-transfer-failure")
+		case "deal-renewal-lookahead":
+			cfg.Deal.RenewalLookahead = cctx.Int64("deal-renewal-lookahead")
+		case "deal-transfer":
+			cfg.Deal.Transfer = config.DealTransfer(cctx.String("deal-transfer"))
+		case "max-transfers-per-miner":
+			cfg.TransferLimits.MaxConcurrentPerMiner = cctx.Int("max-transfers-per-miner")
+		case "max-proposals-per-miner":
+			cfg.TransferLimits.MaxProposalsPerMinerPerDay = cctx.Int("max-proposals-per-miner")
+		case "max-transfer-bandwidth":
+			cfg.TransferLimits.MaxBandwidth = cctx.Int64("max-transfer-bandwidth")
 		case "disable-local-content-adding":
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
 		case "disable-content-adding":
 			cfg.Content.DisableGlobalAdding = cctx.Bool("disable-content-adding")
+		case "upload-expiry":
+			cfg.Content.UploadExpiry = cctx.Duration("upload-expiry")
+		case "content-check-workers":
+			cfg.Content.CheckWorkers = cctx.Int("content-check-workers")
 		case "jaeger-tracing":
 			cfg.Jaeger.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -383,6 +408,31 @@ func main() {
 			Usage: "Defaults to makes deals as verified deal using datacap. Set to false to make deal as regular deal using real FIL(no datacap)",
 			Value: cfg.Deal.Verified,
 		},
+		&cli.Int64Flag{
+			Name:  "deal-renewal-lookahead",
+			Usage: "number of epochs before a deal ends that it is renewed, 0 disables renewals",
+			Value: cfg.Deal.RenewalLookahead,
+		},
+		&cli.StringFlag{
+			Name:  "deal-transfer",
+			Usage: "how providers on the boost deal protocol get deal data: 'libp2p' or 'http', downloading the piece from the /piece endpoint",
+			Value: string(cfg.Deal.Transfer),
+		},
+		&cli.IntFlag{
+			Name:  "max-transfers-per-miner",
+			Usage: "most deals with data still being transferred a miner may have, 0 means no limit",
+			Value: cfg.TransferLimits.MaxConcurrentPerMiner,
+		},
+		&cli.IntFlag{
+			Name:  "max-proposals-per-miner",
+			Usage: "most deals proposed to a miner per day, 0 means no limit",
+			Value: cfg.TransferLimits.MaxProposalsPerMinerPerDay,
+		},
+		&cli.Int64Flag{
+			Name:  "max-transfer-bandwidth",
+			Usage: "bytes per second shared by the transfers served by this node, 0 means no limit",
+			Value: cfg.TransferLimits.MaxBandwidth,
+		},
 		&cli.BoolFlag{
 			Name:  "disable-content-adding",
 			Usage: "disallow new content ingestion globally",
@@ -393,6 +443,16 @@ func main() {
 			Usage: "disallow new content ingestion on this node (shuttles are unaffected)",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.DurationFlag{
+			Name:  "upload-expiry",
+			Usage: "how long resumable uploads are kept without receiving any data",
+			Value: cfg.Content.UploadExpiry,
+		},
+		&cli.IntFlag{
+			Name:  "content-check-workers",
+			Usage: "number of workers checking that content is stored",
+			Value: cfg.Content.CheckWorkers,
+		},
 		&cli.StringFlag{
 			Name:  "blockstore",
 			Usage: "specify blockstore parameters",
@@ -423,6 +483,11 @@ func main() {
 			Usage: "TEMP: turns down certain parameters to attempt to use less memory (will be replaced by a more specific flag later)",
 			Value: cfg.LowMem,
 		},
+		&cli.BoolFlag{
+			Name:  "simulate",
+			Usage: "make deals against a simulated chain and storage providers instead of filecoin, for offline development",
+			Value: cfg.Simulation.Enabled,
+		},
 		&cli.BoolFlag{
 			Name:  "jaeger-tracing",
 			Usage: "enables jaeger tracing",
@@ -496,6 +561,7 @@ func main() {
 				authToken := &AuthToken{
 					Token:  "EST" + uuid.New().String() + "ARY",
 					User:   newUser.ID,
+					Scopes: util.Scopes{util.ScopeAll},
 					Expiry: time.Now().Add(time.Hour * 24 * 365),
 				}
 				if err := db.Create(authToken).Error; err != nil {
@@ -559,18 +625,32 @@ func main() {
 			return err
 		}
 
-		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-		flset.String("api-url", "", "node api url")
-		flset.Set("api-url", cfg.Node.ApiURL)
+		var api api.Gateway
+		var simClient *sim.Client
+		if cfg.Simulation.Enabled {
+			api, simClient, err = sim.New(cfg.Simulation, nd.Blockstore)
+			if err != nil {
+				return err
+			}
 
-		ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-		api, closer, err := lcli.GetGatewayAPI(ncctx)
-		if err != nil {
-			return err
+			if err := registerSimulatedMiners(db, simClient.Providers()); err != nil {
+				return err
+			}
+		} else {
+			// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
+			// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
+			flset := flag.NewFlagSet("lotus", flag.ExitOnError)
+			flset.String("api-url", "", "node api url")
+			flset.Set("api-url", cfg.Node.ApiURL)
+
+			ncctx := cli.NewContext(cli.NewApp(), flset, nil)
+			gapi, closer, err := lcli.GetGatewayAPI(ncctx)
+			if err != nil {
+				return err
+			}
+			defer closer()
+			api = gapi
 		}
-		defer closer()
 
 		// setup tracing to jaeger if enabled
 		if cfg.Jaeger.EnableTracing {
@@ -587,6 +667,7 @@ func main() {
 			Node:        nd,
 			Api:         api,
 			StagingMgr:  sbmgr,
+			Uploads:     resumable.NewManager(db, sbmgr, cfg.Content.UploadExpiry),
 			tracer:      otel.Tracer("api"),
 			cacher:      memo.NewCacher(),
 			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
@@ -616,7 +697,37 @@ func main() {
 			})
 		}
 
-		fc, err := filclient.NewClient(rhost, api, nd.Wallet, addr, nd.Blockstore, nd.Datastore, cfg.DataDir, opts...)
+		// the cap is shared by the http transfers and, through the blockstore
+		// it reads from, the graphsync transfers of the filclient
+		bw := bandwidth.NewLimiter(cfg.TransferLimits.MaxBandwidth)
+
+		var fc dealClient
+		var forWallet func(address.Address) (dealClient, error)
+		if simClient != nil {
+			fc = simClient
+			forWallet = func(a address.Address) (dealClient, error) {
+				return simClient.WithClientAddress(a), nil
+			}
+		} else {
+			lfc, err := filclient.NewClient(rhost, api, nd.Wallet, addr, bw.Blockstore(nd.Blockstore), nd.Datastore, cfg.DataDir, opts...)
+			if err != nil {
+				return err
+			}
+			primary := &filClient{FilClient: lfc, host: rhost}
+			fc = primary
+			forWallet = func(a address.Address) (dealClient, error) {
+				has, err := nd.Wallet.WalletHas(context.TODO(), a)
+				if err != nil {
+					return nil, err
+				}
+				if !has {
+					return nil, fmt.Errorf("the key of %s is not in the wallet", a)
+				}
+				return primary.withClientAddress(a), nil
+			}
+		}
+
+		wallets, err := newWalletPool(db, fc, cfg.Deal.Wallets, forWallet)
 		if err != nil {
 			return err
 		}
@@ -638,13 +749,13 @@ func main() {
 			}
 		}()
 
-		cm, err := NewContentManager(db, api, fc, init.trackingBstore, nd.NotifBlockstore, nd.Provider, pinmgr, nd, cfg)
+		cm, err := NewContentManager(db, api, wallets, init.trackingBstore, nd.NotifBlockstore, nd.Provider, pinmgr, nd, bw, cfg)
 		if err != nil {
 			return err
 		}
 		s.CM = cm
 
-		fc.SetPieceCommFunc(cm.getPieceCommitment)
+		wallets.SetPieceCommFunc(cm.getDealPieceCommitment)
 		s.FilClient = fc
 
 		if cfg.EnableAutoRetrieve {
@@ -652,6 +763,12 @@ func main() {
 		}
 
 		go cm.ContentWatcher()
+		go s.Uploads.Run(cctx.Context, time.Hour)
+		go cm.webhooks.Run(cctx.Context)
+		go cm.runMinerScoreSnapshots(cctx.Context)
+		go cm.runDealRenewals(cctx.Context)
+		go cm.runFundsMonitor(cctx.Context)
+		go cm.runTransferSupervisor(cctx.Context)
 		go cm.handleShuttleMessages(cctx.Context, cfg.ShuttleMessageHandlers) // register workers/handlers to process shuttle rpc messages from a channel(queue)
 
 		// refresh pin queue for local contents
@@ -713,8 +830,15 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	db.AutoMigrate(&ObjRef{})
 	db.AutoMigrate(&Collection{})
 	db.AutoMigrate(&CollectionRef{})
+	db.AutoMigrate(&CollectionDir{})
+	db.AutoMigrate(&contentStateTransition{})
+
+	if err := migrateContentStates(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate content states: %w", err)
+	}
 
 	db.AutoMigrate(&contentDeal{})
+	db.AutoMigrate(&contentCheckJob{})
 	db.AutoMigrate(&dfeRecord{})
 	db.AutoMigrate(&PieceCommRecord{})
 	db.AutoMigrate(&proposalRecord{})
@@ -722,11 +846,27 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	db.AutoMigrate(&retrievalSuccessRecord{})
 
 	db.AutoMigrate(&minerStorageAsk{})
+	db.AutoMigrate(&minerPolicyOverride{})
+	db.AutoMigrate(&stagingPolicyOverride{})
+	db.AutoMigrate(&userWallet{})
+	db.AutoMigrate(&aggregatePiece{})
+	db.AutoMigrate(&aggregateSegment{})
+	db.AutoMigrate(&minerScoreSnapshot{})
 	db.AutoMigrate(&storageMiner{})
 
 	db.AutoMigrate(&User{})
 	db.AutoMigrate(&AuthToken{})
 	db.AutoMigrate(&InviteCode{})
+	db.AutoMigrate(&Organization{})
+	db.AutoMigrate(&OrgMember{})
+	db.AutoMigrate(&resumable.Upload{})
+	db.AutoMigrate(&piecetransfer.PieceTransfer{})
+	db.AutoMigrate(&Webhook{})
+	db.AutoMigrate(&WebhookDelivery{})
+
+	if err := migrateAuthTokenScopes(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate auth token scopes: %w", err)
+	}
 
 	db.AutoMigrate(&Shuttle{})
 
@@ -752,15 +892,30 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	return db, nil
 }
 
+// registerSimulatedMiners adds the simulated providers to the miner list, so
+// deals get made with them
+func registerSimulatedMiners(db *gorm.DB, miners []address.Address) error {
+	for _, m := range miners {
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&storageMiner{
+			Address: util.DbAddr{Addr: m},
+			Name:    "simulated",
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type Server struct {
 	estuaryCfg *config.Estuary
 	tracer     trace.Tracer
 	Node       *node.Node
 	DB         *gorm.DB
-	FilClient  *filclient.FilClient
+	FilClient  dealClient
 	Api        api.Gateway
 	CM         *ContentManager
 	StagingMgr *stagingbs.StagingBSMgr
+	Uploads    *resumable.Manager
 
 	gwayHandler *gateway.GatewayHandler
 
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// minerCandidate is a miner deals may be made with, along with the reasons
+// the policies that considered it gave for keeping it
+type minerCandidate struct {
+	Miner   storageMiner
+	Reasons []string
+}
+
+func (mc minerCandidate) addr() address.Address {
+	return mc.Miner.Address.Addr
+}
+
+func (mc minerCandidate) withReason(format string, args ...interface{}) minerCandidate {
+	mc.Reasons = append(append([]string(nil), mc.Reasons...), fmt.Sprintf(format, args...))
+	return mc
+}
+
+// minerSelection describes the deals miners are being picked for
+type minerSelection struct {
+	Content  Content
+	N        int
+	Size     abi.PaddedPieceSize
+	Verified bool
+}
+
+// minerPolicy narrows down and orders the miners deals may be made with. It
+// gets the candidates left by the policies before it and returns the ones it
+// keeps, in order of preference.
+type minerPolicy interface {
+	Name() string
+	Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error)
+}
+
+// minerPolicyChain applies its policies one after the other
+type minerPolicyChain []minerPolicy
+
+func (pc minerPolicyChain) Name() string {
+	names := make([]string, 0, len(pc))
+	for _, p := range pc {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, "+")
+}
+
+func (pc minerPolicyChain) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	for _, p := range pc {
+		out, err := p.Candidates(ctx, sel, in)
+		if err != nil {
+			return nil, fmt.Errorf("miner policy %s: %w", p.Name(), err)
+		}
+		in = out
+	}
+	return in, nil
+}
+
+// newMinerPolicy builds the chain of policies described by spec: the allow
+// list and region filters, then the ordering strategy, then owner diversity
+// so that the preferred miner of each owner is kept
+func (cm *ContentManager) newMinerPolicy(spec config.MinerPolicy) (minerPolicy, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	var chain minerPolicyChain
+	if len(spec.AllowList) > 0 {
+		allowed := make(map[address.Address]bool)
+		for _, a := range spec.AllowList {
+			addr, err := address.NewFromString(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid miner %q in allow list: %w", a, err)
+			}
+			allowed[addr] = true
+		}
+		chain = append(chain, &allowListMinerPolicy{allowed: allowed})
+	}
+
+	if len(spec.Regions) > 0 {
+		chain = append(chain, &regionMinerPolicy{regions: spec.Regions})
+	}
+
+	switch spec.Strategy {
+	case config.MinerStrategyCheapest:
+		chain = append(chain, &cheapestMinerPolicy{cm: cm})
+	default:
+		chain = append(chain, &defaultMinerPolicy{cm: cm})
+	}
+
+	if spec.OwnerDiverse {
+		chain = append(chain, &ownerDiverseMinerPolicy{})
+	}
+	return chain, nil
+}
+
+// defaultMinerPolicy makes some portion of the deals with randomly chosen
+// miners and the rest with a random few of our best ranked miners. Over time
+// our miner list should be all fairly high quality so this just serves to
+// shake things up a bit and give miners more of a chance to prove themselves.
+type defaultMinerPolicy struct {
+	cm *ContentManager
+}
+
+func (p *defaultMinerPolicy) Name() string {
+	return config.MinerStrategyDefault
+}
+
+func (p *defaultMinerPolicy) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	_, nrand := p.cm.pickMinerDist(sel.N)
+
+	shuffled := append([]minerCandidate(nil), in...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	sortedminers, _, err := p.cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+
+	// the ranked list is cached, don't shuffle it in place
+	top := append([]address.Address(nil), sortedminers...)
+	if len(top) > topMinerSel {
+		top = top[:topMinerSel]
+	}
+	rand.Shuffle(len(top), func(i, j int) {
+		top[i], top[j] = top[j], top[i]
+	})
+
+	byAddr := make(map[address.Address]minerCandidate)
+	for _, c := range in {
+		byAddr[c.addr()] = c
+	}
+
+	used := make(map[address.Address]bool)
+	out := make([]minerCandidate, 0, len(in))
+	for _, c := range shuffled {
+		if len(out) >= nrand {
+			break
+		}
+		used[c.addr()] = true
+		out = append(out, c.withReason("random pick"))
+	}
+
+	for rank, m := range top {
+		c, ok := byAddr[m]
+		if !ok || used[m] {
+			continue
+		}
+		used[m] = true
+		out = append(out, c.withReason("one of the top %d ranked miners (picked %d)", len(top), rank+1))
+	}
+
+	// fall back to the remaining miners in random order
+	for _, c := range shuffled {
+		if !used[c.addr()] {
+			out = append(out, c.withReason("random fallback"))
+		}
+	}
+	return out, nil
+}
+
+// cheapestMinerPolicy orders miners by the price of their last known ask.
+// Miners we have no ask for come last.
+type cheapestMinerPolicy struct {
+	cm *ContentManager
+}
+
+func (p *cheapestMinerPolicy) Name() string {
+	return config.MinerStrategyCheapest
+}
+
+func (p *cheapestMinerPolicy) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	addrs := make([]string, 0, len(in))
+	for _, c := range in {
+		addrs = append(addrs, c.addr().String())
+	}
+
+	var asks []minerStorageAsk
+	if err := p.cm.DB.Find(&asks, "miner in ?", addrs).Error; err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]types.BigInt)
+	for _, a := range asks {
+		get := a.GetPrice
+		if sel.Verified {
+			get = a.GetVerifiedPrice
+		}
+
+		price, err := get()
+		if err != nil {
+			log.Warnf("invalid cached ask price for miner %s: %s", a.Miner, err)
+			continue
+		}
+		prices[a.Miner] = *price
+	}
+
+	out := make([]minerCandidate, 0, len(in))
+	for _, c := range in {
+		if price, ok := prices[c.addr().String()]; ok {
+			out = append(out, c.withReason("ask price %s", types.FIL(price)))
+		} else {
+			out = append(out, c.withReason("no known ask price"))
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		pi, iok := prices[out[i].addr().String()]
+		pj, jok := prices[out[j].addr().String()]
+		if iok != jok {
+			return iok
+		}
+		return iok && types.BigCmp(pi, pj) < 0
+	})
+	return out, nil
+}
+
+// regionMinerPolicy only keeps miners located in one of the given regions
+type regionMinerPolicy struct {
+	regions []string
+}
+
+func (p *regionMinerPolicy) Name() string {
+	return "region"
+}
+
+func (p *regionMinerPolicy) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	var out []minerCandidate
+	for _, c := range in {
+		for _, r := range p.regions {
+			if strings.EqualFold(c.Miner.Location, r) {
+				out = append(out, c.withReason("located in %s", c.Miner.Location))
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// ownerDiverseMinerPolicy only keeps the most preferred miner of each owner
+type ownerDiverseMinerPolicy struct{}
+
+func (p *ownerDiverseMinerPolicy) Name() string {
+	return "owner-diverse"
+}
+
+func (p *ownerDiverseMinerPolicy) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	owners := make(map[uint]bool)
+	var out []minerCandidate
+	for _, c := range in {
+		// miners without a known owner can't be grouped
+		if c.Miner.Owner == 0 {
+			out = append(out, c)
+			continue
+		}
+
+		if owners[c.Miner.Owner] {
+			continue
+		}
+		owners[c.Miner.Owner] = true
+		out = append(out, c.withReason("first miner of owner %d", c.Miner.Owner))
+	}
+	return out, nil
+}
+
+// allowListMinerPolicy only keeps the listed miners
+type allowListMinerPolicy struct {
+	allowed map[address.Address]bool
+}
+
+func (p *allowListMinerPolicy) Name() string {
+	return "allow-list"
+}
+
+func (p *allowListMinerPolicy) Candidates(ctx context.Context, sel *minerSelection, in []minerCandidate) ([]minerCandidate, error) {
+	var out []minerCandidate
+	for _, c := range in {
+		if p.allowed[c.addr()] {
+			out = append(out, c.withReason("on allow list"))
+		}
+	}
+	return out, nil
+}
+
+// minerPolicyOverride replaces the global miner selection policy for the
+// content of a user, or of a collection
+type minerPolicyOverride struct {
+	gorm.Model
+	UserID       uint `gorm:"index;default:0"`
+	CollectionID uint `gorm:"index;default:0"`
+	// Policy is the json encoded config.MinerPolicy
+	Policy string
+}
+
+func (mpo *minerPolicyOverride) spec() (config.MinerPolicy, error) {
+	var spec config.MinerPolicy
+	if err := json.Unmarshal([]byte(mpo.Policy), &spec); err != nil {
+		return spec, fmt.Errorf("invalid miner policy override %d: %w", mpo.ID, err)
+	}
+	return spec, nil
+}
+
+// minerPolicyFor returns the policy deals for cont are made with: the policy
+// of the first of its collections that has one, otherwise the policy of its
+// owner, otherwise the global policy. It also returns where the policy came
+// from.
+func (cm *ContentManager) minerPolicyFor(cont Content) (minerPolicy, string, error) {
+	spec := cm.MinerPolicy
+	source := "global"
+
+	var ovs []minerPolicyOverride
+	if cont.ID != 0 {
+		if err := cm.DB.Where("collection_id in (?)", cm.DB.Model(CollectionRef{}).Select("collection").Where("content = ?", cont.ID)).
+			Order("id").Limit(1).Find(&ovs).Error; err != nil {
+			return nil, "", err
+		}
+
+		if len(ovs) > 0 {
+			source = fmt.Sprintf("collection %d", ovs[0].CollectionID)
+		}
+	}
+
+	if len(ovs) == 0 && cont.UserID != 0 {
+		if err := cm.DB.Where("user_id = ? and collection_id = 0", cont.UserID).Limit(1).Find(&ovs).Error; err != nil {
+			return nil, "", err
+		}
+
+		if len(ovs) > 0 {
+			source = fmt.Sprintf("user %d", cont.UserID)
+		}
+	}
+
+	if len(ovs) > 0 {
+		s, err := ovs[0].spec()
+		if err != nil {
+			return nil, "", err
+		}
+		spec = s
+	}
+
+	pol, err := cm.newMinerPolicy(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	return pol, source, nil
+}
+
+// setMinerPolicyOverride stores the override of the user or collection, a
+// zero policy removes it
+func (s *Server) setMinerPolicyOverride(userID, collectionID uint, spec config.MinerPolicy) error {
+	if err := spec.Validate(); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if _, err := s.CM.newMinerPolicy(spec); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? and collection_id = ?", userID, collectionID).Delete(&minerPolicyOverride{}).Error; err != nil {
+			return err
+		}
+
+		if spec.IsZero() {
+			return nil
+		}
+
+		b, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&minerPolicyOverride{
+			UserID:       userID,
+			CollectionID: collectionID,
+			Policy:       string(b),
+		}).Error
+	})
+}
+
+func (s *Server) getMinerPolicyOverride(userID, collectionID uint) (config.MinerPolicy, error) {
+	var ovs []minerPolicyOverride
+	if err := s.DB.Where("user_id = ? and collection_id = ?", userID, collectionID).Limit(1).Find(&ovs).Error; err != nil {
+		return config.MinerPolicy{}, err
+	}
+
+	if len(ovs) == 0 {
+		return config.MinerPolicy{}, nil
+	}
+	return ovs[0].spec()
+}
+
+// handleAdminGetUserMinerPolicy godoc
+// @Summary      Get the miner selection policy of a user
+// @Description  This endpoint returns the miner selection policy that overrides the global one for the content of a user. An empty policy means the global policy is used.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int  true  "User ID"
+// @Success      200     {object}  config.MinerPolicy
+// @Router       /admin/users/{userid}/miner-policy [get]
+func (s *Server) handleAdminGetUserMinerPolicy(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	spec, err := s.getMinerPolicyOverride(user.ID, 0)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
+
+// handleAdminSetUserMinerPolicy godoc
+// @Summary      Set the miner selection policy of a user
+// @Description  This endpoint sets the miner selection policy used for the content of a user. An empty policy removes the override.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int                 true  "User ID"
+// @Param        body    body      config.MinerPolicy  true  "Miner selection policy"
+// @Success      200     {object}  config.MinerPolicy
+// @Router       /admin/users/{userid}/miner-policy [put]
+func (s *Server) handleAdminSetUserMinerPolicy(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	var spec config.MinerPolicy
+	if err := c.Bind(&spec); err != nil {
+		return err
+	}
+
+	if err := s.setMinerPolicyOverride(user.ID, 0, spec); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
+
+// handleGetCollectionMinerPolicy godoc
+// @Summary      Get the miner selection policy of a collection
+// @Description  This endpoint returns the miner selection policy used for the content of a collection. An empty policy means the policy of the content owner is used.
+// @Tags         collections
+// @Produce      json
+// @Param        coluuid  path      string  true  "Collection UUID"
+// @Success      200      {object}  config.MinerPolicy
+// @Router       /collections/{coluuid}/miner-policy [get]
+func (s *Server) handleGetCollectionMinerPolicy(c echo.Context, u *User) error {
+	coluuid := c.Param("coluuid")
+	if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionRead); err != nil {
+		return err
+	}
+
+	col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	spec, err := s.getMinerPolicyOverride(0, col.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
+
+// handleSetCollectionMinerPolicy godoc
+// @Summary      Set the miner selection policy of a collection
+// @Description  This endpoint sets the miner selection policy used for the content of a collection, overriding the policy of the content owner. An empty policy removes the override.
+// @Tags         collections
+// @Produce      json
+// @Param        coluuid  path      string              true  "Collection UUID"
+// @Param        body     body      config.MinerPolicy  true  "Miner selection policy"
+// @Success      200      {object}  config.MinerPolicy
+// @Router       /collections/{coluuid}/miner-policy [put]
+func (s *Server) handleSetCollectionMinerPolicy(c echo.Context, u *User) error {
+	coluuid := c.Param("coluuid")
+	if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+		return err
+	}
+
+	col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var spec config.MinerPolicy
+	if err := c.Bind(&spec); err != nil {
+		return err
+	}
+
+	if err := s.setMinerPolicyOverride(0, col.ID, spec); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
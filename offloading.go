@@ -152,19 +152,35 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 			return 0, fmt.Errorf("cannot offload aggregated content")
 		}
 
-		if err := cm.DB.Model(&Content{}).Where("id = ?", c).Update("offloaded", true).Error; err != nil {
+		if err := transitionContent(cm.DB, c, util.ContentStateOffloaded, "offloaded", nil); err != nil {
 			return 0, err
 		}
 
+		if !cont.Aggregate {
+			cm.notifyContentEvent(util.EventContentOffloaded, &cont, "")
+		}
+
 		if err := cm.DB.Model(&ObjRef{}).Where("content = ?", c).Update("offloaded", 1).Error; err != nil {
 			return 0, err
 		}
 
 		if cont.Aggregate {
-			if err := cm.DB.Model(&Content{}).Where("aggregated_in = ?", c).Update("offloaded", true).Error; err != nil {
+			var children []Content
+			if err := cm.DB.Find(&children, "aggregated_in = ?", c).Error; err != nil {
 				return 0, err
 			}
 
+			for _, child := range children {
+				// content that is being removed has nothing left to offload
+				if !child.State.CanTransition(util.ContentStateOffloaded) {
+					continue
+				}
+
+				if err := transitionContent(cm.DB, child.ID, util.ContentStateOffloaded, "aggregate offloaded", nil); err != nil {
+					return 0, err
+				}
+			}
+
 			if err := cm.DB.Model(&ObjRef{}).
 				Where("content in (?)",
 					cm.DB.Model(Content{}).
@@ -174,12 +190,9 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 				return 0, err
 			}
 
-			var children []Content
-			if err := cm.DB.Find(&children, "aggregated_in = ?", c).Error; err != nil {
-				return 0, err
-			}
-
 			for _, c := range children {
+				cm.notifyContentEvent(util.EventContentOffloaded, &c, "")
+
 				if cont.Location == util.ContentLocationLocal {
 					local = append(local, c.ID)
 				} else {
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// Organization lets a team share ownership of content and collections. Users
+// take part in an organization through an OrgMember record holding their role.
+type Organization struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	UUID        string `gorm:"unique" json:"uuid"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CreatedBy   uint   `json:"createdBy"`
+}
+
+type OrgMember struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Org  uint   `gorm:"index:org_members_org_user,unique;not null" json:"org"`
+	User uint   `gorm:"index:org_members_org_user,unique;not null" json:"user"`
+	Role string `json:"role"`
+}
+
+// contentOwner is who a request acts on behalf of: the user themselves, or an
+// organization they are a member of, selected with the "org" query param.
+type contentOwner struct {
+	UserID uint
+	Org    *Organization
+	Role   string
+}
+
+func (o *contentOwner) OrgID() uint {
+	if o.Org == nil {
+		return 0
+	}
+	return o.Org.ID
+}
+
+// ownerOf returns the owner of an existing content or collection
+func ownerOf(userID, orgID uint) *contentOwner {
+	o := &contentOwner{UserID: userID}
+	if orgID != 0 {
+		o.Org = &Organization{ID: orgID}
+	}
+	return o
+}
+
+// filter restricts a query on contents, collections or deals to the rows
+// attributed to the owner. Meant to be used with gorm's Scopes.
+func (o *contentOwner) filter(db *gorm.DB) *gorm.DB {
+	if o.Org != nil {
+		return db.Where("org_id = ?", o.Org.ID)
+	}
+	return db.Where("user_id = ? AND org_id = 0", o.UserID)
+}
+
+// ownerForRequest resolves the owner a request acts for, checking that the
+// user holds at least the required role when an organization is selected.
+func (s *Server) ownerForRequest(c echo.Context, u *User, required string) (*contentOwner, error) {
+	return s.ownerForOrg(c.QueryParam("org"), u, required)
+}
+
+// ownerForOrg is like ownerForRequest for an organization uuid that did not
+// come from the query, an empty orguuid means the user themselves.
+func (s *Server) ownerForOrg(orguuid string, u *User, required string) (*contentOwner, error) {
+	if orguuid == "" {
+		return &contentOwner{UserID: u.ID}, nil
+	}
+
+	org, role, err := s.getOrgMembership(orguuid, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := util.IsOrgMember(u.ID, util.OrgAccess{OrgID: org.ID, Role: role, Required: required}); err != nil {
+		return nil, err
+	}
+
+	return &contentOwner{
+		UserID: u.ID,
+		Org:    org,
+		Role:   role,
+	}, nil
+}
+
+// getOrgMembership looks up an organization by uuid along with the role u
+// holds in it, which is empty if they are not a member.
+func (s *Server) getOrgMembership(orguuid string, u *User) (*Organization, string, error) {
+	var org Organization
+	if err := s.DB.First(&org, "uuid = ?", orguuid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_ORG_NOT_FOUND,
+				Details: fmt.Sprintf("organization %s was not found", orguuid),
+			}
+		}
+		return nil, "", err
+	}
+
+	role, err := s.orgRole(org.ID, u.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	return &org, role, nil
+}
+
+func (s *Server) orgRole(org, user uint) (string, error) {
+	var members []OrgMember
+	if err := s.DB.Limit(1).Find(&members, "org = ? AND \"user\" = ?", org, user).Error; err != nil {
+		return "", err
+	}
+
+	if len(members) == 0 {
+		return "", nil
+	}
+	return members[0].Role, nil
+}
+
+func (s *Server) orgAccess(u *User, org uint, required string) (util.OrgAccess, error) {
+	if org == 0 {
+		return util.OrgAccess{}, nil
+	}
+
+	role, err := s.orgRole(org, u.ID)
+	if err != nil {
+		return util.OrgAccess{}, err
+	}
+
+	return util.OrgAccess{OrgID: org, Role: role, Required: required}, nil
+}
+
+// isContentOwner checks that u may act on cont, either as its owner or
+// through a role of at least required in the organization it belongs to.
+func (s *Server) isContentOwner(u *User, cont Content, required string) error {
+	acc, err := s.orgAccess(u, cont.OrgID, required)
+	if err != nil {
+		return err
+	}
+	return util.IsContentOwner(u.ID, cont.UserID, acc)
+}
+
+func (s *Server) isCollectionOwner(u *User, col Collection, required string) error {
+	acc, err := s.orgAccess(u, col.OrgID, required)
+	if err != nil {
+		return err
+	}
+	return util.IsCollectionOwner(u.ID, col.UserID, acc)
+}
+
+// getCollectionForUser looks up a collection by uuid, checking u may act on
+// it with the required organization role.
+func (s *Server) getCollectionForUser(coluuid string, u *User, required string) (*Collection, error) {
+	var col Collection
+	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
+			}
+		}
+		return nil, err
+	}
+
+	if err := s.isCollectionOwner(u, col, required); err != nil {
+		return nil, err
+	}
+	return &col, nil
+}
+
+// checkCollection makes sure content attributed to o is only added to
+// collections with the same owner.
+func (o *contentOwner) checkCollection(col *Collection) error {
+	if col.OrgID != o.OrgID() {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("collection %s does not belong to the same owner as the content, use the org parameter to add content for an organization", col.UUID),
+		}
+	}
+	return nil
+}
+
+type createOrgBody struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type orgResponse struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// handleCreateOrg godoc
+// @Summary      Create an organization
+// @Description  This endpoint creates a new organization, the user creating it becomes its owner. Content and collections can be attributed to an organization by passing its uuid in the org query parameter.
+// @Tags         orgs
+// @Produce      json
+// @Param        body  body      createOrgBody  true  "Organization name and description"
+// @Success      200   {object}  orgResponse
+// @Failure      400   {object}  util.HttpError
+// @Failure      500   {object}  util.HttpError
+// @Router       /orgs/create [post]
+func (s *Server) handleCreateOrg(c echo.Context, u *User) error {
+	var body createOrgBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(body.Name) == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "organization name must be set",
+		}
+	}
+
+	org := &Organization{
+		UUID:        uuid.New().String(),
+		Name:        body.Name,
+		Description: body.Description,
+		CreatedBy:   u.ID,
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&OrgMember{
+			Org:  org.ID,
+			User: u.ID,
+			Role: util.OrgRoleOwner,
+		}).Error
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &orgResponse{
+		Organization: *org,
+		Role:         util.OrgRoleOwner,
+	})
+}
+
+// handleListOrgs godoc
+// @Summary      List organizations
+// @Description  This endpoint lists the organizations the user is a member of, along with their role in each.
+// @Tags         orgs
+// @Produce      json
+// @Success      200  {object}  []orgResponse
+// @Failure      500  {object}  util.HttpError
+// @Router       /orgs/list [get]
+func (s *Server) handleListOrgs(c echo.Context, u *User) error {
+	var out []orgResponse
+	// the membership of the user is the join condition, organizations they
+	// are not a member of are not listed
+	if err := s.DB.Model(Organization{}).
+		Joins("join org_members on org_members.org = organizations.id and org_members.\"user\" = ?", u.ID).
+		Select("organizations.*, org_members.role as role").
+		Scan(&out).Error; err != nil {
+		return err
+	}
+
+	if out == nil {
+		out = []orgResponse{}
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+type orgMemberResponse struct {
+	User     uint      `json:"user"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	Since    time.Time `json:"since"`
+}
+
+// handleGetOrgMembers godoc
+// @Summary      List organization members
+// @Description  This endpoint lists the members of an organization and their roles.
+// @Tags         orgs
+// @Produce      json
+// @Param        orguuid  path      string  true  "Organization UUID"
+// @Success      200      {object}  []orgMemberResponse
+// @Failure      403      {object}  util.HttpError
+// @Failure      404      {object}  util.HttpError
+// @Router       /orgs/{orguuid}/members [get]
+func (s *Server) handleGetOrgMembers(c echo.Context, u *User) error {
+	org, role, err := s.getOrgMembership(c.Param("orguuid"), u)
+	if err != nil {
+		return err
+	}
+
+	if err := util.IsOrgMember(u.ID, util.OrgAccess{OrgID: org.ID, Role: role, Required: util.OrgRoleViewer}); err != nil {
+		return err
+	}
+
+	var out []orgMemberResponse
+	if err := s.DB.Model(OrgMember{}).
+		Joins("left join users on org_members.user = users.id").
+		Where("org_members.org = ?", org.ID).
+		Select("org_members.user as \"user\", users.username as username, org_members.role as role, org_members.created_at as since").
+		Scan(&out).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+type orgMemberBody struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// handleAddOrgMember godoc
+// @Summary      Add an organization member
+// @Description  This endpoint adds a user to an organization with the given role (owner, admin, uploader or viewer). Requires the admin role, only owners can add other owners.
+// @Tags         orgs
+// @Produce      json
+// @Param        orguuid  path  string         true  "Organization UUID"
+// @Param        body     body  orgMemberBody  true  "Username and role of the new member"
+// @Failure      400      {object}  util.HttpError
+// @Failure      403      {object}  util.HttpError
+// @Failure      404      {object}  util.HttpError
+// @Router       /orgs/{orguuid}/members [post]
+func (s *Server) handleAddOrgMember(c echo.Context, u *User) error {
+	var body orgMemberBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	org, role, err := s.getOrgMembership(c.Param("orguuid"), u)
+	if err != nil {
+		return err
+	}
+
+	if err := checkOrgRoleChange(u, org, role, body.Role); err != nil {
+		return err
+	}
+
+	var member User
+	if err := s.DB.First(&member, "username = ?", strings.ToLower(body.Username)).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_USER_NOT_FOUND,
+				Details: fmt.Sprintf("user %q was not found", body.Username),
+			}
+		}
+		return err
+	}
+
+	existing, err := s.orgRole(org.ID, member.ID)
+	if err != nil {
+		return err
+	}
+
+	if existing != "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("user %q is already a member of the organization", member.Username),
+		}
+	}
+
+	if err := s.DB.Create(&OrgMember{
+		Org:  org.ID,
+		User: member.ID,
+		Role: body.Role,
+	}).Error; err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// handleUpdateOrgMember godoc
+// @Summary      Change an organization member's role
+// @Description  This endpoint changes the role of an organization member. Requires the admin role, only owners can grant or revoke the owner role.
+// @Tags         orgs
+// @Produce      json
+// @Param        orguuid  path  string         true  "Organization UUID"
+// @Param        user     path  int            true  "User ID"
+// @Param        body     body  orgMemberBody  true  "New role of the member"
+// @Failure      400      {object}  util.HttpError
+// @Failure      403      {object}  util.HttpError
+// @Router       /orgs/{orguuid}/members/{user} [put]
+func (s *Server) handleUpdateOrgMember(c echo.Context, u *User) error {
+	var body orgMemberBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	org, role, err := s.getOrgMembership(c.Param("orguuid"), u)
+	if err != nil {
+		return err
+	}
+
+	muid, err := strconv.Atoi(c.Param("user"))
+	if err != nil {
+		return err
+	}
+
+	current, err := s.orgRole(org.ID, uint(muid))
+	if err != nil {
+		return err
+	}
+
+	if current == "" {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_USER_NOT_FOUND,
+			Details: fmt.Sprintf("user %d is not a member of the organization", muid),
+		}
+	}
+
+	if err := checkOrgRoleChange(u, org, role, body.Role); err != nil {
+		return err
+	}
+
+	// demoting an owner is an owner only operation as well
+	if err := checkOrgRoleChange(u, org, role, current); err != nil {
+		return err
+	}
+
+	if current == util.OrgRoleOwner && body.Role != util.OrgRoleOwner {
+		if err := s.checkNotLastOwner(org); err != nil {
+			return err
+		}
+	}
+
+	if err := s.DB.Model(OrgMember{}).Where("org = ? AND \"user\" = ?", org.ID, muid).Update("role", body.Role).Error; err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// handleRemoveOrgMember godoc
+// @Summary      Remove an organization member
+// @Description  This endpoint removes a member from an organization. Requires the admin role, except for members removing themselves. The last owner of an organization cannot be removed.
+// @Tags         orgs
+// @Produce      json
+// @Param        orguuid  path  string  true  "Organization UUID"
+// @Param        user     path  int     true  "User ID"
+// @Failure      400      {object}  util.HttpError
+// @Failure      403      {object}  util.HttpError
+// @Failure      404      {object}  util.HttpError
+// @Router       /orgs/{orguuid}/members/{user} [delete]
+func (s *Server) handleRemoveOrgMember(c echo.Context, u *User) error {
+	org, role, err := s.getOrgMembership(c.Param("orguuid"), u)
+	if err != nil {
+		return err
+	}
+
+	muid, err := strconv.Atoi(c.Param("user"))
+	if err != nil {
+		return err
+	}
+
+	current, err := s.orgRole(org.ID, uint(muid))
+	if err != nil {
+		return err
+	}
+
+	if current == "" {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_USER_NOT_FOUND,
+			Details: fmt.Sprintf("user %d is not a member of the organization", muid),
+		}
+	}
+
+	if uint(muid) != u.ID {
+		if err := checkOrgRoleChange(u, org, role, current); err != nil {
+			return err
+		}
+	}
+
+	if current == util.OrgRoleOwner {
+		if err := s.checkNotLastOwner(org); err != nil {
+			return err
+		}
+	}
+
+	if err := s.DB.Delete(&OrgMember{}, "org = ? AND \"user\" = ?", org.ID, muid).Error; err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// checkOrgRoleChange checks that a member holding role may grant (or revoke)
+// target: admins manage everything below owner, owners manage everything.
+func checkOrgRoleChange(u *User, org *Organization, role, target string) error {
+	if !util.IsValidOrgRole(target) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid organization role: %q", target),
+		}
+	}
+
+	required := util.OrgRoleAdmin
+	if target == util.OrgRoleOwner {
+		required = util.OrgRoleOwner
+	}
+
+	return util.IsOrgMember(u.ID, util.OrgAccess{OrgID: org.ID, Role: role, Required: required})
+}
+
+func (s *Server) checkNotLastOwner(org *Organization) error {
+	var owners int64
+	if err := s.DB.Model(OrgMember{}).Where("org = ? AND role = ?", org.ID, util.OrgRoleOwner).Count(&owners).Error; err != nil {
+		return err
+	}
+
+	if owners <= 1 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "an organization needs at least one owner",
+		}
+	}
+	return nil
+}
+
+// handleGetOrgStats godoc
+// @Summary      Get organization stats
+// @Description  This endpoint returns the total size and number of pins attributed to an organization.
+// @Tags         orgs
+// @Produce      json
+// @Param        orguuid  path      string  true  "Organization UUID"
+// @Success      200      {object}  userStatsResponse
+// @Failure      403      {object}  util.HttpError
+// @Failure      404      {object}  util.HttpError
+// @Router       /orgs/{orguuid}/stats [get]
+func (s *Server) handleGetOrgStats(c echo.Context, u *User) error {
+	org, role, err := s.getOrgMembership(c.Param("orguuid"), u)
+	if err != nil {
+		return err
+	}
+
+	if err := util.IsOrgMember(u.ID, util.OrgAccess{OrgID: org.ID, Role: role, Required: util.OrgRoleViewer}); err != nil {
+		return err
+	}
+
+	var stats userStatsResponse
+	if err := s.DB.Raw(` SELECT
+						(SELECT SUM(size) FROM contents where org_id = ? AND aggregated_in = 0 AND active) as total_size,
+						(SELECT COUNT(1) FROM contents where org_id = ? AND active) as num_pins`,
+		org.ID, org.ID).Scan(&stats).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/boost/transport/httptransport"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// sendHttpProposal proposes a deal with the http transfer type, the provider
+// downloads the piece from the node or the shuttle holding the content
+func (cm *ContentManager) sendHttpProposal(ctx context.Context, contentLoc string, netprop network.Proposal, dealUUID uuid.UUID, dbid uint) (func() error, bool, error) {
+	authToken, err := httptransport.GenerateAuthToken()
+	if err != nil {
+		return nil, false, xerrors.Errorf("generating auth token for deal: %w", err)
+	}
+
+	piece := netprop.DealProposal.Proposal.PieceCID
+	payload := netprop.Piece.Root
+	size := netprop.Piece.RawBlockSize
+
+	segs, err := cm.segmentsForPayload(payload)
+	if err != nil {
+		return nil, false, xerrors.Errorf("looking up data segments of piece: %w", err)
+	}
+
+	var baseURL string
+	if contentLoc == util.ContentLocationLocal {
+		baseURL = cm.hostname
+		if err := cm.pieces.Prepare(dbid, authToken, piece, payload, size, segs); err != nil {
+			return nil, false, xerrors.Errorf("preparing piece transfer: %w", err)
+		}
+	} else {
+		if !cm.shuttleIsOnline(contentLoc) {
+			return nil, false, xerrors.Errorf("shuttle is not online: %s", contentLoc)
+		}
+
+		hostname := cm.shuttleHostName(contentLoc)
+		if hostname == "" {
+			return nil, false, xerrors.Errorf("no hostname known for shuttle: %s", contentLoc)
+		}
+		baseURL = shuttleURL(hostname)
+
+		if err := cm.sendPrepareForHttpTransferCommand(ctx, contentLoc, dbid, authToken, piece, payload, size, segs); err != nil {
+			return nil, false, xerrors.Errorf("sending prepare for http transfer command to shuttle: %w", err)
+		}
+	}
+
+	cleanup := func() error {
+		if contentLoc == util.ContentLocationLocal {
+			_, err := cm.pieces.Cleanup(dbid, authToken)
+			return err
+		}
+		return cm.sendCleanupPreparedRequestCommand(ctx, contentLoc, dbid, authToken)
+	}
+
+	// the provider reports nothing until it starts downloading, the transfer
+	// ID tells the deal checks where to look for its status meanwhile
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", dbid).UpdateColumns(map[string]interface{}{
+		"dt_chan": piecetransfer.TransferID(dbid),
+	}).Error; err != nil {
+		return cleanup, false, xerrors.Errorf("failed to update deal with transfer ID: %w", err)
+	}
+
+	propPhase, err := cm.FilClient.SendProposalV120Http(ctx, dbid, netprop, dealUUID, baseURL+piecetransfer.PiecePath(piece), authToken)
+	return cleanup, propPhase, err
+}
+
+func (cm *ContentManager) sendPrepareForHttpTransferCommand(ctx context.Context, loc string, dbid uint, authToken string, piece cid.Cid, payload cid.Cid, size uint64, segs []piecetransfer.Segment) error {
+	psegs := make([]drpc.PieceSegment, len(segs))
+	for i, sg := range segs {
+		psegs[i] = drpc.PieceSegment{
+			PayloadCid: sg.Payload,
+			PieceCid:   sg.Piece,
+			Size:       sg.Size,
+			RootOnly:   sg.RootOnly,
+		}
+	}
+
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_PrepareForHttpTransfer,
+		Params: drpc.CmdParams{
+			PrepareForHttpTransfer: &drpc.PrepareForHttpTransfer{
+				DealDBID:   dbid,
+				AuthToken:  authToken,
+				PieceCid:   piece,
+				PayloadCid: payload,
+				Size:       size,
+				Segments:   psegs,
+			},
+		},
+	})
+}
+
+// onPieceTransferState records the progress of the http transfers served by
+// the node the way shuttles report theirs
+func (cm *ContentManager) onPieceTransferState(dbid uint, st filclient.ChannelState) {
+	if st.Status == datatransfer.Requested {
+		if err := cm.DB.Model(contentDeal{}).Where("id = ?", dbid).UpdateColumns(map[string]interface{}{
+			"dt_chan":           st.TransferID,
+			"transfer_started":  time.Now(),
+			"transfer_finished": time.Time{},
+		}).Error; err != nil {
+			log.Errorf("failed to update deal %d with transfer start: %s", dbid, err)
+		}
+		log.Debugw("Started http transfer", "deal", dbid, "transfer", st.TransferID)
+	}
+
+	var cd contentDeal
+	if err := cm.DB.First(&cd, "id = ?", dbid).Error; err != nil {
+		log.Errorf("failed to look up deal %d of http transfer: %s", dbid, err)
+		return
+	}
+	cm.notifyTransferStatus(&cd, &st)
+}
+
+// handleGetPiece godoc
+// @Summary      Download the piece of a deal
+// @Description  This endpoint serves the car of the data of a deal made with the http transfer type to the provider of the deal. The auth token of the transfer goes in a basic authorization header as the password. Range requests are supported so that downloads can be resumed.
+// @Tags         deals
+// @Produce      application/vnd.ipld.car
+// @Param        commp path string true "Piece CID of the deal"
+// @Router       /piece/{commp} [get]
+func (s *Server) handleGetPiece(c echo.Context) error {
+	s.CM.pieces.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -135,6 +135,11 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		return err
 	}
 
+	// the size of a pin is only known once it is fetched
+	if err := s.CM.checkPinnedWithinQuota(ctx, op.ContId); err != nil {
+		return err
+	}
+
 	if op.MakeDeal {
 		s.CM.ToCheck <- op.ContId
 	}
@@ -189,7 +194,7 @@ func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string
 	return nil
 }
 
-func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid, name string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+func (cm *ContentManager) pinContent(ctx context.Context, user uint, org uint, obj cid.Cid, name string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
 	loc, err := cm.selectLocationForContent(ctx, obj, user)
 	if err != nil {
 		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
@@ -197,7 +202,7 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 
 	if replaceID > 0 {
 		// mark as replace since it will removed and so it should not be fetched anymore
-		if err := cm.DB.Model(&Content{}).Where("id = ?", replaceID).Update("replace", true).Error; err != nil {
+		if err := transitionContent(cm.DB, replaceID, util.ContentStateReplaced, "replaced by new pin", nil); err != nil {
 			return nil, err
 		}
 	}
@@ -224,9 +229,11 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		Cid:         util.DbCID{CID: obj},
 		Name:        name,
 		UserID:      user,
+		OrgID:       org,
 		Active:      false,
 		Replication: cm.Replication,
 		Pinning:     true,
+		State:       util.ContentStatePinning,
 		PinMeta:     metaStr,
 		Location:    loc,
 		Origins:     originsStr,
@@ -478,7 +485,12 @@ func (s *Server) handleListPins(e echo.Context, u *User) error {
 	qlimit := e.QueryParam("limit")
 	qreqids := e.QueryParam("requestid")
 
-	q := s.DB.Model(Content{}).Where("user_id = ? AND not aggregate AND not replace", u.ID).Order("created_at desc")
+	owner, err := s.ownerForRequest(e, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	q := s.DB.Model(Content{}).Scopes(owner.filter).Where("not aggregate AND not replace").Order("created_at desc")
 
 	if qcids != "" {
 		var cids []util.DbCID
@@ -561,7 +573,7 @@ func (s *Server) handleListPins(e echo.Context, u *User) error {
 		}
 	}
 
-	q, err := filterForStatusQuery(q, pinStatuses)
+	q, err = filterForStatusQuery(q, pinStatuses)
 	if err != nil {
 		return err
 	}
@@ -678,10 +690,27 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 		return err
 	}
 
+	owner, err := s.ownerForRequest(e, u, util.OrgRoleUploader)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkUserQuota(ctx, u, 0, s.CM.Replication); err != nil {
+		return err
+	}
+
 	var cols []*CollectionRef
 	if c, ok := pin.Meta["collection"].(string); ok && c != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", c, u.ID).Error; err != nil {
+		if err := u.authToken.Scopes.CheckCollection(c, util.ScopeActionWrite); err != nil {
+			return err
+		}
+
+		srchCol, err := s.getCollectionForUser(c, u, util.OrgRoleUploader)
+		if err != nil {
+			return err
+		}
+
+		if err := owner.checkCollection(srchCol); err != nil {
 			return err
 		}
 
@@ -720,7 +749,7 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 
 	makeDeal := true
 	// TODO pinning should be async
-	status, err := s.CM.pinContent(ctx, u.ID, obj, pin.Name, cols, origins, 0, pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(ctx, u.ID, owner.OrgID(), obj, pin.Name, cols, origins, 0, pin.Meta, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -752,7 +781,7 @@ func (s *Server) handleGetPin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleViewer); err != nil {
 		return err
 	}
 
@@ -798,7 +827,7 @@ func (s *Server) handleReplacePin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleUploader); err != nil {
 		return err
 	}
 
@@ -817,7 +846,7 @@ func (s *Server) handleReplacePin(e echo.Context, u *User) error {
 	}
 
 	makeDeal := true
-	status, err := s.CM.pinContent(e.Request().Context(), u.ID, pinCID, pin.Name, nil, origins, uint(pinID), pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(e.Request().Context(), u.ID, content.OrgID, pinCID, pin.Name, nil, origins, uint(pinID), pin.Meta, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -849,12 +878,12 @@ func (s *Server) handleDeletePin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := s.isContentOwner(u, content, util.OrgRoleUploader); err != nil {
 		return err
 	}
 
 	// mark as replace since it will removed and so it should not be fetched anymore
-	if err := s.DB.Model(&Content{}).Where("id = ?", pinID).Update("replace", true).Error; err != nil {
+	if err := transitionContent(s.DB, uint(pinID), util.ContentStateReplaced, "unpinned", nil); err != nil {
 		return err
 	}
 
@@ -878,22 +907,22 @@ func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status t
 
 	if status == types.PinningStatusFailed {
 		var c Content
-		if err := cm.DB.First(&c, "id = ?", contID).Error; err != nil {
+		err := cm.DB.First(&c, "id = ?", contID).Error
+		switch {
+		case xerrors.Is(err, gorm.ErrRecordNotFound):
+			// the content was removed while pinning, e.g. for being over quota
+		case err != nil:
 			return errors.Wrap(err, "failed to look up content")
-		}
-
-		if c.Active {
+		case c.Active:
 			return fmt.Errorf("got failed pin status message from location: %s where content(%d) was already active, refusing to do anything", location, contID)
-		}
-
-		if err := cm.DB.Model(Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
-			"active":  false,
-			"pinning": false,
-			"failed":  true,
-		}).Error; err != nil {
-			log.Errorf("failed to mark content as failed in database: %s", err)
+		default:
+			if err := transitionContent(cm.DB, contID, util.ContentStateFailed, fmt.Sprintf("pin failed on %s", location), nil); err != nil {
+				log.Errorf("failed to mark content as failed in database: %s", err)
+			}
 		}
 	}
+
+	cm.notifyPinStatus(location, contID, status)
 	op.SetStatus(status)
 	return nil
 }
@@ -920,11 +949,9 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 	}
 
 	if cont.Aggregate {
-		if err := cm.DB.Model(Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
-			"active":   true,
-			"pinning":  false,
+		if err := transitionContent(cm.DB, cont.ID, util.ContentStateActive, "aggregate created", map[string]interface{}{
 			"location": handle,
-		}).Error; err != nil {
+		}); err != nil {
 			return xerrors.Errorf("failed to update content in database: %w", err)
 		}
 		return nil
@@ -942,6 +969,15 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 		return xerrors.Errorf("failed to add objects to database: %w", err)
 	}
 
+	// the size of a pin is only known once it is fetched
+	if err := cm.checkPinnedWithinQuota(ctx, cont.ID); err != nil {
+		if _, ok := err.(*util.HttpError); ok {
+			return nil
+		}
+		return err
+	}
+
+	cm.notifyContentEvent(util.EventPinPinned, &cont, "")
 	cm.ToCheck <- cont.ID
 
 	return nil
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"sort"
 	"time"
 
+	"github.com/application-research/estuary/util"
 	"github.com/filecoin-project/go-address"
 )
 
 const minerListTTL = time.Minute
 
+// events older than this barely count towards a miner's reputation anymore,
+// so retrieval records older than it aren't loaded
+const reputationWindow = 8 * util.ReputationHalfLife
+
+const (
+	minerScoreSnapshotInterval = 6 * time.Hour
+	minerScoreSnapshotTTL      = 90 * 24 * time.Hour
+)
+
 func (cm *ContentManager) sortedMinerList() ([]address.Address, []*minerDealStats, error) {
 	cm.minerLk.Lock()
 	defer cm.minerLk.Unlock()
@@ -55,6 +66,8 @@ type minerDealStats struct {
 	ConfirmedDeals int `json:"confirmedDeals"`
 	FailedDeals    int `json:"failedDeals"`
 	DealFaults     int `json:"dealFaults"`
+
+	Reputation util.ReputationScore `json:"reputation"`
 }
 
 func (mds *minerDealStats) SuccessRatio() float64 {
@@ -63,30 +76,50 @@ func (mds *minerDealStats) SuccessRatio() float64 {
 
 // The comparison function that decides 'miner X is better than miner Y'
 func (mds *minerDealStats) Better(o *minerDealStats) bool {
+	if mds.Reputation.Score != o.Reputation.Score {
+		return mds.Reputation.Score > o.Reputation.Score
+	}
 	return mds.SuccessRatio() > o.SuccessRatio()
 }
 
+type dealWithSize struct {
+	contentDeal
+	Size int64
+}
+
 func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
-	var deals []contentDeal
-	if err := cm.DB.Find(&deals).Error; err != nil {
+	now := time.Now()
+
+	var deals []dealWithSize
+	if err := cm.DB.Model(contentDeal{}).
+		Joins("left join contents on contents.id = content_deals.content").
+		Select("content_deals.*, contents.size as size").
+		Scan(&deals).Error; err != nil {
 		return nil, err
 	}
 
 	stats := make(map[address.Address]*minerDealStats)
-	for _, d := range deals {
-		maddr, err := d.MinerAddr()
-		if err != nil {
-			return nil, err
-		}
-
+	reps := make(map[address.Address]*util.MinerReputation)
+	getStats := func(maddr address.Address) (*minerDealStats, *util.MinerReputation) {
 		st, ok := stats[maddr]
 		if !ok {
 			st = &minerDealStats{
 				Miner: maddr,
 			}
 			stats[maddr] = st
+			reps[maddr] = util.NewMinerReputation(now)
+		}
+		return st, reps[maddr]
+	}
+
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			return nil, err
 		}
 
+		st, rep := getStats(maddr)
+
 		st.TotalDeals++
 		if d.DealID > 0 {
 			if d.Failed {
@@ -99,10 +132,55 @@ func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
 		} else {
 			// in progress
 		}
+
+		rep.AddDeal(util.DealSignal{
+			CreatedAt:        d.CreatedAt,
+			OnChainAt:        d.OnChainAt,
+			SealedAt:         d.SealedAt,
+			TransferStarted:  d.TransferStarted,
+			TransferFinished: d.TransferFinished,
+			Size:             d.Size,
+			Succeeded:        d.DealID > 0,
+			Failed:           d.Failed,
+			Slashed:          d.Slashed,
+			FailedAt:         d.FailedAt,
+			SlashedAt:        d.SlashedAt,
+		})
+	}
+
+	type retrievalEvent struct {
+		Miner     string
+		CreatedAt time.Time
+	}
+
+	since := now.Add(-reputationWindow)
+	for _, success := range []bool{true, false} {
+		q := cm.DB.Model(retrievalSuccessRecord{})
+		if !success {
+			q = cm.DB.Model(util.RetrievalFailureRecord{})
+		}
+
+		var events []retrievalEvent
+		if err := q.Where("created_at > ?", since).Select("miner, created_at").Scan(&events).Error; err != nil {
+			return nil, err
+		}
+
+		for _, ev := range events {
+			maddr, err := address.NewFromString(ev.Miner)
+			if err != nil {
+				continue
+			}
+
+			// only rank miners we made deals with
+			if rep, ok := reps[maddr]; ok {
+				rep.AddRetrieval(ev.CreatedAt, success)
+			}
+		}
 	}
 
 	minerStatsArr := make([]*minerDealStats, 0, len(stats))
-	for _, st := range stats {
+	for maddr, st := range stats {
+		st.Reputation = reps[maddr].Score()
 		minerStatsArr = append(minerStatsArr, st)
 	}
 
@@ -112,3 +190,55 @@ func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
 
 	return minerStatsArr, nil
 }
+
+// minerScoreSnapshot is the reputation of a miner at some point in time
+type minerScoreSnapshot struct {
+	ID         uint                 `gorm:"primarykey" json:"-"`
+	CreatedAt  time.Time            `gorm:"index" json:"createdAt"`
+	Miner      string               `gorm:"index" json:"miner"`
+	TotalDeals int                  `json:"totalDeals"`
+	Reputation util.ReputationScore `gorm:"embedded;embeddedPrefix:rep_" json:"reputation"`
+}
+
+// runMinerScoreSnapshots periodically records the reputation of every miner,
+// and drops snapshots that are too old to be interesting
+func (cm *ContentManager) runMinerScoreSnapshots(ctx context.Context) {
+	ticker := time.NewTicker(minerScoreSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.snapshotMinerScores(); err != nil {
+			log.Errorf("failed to snapshot miner scores: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) snapshotMinerScores() error {
+	sml, err := cm.computeSortedMinerList()
+	if err != nil {
+		return err
+	}
+
+	snaps := make([]*minerScoreSnapshot, 0, len(sml))
+	for _, st := range sml {
+		snaps = append(snaps, &minerScoreSnapshot{
+			Miner:      st.Miner.String(),
+			TotalDeals: st.TotalDeals,
+			Reputation: st.Reputation,
+		})
+	}
+
+	if len(snaps) > 0 {
+		if err := cm.DB.CreateInBatches(snaps, 500).Error; err != nil {
+			return err
+		}
+	}
+
+	return cm.DB.Where("created_at < ?", time.Now().Add(-minerScoreSnapshotTTL)).Delete(&minerScoreSnapshot{}).Error
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// how often deals are checked for renewal
+const dealRenewalInterval = time.Hour
+
+// offloaded content is retrieved this many epochs before its deals are due
+// for renewal, so that it is back by the time they are
+const renewalRefreshLead = 2880 * 7
+
+// deals are renewed with the same miner if its reputation is at least this
+const renewalMinScore = 0.5
+
+// number of other miners tried when the same miner can't renew a deal
+const renewalFallbackMiners = 2
+
+// duration of an epoch on mainnet, used to estimate when deals end
+const epochDuration = 30 * time.Second
+
+// runDealRenewals periodically makes new deals for deals that are about to
+// end, so that content never has fewer deals than it should
+func (cm *ContentManager) runDealRenewals(ctx context.Context) {
+	if cm.DealRenewalLookahead <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(dealRenewalInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.renewExpiringDeals(ctx); err != nil {
+			log.Errorf("failed to renew expiring deals: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) renewExpiringDeals(ctx context.Context) error {
+	if cm.dealMakingDisabled() {
+		return nil
+	}
+
+	head, err := cm.Api.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to get chain head: %w", err)
+	}
+	horizon := int64(head.Height()) + cm.DealRenewalLookahead
+
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "not failed and deal_id > 0 and renewed_by = 0 and end_epoch > 0 and end_epoch < ?", horizon+renewalRefreshLead).Error; err != nil {
+		return err
+	}
+
+	for i := range deals {
+		d := &deals[i]
+		if err := cm.renewDeal(ctx, d, d.EndEpoch < horizon); err != nil {
+			log.Warnw("failed to renew deal", "deal", d.ID, "content", d.Content, "miner", d.Miner, "endEpoch", d.EndEpoch, "err", err)
+		}
+	}
+	return nil
+}
+
+// renewDeal makes a new deal to replace d. Content that was offloaded is
+// retrieved first, which starts before the deal is due so that the data is
+// back in time.
+func (cm *ContentManager) renewDeal(ctx context.Context, d *contentDeal, due bool) error {
+	content, err := cm.getContent(d.Content)
+	if err != nil {
+		return err
+	}
+
+	offloaded, err := cm.contentIsOffloaded(content)
+	if err != nil {
+		return err
+	}
+
+	if offloaded {
+		// every deal of the content comes up for renewal, on every tick until
+		// the content is back, but it only needs to be retrieved once
+		cm.refreshingLk.Lock()
+		defer cm.refreshingLk.Unlock()
+		if cm.refreshing[content.ID] {
+			return nil
+		}
+		cm.refreshing[content.ID] = true
+
+		log.Infow("retrieving offloaded content ahead of deal renewal", "content", content.ID, "deal", d.ID)
+		go func() {
+			defer func() {
+				cm.refreshingLk.Lock()
+				delete(cm.refreshing, content.ID)
+				cm.refreshingLk.Unlock()
+			}()
+
+			if err := cm.RefreshContent(context.Background(), content.ID); err != nil {
+				log.Errorf("failed to retrieve content %d for deal renewal: %s", content.ID, err)
+			}
+		}()
+		return nil
+	}
+
+	if !due {
+		return nil
+	}
+
+	if content.Location != util.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
+		return fmt.Errorf("content shuttle %s is not online", content.Location)
+	}
+
+	miners, err := cm.renewalMiners(ctx, content, d)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range miners {
+		id, err := cm.makeDealWithMiner(ctx, *content, m, d.Verified)
+		if xerrors.Is(err, errTransferLimit) {
+			log.Infow("deferring renewal deal with miner", "deal", d.ID, "content", content.ID, "miner", m, "reason", err)
+			continue
+		}
+		if err != nil {
+			log.Warnw("miner did not take renewal deal", "deal", d.ID, "content", content.ID, "miner", m, "err", err)
+			continue
+		}
+
+		if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("renewed_by", id).Error; err != nil {
+			return err
+		}
+
+		log.Infow("renewed deal", "deal", d.ID, "renewal", id, "content", content.ID, "miner", m, "endEpoch", d.EndEpoch)
+		cm.notifyDealEvent(util.EventDealRenewed, d, fmt.Sprintf("deal ending at epoch %d renewed by deal %d with %s", d.EndEpoch, id, m))
+		return nil
+	}
+
+	return fmt.Errorf("none of the %d miners tried accepted a renewal deal", len(miners))
+}
+
+// renewalMiners returns the miners to try to renew d with, in order: the
+// miner of d if it has been behaving well, then miners picked by the miner
+// selection policy of the content
+func (cm *ContentManager) renewalMiners(ctx context.Context, content *Content, d *contentDeal) ([]address.Address, error) {
+	maddr, err := d.MinerAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []address.Address
+	ok, why, err := cm.minerIsWellBehaved(maddr, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		out = append(out, maddr)
+	} else {
+		log.Infow("not renewing deal with the same miner", "deal", d.ID, "miner", maddr, "reason", why)
+	}
+
+	var active []contentDeal
+	if err := cm.DB.Find(&active, "content = ? and not failed", content.ID).Error; err != nil {
+		return nil, err
+	}
+
+	exclude := make(map[address.Address]bool)
+	for _, ad := range active {
+		if m, err := ad.MinerAddr(); err == nil {
+			exclude[m] = true
+		}
+	}
+
+	_, _, size, err := cm.getDealPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get piece commitment of content %d: %w", content.ID, err)
+	}
+
+	others, err := cm.pickMiners(ctx, *content, renewalFallbackMiners, size.Padded(), exclude, d.Verified)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, others...), nil
+}
+
+// minerIsWellBehaved returns whether deals can be renewed with the miner of
+// d, and why not if they can't
+func (cm *ContentManager) minerIsWellBehaved(maddr address.Address, d *contentDeal) (bool, string, error) {
+	if d.Slashed {
+		return false, "deal was slashed", nil
+	}
+
+	sus, err := cm.minerIsSuspended(maddr)
+	if err != nil {
+		return false, "", err
+	}
+
+	if sus {
+		return false, "miner is suspended", nil
+	}
+
+	_, sml, err := cm.sortedMinerList()
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, st := range sml {
+		if st.Miner == maddr {
+			if st.Reputation.Score < renewalMinScore {
+				return false, fmt.Sprintf("reputation score %.2f is below %.2f", st.Reputation.Score, renewalMinScore), nil
+			}
+			return true, "", nil
+		}
+	}
+	return false, "miner has no reputation", nil
+}
+
+// retireExpiringDeal stops counting a deal that is about to end towards the
+// replication of its content. Unlike repairDeal this does not count as a
+// failure of the miner.
+func (cm *ContentManager) retireExpiringDeal(d *contentDeal) error {
+	log.Infow("deal is about to expire", "deal", d.DealID, "content", d.Content, "miner", d.Miner, "endEpoch", d.EndEpoch, "renewedBy", d.RenewedBy)
+	return cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
+		"failed":    true,
+		"failed_at": time.Now(),
+	}).Error
+}
+
+// contentIsOffloaded returns whether some of the blocks of the content need
+// to be retrieved before deals can be made for it
+func (cm *ContentManager) contentIsOffloaded(cont *Content) (bool, error) {
+	if cont.Offloaded {
+		return true, nil
+	}
+
+	var offloaded int64
+	if err := cm.DB.Model(ObjRef{}).Where("content = ? and offloaded > 0", cont.ID).Count(&offloaded).Error; err != nil {
+		return false, err
+	}
+	return offloaded > 0, nil
+}
+
+type expiringDeal struct {
+	ID         uint       `json:"id"`
+	Content    uint       `json:"content"`
+	ContentCid util.DbCID `json:"contentCid"`
+	Miner      string     `json:"miner"`
+	DealID     int64      `json:"dealId"`
+	EndEpoch   int64      `json:"endEpoch"`
+	RenewedBy  uint       `json:"renewedBy,omitempty"`
+	// EpochsLeft and ExpiresAt are estimated from the current chain head
+	EpochsLeft int64     `json:"epochsLeft"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// handleGetExpiringDeals godoc
+// @Summary      List deals that are about to expire
+// @Description  This endpoint lists the active deals of the user, or of an organization, that end within the given number of epochs, along with the deal renewing each of them if there is one already.
+// @Tags         deals
+// @Produce      json
+// @Param        epochs  query     int     false  "Number of epochs to look ahead, defaults to the renewal lookahead"
+// @Param        org     query     string  false  "Organization UUID"
+// @Success      200     {array}   expiringDeal
+// @Router       /deals/expiring [get]
+func (s *Server) handleGetExpiringDeals(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	owner, err := s.ownerForRequest(c, u, util.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	lookahead := s.CM.DealRenewalLookahead
+	if e := c.QueryParam("epochs"); e != "" {
+		n, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || n < 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid epochs %q", e),
+			}
+		}
+		lookahead = n
+	}
+
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	height := int64(head.Height())
+
+	var deals []expiringDeal
+	if err := s.DB.Model(contentDeal{}).
+		Where("content_deals.id in (?)", s.DB.Model(contentDeal{}).Scopes(owner.filter).Select("id")).
+		Joins("left join contents on contents.id = content_deals.content").
+		Where("not content_deals.failed and content_deals.deal_id > 0 and content_deals.end_epoch > 0 and content_deals.end_epoch < ?", height+lookahead).
+		Order("content_deals.end_epoch").
+		Select("content_deals.id, content_deals.content, contents.cid as content_cid, content_deals.miner, content_deals.deal_id, content_deals.end_epoch, content_deals.renewed_by").
+		Scan(&deals).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range deals {
+		deals[i].EpochsLeft = deals[i].EndEpoch - height
+		deals[i].ExpiresAt = now.Add(time.Duration(deals[i].EpochsLeft) * epochDuration)
+	}
+	return c.JSON(http.StatusOK, deals)
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
-	"container/heap"
 	"context"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,7 +15,10 @@ import (
 	"github.com/application-research/estuary/node"
 	"github.com/application-research/estuary/pinner"
 	util "github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bandwidth"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/estuary/util/transferwatch"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/boost/transport/httptransport"
 	"github.com/filecoin-project/go-address"
@@ -38,13 +41,11 @@ import (
 	cbor "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-metrics-interface"
 	"github.com/ipfs/go-unixfs"
 	"github.com/labstack/echo/v4"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multiaddr"
-	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -60,7 +61,9 @@ const dealDuration = 1555200 - (2880 * 21)
 type ContentManager struct {
 	DB        *gorm.DB
 	Api       api.Gateway
-	FilClient *filclient.FilClient
+	FilClient dealClient
+	Wallets   *walletPool
+	funds     *fundsMonitor
 	Provider  *batched.BatchProvidingSystem
 	Node      *node.Node
 
@@ -72,12 +75,17 @@ type ContentManager struct {
 	Tracker          *TrackingBlockstore
 	NotifyBlockstore *node.NotifyBlockstore
 
-	ToCheck  chan uint
-	queueMgr *queueManager
+	ToCheck      chan uint
+	jobs         *contentQueue
+	checkWorkers int
 
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*util.RetrievalProgress
 
+	// refreshing holds the contents being retrieved ahead of deal renewals
+	refreshingLk sync.Mutex
+	refreshing   map[uint]bool
+
 	contentLk sync.RWMutex
 
 	contentSizeLimit int64
@@ -119,10 +127,30 @@ type ContentManager struct {
 	inflightCidsLk sync.Mutex
 
 	VerifiedDeal bool
+	// MinerPolicy is the global miner selection policy
+	MinerPolicy config.MinerPolicy
+
+	// StagingPolicy is the global staging zone policy
+	StagingPolicy config.StagingPolicy
+	// DealRenewalLookahead is how many epochs before their end deals are
+	// renewed
+	DealRenewalLookahead int64
+	// DealTransfer is how providers on the boost deal protocol get the data
+	// of deals
+	DealTransfer config.DealTransfer
 
 	DisableFilecoinStorage bool
 
 	IncomingRPCMessages chan *drpc.Message
+
+	webhooks *webhookDispatcher
+	events   *eventBus
+	pieces   *piecetransfer.Server
+
+	transferSupervisor config.TransferSupervisor
+	transfers          *transferwatch.Supervisor
+	transferLimits     *transferLimiter
+	bandwidth          *bandwidth.Limiter
 }
 
 func (cm *ContentManager) isInflight(c cid.Cid) bool {
@@ -133,16 +161,6 @@ func (cm *ContentManager) isInflight(c cid.Cid) bool {
 	return ok && v > 0
 }
 
-// 90% of the unpadded data size for a 4GB piece
-// the 10% gap is to accommodate car file packing overhead, can probably do this better
-var individualDealThreshold = (abi.PaddedPieceSize(4<<30).Unpadded() * 9) / 10
-
-// 14.29 Gib
-var maxStagingZoneSizeLimit = int64((abi.PaddedPieceSize(16<<30).Unpadded() * 9) / 10)
-
-// 13.29 GiB
-var minStagingZoneSizeLimit = int64(maxStagingZoneSizeLimit - (1 << 30))
-
 type contentStagingZone struct {
 	ZoneOpened time.Time `json:"zoneOpened"`
 
@@ -159,10 +177,14 @@ type contentStagingZone struct {
 	CurSize int64 `json:"curSize"`
 
 	User uint `json:"user"`
+	Org  uint `json:"org"`
 
 	ContID   uint   `json:"contentID"`
 	Location string `json:"location"`
 
+	// Policy is the staging policy of the user when the zone was opened
+	Policy config.StagingPolicy `json:"policy"`
+
 	lk sync.Mutex
 }
 
@@ -179,20 +201,29 @@ func (cb *contentStagingZone) DeepCopy() *contentStagingZone {
 		MaxItems:        cb.MaxItems,
 		CurSize:         cb.CurSize,
 		User:            cb.User,
+		Org:             cb.Org,
 		ContID:          cb.ContID,
 		Location:        cb.Location,
+		Policy:          cb.Policy,
 	}
 	copy(cb2.Contents, cb.Contents)
 	return cb2
 }
 
-func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*contentStagingZone, error) {
+func (cm *ContentManager) newContentStagingZone(user uint, org uint, loc string) (*contentStagingZone, error) {
+	pol, err := cm.stagingPolicyFor(user)
+	if err != nil {
+		return nil, err
+	}
+
 	content := &Content{
 		Size:        0,
 		Name:        "aggregate",
 		Active:      false,
 		Pinning:     true,
+		State:       util.ContentStateStaging,
 		UserID:      user,
+		OrgID:       org,
 		Replication: cm.Replication,
 		Aggregate:   true,
 		Location:    loc,
@@ -204,31 +235,20 @@ func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*content
 
 	return &contentStagingZone{
 		ZoneOpened: time.Now(),
-		CloseTime:  time.Now().Add(maxStagingZoneLifetime),
-		MinSize:    minStagingZoneSizeLimit,
-		MaxSize:    maxStagingZoneSizeLimit,
-		MaxItems:   maxBucketItems,
+		CloseTime:  time.Now().Add(pol.MaxLifetime),
+		MinSize:    pol.MinSize,
+		MaxSize:    pol.MaxSize,
+		MaxItems:   pol.MaxItems,
 		User:       user,
+		Org:        org,
 		ContID:     content.ID,
 		Location:   content.Location,
+		Policy:     pol,
 	}, nil
 }
 
-// amount of time a staging zone will remain open before we aggregate it into a piece of content
-const maxStagingZoneLifetime = time.Hour * 8
-
-// maximum amount of time a piece of content will go without either being aggregated or having a deal made for it
-const maxContentAge = time.Hour * 24 * 7
-
-// staging zones will remain open for at least this long after the last piece of content is added to them (unless they are full)
-const stagingZoneKeepAlive = time.Minute * 40
-
-const minDealSize = 256 << 20
-
-const maxBucketItems = 10000
-
 func (cb *contentStagingZone) isReady() bool {
-	if cb.CurSize < minDealSize {
+	if cb.CurSize < cb.Policy.MinDealSize {
 		return false
 	}
 
@@ -241,7 +261,7 @@ func (cb *contentStagingZone) isReady() bool {
 		return true
 	}
 
-	if time.Since(cb.EarliestContent) > maxContentAge {
+	if time.Since(cb.EarliestContent) > cb.Policy.MaxContentAge {
 		return true
 	}
 
@@ -274,9 +294,9 @@ func (cm *ContentManager) tryAddContent(cb *contentStagingZone, c Content) (bool
 		return false, nil
 	}
 
-	if err := cm.DB.Model(Content{}).
-		Where("id = ?", c.ID).
-		UpdateColumn("aggregated_in", cb.ContID).Error; err != nil {
+	if err := transitionContent(cm.DB, c.ID, util.ContentStateAggregated, "added to staging zone", map[string]interface{}{
+		"aggregated_in": cb.ContID,
+	}); err != nil {
 		return false, err
 	}
 
@@ -287,13 +307,60 @@ func (cm *ContentManager) tryAddContent(cb *contentStagingZone, c Content) (bool
 	cb.Contents = append(cb.Contents, c)
 	cb.CurSize += c.Size
 
-	nowPlus := time.Now().Add(stagingZoneKeepAlive)
+	nowPlus := time.Now().Add(cb.Policy.KeepAlive)
 	if cb.CloseTime.Before(nowPlus) {
 		cb.CloseTime = nowPlus
 	}
 	return true, nil
 }
 
+// splitStagingZone moves conts out of the staging zone b into a new zone of
+// the same user, they are aggregated once that zone is ready
+func (cm *ContentManager) splitStagingZone(b *contentStagingZone, conts []Content) error {
+	nb, err := cm.newContentStagingZone(b.User, b.Org, b.Location)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint, len(conts))
+	move := make(map[uint]bool, len(conts))
+	for i, c := range conts {
+		ids[i] = c.ID
+		move[c.ID] = true
+	}
+
+	if err := cm.DB.Model(Content{}).Where("id in ? and aggregated_in = ?", ids, b.ContID).UpdateColumn("aggregated_in", nb.ContID).Error; err != nil {
+		return err
+	}
+
+	b.lk.Lock()
+	var keep []Content
+	b.CurSize = 0
+	for _, c := range b.Contents {
+		if !move[c.ID] {
+			keep = append(keep, c)
+			b.CurSize += c.Size
+		}
+	}
+	b.Contents = keep
+	b.lk.Unlock()
+
+	for _, c := range conts {
+		if len(nb.Contents) == 0 || c.CreatedAt.Before(nb.EarliestContent) {
+			nb.EarliestContent = c.CreatedAt
+		}
+		nb.Contents = append(nb.Contents, c)
+		nb.CurSize += c.Size
+	}
+
+	log.Infow("split staging zone over the aggregate size limit", "content", b.ContID, "newZone", nb.ContID, "moved", len(conts))
+
+	cm.bucketLk.Lock()
+	cm.buckets[b.User] = append(cm.buckets[b.User], nb)
+	cm.bucketLk.Unlock()
+	return nil
+}
+
 func (cb *contentStagingZone) hasContent(c Content) bool {
 	cb.lk.Lock()
 	defer cb.lk.Unlock()
@@ -306,17 +373,40 @@ func (cb *contentStagingZone) hasContent(c Content) bool {
 	return false
 }
 
-func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tbs *TrackingBlockstore, nbs *node.NotifyBlockstore, prov *batched.BatchProvidingSystem, pinmgr *pinner.PinManager, nd *node.Node, cfg *config.Estuary) (*ContentManager, error) {
+func NewContentManager(db *gorm.DB, api api.Gateway, wallets *walletPool, tbs *TrackingBlockstore, nbs *node.NotifyBlockstore, prov *batched.BatchProvidingSystem, pinmgr *pinner.PinManager, nd *node.Node, bw *bandwidth.Limiter, cfg *config.Estuary) (*ContentManager, error) {
 	cache, err := lru.NewARC(50000)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := cfg.StagingZone.Resolve().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid staging zone policy: %w", err)
+	}
+
+	funds, err := newFundsMonitor(cfg.FundsMonitor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid funds monitor config: %w", err)
+	}
+
+	if err := cfg.Deal.Transfer.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.TransferSupervisor.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid transfer supervisor config: %w", err)
+	}
+
+	if err := cfg.TransferLimits.Validate(); err != nil {
+		return nil, err
+	}
+
 	cm := &ContentManager{
 		Provider:                   prov,
 		DB:                         db,
 		Api:                        api,
-		FilClient:                  fc,
+		FilClient:                  wallets.Primary(),
+		Wallets:                    wallets,
+		funds:                      funds,
 		Blockstore:                 tbs.Under().(node.EstuaryBlockstore),
 		Host:                       nd.Host,
 		Node:                       nd,
@@ -324,6 +414,7 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		Tracker:                    tbs,
 		ToCheck:                    make(chan uint, 100000),
 		retrievalsInProgress:       make(map[uint]*util.RetrievalProgress),
+		refreshing:                 make(map[uint]bool),
 		buckets:                    make(map[uint][]*contentStagingZone),
 		pinJobs:                    make(map[uint]*pinner.PinningOperation),
 		pinMgr:                     pinmgr,
@@ -337,16 +428,25 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		contentAddingDisabled:      cfg.Content.DisableGlobalAdding,
 		localContentAddingDisabled: cfg.Content.DisableLocalAdding,
 		VerifiedDeal:               cfg.Deal.Verified,
+		MinerPolicy:                cfg.Deal.MinerPolicy,
+		StagingPolicy:              cfg.StagingZone,
+		DealRenewalLookahead:       cfg.Deal.RenewalLookahead,
+		DealTransfer:               cfg.Deal.Transfer,
+		pieces:                     piecetransfer.NewServer(db, tbs.Under(), bw),
+		bandwidth:                  bw,
+		transferLimits:             newTransferLimiter(db, cfg.TransferLimits),
 		Replication:                cfg.Replication,
 		tracer:                     otel.Tracer("replicator"),
 		DisableFilecoinStorage:     cfg.DisableFilecoinStorage,
 		IncomingRPCMessages:        make(chan *drpc.Message),
-	}
-	qm := newQueueManager(func(c uint) {
-		cm.ToCheck <- c
-	})
-
-	cm.queueMgr = qm
+		webhooks:                   newWebhookDispatcher(db),
+		events:                     newEventBus(),
+		jobs:                       newContentQueue(db),
+		checkWorkers:               cfg.Content.CheckWorkers,
+		transferSupervisor:         cfg.TransferSupervisor,
+	}
+	cm.pieces.Subscribe(cm.onPieceTransferState)
+	cm.transfers = transferwatch.New(cfg.TransferSupervisor, cm.restartStalledTransfer, cm.onTransferSupervisorEvent)
 	return cm, nil
 }
 
@@ -364,158 +464,39 @@ func (cm *ContentManager) ContentWatcher() {
 		log.Errorf("failed to recheck existing content: %s", err)
 	}
 
-	timer := time.NewTimer(time.Minute * 5)
-
-	for {
-		select {
-		case c := <-cm.ToCheck:
-			var content Content
-			if err := cm.DB.First(&content, "id = ?", c).Error; err != nil {
-				log.Errorf("finding content %d in database: %s", c, err)
-				continue
-			}
-
-			log.Infof("checking content: %d", content.ID)
-			err := cm.ensureStorage(context.TODO(), content, func(dur time.Duration) {
-				cm.queueMgr.add(content.ID, dur)
-			})
-			if err != nil {
-				log.Errorf("failed to ensure replication of content %d: %s", content.ID, err)
-				cm.queueMgr.add(content.ID, time.Minute*5)
-			}
-
-		case <-timer.C:
-			log.Infow("content check queue", "length", len(cm.queueMgr.queue.elems), "nextEvent", cm.queueMgr.nextEvent)
-
-			/*
-				if err := cm.queueAllContent(); err != nil {
-					log.Errorf("rechecking content: %s", err)
-					continue
-				}
-			*/
-
-			buckets := cm.popReadyStagingZone()
-			for _, b := range buckets {
-				if err := cm.aggregateContent(context.TODO(), b); err != nil {
-					log.Errorf("content aggregation failed (bucket %d): %s", b.ContID, err)
-					continue
-				}
-			}
+	ctx := context.TODO()
+	go cm.queueChecks(ctx)
 
-			timer.Reset(time.Minute * 5)
-		}
+	workers := cm.checkWorkers
+	if workers < 1 {
+		workers = 1
 	}
-}
-
-type queueEntry struct {
-	content   uint
-	checkTime time.Time
-}
-
-type entryQueue struct {
-	elems []*queueEntry
-}
-
-func (eq *entryQueue) Len() int {
-	return len(eq.elems)
-}
-
-func (eq *entryQueue) Less(i, j int) bool {
-	return eq.elems[i].checkTime.Before(eq.elems[j].checkTime)
-}
-
-func (eq *entryQueue) Swap(i, j int) {
-	eq.elems[i], eq.elems[j] = eq.elems[j], eq.elems[i]
-}
-
-func (eq *entryQueue) Push(e interface{}) {
-	eq.elems = append(eq.elems, e.(*queueEntry))
-}
-
-func (eq *entryQueue) Pop() interface{} {
-	out := eq.elems[len(eq.elems)-1]
-	eq.elems = eq.elems[:len(eq.elems)-1]
-	return out
-}
-
-func (eq *entryQueue) PopEntry() *queueEntry {
-	return heap.Pop(eq).(*queueEntry)
-}
-
-type queueManager struct {
-	queue *entryQueue
-	cb    func(uint)
-	qlk   sync.Mutex
-
-	nextEvent time.Time
-	evtTimer  *time.Timer
-
-	qsizeMetr metrics.Gauge
-	qnextMetr metrics.Gauge
-}
-
-func newQueueManager(cb func(c uint)) *queueManager {
-	metCtx := metrics.CtxScope(context.Background(), "content_manager")
-	qsizeMetr := metrics.NewCtx(metCtx, "queue_size", "number of items in the replicator queue").Gauge()
-	qnextMetr := metrics.NewCtx(metCtx, "queue_next", "next event time for queue").Gauge()
-
-	qm := &queueManager{
-		queue: new(entryQueue),
-		cb:    cb,
-
-		qsizeMetr: qsizeMetr,
-		qnextMetr: qnextMetr,
+	for i := 0; i < workers; i++ {
+		go cm.runContentChecks(ctx)
 	}
 
-	heap.Init(qm.queue)
-	return qm
-}
-
-func (qm *queueManager) add(content uint, wait time.Duration) {
-	qm.qlk.Lock()
-	defer qm.qlk.Unlock()
-
-	at := time.Now().Add(wait)
-
-	heap.Push(qm.queue, &queueEntry{
-		content:   content,
-		checkTime: at,
-	})
-
-	qm.qsizeMetr.Add(1)
+	timer := time.NewTimer(time.Minute * 5)
 
-	if qm.nextEvent.IsZero() || at.Before(qm.nextEvent) {
-		qm.nextEvent = at
-		qm.qnextMetr.Set(float64(at.Unix()))
+	for {
+		<-timer.C
+		cm.jobs.updateMetrics()
 
-		if qm.evtTimer != nil {
-			qm.evtTimer.Reset(wait)
-		} else {
-			qm.evtTimer = time.AfterFunc(wait, func() {
-				qm.processQueue()
-			})
+		var due int64
+		if err := cm.DB.Model(contentCheckJob{}).Where("scheduled and not paused and next_check <= ?", time.Now()).Count(&due).Error; err != nil {
+			log.Errorf("failed to count due content checks: %s", err)
 		}
-	}
-}
-
-func (qm *queueManager) processQueue() {
-	qm.qlk.Lock()
-	defer qm.qlk.Unlock()
+		log.Infow("content check queue", "due", due)
 
-	for qm.queue.Len() > 0 {
-		qe := qm.queue.PopEntry()
-		if time.Now().After(qe.checkTime) {
-			qm.qsizeMetr.Add(-1)
-			go qm.cb(qe.content)
-		} else {
-			heap.Push(qm.queue, qe)
-			qm.nextEvent = qe.checkTime
-			qm.qnextMetr.Set(float64(qe.checkTime.Unix()))
-			qm.evtTimer.Reset(qe.checkTime.Sub(time.Now()))
-			return
+		buckets := cm.popReadyStagingZone()
+		for _, b := range buckets {
+			if err := cm.aggregateContent(context.TODO(), b); err != nil {
+				log.Errorf("content aggregation failed (bucket %d): %s", b.ContID, err)
+				continue
+			}
 		}
+
+		timer.Reset(time.Minute * 5)
 	}
-	qm.nextEvent = time.Time{}
 }
 
 func (cm *ContentManager) currentLocationForContent(c uint) (string, error) {
@@ -611,6 +592,25 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 		loc = k
 	}
 
+	fit, rest, err := cm.planSegmentAggregate(ctx, b)
+	if err != nil {
+		if !xerrors.Is(err, ErrWaitForRemoteCompute) {
+			return xerrors.Errorf("failed to plan data segment aggregate: %w", err)
+		}
+
+		// try again once the shuttle computed the piece commitments
+		cm.bucketLk.Lock()
+		cm.buckets[b.User] = append(cm.buckets[b.User], b)
+		cm.bucketLk.Unlock()
+		return nil
+	}
+
+	if len(rest) > 0 {
+		if err := cm.splitStagingZone(b, rest); err != nil {
+			return xerrors.Errorf("failed to split staging zone: %w", err)
+		}
+	}
+
 	dir, err := cm.createAggregate(ctx, b.Contents)
 	if err != nil {
 		return xerrors.Errorf("failed to create aggregate: %w", err)
@@ -626,6 +626,10 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 		log.Warnf("content %d aggregate dir apparent size is zero", b.ContID)
 	}
 
+	if _, err := cm.buildSegmentAggregate(ctx, b.ContID, dir, fit); err != nil {
+		return xerrors.Errorf("failed to build data segment aggregate: %w", err)
+	}
+
 	if err := cm.DB.Model(Content{}).Where("id = ?", b.ContID).UpdateColumns(map[string]interface{}{
 		"cid":  util.DbCID{ncid},
 		"size": size,
@@ -658,10 +662,7 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 			return err
 		}
 
-		if err := cm.DB.Model(Content{}).Where("id = ?", b.ContID).UpdateColumns(map[string]interface{}{
-			"active":  true,
-			"pinning": false,
-		}).Error; err != nil {
+		if err := transitionContent(cm.DB, b.ContID, util.ContentStateActive, "aggregate created", nil); err != nil {
 			return err
 		}
 
@@ -669,13 +670,19 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 			cm.ToCheck <- b.ContID
 		}()
 
+		cm.notifyAggregated(b)
 		return nil
 	} else {
 		var ids []uint
 		for _, c := range b.Contents {
 			ids = append(ids, c.ID)
 		}
-		return cm.sendAggregateCmd(ctx, loc, content, ids, dir.RawData())
+		if err := cm.sendAggregateCmd(ctx, loc, content, ids, dir.RawData()); err != nil {
+			return err
+		}
+
+		cm.notifyAggregated(b)
+		return nil
 	}
 }
 
@@ -697,6 +704,21 @@ func (cm *ContentManager) createAggregate(ctx context.Context, conts []Content)
 }
 
 func (cm *ContentManager) startup() error {
+	// checks that were running when estuary stopped are picked up again
+	if err := cm.jobs.recover(); err != nil {
+		return err
+	}
+
+	// the queue is persisted, all content only needs to be queued the first
+	// time estuary runs with it
+	empty, err := cm.jobs.isEmpty()
+	if err != nil {
+		return err
+	}
+
+	if !empty {
+		return nil
+	}
 	return cm.queueAllContent()
 }
 
@@ -710,18 +732,25 @@ func (cm *ContentManager) reBuildStagingZones() error {
 
 	zones := make(map[uint][]*contentStagingZone)
 	for _, c := range stages {
+		pol, err := cm.stagingPolicyFor(c.UserID)
+		if err != nil {
+			return err
+		}
+
 		z := &contentStagingZone{
 			ZoneOpened: c.CreatedAt,
-			CloseTime:  c.CreatedAt.Add(maxStagingZoneLifetime),
-			MinSize:    minStagingZoneSizeLimit,
-			MaxSize:    maxStagingZoneSizeLimit,
-			MaxItems:   maxBucketItems,
+			CloseTime:  c.CreatedAt.Add(pol.MaxLifetime),
+			MinSize:    pol.MinSize,
+			MaxSize:    pol.MaxSize,
+			MaxItems:   pol.MaxItems,
 			User:       c.UserID,
+			Org:        c.OrgID,
 			ContID:     c.ID,
 			Location:   c.Location,
+			Policy:     pol,
 		}
 
-		minClose := time.Now().Add(stagingZoneKeepAlive)
+		minClose := time.Now().Add(pol.KeepAlive)
 		if z.CloseTime.Before(minClose) {
 			z.CloseTime = minClose
 		}
@@ -751,18 +780,24 @@ func (cm *ContentManager) queueAllContent() error {
 
 	log.Infof("queueing all content for checking: %d", len(allcontent))
 
-	go func() {
-		for _, c := range allcontent {
-			log.Infof("queueing content: %d", c.ID)
-			cm.ToCheck <- c.ID
-		}
-	}()
-	/* TODO: this should be more correct, just testing the above out though to ensure the things from here are first in queue
+	jobs := make([]contentCheckJob, 0, len(allcontent))
 	for _, c := range allcontent {
-		cm.queueMgr.add(c.ID, 0)
+		jobs = append(jobs, contentCheckJob{
+			Content:   c.ID,
+			Scheduled: true,
+			NextCheck: time.Now(),
+			Reason:    "queued at startup",
+		})
 	}
-	*/
 
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	if err := cm.DB.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(jobs, 500).Error; err != nil {
+		return xerrors.Errorf("queueing all content: %w", err)
+	}
+	cm.jobs.notify()
 	return nil
 }
 
@@ -777,7 +812,7 @@ func (cm *ContentManager) estimatePrice(ctx context.Context, repl int, size abi.
 	))
 	defer span.End()
 
-	miners, err := cm.pickMiners(ctx, Content{}, repl, size, nil)
+	miners, err := cm.pickMiners(ctx, Content{}, repl, size, nil, verified)
 	if err != nil {
 		return nil, err
 	}
@@ -870,69 +905,53 @@ func (cm *ContentManager) pickMinerDist(n int) (int, int) {
 
 const topMinerSel = 15
 
-func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, size abi.PaddedPieceSize, exclude map[address.Address]bool) ([]address.Address, error) {
+// pickMiners picks up to n miners to make deals for cont with, as decided by
+// the miner selection policy that applies to it
+func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, size abi.PaddedPieceSize, exclude map[address.Address]bool, verified bool) ([]address.Address, error) {
 	ctx, span := cm.tracer.Start(ctx, "pickMiners", trace.WithAttributes(
 		attribute.Int("count", n),
 	))
 	defer span.End()
-	if exclude == nil {
-		exclude = make(map[address.Address]bool)
-	}
-
-	// some portion of the miners will be 'first N of our best miners' and the rest will be randomly chosen from our list
-	// over time, our miner list will be all fairly high quality so this should just serve to shake things up a bit and
-	// give miners more of a chance to prove themselves
-	_, nrand := cm.pickMinerDist(n)
 
-	randminers, err := cm.randomMinerList()
+	policy, source, err := cm.minerPolicyFor(cont)
 	if err != nil {
 		return nil, err
 	}
 
-	var out []address.Address
-	for _, m := range randminers {
-		if len(out) >= nrand {
-			break
-		}
-
-		if exclude[m] {
-			continue
-		}
-
-		exclude[m] = true
-
-		ask, err := cm.getAsk(ctx, m, time.Minute*30)
-		if err != nil {
-			log.Errorf("getting ask from %s failed: %s", m, err)
-			continue
-		}
+	var dbminers []storageMiner
+	if err := cm.DB.Find(&dbminers, "not suspended").Error; err != nil {
+		return nil, err
+	}
 
-		if cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
-			out = append(out, m)
+	cands := make([]minerCandidate, 0, len(dbminers))
+	for _, dbm := range dbminers {
+		if !exclude[dbm.Address.Addr] {
+			cands = append(cands, minerCandidate{Miner: dbm})
 		}
 	}
 
-	sortedminers, _, err := cm.sortedMinerList()
+	cands, err = policy.Candidates(ctx, &minerSelection{
+		Content:  cont,
+		N:        n,
+		Size:     size,
+		Verified: verified,
+	}, cands)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(sortedminers) > topMinerSel {
-		sortedminers = sortedminers[:topMinerSel]
-	}
-
-	rand.Shuffle(len(sortedminers), func(i, j int) {
-		sortedminers[i], sortedminers[j] = sortedminers[j], sortedminers[i]
-	})
-
-	for _, m := range sortedminers {
+	seen := make(map[address.Address]bool)
+	var out []address.Address
+	for _, c := range cands {
 		if len(out) >= n {
 			break
 		}
 
-		if exclude[m] {
+		m := c.addr()
+		if seen[m] {
 			continue
 		}
+		seen[m] = true
 
 		ask, err := cm.getAsk(ctx, m, time.Minute*30)
 		if err != nil {
@@ -940,29 +959,14 @@ func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, s
 			continue
 		}
 
-		if cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
-			out = append(out, m)
+		if !cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
+			continue
 		}
-	}
 
-	return out, nil
-}
-
-func (cm *ContentManager) randomMinerList() ([]address.Address, error) {
-	var dbminers []storageMiner
-	if err := cm.DB.Find(&dbminers, "not suspended").Error; err != nil {
-		return nil, err
-	}
-
-	out := make([]address.Address, 0, len(dbminers))
-	for _, dbm := range dbminers {
-		out = append(out, dbm.Address.Addr)
+		log.Infow("picked miner for deal", "content", cont.ID, "miner", m, "policy", policy.Name(), "policySource", source, "reason", strings.Join(c.Reasons, "; "))
+		out = append(out, m)
 	}
 
-	rand.Shuffle(len(dbminers), func(i, j int) {
-		out[i], out[j] = out[j], out[i]
-	})
-
 	return out, nil
 }
 
@@ -1066,6 +1070,7 @@ type contentDeal struct {
 	gorm.Model
 	Content          uint       `json:"content" gorm:"index:,option:CONCURRENTLY"`
 	UserID           uint       `json:"user_id" gorm:"index:,option:CONCURRENTLY"`
+	OrgID            uint       `json:"org_id" gorm:"default:0"`
 	PropCid          util.DbCID `json:"propCid"`
 	DealUUID         string     `json:"dealUuid"`
 	Miner            string     `json:"miner"`
@@ -1073,6 +1078,7 @@ type contentDeal struct {
 	Failed           bool       `json:"failed"`
 	Verified         bool       `json:"verified"`
 	Slashed          bool       `json:"slashed"`
+	SlashedAt        time.Time  `json:"slashedAt"`
 	FailedAt         time.Time  `json:"failedAt,omitempty"`
 	DTChan           string     `json:"dtChan" gorm:"index"`
 	TransferStarted  time.Time  `json:"transferStarted"`
@@ -1080,6 +1086,15 @@ type contentDeal struct {
 
 	OnChainAt time.Time `json:"onChainAt"`
 	SealedAt  time.Time `json:"sealedAt"`
+
+	// EndEpoch is the end epoch of the deal once it is on chain
+	EndEpoch int64 `json:"endEpoch" gorm:"default:0"`
+	// RenewedBy is the deal made to replace this one before it ends
+	RenewedBy uint `json:"renewedBy" gorm:"default:0"`
+
+	// Wallet is the client address the deal was made from, empty for deals
+	// from before the wallet pool, which are from the primary wallet
+	Wallet string `json:"wallet"`
 }
 
 func (cd contentDeal) MinerAddr() (address.Address, error) {
@@ -1106,12 +1121,7 @@ func (cm *ContentManager) contentInStagingZone(ctx context.Context, content Cont
 	cm.bucketLk.Lock()
 	defer cm.bucketLk.Unlock()
 
-	bucks, ok := cm.buckets[content.UserID]
-	if !ok {
-		return false
-	}
-
-	for _, b := range bucks {
+	for _, b := range cm.stagingZonesFor(content) {
 		if b.hasContent(content) {
 			return true
 		}
@@ -1120,6 +1130,31 @@ func (cm *ContentManager) contentInStagingZone(ctx context.Context, content Cont
 	return false
 }
 
+// stagingZonesFor returns the staging zones content can be aggregated in.
+// Zones are kept by the user that opened them, the content of an
+// organization shares the zones of the organization whichever member opened
+// them. It must be called with the bucket lock held.
+func (cm *ContentManager) stagingZonesFor(content Content) []*contentStagingZone {
+	var out []*contentStagingZone
+	if content.OrgID == 0 {
+		for _, b := range cm.buckets[content.UserID] {
+			if b.Org == 0 {
+				out = append(out, b)
+			}
+		}
+		return out
+	}
+
+	for _, blist := range cm.buckets {
+		for _, b := range blist {
+			if b.Org == content.OrgID {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
 func (cm *ContentManager) getStagingZonesForUser(ctx context.Context, user uint) []*contentStagingZone {
 	cm.bucketLk.Lock()
 	defer cm.bucketLk.Unlock()
@@ -1131,12 +1166,30 @@ func (cm *ContentManager) getStagingZonesForUser(ctx context.Context, user uint)
 
 	var out []*contentStagingZone
 	for _, b := range blist {
+		if b.Org != 0 {
+			continue
+		}
 		out = append(out, b.DeepCopy())
 	}
 
 	return out
 }
 
+func (cm *ContentManager) getStagingZonesForOrg(ctx context.Context, org uint) []*contentStagingZone {
+	cm.bucketLk.Lock()
+	defer cm.bucketLk.Unlock()
+
+	out := []*contentStagingZone{}
+	for _, blist := range cm.buckets {
+		for _, b := range blist {
+			if b.Org == org {
+				out = append(out, b.DeepCopy())
+			}
+		}
+	}
+	return out
+}
+
 func (cm *ContentManager) getStagingZoneSnapshot(ctx context.Context) map[uint][]*contentStagingZone {
 	cm.bucketLk.Lock()
 	defer cm.bucketLk.Unlock()
@@ -1162,27 +1215,21 @@ func (cm *ContentManager) addContentToStagingZone(ctx context.Context, content C
 		return nil
 	}
 
+	// content over the max size would never fit, so each attempt would open
+	// another empty staging zone
+	pol, err := cm.stagingPolicyFor(content.UserID)
+	if err != nil {
+		return err
+	}
+	if !pol.Aggregates(content.Size) {
+		return fmt.Errorf("content %d of %d bytes does not fit in a staging zone", content.ID, content.Size)
+	}
+
 	log.Infof("adding content to staging zone: %d", content.ID)
 	cm.bucketLk.Lock()
 	defer cm.bucketLk.Unlock()
 
-	blist, ok := cm.buckets[content.UserID]
-	if !ok {
-		b, err := cm.newContentStagingZone(content.UserID, content.Location)
-		if err != nil {
-			return fmt.Errorf("failed to create new staging zone content: %w", err)
-		}
-
-		_, err = cm.tryAddContent(b, content)
-		if err != nil {
-			return fmt.Errorf("failed to add content to staging zone: %w", err)
-		}
-
-		cm.buckets[content.UserID] = []*contentStagingZone{b}
-		return nil
-	}
-
-	for _, b := range blist {
+	for _, b := range cm.stagingZonesFor(content) {
 		ok, err := cm.tryAddContent(b, content)
 		if err != nil {
 			return err
@@ -1193,15 +1240,14 @@ func (cm *ContentManager) addContentToStagingZone(ctx context.Context, content C
 		}
 	}
 
-	b, err := cm.newContentStagingZone(content.UserID, content.Location)
+	b, err := cm.newContentStagingZone(content.UserID, content.OrgID, content.Location)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create new staging zone content: %w", err)
 	}
-	cm.buckets[content.UserID] = append(blist, b)
+	cm.buckets[content.UserID] = append(cm.buckets[content.UserID], b)
 
-	_, err = cm.tryAddContent(b, content)
-	if err != nil {
-		return err
+	if _, err := cm.tryAddContent(b, content); err != nil {
+		return fmt.Errorf("failed to add content to staging zone: %w", err)
 	}
 
 	return nil
@@ -1227,99 +1273,112 @@ func (cm *ContentManager) popReadyStagingZone() []*contentStagingZone {
 	return out
 }
 
-const bucketingEnabled = true
-
 const errDelay = time.Minute * 5
 
+// ensureStorage makes progress on storing content. Unless it returns an error
+// it calls done exactly once, possibly after returning, with the time until
+// content should be checked again or contentCheckIdle.
 func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, done func(time.Duration)) error {
 	ctx, span := cm.tracer.Start(ctx, "ensureStorage", trace.WithAttributes(
 		attribute.Int("content", int(content.ID)),
 	))
 	defer span.End()
 
-	verified := cm.VerifiedDeal
-
-	if content.AggregatedIn > 0 {
-		// This content is aggregated inside another piece of content, nothing to do here
-		return nil
+	sc, err := cm.checkStorage(ctx, content, cm.checkContentDeals)
+	if err != nil {
+		return err
 	}
 
-	if content.DagSplit && content.SplitFrom == 0 {
-		// This is the 'root' of a split dag, we dont need to process it
-		return nil
+	if sc.Status != storageDatacapTooLow {
+		cm.funds.resolveContent(ctx, alertContentDatacap, content.ID)
 	}
 
-	// if it's a shuttle content and the shuttle is not online, do not proceed
-	if content.Location != util.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
+	switch sc.Status {
+	case storageAggregated, storageSplitRoot, storageStaged:
+		// nothing to do here, the aggregate, the split pieces or the staging
+		// zone take care of it
+		done(contentCheckIdle)
+		return nil
+	case storageShuttleOffline:
 		log.Debugf("content shuttle: %s, is not online", content.Location)
 		done(time.Minute * 15)
 		return nil
-	}
-
-	if cm.contentInStagingZone(ctx, content) {
-		// This content is already scheduled to be aggregated and is waiting in a bucket
-		return nil
-	}
-
-	// its too big, need to split it up into chunks
-	if content.Size > cm.contentSizeLimit {
+	case storageNeedsSplit:
+		// its too big, need to split it up into chunks
+		// no need to requeue dagsplit root content
 		if err := cm.splitContent(ctx, content, cm.contentSizeLimit); err != nil {
 			return err
 		}
-		// no need to requeue dagsplit root content
+		done(contentCheckIdle)
 		return nil
-	}
-
-	// check if content has enough deals made for it
-	// if not enough deals, go make more
-	// check all existing deals, ensure they are still active
-	// if not active, repair!
-
-	var deals []contentDeal
-	if err := cm.DB.Find(&deals, "content = ? AND NOT failed", content.ID).Error; err != nil {
-		if !xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return err
-		}
-	}
-
-	var user User
-	if err := cm.DB.First(&user, "id = ?", content.UserID).Error; err != nil {
-		return err
-	}
-
-	if len(deals) == 0 &&
-		content.Size < int64(individualDealThreshold) &&
-		!content.Aggregate &&
-		bucketingEnabled {
+	case storageNeedsStaging:
 		// Put it in a bucket!
 		if err := cm.addContentToStagingZone(ctx, content); err != nil {
 			return err
 		}
+		done(contentCheckIdle)
 		return nil
-	}
-
-	replicationFactor := cm.Replication
-	if content.Replication > 0 {
-		replicationFactor = content.Replication
-	}
+	case storageWaitingForCommP:
+		// pre-compute piece commitment in a goroutine and dont block the checker loop while doing so
+		go func() {
+			_, _, _, err := cm.getPieceCommitment(context.Background(), content.Cid.CID, cm.Blockstore)
+			if err != nil {
+				log.Errorf("failed to compute piece commitment for content %d: %s", content.ID, err)
+				done(time.Minute * 5)
+			} else {
+				done(time.Second * 10)
+			}
+		}()
+		return nil
+	case storageOffloaded:
+		go func() {
+			if err := cm.RefreshContent(context.Background(), content.ID); err != nil {
+				log.Errorf("failed to retrieve content in need of repair %d: %s", content.ID, err)
+			}
 
-	minersAlready := make(map[address.Address]bool)
-	for _, d := range deals {
-		if d.Failed {
-			// TODO: this is an interesting choice, because it gives miners more chances to try again if they fail.
-			// I think that as we get a more diverse set of stable miners, we can *not* do this.
-			continue
-		}
-		maddr, err := d.MinerAddr()
-		if err != nil {
-			return err
+			done(time.Second * 30)
+		}()
+		return nil
+	case storageDealsDisabled:
+		log.Warnf("deal making is disabled for now")
+		done(time.Minute * 60)
+		return nil
+	case storageDatacapTooLow:
+		cm.funds.raiseContent(ctx, alertContentDatacap, content.ID, "content can not be stored, %s", sc.Explanation)
+		return fmt.Errorf("will not make deal, %s", sc.Explanation)
+	case storageWalletsPaused:
+		log.Warnf("deal making is paused for every wallet")
+		done(time.Minute * 30)
+		return nil
+	case storageNeedsDeals:
+		go func() {
+			// make some more deals!
+			log.Infow("making more deals for content", "content", content.ID, "curDealCount", len(sc.deals), "newDeals", sc.Replication-len(sc.deals))
+			if err := cm.makeDealsForContent(ctx, content, sc.Replication-len(sc.deals), sc.minersAlready, sc.Verified); err != nil {
+				log.Errorf("failed to make more deals: %s", err)
+			}
+			done(time.Minute * 10)
+		}()
+		return nil
+	case storageReplicated:
+		if sc.DealsSealed >= sc.Replication {
+			done(time.Hour * 24)
+		} else if sc.DealsSealed+sc.DealsPublished >= sc.Replication {
+			done(time.Hour)
+		} else {
+			done(time.Minute * 10)
 		}
-		minersAlready[maddr] = true
+		return nil
+	default:
+		return fmt.Errorf("unrecognized storage status: %s", sc.Status)
 	}
+}
 
-	// check on each of the existing deals, see if they need fixing
+// checkContentDeals checks on each of the existing deals of a content, and
+// fixes the ones that need it
+func (cm *ContentManager) checkContentDeals(ctx context.Context, deals []contentDeal) (dealCounts, error) {
 	var countLk sync.Mutex
-	var numSealed, numPublished, numProgress int
+	var counts dealCounts
 	errs := make([]error, len(deals))
 	var wg sync.WaitGroup
 	for i := range deals {
@@ -1341,17 +1400,24 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 			countLk.Lock()
 			defer countLk.Unlock()
 			switch status {
-			case DEAL_CHECK_UNKNOWN, DEAL_NEARLY_EXPIRED:
+			case DEAL_CHECK_UNKNOWN:
 				if err := cm.repairDeal(&d); err != nil {
 					errs[i] = xerrors.Errorf("repairing deal failed: %w", err)
 					return
 				}
+			case DEAL_NEARLY_EXPIRED:
+				// the deal should have been renewed by now, if it wasn't
+				// replication tops the content up again
+				if err := cm.retireExpiringDeal(&d); err != nil {
+					errs[i] = xerrors.Errorf("retiring expiring deal failed: %w", err)
+					return
+				}
 			case DEAL_CHECK_SECTOR_ON_CHAIN:
-				numSealed++
+				counts.sealed++
 			case DEAL_CHECK_DEALID_ON_CHAIN:
-				numPublished++
+				counts.published++
 			case DEAL_CHECK_PROGRESS:
-				numProgress++
+				counts.inProgress++
 			default:
 				log.Errorf("unrecognized deal check status: %d", status)
 			}
@@ -1369,82 +1435,9 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 		}
 	}
 	if retErr != nil {
-		return fmt.Errorf("deal check errored: %w", retErr)
-	}
-
-	goodDeals := numSealed + numPublished + numProgress
-	if goodDeals < replicationFactor {
-		pc, err := cm.lookupPieceCommRecord(content.Cid.CID)
-		if err != nil {
-			return err
-		}
-
-		if pc == nil {
-			// pre-compute piece commitment in a goroutine and dont block the checker loop while doing so
-			go func() {
-				_, _, _, err := cm.getPieceCommitment(context.Background(), content.Cid.CID, cm.Blockstore)
-				if err != nil {
-					log.Errorf("failed to compute piece commitment for content %d: %s", content.ID, err)
-					done(time.Minute * 5)
-				} else {
-					done(time.Second * 10)
-				}
-			}()
-
-			return nil
-		}
-
-		if content.Offloaded {
-			go func() {
-				if err := cm.RefreshContent(context.Background(), content.ID); err != nil {
-					log.Errorf("failed to retrieve content in need of repair %d: %s", content.ID, err)
-				}
-
-				done(time.Second * 30)
-			}()
-
-			return nil
-		}
-
-		if cm.dealMakingDisabled() {
-			log.Warnf("deal making is disabled for now")
-			done(time.Minute * 60)
-			return nil
-		}
-
-		// only verified deals need datacap checks
-		if verified {
-			bl, err := cm.FilClient.Balance(ctx)
-			if err != nil {
-				return errors.Wrap(err, "could not retrieve dataCap from client balance")
-			}
-
-			if bl.VerifiedClientBalance.LessThan(big.NewIntUnsigned(uint64(abi.UnpaddedPieceSize(content.Size).Padded()))) {
-				// how do we notify admin to top up datacap?
-				return errors.Wrapf(err, "will not make deal, client address dataCap:%d GiB is lower than content size:%d GiB", big.Div(*bl.VerifiedClientBalance, big.NewIntUnsigned(uint64(1073741824))), abi.UnpaddedPieceSize(content.Size).Padded()/1073741824)
-			}
-		}
-
-		go func() {
-			// make some more deals!
-			log.Infow("making more deals for content", "content", content.ID, "curDealCount", len(deals), "newDeals", replicationFactor-len(deals))
-			if err := cm.makeDealsForContent(ctx, content, replicationFactor-len(deals), minersAlready, verified); err != nil {
-				log.Errorf("failed to make more deals: %s", err)
-			}
-			done(time.Minute * 10)
-		}()
-		return nil
-	}
-
-	if numSealed >= replicationFactor {
-		done(time.Hour * 24)
-	} else if numSealed+numPublished >= replicationFactor {
-		done(time.Hour)
-	} else {
-		done(time.Minute * 10)
+		return counts, fmt.Errorf("deal check errored: %w", retErr)
 	}
-
-	return nil
+	return counts, nil
 }
 
 func (cm *ContentManager) splitContent(ctx context.Context, cont Content, size int64) error {
@@ -1518,8 +1511,13 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 
 		if deal.State.SlashEpoch > 0 {
 			// Deal slashed!
-			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("slashed", true).Error; err != nil {
-				return DEAL_CHECK_UNKNOWN, err
+			if !d.Slashed {
+				if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
+					"slashed":    true,
+					"slashed_at": time.Now(),
+				}).Error; err != nil {
+					return DEAL_CHECK_UNKNOWN, err
+				}
 			}
 
 			cm.recordDealFailure(&DealFailureError{
@@ -1532,6 +1530,13 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			return DEAL_CHECK_UNKNOWN, nil
 		}
 
+		if d.EndEpoch != int64(deal.Proposal.EndEpoch) {
+			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("end_epoch", int64(deal.Proposal.EndEpoch)).Error; err != nil {
+				return DEAL_CHECK_UNKNOWN, err
+			}
+			d.EndEpoch = int64(deal.Proposal.EndEpoch)
+		}
+
 		head, err := cm.Api.ChainHead(ctx)
 		if err != nil {
 			return DEAL_CHECK_UNKNOWN, fmt.Errorf("failed to check chain head: %w", err)
@@ -1545,6 +1550,8 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("sealed_at", time.Now()).Error; err != nil {
 				return DEAL_CHECK_UNKNOWN, err
 			}
+
+			cm.notifyDealEvent(util.EventDealSealed, d, fmt.Sprintf("sector start epoch %d", deal.State.SectorStartEpoch))
 			return DEAL_CHECK_SECTOR_ON_CHAIN, nil
 		}
 		return DEAL_CHECK_DEALID_ON_CHAIN, nil
@@ -1572,7 +1579,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 
 	var provds *storagemarket.ProviderDealState
 	if err == nil {
-		provds, err = cm.FilClient.DealStatus(subctx, maddr, d.PropCid.CID, dealUUID)
+		provds, err = cm.dealStatus(subctx, *d, maddr, dealUUID)
 	}
 	if err != nil {
 		log.Warnf("failed to check deal status for deal %s with miner %s: %s", statusCheckID, maddr, err)
@@ -1623,12 +1630,12 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			return DEAL_CHECK_UNKNOWN, fmt.Errorf("failed to lookup deal on chain: %w", err)
 		}
 
-		pcr, err := cm.lookupPieceCommRecord(content.Cid.CID)
-		if err != nil || pcr == nil {
+		ours, err := cm.isDealPiece(content.Cid.CID, deal.Proposal.PieceCID)
+		if err != nil {
 			return DEAL_CHECK_UNKNOWN, xerrors.Errorf("failed to look up piece commitment for content: %w", err)
 		}
 
-		if deal.Proposal.Provider != maddr || deal.Proposal.PieceCID != pcr.Piece.CID {
+		if deal.Proposal.Provider != maddr || !ours {
 			log.Errorf("proposal in deal ID miner sent back did not match our expectations")
 			return DEAL_CHECK_UNKNOWN, nil
 		}
@@ -1638,6 +1645,8 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			return DEAL_CHECK_UNKNOWN, err
 		}
 
+		cm.notifyDealEvent(util.EventDealOnChain, d, "")
+
 		return DEAL_CHECK_DEALID_ON_CHAIN, nil
 	}
 
@@ -1664,6 +1673,8 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 		if err := cm.updateDealID(d, int64(id)); err != nil {
 			return DEAL_CHECK_UNKNOWN, err
 		}
+
+		cm.notifyDealEvent(util.EventDealOnChain, d, "")
 		return DEAL_CHECK_DEALID_ON_CHAIN, nil
 	}
 
@@ -1800,12 +1811,16 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 }
 
 func (cm *ContentManager) updateDealID(d *contentDeal, id int64) error {
+	now := time.Now()
 	if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).Updates(map[string]interface{}{
 		"deal_id":     id,
-		"on_chain_at": time.Now(),
+		"on_chain_at": now,
 	}).Error; err != nil {
 		return err
 	}
+
+	d.DealID = id
+	d.OnChainAt = now
 	return nil
 }
 
@@ -1867,6 +1882,10 @@ func (cm *ContentManager) updateTransferStatus(ctx context.Context, loc string,
 }
 
 func (cm *ContentManager) getLocalTransferStatus(ctx context.Context, d *contentDeal, content *Content) (*filclient.ChannelState, error) {
+	if strings.HasPrefix(d.DTChan, piecetransfer.TransferIDPrefix) {
+		return cm.pieces.TransferStatus(d.ID)
+	}
+
 	ccid := content.Cid.CID
 
 	miner, err := d.MinerAddr()
@@ -2024,22 +2043,49 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 		return fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
-	_, _, size, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
+	_, _, size, err := cm.getDealPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
 	if err != nil {
 		return xerrors.Errorf("failed to compute piece commitment while making deals %d: %w", content.ID, err)
 	}
 
-	minerpool, err := cm.pickMiners(ctx, content, count*2, size.Padded(), exclude)
+	fc, err := cm.Wallets.pick(ctx, content, size.Padded(), verified)
+	if err != nil {
+		return err
+	}
+
+	ap, err := cm.segmentPieceFor(content.Cid.CID)
 	if err != nil {
 		return err
 	}
+	segmented := ap != nil
+
+	minerpool, err := cm.pickMiners(ctx, content, count*2, size.Padded(), exclude, verified)
+	if err != nil {
+		return err
+	}
+
+	// miners at their transfer limits are skipped, the content is checked
+	// again later and gets its missing deals then
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
 
 	var asks []*network.AskResponse
 	var ms []address.Address
 	var successes int
 	for _, m := range minerpool {
+		release, err := cm.transferLimits.reserve(m)
+		if err != nil {
+			log.Infow("deferring deal with miner", "miner", m, "content", content.ID, "reason", err)
+			continue
+		}
+
 		ask, err := cm.FilClient.GetAsk(ctx, m)
 		if err != nil {
+			release()
 			var clientErr *filclient.Error
 			if !(xerrors.As(err, &clientErr) && clientErr.Code == filclient.ErrLotusError) {
 				cm.recordDealFailure(&DealFailureError{
@@ -2060,6 +2106,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 		}
 
 		if cm.priceIsTooHigh(price, verified) {
+			release()
 			log.Infow("miners price is too high", "miner", m, "price", price)
 			cm.recordDealFailure(&DealFailureError{
 				Miner:   m,
@@ -2071,6 +2118,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			continue
 		}
 
+		releases = append(releases, release)
 		ms = append(ms, m)
 		asks = append(asks, ask)
 		successes++
@@ -2090,7 +2138,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			price = asks[i].Ask.Ask.VerifiedPrice
 		}
 
-		prop, err := cm.FilClient.MakeDeal(ctx, m, content.Cid.CID, price, asks[i].Ask.Ask.MinPieceSize, dealDuration, verified)
+		prop, err := fc.MakeDeal(ctx, m, content.Cid.CID, price, asks[i].Ask.Ask.MinPieceSize, dealDuration, verified)
 		if err != nil {
 			return xerrors.Errorf("failed to construct a deal proposal: %w", err)
 		}
@@ -2121,6 +2169,17 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			continue
 		}
 
+		if segmented && proto == filclient.DealProtocolv110 {
+			cm.recordDealFailure(&DealFailureError{
+				Miner:   ms[i],
+				Phase:   "send-proposal",
+				Message: errSegmentAggregatePush.Error(),
+				Content: content.ID,
+				UserID:  content.UserID,
+			})
+			continue
+		}
+
 		propnd, err := cborutil.AsIpld(p.DealProposal)
 		if err != nil {
 			return xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
@@ -2133,7 +2192,9 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			DealUUID: dealUUID.String(),
 			Miner:    ms[i].String(),
 			Verified: verified,
+			Wallet:   fc.ClientAddress().String(),
 			UserID:   content.UserID,
+			OrgID:    content.OrgID,
 		}
 
 		if err := cm.DB.Create(cd).Error; err != nil {
@@ -2216,6 +2277,10 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 }
 
 func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc string, netprop network.Proposal, propCid cid.Cid, dealUUID uuid.UUID, dbid uint) (func() error, bool, error) {
+	if cm.DealTransfer == config.DealTransferHttp {
+		return cm.sendHttpProposal(ctx, contentLoc, netprop, dealUUID, dbid)
+	}
+
 	// In deal protocol v120 the transfer will be initiated by the
 	// storage provider (a pull transfer) so we need to prepare for
 	// the data request
@@ -2241,7 +2306,7 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 		}
 
 		// Add an auth token for the data to the auth DB
-		err := cm.FilClient.Libp2pTransferMgr.PrepareForDataRequest(ctx, dbid, authToken, propCid, rootCid, size)
+		err := cm.FilClient.PrepareForDataRequest(ctx, dbid, authToken, propCid, rootCid, size)
 		if err != nil {
 			return nil, false, xerrors.Errorf("preparing for data request: %w", err)
 		}
@@ -2277,7 +2342,7 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 
 	cleanup := func() error {
 		if contentLoc == util.ContentLocationLocal {
-			return cm.FilClient.Libp2pTransferMgr.CleanupPreparedRequest(ctx, dbid, authToken)
+			return cm.FilClient.CleanupPreparedRequest(ctx, dbid, authToken)
 		}
 		return cm.sendCleanupPreparedRequestCommand(ctx, contentLoc, dbid, authToken)
 	}
@@ -2303,6 +2368,13 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		return 0, fmt.Errorf("content shuttle: %s, is not online", content.Location)
 	}
 
+	// a miner at its transfer limits gets the deal later
+	release, err := cm.transferLimits.reserve(miner)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
 	ask, err := cm.FilClient.GetAsk(ctx, miner)
 	if err != nil {
 		var clientErr *filclient.Error
@@ -2327,7 +2399,17 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		return 0, fmt.Errorf("miners price is too high: %s %s", miner, price)
 	}
 
-	prop, err := cm.FilClient.MakeDeal(ctx, miner, content.Cid.CID, price, ask.Ask.Ask.MinPieceSize, dealDuration, verified)
+	_, _, size, err := cm.getDealPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to compute piece commitment while making deal %d: %w", content.ID, err)
+	}
+
+	fc, err := cm.Wallets.pick(ctx, content, size.Padded(), verified)
+	if err != nil {
+		return 0, err
+	}
+
+	prop, err := fc.MakeDeal(ctx, miner, content.Cid.CID, price, ask.Ask.Ask.MinPieceSize, dealDuration, verified)
 	if err != nil {
 		return 0, xerrors.Errorf("failed to construct a deal proposal: %w", err)
 	}
@@ -2348,6 +2430,23 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		return 0, err
 	}
 
+	if proto == filclient.DealProtocolv110 {
+		ap, err := cm.segmentPieceFor(content.Cid.CID)
+		if err != nil {
+			return 0, err
+		}
+		if ap != nil {
+			cm.recordDealFailure(&DealFailureError{
+				Miner:   miner,
+				Phase:   "send-proposal",
+				Message: errSegmentAggregatePush.Error(),
+				Content: content.ID,
+				UserID:  content.UserID,
+			})
+			return 0, errSegmentAggregatePush
+		}
+	}
+
 	propnd, err := cborutil.AsIpld(prop.DealProposal)
 	if err != nil {
 		return 0, xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
@@ -2360,13 +2459,17 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		DealUUID: dealUUID.String(),
 		Miner:    miner.String(),
 		Verified: verified,
+		Wallet:   fc.ClientAddress().String(),
 		UserID:   content.UserID,
+		OrgID:    content.OrgID,
 	}
 
 	if err := cm.DB.Create(deal).Error; err != nil {
 		return 0, xerrors.Errorf("failed to create database entry for deal: %w", err)
 	}
 
+	cm.notifyDealEvent(util.EventDealProposed, deal, "")
+
 	// Send the deal proposal to the storage provider
 	var cleanupDealPrep func() error
 	var propPhase bool
@@ -2408,6 +2511,8 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		return 0, err
 	}
 
+	cm.notifyDealEvent(util.EventDealAccepted, deal, "")
+
 	// If the data transfer is a pull transfer, we don't need to explicitly
 	// start the transfer (the Storage Provider will start pulling data as
 	// soon as it accepts the proposal)
@@ -2507,7 +2612,13 @@ func (cm *ContentManager) recordDealFailure(dfe *DealFailureError) error {
 		}
 		rec.MinerVersion = m.Version
 	}
-	return cm.DB.Create(rec).Error
+
+	if err := cm.DB.Create(rec).Error; err != nil {
+		return err
+	}
+
+	cm.notifyDealFailure(dfe)
+	return nil
 }
 
 type DealFailureError struct {
@@ -2759,7 +2870,7 @@ func (cm *ContentManager) RefreshContent(ctx context.Context, cont uint) error {
 			return err
 		}
 
-		if err := cm.DB.Model(&Content{}).Where("id = ?", cont).Update("offloaded", false).Error; err != nil {
+		if err := transitionContent(cm.DB, cont, restoredContentState(&c), "retrieved offloaded content", nil); err != nil {
 			return err
 		}
 
@@ -2982,7 +3093,7 @@ func (s *Server) handleFixupDeals(c echo.Context) error {
 				}
 				dealUUID = &parsed
 			}
-			provds, err := s.CM.FilClient.DealStatus(subctx, miner, d.PropCid.CID, dealUUID)
+			provds, err := s.CM.dealStatus(subctx, d, miner, dealUUID)
 			if err != nil {
 				log.Errorf("failed to get deal status: %d %s: %s", d.ID, miner, err)
 				return
@@ -3025,17 +3136,8 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 	ctx, span := cm.tracer.Start(ctx, "addObjectsToDatabase")
 	defer span.End()
 
-	if err := cm.DB.CreateInBatches(objects, 300).Error; err != nil {
-		return xerrors.Errorf("failed to create objects in db: %w", err)
-	}
-
-	refs := make([]ObjRef, 0, len(objects))
 	var totalSize int64
 	for _, o := range objects {
-		refs = append(refs, ObjRef{
-			Content: content,
-			Object:  o.ID,
-		})
 		totalSize += int64(o.Size)
 	}
 
@@ -3044,20 +3146,32 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 		attribute.Int("numObjects", len(objects)),
 	)
 
-	if err := cm.DB.Model(Content{}).Where("id = ?", content).UpdateColumns(map[string]interface{}{
-		"active":   true,
-		"size":     totalSize,
-		"pinning":  false,
-		"location": loc,
-	}).Error; err != nil {
-		return xerrors.Errorf("failed to update content in database: %w", err)
-	}
+	// an illegal transition must not leave the objects and refs behind
+	return cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := transitionContentTx(tx, content, util.ContentStateActive, "content pinned", map[string]interface{}{
+			"size":     totalSize,
+			"location": loc,
+		}); err != nil {
+			return xerrors.Errorf("failed to update content in database: %w", err)
+		}
 
-	if err := cm.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return xerrors.Errorf("failed to create refs: %w", err)
-	}
+		if err := tx.CreateInBatches(objects, 300).Error; err != nil {
+			return xerrors.Errorf("failed to create objects in db: %w", err)
+		}
 
-	return nil
+		refs := make([]ObjRef, 0, len(objects))
+		for _, o := range objects {
+			refs = append(refs, ObjRef{
+				Content: content,
+				Object:  o.ID,
+			})
+		}
+
+		if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+			return xerrors.Errorf("failed to create refs: %w", err)
+		}
+		return nil
+	})
 }
 
 func (cm *ContentManager) migrateContentsToLocalNode(ctx context.Context, toMove []Content) error {
@@ -3084,10 +3198,15 @@ func (cm *ContentManager) migrateContentToLocalNode(ctx context.Context, cont Co
 		return err
 	}
 
-	if err := cm.DB.Model(Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+	to := cont.State
+	if to == util.ContentStateOffloaded {
+		to = restoredContentState(&cont)
+	}
+
+	if err := transitionContent(cm.DB, cont.ID, to, "migrated to local node", map[string]interface{}{
 		"offloaded": false,
 		"location":  util.ContentLocationLocal,
-	}).Error; err != nil {
+	}); err != nil {
 		return err
 	}
 
@@ -3315,10 +3434,12 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont Content, s
 			Active:      true,
 			Pinning:     true,
 			UserID:      cont.UserID,
+			OrgID:       cont.OrgID,
 			Replication: cont.Replication,
 			Location:    util.ContentLocationLocal,
 			DagSplit:    true,
 			SplitFrom:   cont.ID,
+			State:       util.ContentStatePinning,
 		}
 
 		if err := cm.DB.Create(content).Error; err != nil {
@@ -3336,11 +3457,9 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont Content, s
 		}()
 	}
 
-	if err := cm.DB.Model(Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
-		"dag_split": true,
-		"active":    false,
-		"size":      0,
-	}).Error; err != nil {
+	if err := transitionContent(cm.DB, cont.ID, util.ContentStateSplit, fmt.Sprintf("split into %d contents", len(boxCids)), map[string]interface{}{
+		"size": 0,
+	}); err != nil {
 		return err
 	}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel/trace"
@@ -13,6 +14,7 @@ import (
 
 	drpc "github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bandwidth"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -52,6 +54,8 @@ type ShuttleConnection struct {
 	blockstoreFree uint64
 	pinCount       int64
 	pinQueueLength int64
+
+	transferBandwidth bandwidth.Usage
 }
 
 func (sc *ShuttleConnection) sendMessage(ctx context.Context, cmd *drpc.Command) error {
@@ -204,6 +208,16 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorf("handling transfer status message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_TransferStalled:
+		param := msg.Params.TransferStalled
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcTransferStalled(ctx, handle, param); err != nil {
+			log.Errorf("handling transfer stalled message from shuttle %s: %s", handle, err)
+		}
+		return nil
 	case drpc.OP_ShuttleUpdate:
 		param := msg.Params.ShuttleUpdate
 		if param == nil {
@@ -292,6 +306,15 @@ func (cm *ContentManager) shuttleHostName(handle string) string {
 	return ""
 }
 
+// shuttleURL is the base url of the api of a shuttle with the given hostname,
+// https unless the hostname has a scheme
+func shuttleURL(hostname string) string {
+	if strings.HasPrefix(hostname, "http://") || strings.HasPrefix(hostname, "https://") {
+		return hostname
+	}
+	return "https://" + hostname
+}
+
 func (cm *ContentManager) shuttleStorageStats(handle string) *util.ShuttleStorageStats {
 	cm.shuttlesLk.Lock()
 	defer cm.shuttlesLk.Unlock()
@@ -380,6 +403,7 @@ func (cm *ContentManager) handleRpcTransferStatus(ctx context.Context, handle st
 		}
 	}
 	cm.updateTransferStatus(ctx, handle, cd.ID, param.State)
+	cm.notifyTransferStatus(&cd, param.State)
 	return nil
 }
 
@@ -396,6 +420,15 @@ func (cm *ContentManager) handleRpcShuttleUpdate(ctx context.Context, handle str
 	d.blockstoreSize = param.BlockstoreSize
 	d.pinCount = param.NumPins
 	d.pinQueueLength = int64(param.PinQueueSize)
+	d.transferBandwidth = bandwidth.Usage{
+		Limit:   param.MaxTransferBandwidth,
+		Rate:    param.TransferBandwidth,
+		Streams: param.ActiveTransfers,
+		Share:   param.MaxTransferBandwidth,
+	}
+	if param.MaxTransferBandwidth > 0 && param.ActiveTransfers > 0 {
+		d.transferBandwidth.Share = param.MaxTransferBandwidth / int64(param.ActiveTransfers)
+	}
 
 	return nil
 }
@@ -427,9 +460,7 @@ func (cm *ContentManager) handleRpcSplitComplete(ctx context.Context, handle str
 
 	// TODO: do some sanity checks that the sub pieces were all made successfully...
 
-	if err := cm.DB.Model(Content{}).Where("id = ?", param.ID).UpdateColumns(map[string]interface{}{
-		"dag_split": true,
-	}).Error; err != nil {
+	if err := transitionContent(cm.DB, param.ID, util.ContentStateSplit, fmt.Sprintf("split on shuttle %s", handle), nil); err != nil {
 		return fmt.Errorf("failed to update content for split complete: %w", err)
 	}
 
@@ -0,0 +1,251 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	lmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+)
+
+type chainDeal struct {
+	proposal  market.DealProposal
+	published abi.ChainEpoch
+	sealAt    abi.ChainEpoch
+}
+
+type chainMessage struct {
+	msg     *types.Message
+	receipt types.MessageReceipt
+	height  abi.ChainEpoch
+}
+
+// Chain is a fake lotus gateway. It holds the state of the market actor and
+// of the simulated providers, the other gateway methods are not implemented
+// and panic when called.
+type Chain struct {
+	api.Gateway
+
+	clock *Clock
+
+	lk       sync.Mutex
+	nextDeal abi.DealID
+	deals    map[abi.DealID]*chainDeal
+	msgs     map[cid.Cid]*chainMessage
+	nonces   map[address.Address]uint64
+	miners   map[address.Address]*Provider
+}
+
+func NewChain(clock *Clock) *Chain {
+	return &Chain{
+		clock:    clock,
+		nextDeal: 1,
+		deals:    make(map[abi.DealID]*chainDeal),
+		msgs:     make(map[cid.Cid]*chainMessage),
+		nonces:   make(map[address.Address]uint64),
+		miners:   make(map[address.Address]*Provider),
+	}
+}
+
+func (ch *Chain) Clock() *Clock {
+	return ch.clock
+}
+
+func (ch *Chain) addMiner(p *Provider) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+	ch.miners[p.Address] = p
+}
+
+// publish records a publish storage deals message for the proposals and
+// returns its cid along with the IDs of the deals
+func (ch *Chain) publish(worker address.Address, props []market.ClientDealProposal, sealDelay abi.ChainEpoch) (cid.Cid, []abi.DealID, error) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	var params bytes.Buffer
+	if err := (&market.PublishStorageDealsParams{Deals: props}).MarshalCBOR(&params); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	height := ch.clock.Height()
+	ids := make([]abi.DealID, 0, len(props))
+	for _, p := range props {
+		id := ch.nextDeal
+		ch.nextDeal++
+
+		ch.deals[id] = &chainDeal{
+			proposal:  p.Proposal,
+			published: height,
+			sealAt:    height + sealDelay,
+		}
+		ids = append(ids, id)
+	}
+
+	var ret bytes.Buffer
+	if err := (&market.PublishStorageDealsReturn{IDs: ids}).MarshalCBOR(&ret); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	msg := &types.Message{
+		Version:    0,
+		To:         builtin.StorageMarketActorAddr,
+		From:       worker,
+		Nonce:      ch.nonces[worker],
+		Value:      big.Zero(),
+		GasLimit:   0,
+		GasFeeCap:  big.Zero(),
+		GasPremium: big.Zero(),
+		Method:     builtin.MethodsMarket.PublishStorageDeals,
+		Params:     params.Bytes(),
+	}
+	ch.nonces[worker]++
+
+	ch.msgs[msg.Cid()] = &chainMessage{
+		msg:     msg,
+		receipt: types.MessageReceipt{ExitCode: 0, Return: ret.Bytes()},
+		height:  height,
+	}
+	return msg.Cid(), ids, nil
+}
+
+// Slash marks a deal as slashed, as if its provider failed to prove it
+func (ch *Chain) Slash(id abi.DealID) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	if d, ok := ch.deals[id]; ok {
+		d.sealAt = -1
+	}
+}
+
+func (ch *Chain) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	h := ch.clock.Height()
+	blk := mock.MkBlock(nil, 0, uint64(h))
+	blk.Height = h
+	return types.NewTipSet([]*types.BlockHeader{blk})
+}
+
+func (ch *Chain) ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message, error) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	m, ok := ch.msgs[mc]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found", mc)
+	}
+	return m.msg, nil
+}
+
+func (ch *Chain) StateSearchMsg(ctx context.Context, from types.TipSetKey, msg cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	m, ok := ch.msgs[msg]
+	if !ok {
+		return nil, nil
+	}
+
+	return &api.MsgLookup{
+		Message: msg,
+		Receipt: m.receipt,
+		Height:  m.height,
+	}, nil
+}
+
+func (ch *Chain) StateMarketStorageDeal(ctx context.Context, dealId abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	d, ok := ch.deals[dealId]
+	if !ok {
+		// same message as lotus, filclient relies on it to tell missing deals
+		// from errors
+		return nil, fmt.Errorf("deal %d not found", dealId)
+	}
+
+	height := ch.clock.Height()
+	state := lmarket.DealState{
+		SectorStartEpoch: -1,
+		LastUpdatedEpoch: -1,
+		SlashEpoch:       -1,
+	}
+
+	switch {
+	case d.sealAt < 0:
+		state.SlashEpoch = d.published
+	case height >= d.sealAt:
+		state.SectorStartEpoch = d.sealAt
+		state.LastUpdatedEpoch = height
+	}
+
+	p := d.proposal
+	return &api.MarketDeal{
+		Proposal: lmarket.DealProposal{
+			PieceCID:             p.PieceCID,
+			PieceSize:            p.PieceSize,
+			VerifiedDeal:         p.VerifiedDeal,
+			Client:               p.Client,
+			Provider:             p.Provider,
+			Label:                p.Label,
+			StartEpoch:           p.StartEpoch,
+			EndEpoch:             p.EndEpoch,
+			StoragePricePerEpoch: p.StoragePricePerEpoch,
+			ProviderCollateral:   p.ProviderCollateral,
+			ClientCollateral:     p.ClientCollateral,
+		},
+		State: state,
+	}, nil
+}
+
+func (ch *Chain) StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (miner.MinerInfo, error) {
+	ch.lk.Lock()
+	p, ok := ch.miners[actor]
+	ch.lk.Unlock()
+	if !ok {
+		return miner.MinerInfo{}, fmt.Errorf("miner %s not found", actor)
+	}
+
+	pid := p.PeerID
+	return miner.MinerInfo{
+		Owner:      p.Owner,
+		Worker:     p.Worker,
+		PeerId:     &pid,
+		SectorSize: abi.SectorSize(32 << 30),
+	}, nil
+}
+
+func (ch *Chain) StateMinerPower(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.MinerPower, error) {
+	ch.lk.Lock()
+	_, ok := ch.miners[addr]
+	total := int64(len(ch.miners))
+	ch.lk.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("miner %s not found", addr)
+	}
+
+	pow := abi.NewStoragePower(1 << 50)
+	return &api.MinerPower{
+		MinerPower:  power.Claim{RawBytePower: pow, QualityAdjPower: pow},
+		TotalPower:  power.Claim{RawBytePower: big.Mul(pow, big.NewInt(total)), QualityAdjPower: big.Mul(pow, big.NewInt(total))},
+		HasMinPower: true,
+	}, nil
+}
+
+// StateAccountKey returns addr itself, simulated accounts have no separate
+// key address
+func (ch *Chain) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	return addr, nil
+}
@@ -0,0 +1,431 @@
+package sim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipfs/go-merkledag"
+	lcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("sim")
+
+// the id addresses of the simulated providers start at this
+const firstProviderID = 10000
+
+// like filclient, give providers a week to seal and commit the sector
+const dealStartDelay = 2880 * 7
+
+// Client makes deals with the simulated providers of a chain, in place of
+// filclient
+type Client struct {
+	ClientAddr address.Address
+
+	*clientNet
+}
+
+// clientNet is what the clients of the different wallets share
+type clientNet struct {
+	chain *Chain
+	peer  peer.ID
+	bs    blockstore.Blockstore
+	dag   ipld.NodeGetter
+
+	lk           sync.Mutex
+	pieceComm    filclient.GetPieceCommFunc
+	providers    map[address.Address]*Provider
+	nextTransfer datatransfer.TransferID
+}
+
+// New sets up a simulated chain with the providers described by cfg, and a
+// client that makes deals with them for the data in bs
+func New(cfg config.Simulation, bs blockstore.Blockstore) (*Chain, *Client, error) {
+	chain := NewChain(NewClock(0, cfg.EpochDuration))
+
+	caddr, err := address.NewIDAddress(firstProviderID - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cpeer, err := simPeerID(0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &Client{
+		ClientAddr: caddr,
+		clientNet: &clientNet{
+			chain:     chain,
+			peer:      cpeer,
+			bs:        bs,
+			dag:       merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+			providers: make(map[address.Address]*Provider),
+		},
+	}
+
+	for i := 0; i < cfg.Providers; i++ {
+		maddr, err := address.NewIDAddress(uint64(firstProviderID + 2*i))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		worker, err := address.NewIDAddress(uint64(firstProviderID + 2*i + 1))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pid, err := simPeerID(i + 1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.providers[maddr] = NewProvider(chain, maddr, worker, pid, ProviderConfig{
+			// providers get more expensive the further down the list
+			Price:         abi.NewTokenAmount(int64(i+1) * 2_000_000_000),
+			VerifiedPrice: big.Zero(),
+			MinPieceSize:  256,
+			MaxPieceSize:  32 << 30,
+			Throughput:    cfg.Throughput,
+			PublishDelay:  abi.ChainEpoch(cfg.PublishDelay),
+			SealDelay:     abi.ChainEpoch(cfg.SealDelay),
+			RejectRate:    cfg.RejectRate,
+		})
+	}
+
+	log.Infow("simulating chain and storage providers", "providers", cfg.Providers, "epoch", cfg.EpochDuration)
+	return chain, c, nil
+}
+
+// simPeerID derives a stable peer ID for the n-th simulated node
+func simPeerID(n int) (peer.ID, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	binary.BigEndian.PutUint64(seed, uint64(n)+1)
+
+	priv, _, err := lcrypto.KeyPairFromStdKey(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPrivateKey(priv)
+}
+
+// WithClientAddress returns a client making deals from another wallet with
+// the same providers
+func (c *Client) WithClientAddress(addr address.Address) *Client {
+	return &Client{
+		ClientAddr: addr,
+		clientNet:  c.clientNet,
+	}
+}
+
+// Providers returns the addresses of the simulated providers
+func (c *Client) Providers() []address.Address {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	out := make([]address.Address, 0, len(c.providers))
+	for a := range c.providers {
+		out = append(out, a)
+	}
+	return out
+}
+
+func (c *Client) provider(maddr address.Address) (*Provider, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	p, ok := c.providers[maddr]
+	if !ok {
+		return nil, fmt.Errorf("no simulated provider %s", maddr)
+	}
+	return p, nil
+}
+
+func (c *Client) SetPieceCommFunc(pcf filclient.GetPieceCommFunc) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.pieceComm = pcf
+}
+
+func (c *Client) ClientAddress() address.Address {
+	return c.ClientAddr
+}
+
+func (c *Client) GetAsk(ctx context.Context, maddr address.Address) (*network.AskResponse, error) {
+	p, err := c.provider(maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &network.AskResponse{
+		Ask: &storagemarket.SignedStorageAsk{
+			Ask:       p.ask(),
+			Signature: &crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte("simulated")},
+		},
+	}, nil
+}
+
+func (c *Client) GetMinerVersion(ctx context.Context, maddr address.Address) (string, error) {
+	if _, err := c.provider(maddr); err != nil {
+		return "", err
+	}
+	return "simulated", nil
+}
+
+func (c *Client) DealProtocolForMiner(ctx context.Context, maddr address.Address) (protocol.ID, error) {
+	if _, err := c.provider(maddr); err != nil {
+		return "", err
+	}
+	return filclient.DealProtocolv110, nil
+}
+
+func (c *Client) MakeDeal(ctx context.Context, maddr address.Address, data cid.Cid, price types.BigInt, minSize abi.PaddedPieceSize, duration abi.ChainEpoch, verified bool) (*network.Proposal, error) {
+	c.lk.Lock()
+	pieceComm := c.pieceComm
+	c.lk.Unlock()
+
+	if pieceComm == nil {
+		return nil, fmt.Errorf("no piece commitment function set")
+	}
+
+	commP, _, size, err := pieceComm(ctx, data, c.bs)
+	if err != nil {
+		return nil, err
+	}
+
+	if size.Padded() < minSize {
+		padded, err := filclient.ZeroPadPieceCommitment(commP, size, minSize.Unpadded())
+		if err != nil {
+			return nil, err
+		}
+
+		commP = padded
+		size = minSize.Unpadded()
+	}
+
+	start := c.chain.Clock().Height() + dealStartDelay
+	return &network.Proposal{
+		DealProposal: &market.ClientDealProposal{
+			Proposal: market.DealProposal{
+				PieceCID:             commP,
+				PieceSize:            size.Padded(),
+				VerifiedDeal:         verified,
+				Client:               c.ClientAddr,
+				Provider:             maddr,
+				Label:                data.String(),
+				StartEpoch:           start,
+				EndEpoch:             start + duration,
+				StoragePricePerEpoch: big.Div(big.Mul(big.NewInt(int64(size.Padded())), price), big.NewInt(1<<30)),
+				ProviderCollateral:   big.Zero(),
+				ClientCollateral:     big.Zero(),
+			},
+			ClientSignature: crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte("simulated")},
+		},
+		Piece: &storagemarket.DataRef{
+			TransferType: storagemarket.TTGraphsync,
+			Root:         data,
+		},
+		FastRetrieval: true,
+	}, nil
+}
+
+func (c *Client) SendProposalV110(ctx context.Context, netprop network.Proposal, propCid cid.Cid) (bool, error) {
+	p, err := c.provider(netprop.DealProposal.Proposal.Provider)
+	if err != nil {
+		return false, err
+	}
+
+	if err := p.propose(*netprop.DealProposal, propCid); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (c *Client) SendProposalV120(ctx context.Context, dbid uint, netprop network.Proposal, dealUUID uuid.UUID, announce multiaddr.Multiaddr, authToken string) (bool, error) {
+	return false, fmt.Errorf("simulated providers only support %s", filclient.DealProtocolv110)
+}
+
+func (c *Client) SendProposalV120Http(ctx context.Context, dbid uint, netprop network.Proposal, dealUUID uuid.UUID, pieceURL string, authToken string) (bool, error) {
+	return false, fmt.Errorf("simulated providers only support %s", filclient.DealProtocolv110)
+}
+
+func (c *Client) PrepareForDataRequest(ctx context.Context, id uint, authToken string, proposalCid cid.Cid, payloadCid cid.Cid, size uint64) error {
+	return fmt.Errorf("simulated providers only support %s", filclient.DealProtocolv110)
+}
+
+func (c *Client) CleanupPreparedRequest(ctx context.Context, dbid uint, authToken string) error {
+	return nil
+}
+
+func (c *Client) DealStatus(ctx context.Context, maddr address.Address, propCid cid.Cid, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, error) {
+	p, err := c.provider(maddr)
+	if err != nil {
+		return nil, err
+	}
+	return p.dealState(propCid)
+}
+
+func (c *Client) StartDataTransfer(ctx context.Context, maddr address.Address, propCid cid.Cid, dataCid cid.Cid) (*datatransfer.ChannelID, error) {
+	p, err := c.provider(maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lk.Lock()
+	c.nextTransfer++
+	chid := datatransfer.ChannelID{
+		Initiator: c.peer,
+		Responder: p.PeerID,
+		ID:        c.nextTransfer,
+	}
+	c.lk.Unlock()
+
+	if err := p.pull(chid, propCid, dataCid, c.dag); err != nil {
+		return nil, err
+	}
+	return &chid, nil
+}
+
+func (c *Client) RestartTransfer(ctx context.Context, chanid *datatransfer.ChannelID) error {
+	if _, err := c.TransferStatus(ctx, chanid); err != nil {
+		return err
+	}
+	// simulated transfers do not stall, there is nothing to restart
+	return nil
+}
+
+func (c *Client) TransferStatus(ctx context.Context, chanid *datatransfer.ChannelID) (*filclient.ChannelState, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	for _, p := range c.providers {
+		if p.PeerID != chanid.Responder {
+			continue
+		}
+
+		if st, ok := p.transferState(*chanid); ok {
+			return st, nil
+		}
+	}
+	return nil, fmt.Errorf("no transfer %s", chanid)
+}
+
+func (c *Client) TransferStatusByID(ctx context.Context, id string) (*filclient.ChannelState, error) {
+	chid, err := filclient.ChannelIDFromString(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.TransferStatus(ctx, chid)
+}
+
+func (c *Client) TransferStatusForContent(ctx context.Context, content cid.Cid, maddr address.Address) (*filclient.ChannelState, error) {
+	p, err := c.provider(maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range p.transferStates() {
+		if st.BaseCid == content.String() {
+			return st, nil
+		}
+	}
+	return nil, filclient.ErrNoTransferFound
+}
+
+func (c *Client) TransfersInProgress(ctx context.Context) (map[string]*filclient.ChannelState, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	out := make(map[string]*filclient.ChannelState)
+	for _, p := range c.providers {
+		for _, st := range p.transferStates() {
+			out[st.TransferID] = st
+		}
+	}
+	return out, nil
+}
+
+func (c *Client) MinerTransferDiagnostics(ctx context.Context, maddr address.Address) (*filclient.MinerTransferDiagnostics, error) {
+	if _, err := c.provider(maddr); err != nil {
+		return nil, err
+	}
+	return &filclient.MinerTransferDiagnostics{}, nil
+}
+
+func (c *Client) CheckOngoingTransfer(ctx context.Context, maddr address.Address, st *filclient.ChannelState) error {
+	return nil
+}
+
+func (c *Client) CheckChainDeal(ctx context.Context, dealid abi.DealID) (bool, *api.MarketDeal, error) {
+	deal, err := c.chain.StateMarketStorageDeal(ctx, dealid, types.EmptyTSK)
+	if err != nil {
+		return false, nil, nil
+	}
+	return true, deal, nil
+}
+
+// Balance reports a wallet with plenty of funds in escrow
+func (c *Client) Balance(ctx context.Context) (*filclient.Balance, error) {
+	fil := types.FIL(types.MustParseFIL("1000"))
+	datacap := abi.NewStoragePower(1 << 50)
+	return &filclient.Balance{
+		Account:               c.ClientAddr,
+		Balance:               fil,
+		MarketEscrow:          fil,
+		MarketLocked:          types.FIL(big.Zero()),
+		MarketAvailable:       fil,
+		VerifiedClientBalance: &datacap,
+	}, nil
+}
+
+func (c *Client) LockMarketFunds(ctx context.Context, amt types.FIL) (*filclient.LockFundsResp, error) {
+	nd, err := cborutil.AsIpld(&market.PublishStorageDealsParams{})
+	if err != nil {
+		return nil, err
+	}
+	return &filclient.LockFundsResp{MsgCid: nd.Cid()}, nil
+}
+
+func (c *Client) RetrievalQuery(ctx context.Context, maddr address.Address, pcid cid.Cid) (*retrievalmarket.QueryResponse, error) {
+	if _, err := c.provider(maddr); err != nil {
+		return nil, err
+	}
+
+	return &retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseUnavailable,
+		PieceCIDFound:   retrievalmarket.QueryItemUnavailable,
+		MinPricePerByte: big.Zero(),
+		UnsealPrice:     big.Zero(),
+		Message:         "simulated providers do not serve retrievals",
+	}, nil
+}
+
+func (c *Client) RetrieveContent(ctx context.Context, maddr address.Address, proposal *retrievalmarket.DealProposal) (*filclient.RetrievalStats, error) {
+	return nil, fmt.Errorf("simulated providers do not serve retrievals")
+}
@@ -0,0 +1,45 @@
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// Clock is the time of the simulated chain. Epochs pass every epoch
+// duration, and can be skipped ahead with Advance.
+type Clock struct {
+	lk       sync.Mutex
+	start    time.Time
+	base     abi.ChainEpoch
+	epoch    time.Duration
+	advanced abi.ChainEpoch
+}
+
+func NewClock(base abi.ChainEpoch, epoch time.Duration) *Clock {
+	return &Clock{
+		start: time.Now(),
+		base:  base,
+		epoch: epoch,
+	}
+}
+
+// Height returns the current epoch
+func (c *Clock) Height() abi.ChainEpoch {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	h := c.base + c.advanced
+	if c.epoch > 0 {
+		h += abi.ChainEpoch(time.Since(c.start) / c.epoch)
+	}
+	return h
+}
+
+// Advance moves the clock n epochs forward
+func (c *Clock) Advance(n abi.ChainEpoch) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.advanced += n
+}
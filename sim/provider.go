@@ -0,0 +1,325 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ProviderConfig is how a simulated provider behaves
+type ProviderConfig struct {
+	Price         abi.TokenAmount
+	VerifiedPrice abi.TokenAmount
+	MinPieceSize  abi.PaddedPieceSize
+	MaxPieceSize  abi.PaddedPieceSize
+	// Throughput is how many bytes the provider pulls per epoch
+	Throughput int64
+	// PublishDelay is how many epochs after receiving the data the provider
+	// publishes a deal
+	PublishDelay abi.ChainEpoch
+	// SealDelay is how many epochs after publishing a deal its sector is
+	// proven
+	SealDelay abi.ChainEpoch
+	// RejectRate is the fraction of proposals the provider rejects
+	RejectRate float64
+}
+
+type simTransfer struct {
+	id      datatransfer.ChannelID
+	started abi.ChainEpoch
+	// size and done are set once the provider pulled all the data, done is
+	// the epoch the transfer finishes at given the provider throughput
+	pulled bool
+	size   uint64
+	done   abi.ChainEpoch
+	err    error
+}
+
+type simDeal struct {
+	propCid    cid.Cid
+	proposal   market.ClientDealProposal
+	transfer   *simTransfer
+	publishCid *cid.Cid
+	dealID     abi.DealID
+}
+
+// Provider is a simulated storage provider. It keeps no data, it only walks
+// the dag of a deal to know how long pulling it takes.
+type Provider struct {
+	Address address.Address
+	Owner   address.Address
+	Worker  address.Address
+	PeerID  peer.ID
+
+	cfg   ProviderConfig
+	chain *Chain
+	clock *Clock
+
+	lk    sync.Mutex
+	rng   *rand.Rand
+	deals map[cid.Cid]*simDeal
+}
+
+func NewProvider(chain *Chain, maddr, worker address.Address, pid peer.ID, cfg ProviderConfig) *Provider {
+	seed, _ := address.IDFromAddress(maddr)
+	p := &Provider{
+		Address: maddr,
+		Owner:   worker,
+		Worker:  worker,
+		PeerID:  pid,
+		cfg:     cfg,
+		chain:   chain,
+		clock:   chain.Clock(),
+		rng:     rand.New(rand.NewSource(int64(seed))),
+		deals:   make(map[cid.Cid]*simDeal),
+	}
+	chain.addMiner(p)
+	return p
+}
+
+func (p *Provider) ask() *storagemarket.StorageAsk {
+	h := p.clock.Height()
+	return &storagemarket.StorageAsk{
+		Price:         p.cfg.Price,
+		VerifiedPrice: p.cfg.VerifiedPrice,
+		MinPieceSize:  p.cfg.MinPieceSize,
+		MaxPieceSize:  p.cfg.MaxPieceSize,
+		Miner:         p.Address,
+		Timestamp:     h,
+		Expiry:        h + 2880,
+	}
+}
+
+// propose accepts or rejects a deal proposal the way a provider would
+func (p *Provider) propose(prop market.ClientDealProposal, propCid cid.Cid) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if _, ok := p.deals[propCid]; ok {
+		return nil
+	}
+
+	dp := prop.Proposal
+	if dp.Provider != p.Address {
+		return fmt.Errorf("proposal is for provider %s, not %s", dp.Provider, p.Address)
+	}
+
+	if dp.PieceSize < p.cfg.MinPieceSize || dp.PieceSize > p.cfg.MaxPieceSize {
+		return fmt.Errorf("piece size %d outside of the range %d-%d accepted", dp.PieceSize, p.cfg.MinPieceSize, p.cfg.MaxPieceSize)
+	}
+
+	price := p.cfg.Price
+	if dp.VerifiedDeal {
+		price = p.cfg.VerifiedPrice
+	}
+	minPrice := big.Div(big.Mul(big.NewInt(int64(dp.PieceSize)), price), big.NewInt(1<<30))
+	if dp.StoragePricePerEpoch.LessThan(minPrice) {
+		return fmt.Errorf("storage price per epoch %s is less than %s", dp.StoragePricePerEpoch, minPrice)
+	}
+
+	if dp.StartEpoch <= p.clock.Height()+p.cfg.PublishDelay {
+		return fmt.Errorf("deal start epoch %d is too soon", dp.StartEpoch)
+	}
+
+	if p.rng.Float64() < p.cfg.RejectRate {
+		return fmt.Errorf("deal rejected by simulated provider")
+	}
+
+	p.deals[propCid] = &simDeal{
+		propCid:  propCid,
+		proposal: prop,
+	}
+	return nil
+}
+
+// pull starts fetching the data of a deal through dag
+func (p *Provider) pull(id datatransfer.ChannelID, propCid cid.Cid, root cid.Cid, dag ipld.NodeGetter) error {
+	p.lk.Lock()
+	d, ok := p.deals[propCid]
+	if !ok {
+		p.lk.Unlock()
+		return fmt.Errorf("no deal with proposal %s", propCid)
+	}
+
+	t := &simTransfer{
+		id:      id,
+		started: p.clock.Height(),
+	}
+	d.transfer = t
+	p.lk.Unlock()
+
+	go func() {
+		var size uint64
+		var lk sync.Mutex
+		err := merkledag.Walk(context.Background(), func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+			nd, err := dag.Get(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+
+			lk.Lock()
+			size += uint64(len(nd.RawData()))
+			lk.Unlock()
+
+			if c.Type() == cid.Raw {
+				return nil, nil
+			}
+			return nd.Links(), nil
+		}, root, cid.NewSet().Visit, merkledag.Concurrent())
+
+		p.lk.Lock()
+		defer p.lk.Unlock()
+
+		if err != nil {
+			t.err = err
+			return
+		}
+
+		epochs := abi.ChainEpoch(0)
+		if p.cfg.Throughput > 0 {
+			epochs = abi.ChainEpoch((int64(size) + p.cfg.Throughput - 1) / p.cfg.Throughput)
+		}
+
+		t.pulled = true
+		t.size = size
+		t.done = t.started + epochs
+	}()
+	return nil
+}
+
+// progress publishes the deal once it is due
+func (p *Provider) progress(d *simDeal) error {
+	t := d.transfer
+	if t == nil || !t.pulled || d.publishCid != nil {
+		return nil
+	}
+
+	if p.clock.Height() < t.done+p.cfg.PublishDelay {
+		return nil
+	}
+
+	mcid, ids, err := p.chain.publish(p.Worker, []market.ClientDealProposal{d.proposal}, p.cfg.SealDelay)
+	if err != nil {
+		return err
+	}
+
+	d.publishCid = &mcid
+	d.dealID = ids[0]
+	return nil
+}
+
+func (p *Provider) dealState(propCid cid.Cid) (*storagemarket.ProviderDealState, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	d, ok := p.deals[propCid]
+	if !ok {
+		return nil, fmt.Errorf("no deal with proposal %s", propCid)
+	}
+
+	if err := p.progress(d); err != nil {
+		return nil, err
+	}
+
+	pc := d.propCid
+	st := &storagemarket.ProviderDealState{
+		State:         storagemarket.StorageDealWaitingForData,
+		Proposal:      &d.proposal.Proposal,
+		ProposalCid:   &pc,
+		PublishCid:    d.publishCid,
+		FastRetrieval: true,
+	}
+
+	t := d.transfer
+	switch {
+	case t == nil:
+	case t.err != nil:
+		st.State = storagemarket.StorageDealFailing
+		st.Message = fmt.Sprintf("failed to pull data: %s", t.err)
+	case !t.pulled || p.clock.Height() < t.done:
+		st.State = storagemarket.StorageDealTransferring
+	case d.publishCid == nil:
+		st.State = storagemarket.StorageDealPublishing
+	default:
+		// the deal ID is left for the client to find from the publish
+		// message, like with providers that don't report it
+		md, err := p.chain.StateMarketStorageDeal(context.Background(), d.dealID, types.EmptyTSK)
+		if err != nil {
+			return nil, err
+		}
+
+		st.State = storagemarket.StorageDealSealing
+		if md.State.SectorStartEpoch > 0 {
+			st.State = storagemarket.StorageDealActive
+		}
+	}
+	return st, nil
+}
+
+func (p *Provider) transferState(id datatransfer.ChannelID) (*filclient.ChannelState, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	for _, d := range p.deals {
+		if d.transfer != nil && d.transfer.id == id {
+			return p.channelState(d), true
+		}
+	}
+	return nil, false
+}
+
+// transferStates returns the state of every transfer the provider has
+// started
+func (p *Provider) transferStates() []*filclient.ChannelState {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	var out []*filclient.ChannelState
+	for _, d := range p.deals {
+		if d.transfer != nil {
+			out = append(out, p.channelState(d))
+		}
+	}
+	return out
+}
+
+func (p *Provider) channelState(d *simDeal) *filclient.ChannelState {
+	t := d.transfer
+	st := &filclient.ChannelState{
+		SelfPeer:   t.id.Initiator,
+		RemotePeer: t.id.Responder,
+		Status:     datatransfer.Ongoing,
+		BaseCid:    d.proposal.Proposal.Label,
+		ChannelID:  t.id,
+		TransferID: t.id.String(),
+	}
+
+	h := p.clock.Height()
+	switch {
+	case t.err != nil:
+		st.Status = datatransfer.Failed
+		st.Message = t.err.Error()
+	case !t.pulled:
+	case h >= t.done:
+		st.Status = datatransfer.Completed
+		st.Sent = t.size
+	default:
+		st.Sent = t.size * uint64(h-t.started) / uint64(t.done-t.started)
+	}
+	st.StatusStr = datatransfer.Statuses[st.Status]
+	return st
+}
@@ -0,0 +1,143 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForState(t *testing.T, c *Client, prop *market.ClientDealProposal, propCid cid.Cid, want storagemarket.StorageDealStatus) *storagemarket.ProviderDealState {
+	for i := 0; i < 1000; i++ {
+		st, err := c.DealStatus(context.Background(), prop.Proposal.Provider, propCid, nil)
+		require.NoError(t, err)
+		if st.State == want {
+			return st
+		}
+		// give the provider a moment to walk the dag before moving on
+		time.Sleep(time.Millisecond)
+		c.chain.Clock().Advance(1)
+	}
+	t.Fatalf("deal never reached state %s", storagemarket.DealStates[want])
+	return nil
+}
+
+func TestDealLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	nd := merkledag.NewRawNode(bytes.Repeat([]byte("estuary"), 100))
+	require.NoError(t, bs.Put(ctx, nd))
+
+	chain, c, err := New(config.Simulation{
+		Providers:    2,
+		Throughput:   128,
+		PublishDelay: 3,
+		SealDelay:    10,
+	}, bs)
+	require.NoError(t, err)
+
+	c.SetPieceCommFunc(func(ctx context.Context, data cid.Cid, bs blockstore.Blockstore) (cid.Cid, uint64, abi.UnpaddedPieceSize, error) {
+		return data, 700, abi.PaddedPieceSize(1024).Unpadded(), nil
+	})
+
+	providers := c.Providers()
+	require.Len(t, providers, 2)
+	maddr := providers[0]
+
+	ask, err := c.GetAsk(ctx, maddr)
+	require.NoError(t, err)
+
+	prop, err := c.MakeDeal(ctx, maddr, nd.Cid(), ask.Ask.Ask.Price, ask.Ask.Ask.MinPieceSize, 2880*365, false)
+	require.NoError(t, err)
+
+	pnd, err := cborutil.AsIpld(prop.DealProposal)
+	require.NoError(t, err)
+	propCid := pnd.Cid()
+
+	ok, err := c.SendProposalV110(ctx, *prop, propCid)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	chid, err := c.StartDataTransfer(ctx, maddr, propCid, nd.Cid())
+	require.NoError(t, err)
+
+	waitForState(t, c, prop.DealProposal, propCid, storagemarket.StorageDealPublishing)
+
+	tst, err := c.TransferStatus(ctx, chid)
+	require.NoError(t, err)
+	assert.Equal(t, datatransfer.Completed, tst.Status)
+	assert.Equal(t, uint64(len(nd.RawData())), tst.Sent)
+
+	st := waitForState(t, c, prop.DealProposal, propCid, storagemarket.StorageDealSealing)
+	require.NotNil(t, st.PublishCid)
+
+	// find the deal ID from the publish message, like the content manager
+	lookup, err := chain.StateSearchMsg(ctx, types.EmptyTSK, *st.PublishCid, 1000, false)
+	require.NoError(t, err)
+	require.NotNil(t, lookup)
+
+	msg, err := chain.ChainGetMessage(ctx, lookup.Message)
+	require.NoError(t, err)
+
+	var params market.PublishStorageDealsParams
+	require.NoError(t, params.UnmarshalCBOR(bytes.NewReader(msg.Params)))
+	require.Len(t, params.Deals, 1)
+
+	var ret market.PublishStorageDealsReturn
+	require.NoError(t, ret.UnmarshalCBOR(bytes.NewReader(lookup.Receipt.Return)))
+	require.Len(t, ret.IDs, 1)
+
+	onChain, deal, err := c.CheckChainDeal(ctx, ret.IDs[0])
+	require.NoError(t, err)
+	assert.True(t, onChain)
+	assert.Equal(t, abi.ChainEpoch(-1), deal.State.SectorStartEpoch)
+
+	waitForState(t, c, prop.DealProposal, propCid, storagemarket.StorageDealActive)
+
+	_, deal, err = c.CheckChainDeal(ctx, ret.IDs[0])
+	require.NoError(t, err)
+	assert.Greater(t, int64(deal.State.SectorStartEpoch), int64(0))
+}
+
+func TestProposalRejected(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	_, c, err := New(config.Simulation{Providers: 1, RejectRate: 1}, bs)
+	require.NoError(t, err)
+
+	c.SetPieceCommFunc(func(ctx context.Context, data cid.Cid, bs blockstore.Blockstore) (cid.Cid, uint64, abi.UnpaddedPieceSize, error) {
+		return data, 700, abi.PaddedPieceSize(1024).Unpadded(), nil
+	})
+
+	maddr := c.Providers()[0]
+	nd := merkledag.NewRawNode([]byte("rejected"))
+
+	ask, err := c.GetAsk(ctx, maddr)
+	require.NoError(t, err)
+
+	prop, err := c.MakeDeal(ctx, maddr, nd.Cid(), ask.Ask.Ask.Price, ask.Ask.Ask.MinPieceSize, 2880*365, false)
+	require.NoError(t, err)
+
+	pnd, err := cborutil.AsIpld(prop.DealProposal)
+	require.NoError(t, err)
+
+	_, err = c.SendProposalV110(ctx, *prop, pnd.Cid())
+	assert.Error(t, err)
+}
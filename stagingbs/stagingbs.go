@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -52,6 +53,74 @@ func (sbmgr *StagingBSMgr) AllocNew() (BSID, blockstore.Blockstore, error) {
 	return BSID(dir), bstore, nil
 }
 
+// AllocUpload allocates a staging area for a resumable upload. The
+// blockstore is not opened until the upload is complete (see Open), until then
+// the raw upload data is appended to the file at UploadPath.
+func (sbmgr *StagingBSMgr) AllocUpload() (BSID, error) {
+	dir, err := ioutil.TempDir(sbmgr.RootDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	return BSID(dir), nil
+}
+
+// UploadPath returns the file partial upload data is stored in
+func (sbmgr *StagingBSMgr) UploadPath(bsid BSID) (string, error) {
+	if err := sbmgr.checkManaged(bsid); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(string(bsid), "upload.data"), nil
+}
+
+// CarPath returns the file a CAR being imported into the staging area can be
+// written to when it is read in place instead of loaded into the blockstore
+func (sbmgr *StagingBSMgr) CarPath(bsid BSID) (string, error) {
+	if err := sbmgr.checkManaged(bsid); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(string(bsid), "import.car"), nil
+}
+
+// Open returns the blockstore of a previously allocated staging area, opening
+// it if needed. This lets staging areas outlive the process that created them.
+func (sbmgr *StagingBSMgr) Open(bsid BSID) (blockstore.Blockstore, error) {
+	if err := sbmgr.checkManaged(bsid); err != nil {
+		return nil, err
+	}
+
+	sbmgr.olk.Lock()
+	defer sbmgr.olk.Unlock()
+
+	if bs, ok := sbmgr.open[bsid]; ok {
+		return bs, nil
+	}
+
+	bstore, err := lmdb.Open(&lmdb.Options{
+		Path:   string(bsid),
+		NoSync: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sbmgr.open[bsid] = bstore
+	return bstore, nil
+}
+
+func (sbmgr *StagingBSMgr) checkManaged(bsid BSID) error {
+	if bsid == "" {
+		return fmt.Errorf("empty BSID")
+	}
+
+	if !strings.HasPrefix(string(bsid), sbmgr.RootDir) {
+		return fmt.Errorf("given bsid not managed by this instance")
+	}
+	return nil
+}
+
 func (sbmgr *StagingBSMgr) CleanUp(bsid BSID) error {
 	if bsid == "" {
 		return fmt.Errorf("refusing to cleanup empty BSID")
@@ -63,6 +132,7 @@ func (sbmgr *StagingBSMgr) CleanUp(bsid BSID) error {
 
 	sbmgr.olk.Lock()
 	bs, ok := sbmgr.open[bsid]
+	delete(sbmgr.open, bsid)
 	sbmgr.olk.Unlock()
 	if ok {
 		bs.Close()
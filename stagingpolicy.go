@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// stagingPolicyOverride changes the global staging zone policy for the
+// content of a user
+type stagingPolicyOverride struct {
+	gorm.Model
+	UserID uint `gorm:"uniqueIndex"`
+	// Policy is the json encoded config.StagingPolicy
+	Policy string
+}
+
+func (spo *stagingPolicyOverride) spec() (config.StagingPolicy, error) {
+	var spec config.StagingPolicy
+	if err := json.Unmarshal([]byte(spo.Policy), &spec); err != nil {
+		return spec, fmt.Errorf("invalid staging policy override %d: %w", spo.ID, err)
+	}
+	return spec, nil
+}
+
+// stagingPolicyFor returns the staging zone policy in effect for the content
+// of a user: the global policy with the override of the user applied
+func (cm *ContentManager) stagingPolicyFor(user uint) (config.StagingPolicy, error) {
+	pol := cm.StagingPolicy
+
+	ov, err := getStagingPolicyOverride(cm.DB, user)
+	if err != nil {
+		return config.StagingPolicy{}, err
+	}
+	return pol.Merge(ov).Resolve(), nil
+}
+
+func getStagingPolicyOverride(db *gorm.DB, user uint) (config.StagingPolicy, error) {
+	var ovs []stagingPolicyOverride
+	if err := db.Where("user_id = ?", user).Limit(1).Find(&ovs).Error; err != nil {
+		return config.StagingPolicy{}, err
+	}
+
+	if len(ovs) == 0 {
+		return config.StagingPolicy{}, nil
+	}
+	return ovs[0].spec()
+}
+
+// setStagingPolicyOverride stores the override of the user, a zero policy
+// removes it
+func (s *Server) setStagingPolicyOverride(user uint, spec config.StagingPolicy) error {
+	if err := spec.Validate(); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	// the override has to make sense on top of the global policy too, e.g. a
+	// max size alone could end up below the global min size
+	if err := s.CM.StagingPolicy.Merge(spec).Resolve().Validate(); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user).Delete(&stagingPolicyOverride{}).Error; err != nil {
+			return err
+		}
+
+		if spec.IsZero() {
+			return nil
+		}
+
+		b, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&stagingPolicyOverride{
+			UserID: user,
+			Policy: string(b),
+		}).Error
+	})
+}
+
+// handleAdminGetUserStagingPolicy godoc
+// @Summary      Get the staging zone policy of a user
+// @Description  This endpoint returns the staging zone policy override of a user. An empty policy means the global policy is used.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int  true  "User ID"
+// @Success      200     {object}  config.StagingPolicy
+// @Router       /admin/users/{userid}/staging-policy [get]
+func (s *Server) handleAdminGetUserStagingPolicy(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	spec, err := getStagingPolicyOverride(s.DB, user.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
+
+// handleAdminSetUserStagingPolicy godoc
+// @Summary      Set the staging zone policy of a user
+// @Description  This endpoint overrides fields of the global staging zone policy for the content of a user, e.g. to aggregate into bigger pieces or not at all. An empty policy removes the override.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int                   true  "User ID"
+// @Param        body    body      config.StagingPolicy  true  "Staging zone policy"
+// @Success      200     {object}  config.StagingPolicy
+// @Router       /admin/users/{userid}/staging-policy [put]
+func (s *Server) handleAdminSetUserStagingPolicy(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	var spec config.StagingPolicy
+	if err := c.Bind(&spec); err != nil {
+		return err
+	}
+
+	if err := s.setStagingPolicyOverride(user.ID, spec); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, spec)
+}
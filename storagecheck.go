@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// storageStatus is what ensureStorage does next for a content
+type storageStatus string
+
+const (
+	storageAggregated      storageStatus = "aggregated"
+	storageSplitRoot       storageStatus = "split-root"
+	storageShuttleOffline  storageStatus = "shuttle-offline"
+	storageStaged          storageStatus = "in-staging-zone"
+	storageNeedsSplit      storageStatus = "needs-split"
+	storageNeedsStaging    storageStatus = "needs-staging"
+	storageWaitingForCommP storageStatus = "waiting-for-commp"
+	storageOffloaded       storageStatus = "offloaded"
+	storageDealsDisabled   storageStatus = "deal-making-disabled"
+	storageWalletsPaused   storageStatus = "wallets-paused"
+	storageDatacapTooLow   storageStatus = "datacap-too-low"
+	storageNeedsDeals      storageStatus = "needs-deals"
+	storageReplicated      storageStatus = "replicated"
+)
+
+// storageCheck is where a content stands on the way to being stored with
+// enough deals
+type storageCheck struct {
+	Status      storageStatus `json:"status"`
+	Explanation string        `json:"explanation"`
+
+	Replication     int  `json:"replication"`
+	Verified        bool `json:"verified"`
+	DealsSealed     int  `json:"dealsSealed"`
+	DealsPublished  int  `json:"dealsPublished"`
+	DealsInProgress int  `json:"dealsInProgress"`
+
+	deals         []contentDeal
+	minersAlready map[address.Address]bool
+}
+
+func (sc *storageCheck) goodDeals() int {
+	return sc.DealsSealed + sc.DealsPublished + sc.DealsInProgress
+}
+
+// dealCounts are the deals of a content by how far along they are
+type dealCounts struct {
+	sealed, published, inProgress int
+}
+
+// dealCounter sorts the live deals of a content. ensureStorage checks each
+// of them against the chain and the miner, diagnoses only look at what is
+// recorded.
+type dealCounter func(ctx context.Context, deals []contentDeal) (dealCounts, error)
+
+// checkStorage evaluates what needs to happen for content to be stored,
+// without acting on it. ensureStorage acts on the result, and the same result
+// explains to users why their content is not stored yet.
+func (cm *ContentManager) checkStorage(ctx context.Context, content Content, count dealCounter) (*storageCheck, error) {
+	sc := &storageCheck{
+		Verified:    cm.VerifiedDeal,
+		Replication: cm.Replication,
+	}
+	if content.Replication > 0 {
+		sc.Replication = content.Replication
+	}
+
+	set := func(st storageStatus, format string, args ...interface{}) (*storageCheck, error) {
+		sc.Status = st
+		sc.Explanation = fmt.Sprintf(format, args...)
+		return sc, nil
+	}
+
+	if content.AggregatedIn > 0 {
+		return set(storageAggregated, "content is aggregated in content %d, which gets the deals", content.AggregatedIn)
+	}
+
+	if content.DagSplit && content.SplitFrom == 0 {
+		return set(storageSplitRoot, "content was split into smaller contents, which get the deals")
+	}
+
+	if content.Location != util.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
+		return set(storageShuttleOffline, "content is on shuttle %s, which is offline", content.Location)
+	}
+
+	if cm.contentInStagingZone(ctx, content) {
+		return set(storageStaged, "content is waiting in a staging zone to be aggregated with other content")
+	}
+
+	if content.Size > cm.contentSizeLimit {
+		var u User
+		if err := cm.DB.First(&u, "id = ?", content.UserID).Error; err != nil {
+			return nil, err
+		}
+
+		if !u.FlagSplitContent() {
+			return set(storageNeedsSplit, "content is over the size limit of %d bytes and splitting is not enabled for its user", cm.contentSizeLimit)
+		}
+		return set(storageNeedsSplit, "content is over the size limit of %d bytes and gets split into smaller contents", cm.contentSizeLimit)
+	}
+
+	if err := cm.DB.Find(&sc.deals, "content = ? AND NOT failed", content.ID).Error; err != nil {
+		if !xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	var user User
+	if err := cm.DB.First(&user, "id = ?", content.UserID).Error; err != nil {
+		return nil, err
+	}
+
+	stagingPolicy, err := cm.stagingPolicyFor(content.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sc.deals) == 0 &&
+		stagingPolicy.Aggregates(content.Size) &&
+		!content.Aggregate {
+		return set(storageNeedsStaging, "content is smaller than %d bytes and gets aggregated with other content", stagingPolicy.IndividualDealThreshold)
+	}
+
+	sc.minersAlready = make(map[address.Address]bool)
+	for _, d := range sc.deals {
+		if d.Failed {
+			// TODO: this is an interesting choice, because it gives miners more chances to try again if they fail.
+			// I think that as we get a more diverse set of stable miners, we can *not* do this.
+			continue
+		}
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			return nil, err
+		}
+		sc.minersAlready[maddr] = true
+	}
+
+	counts, err := count(ctx, sc.deals)
+	if err != nil {
+		return nil, err
+	}
+	sc.DealsSealed = counts.sealed
+	sc.DealsPublished = counts.published
+	sc.DealsInProgress = counts.inProgress
+
+	if sc.goodDeals() >= sc.Replication {
+		return set(storageReplicated, "content has %d of the %d deals it needs", sc.goodDeals(), sc.Replication)
+	}
+
+	pc, err := cm.lookupPieceCommRecord(content.Cid.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc == nil {
+		return set(storageWaitingForCommP, "the piece commitment of the content is being computed")
+	}
+
+	if content.Offloaded {
+		return set(storageOffloaded, "content was offloaded and is retrieved again before making deals")
+	}
+
+	if cm.dealMakingDisabled() {
+		return set(storageDealsDisabled, "deal making is disabled on this node")
+	}
+
+	if len(cm.Wallets.usable()) == 0 {
+		return set(storageWalletsPaused, "deal making is paused for every wallet until they are funded again")
+	}
+
+	// only verified deals need datacap checks, a deal is made from a single
+	// wallet so one of them has to have enough for the content
+	if sc.Verified {
+		largest, _, err := cm.Wallets.datacap(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("could not retrieve dataCap from client balance: %w", err)
+		}
+
+		size := abi.UnpaddedPieceSize(content.Size).Padded()
+		if largest.LessThan(big.NewIntUnsigned(uint64(size))) {
+			return set(storageDatacapTooLow, "the most dataCap a client address has:%d GiB is lower than content size:%d GiB", big.Div(largest, big.NewIntUnsigned(uint64(1073741824))), size/1073741824)
+		}
+	}
+
+	return set(storageNeedsDeals, "content has %d of the %d deals it needs, more deals are being made", sc.goodDeals(), sc.Replication)
+}
+
+// countRecordedDeals sorts deals by what was last recorded of them
+func countRecordedDeals(ctx context.Context, deals []contentDeal) (dealCounts, error) {
+	var counts dealCounts
+	for _, d := range deals {
+		switch {
+		case !d.SealedAt.IsZero():
+			counts.sealed++
+		case d.DealID != 0:
+			counts.published++
+		default:
+			counts.inProgress++
+		}
+	}
+	return counts, nil
+}
+
+type contentDiagnosis struct {
+	Content uint              `json:"content"`
+	State   util.ContentState `json:"state"`
+	Storage *storageCheck     `json:"storage"`
+
+	// NextCheck is when ensureStorage runs next for the content, nil when no
+	// check is scheduled
+	NextCheck      *time.Time  `json:"nextCheck"`
+	CheckPaused    bool        `json:"checkPaused"`
+	LastCheckError string      `json:"lastCheckError,omitempty"`
+	RecentFailures []dfeRecord `json:"recentFailures"`
+}
+
+// handleDiagnoseContent godoc
+// @Summary      Explain why a content is not stored yet
+// @Description  This endpoint evaluates the conditions deal making checks for a content and explains which one applies, along with the next scheduled check and the recent deal failures of the content.
+// @Tags         content
+// @Produce      json
+// @Param        content  path      int  true  "Content ID"
+// @Success      200      {object}  contentDiagnosis
+// @Router       /content/diagnose/{content} [get]
+func (s *Server) handleDiagnoseContent(c echo.Context, u *User) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", c.Param("content")),
+		}
+	}
+
+	content, err := s.CM.getContent(uint(contID))
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if err := s.isContentOwner(u, *content, util.OrgRoleViewer); err != nil {
+		return err
+	}
+
+	sc, err := s.CM.checkStorage(c.Request().Context(), *content, countRecordedDeals)
+	if err != nil {
+		return err
+	}
+
+	diag := &contentDiagnosis{
+		Content: content.ID,
+		State:   content.State,
+		Storage: sc,
+	}
+
+	var jobs []contentCheckJob
+	if err := s.DB.Where("content = ?", content.ID).Limit(1).Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	if len(jobs) > 0 {
+		j := jobs[0]
+		if j.Scheduled {
+			next := j.NextCheck
+			diag.NextCheck = &next
+		}
+		diag.CheckPaused = j.Paused
+		diag.LastCheckError = j.LastError
+	}
+
+	if err := s.DB.Order("created_at desc").Limit(10).Find(&diag.RecentFailures, "content = ?", content.ID).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, diag)
+}
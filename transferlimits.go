@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util/bandwidth"
+	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// transferLimiter keeps the deals made with a miner within the concurrent
+// transfer and daily proposal limits
+type transferLimiter struct {
+	cfg config.TransferLimits
+	db  *gorm.DB
+
+	lk sync.Mutex
+	// pending counts the proposals being made to a miner, from when the limits
+	// are checked until the deals are in the database
+	pending map[address.Address]int
+	// released counts the reservations given back for a miner, a reservation
+	// made from counts taken before one was given back is retried
+	released map[address.Address]uint64
+}
+
+func newTransferLimiter(db *gorm.DB, cfg config.TransferLimits) *transferLimiter {
+	return &transferLimiter{
+		cfg:      cfg,
+		db:       db,
+		pending:  make(map[address.Address]int),
+		released: make(map[address.Address]uint64),
+	}
+}
+
+// errTransferLimit is returned for deals with a miner at one of its limits,
+// they are made later instead
+var errTransferLimit = errors.New("miner is at its transfer limits")
+
+type minerTransferUsage struct {
+	Miner              string `json:"miner"`
+	ActiveTransfers    int64  `json:"activeTransfers"`
+	MaxConcurrent      int    `json:"maxConcurrent"`
+	ProposalsLastDay   int64  `json:"proposalsLastDay"`
+	MaxProposalsPerDay int    `json:"maxProposalsPerDay"`
+	Pending            int    `json:"pending"`
+}
+
+func (tl *transferLimiter) enabled() bool {
+	return tl.cfg.MaxConcurrentPerMiner > 0 || tl.cfg.MaxProposalsPerMinerPerDay > 0
+}
+
+// reserve takes a slot for a deal with a miner, the returned function gives it
+// back and must be called once the deal is in the database or was given up on
+func (tl *transferLimiter) reserve(miner address.Address) (func(), error) {
+	if !tl.enabled() {
+		return func() {}, nil
+	}
+
+	// the counts are taken without the lock held, if a deal made it to the
+	// database and gave its reservation back in the meantime they are
+	// taken again so that it is not missed
+	var usage map[address.Address]*minerTransferUsage
+	for {
+		tl.lk.Lock()
+		gen := tl.released[miner]
+		tl.lk.Unlock()
+
+		var err error
+		usage, err = tl.usage(miner)
+		if err != nil {
+			return nil, err
+		}
+
+		tl.lk.Lock()
+		if tl.released[miner] == gen {
+			break
+		}
+		tl.lk.Unlock()
+	}
+	defer tl.lk.Unlock()
+
+	inflight := int64(tl.pending[miner])
+	if tl.cfg.MaxConcurrentPerMiner > 0 && usage[miner].ActiveTransfers+inflight >= int64(tl.cfg.MaxConcurrentPerMiner) {
+		return nil, fmt.Errorf("%w: %d transfers in progress, the limit is %d", errTransferLimit, usage[miner].ActiveTransfers+inflight, tl.cfg.MaxConcurrentPerMiner)
+	}
+
+	if tl.cfg.MaxProposalsPerMinerPerDay > 0 && usage[miner].ProposalsLastDay+inflight >= int64(tl.cfg.MaxProposalsPerMinerPerDay) {
+		return nil, fmt.Errorf("%w: %d deals proposed in the last day, the limit is %d", errTransferLimit, usage[miner].ProposalsLastDay+inflight, tl.cfg.MaxProposalsPerMinerPerDay)
+	}
+
+	tl.pending[miner]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tl.lk.Lock()
+			defer tl.lk.Unlock()
+			if tl.pending[miner]--; tl.pending[miner] <= 0 {
+				delete(tl.pending, miner)
+			}
+			tl.released[miner]++
+		})
+	}, nil
+}
+
+// usage counts the transfers in progress and the deals proposed in the last
+// day of a miner, or of every miner with any when miner is undefined
+func (tl *transferLimiter) usage(miner address.Address) (map[address.Address]*minerTransferUsage, error) {
+	out := make(map[address.Address]*minerTransferUsage)
+	get := func(m string) *minerTransferUsage {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return nil
+		}
+
+		u, ok := out[maddr]
+		if !ok {
+			u = &minerTransferUsage{
+				Miner:              m,
+				MaxConcurrent:      tl.cfg.MaxConcurrentPerMiner,
+				MaxProposalsPerDay: tl.cfg.MaxProposalsPerMinerPerDay,
+			}
+			out[maddr] = u
+		}
+		return u
+	}
+
+	if miner != address.Undef {
+		get(miner.String())
+	}
+
+	// the transfer of a deal is in progress from when it starts until it
+	// finishes or the deal is on chain or failed
+	var active []contentDeal
+	q := tl.db.Model(contentDeal{}).Select("miner, transfer_started, transfer_finished").Where("not failed and deal_id = 0")
+	if miner != address.Undef {
+		q = q.Where("miner = ?", miner.String())
+	}
+	if err := q.Scan(&active).Error; err != nil {
+		return nil, err
+	}
+
+	for _, d := range active {
+		if d.TransferStarted.IsZero() || !d.TransferFinished.IsZero() {
+			continue
+		}
+
+		if u := get(d.Miner); u != nil {
+			u.ActiveTransfers++
+		}
+	}
+
+	// proposals that failed to be sent are deleted, they count all the same
+	var proposals []struct {
+		Miner string
+		Count int64
+	}
+	q = tl.db.Unscoped().Model(contentDeal{}).Select("miner, count(*) as count").Where("created_at > ?", time.Now().Add(-time.Hour*24)).Group("miner")
+	if miner != address.Undef {
+		q = q.Where("miner = ?", miner.String())
+	}
+	if err := q.Scan(&proposals).Error; err != nil {
+		return nil, err
+	}
+
+	for _, p := range proposals {
+		if u := get(p.Miner); u != nil {
+			u.ProposalsLastDay = p.Count
+		}
+	}
+	return out, nil
+}
+
+type shuttleBandwidthUsage struct {
+	Handle string `json:"handle"`
+	bandwidth.Usage
+}
+
+type transferLimitsUsage struct {
+	Limits    config.TransferLimits    `json:"limits"`
+	Miners    []*minerTransferUsage    `json:"miners"`
+	Bandwidth bandwidth.Usage          `json:"bandwidth"`
+	Shuttles  []*shuttleBandwidthUsage `json:"shuttles"`
+}
+
+// handleAdminGetTransferLimits godoc
+// @Summary      Transfer limits usage
+// @Description  This endpoint returns the transfer limits along with the transfers in progress and the deals proposed in the last day of every miner with any, and the bandwidth used by the transfers of this node and of every shuttle against their caps. Deals with miners at their limits are deferred.
+// @Tags         admin
+// @Produce      json
+// @Param        miner query string false "Only return the usage of this miner"
+// @Router       /admin/cm/transfer-limits [get]
+func (s *Server) handleAdminGetTransferLimits(c echo.Context) error {
+	miner := address.Undef
+	if m := c.QueryParam("miner"); m != "" {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return err
+		}
+		miner = maddr
+	}
+
+	tl := s.CM.transferLimits
+	usage, err := tl.usage(miner)
+	if err != nil {
+		return err
+	}
+
+	tl.lk.Lock()
+	for maddr, u := range usage {
+		u.Pending = tl.pending[maddr]
+	}
+	tl.lk.Unlock()
+
+	out := &transferLimitsUsage{
+		Limits:    tl.cfg,
+		Miners:    make([]*minerTransferUsage, 0, len(usage)),
+		Bandwidth: s.CM.bandwidth.Usage(),
+		Shuttles:  s.CM.shuttleBandwidthUsage(),
+	}
+	for _, u := range usage {
+		out.Miners = append(out.Miners, u)
+	}
+	sort.Slice(out.Miners, func(i, j int) bool {
+		return out.Miners[i].Miner < out.Miners[j].Miner
+	})
+	return c.JSON(http.StatusOK, out)
+}
+
+func (cm *ContentManager) shuttleBandwidthUsage() []*shuttleBandwidthUsage {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+
+	out := make([]*shuttleBandwidthUsage, 0, len(cm.shuttles))
+	for handle, sc := range cm.shuttles {
+		out = append(out, &shuttleBandwidthUsage{
+			Handle: handle,
+			Usage:  sc.transferBandwidth,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Handle < out[j].Handle
+	})
+	return out
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/piecetransfer"
+	"github.com/application-research/estuary/util/transferwatch"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/labstack/echo/v4"
+)
+
+// runTransferSupervisor feeds the progress of the transfers of the content
+// stored on this node to the transfer supervisor, which restarts those that
+// stalled and fails their deals when restarting does not help. Shuttles run
+// their own supervisor and report to handleRpcTransferStalled.
+func (cm *ContentManager) runTransferSupervisor(ctx context.Context) {
+	if !cm.transferSupervisor.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(cm.transferSupervisor.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := cm.updateLocalTransfers(ctx); err != nil {
+				log.Errorf("failed to update progress of local transfers: %s", err)
+			}
+			cm.transfers.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) updateLocalTransfers(ctx context.Context) error {
+	var deals []contentDeal
+	if err := cm.DB.Model(contentDeal{}).
+		Joins("left join contents on contents.id = content_deals.content").
+		Where("not content_deals.failed and content_deals.deal_id = 0 and content_deals.dt_chan != '' and location = ?", util.ContentLocationLocal).
+		Select("content_deals.*").
+		Scan(&deals).Error; err != nil {
+		return err
+	}
+
+	for _, d := range deals {
+		if !d.TransferFinished.IsZero() {
+			cm.transfers.Remove(d.DTChan)
+			continue
+		}
+
+		miner, err := d.MinerAddr()
+		if err != nil {
+			log.Errorf("failed to get miner of deal %d: %s", d.ID, err)
+			continue
+		}
+
+		var st *filclient.ChannelState
+		if strings.HasPrefix(d.DTChan, piecetransfer.TransferIDPrefix) {
+			st, err = cm.pieces.TransferStatus(d.ID)
+		} else {
+			st, err = cm.FilClient.TransferStatusByID(ctx, d.DTChan)
+		}
+		if err != nil {
+			log.Debugf("failed to get transfer status of deal %d: %s", d.ID, err)
+			continue
+		}
+
+		// http transfers have an ID from the proposal on, they only start
+		// once the provider first requests the piece
+		if st != nil && st.Status == datatransfer.Requested && strings.HasPrefix(d.DTChan, piecetransfer.TransferIDPrefix) {
+			continue
+		}
+		cm.transfers.Update(d.DTChan, d.ID, miner, st)
+	}
+	return nil
+}
+
+// restartStalledTransfer restarts a stalled local transfer, only legacy push
+// transfers can be restarted from here, providers restart the transfers they
+// pull themselves
+func (cm *ContentManager) restartStalledTransfer(ctx context.Context, ch transferwatch.Channel) error {
+	chanid, err := filclient.ChannelIDFromString(ch.ID)
+	if err != nil {
+		return fmt.Errorf("%w: %s is pulled by the provider", transferwatch.ErrNotRestartable, ch.ID)
+	}
+	return cm.RestartTransfer(ctx, util.ContentLocationLocal, *chanid, ch.DealDBID)
+}
+
+func (cm *ContentManager) onTransferSupervisorEvent(ch transferwatch.Channel, ev transferwatch.Event) {
+	if ev != transferwatch.EventFailed {
+		return
+	}
+
+	if err := cm.failStalledTransfer(ch.DealDBID, ch.ID, ch.Restarts, ""); err != nil {
+		log.Errorf("failed to fail deal %d of stalled transfer: %s", ch.DealDBID, err)
+	}
+}
+
+// failStalledTransfer fails the deal of a transfer that is still stalled
+// after being restarted, so that the content gets replicated elsewhere
+func (cm *ContentManager) failStalledTransfer(dbid uint, chanid string, restarts int, shuttle string) error {
+	var cd contentDeal
+	if err := cm.DB.First(&cd, "id = ?", dbid).Error; err != nil {
+		return err
+	}
+
+	miner, err := cd.MinerAddr()
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("transfer %s stalled after %d restarts", chanid, restarts)
+	if shuttle != "" {
+		msg = fmt.Sprintf("failure from shuttle %s: %s", shuttle, msg)
+	}
+
+	if err := cm.recordDealFailure(&DealFailureError{
+		Miner:   miner,
+		Phase:   "data-transfer",
+		Message: msg,
+		Content: cd.Content,
+		UserID:  cd.UserID,
+	}); err != nil {
+		return err
+	}
+
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", cd.ID).UpdateColumns(map[string]interface{}{
+		"failed":    true,
+		"failed_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+
+	cm.notifyTransferStatus(&cd, &filclient.ChannelState{
+		Status:     datatransfer.Failed,
+		Message:    msg,
+		TransferID: chanid,
+	})
+	return nil
+}
+
+func (cm *ContentManager) handleRpcTransferStalled(ctx context.Context, handle string, param *drpc.TransferStalled) error {
+	var cd contentDeal
+	if err := cm.DB.First(&cd, "id = ?", param.DealDBID).Error; err != nil {
+		return err
+	}
+
+	miner, err := cd.MinerAddr()
+	if err != nil {
+		return err
+	}
+
+	ev := transferwatch.Event(param.Event)
+	cm.transfers.Observe(miner, ev)
+	if ev != transferwatch.EventFailed {
+		return nil
+	}
+	return cm.failStalledTransfer(cd.ID, param.Chanid, param.Restarts, handle)
+}
+
+type minerTransferDiagnostics struct {
+	*filclient.MinerTransferDiagnostics
+	Stalls  transferwatch.MinerStats `json:"stalls"`
+	Stalled []transferwatch.Channel  `json:"stalled"`
+}
+
+// handleMinerTransferDiagnostics godoc
+// @Summary      Transfer diagnostics of a miner
+// @Description  This endpoint returns the state of the data transfers with a miner along with how often they stalled and the local transfers to it being restarted. Stalls of transfers of shuttles are counted, the shuttles list their own stalled transfers.
+// @Tags         admin
+// @Produce      json
+// @Param        miner path string true "Miner address"
+// @Router       /admin/miners/transfers/{miner} [get]
+func (s *Server) handleMinerTransferDiagnostics(c echo.Context) error {
+	m, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	diag, err := s.FilClient.MinerTransferDiagnostics(c.Request().Context(), m)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &minerTransferDiagnostics{
+		MinerTransferDiagnostics: diag,
+		Stalls:                   s.CM.transfers.MinerStats(m),
+		Stalled:                  s.CM.transfers.Stalled(m),
+	})
+}
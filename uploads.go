@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/resumable"
+	blockservice "github.com/ipfs/go-blockservice"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// uploadTarget is where the content of a resumable upload ends up, resolved
+// from the metadata given when the upload was created
+type uploadTarget struct {
+	owner       *contentOwner
+	filename    string
+	replication int
+	col         *Collection
+	path        *string
+}
+
+func (s *Server) resolveUploadTarget(u *User, up *resumable.Upload) (*uploadTarget, error) {
+	owner, err := s.ownerForOrg(up.Metadata["org"], u, util.OrgRoleUploader)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &uploadTarget{
+		owner:       owner,
+		filename:    up.Metadata["filename"],
+		replication: s.CM.Replication,
+	}
+
+	if t.filename == "" {
+		t.filename = up.UUID
+	}
+
+	if replVal := up.Metadata["replication"]; replVal != "" {
+		parsed, err := strconv.Atoi(replVal)
+		if err != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid replication: %q", replVal),
+			}
+		}
+		t.replication = parsed
+	}
+
+	if coluuid := up.Metadata["coluuid"]; coluuid != "" {
+		if err := u.authToken.Scopes.CheckCollection(coluuid, util.ScopeActionWrite); err != nil {
+			return nil, err
+		}
+
+		col, err := s.getCollectionForUser(coluuid, u, util.OrgRoleUploader)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := owner.checkCollection(col); err != nil {
+			return nil, err
+		}
+
+		path := "/"
+		if cp := up.Metadata["colpath"]; cp != "" {
+			sp, err := sanitizePath(cp)
+			if err != nil {
+				return nil, err
+			}
+			path = sp
+		}
+
+		t.col = col
+		t.path = &path
+	}
+	return t, nil
+}
+
+// handleCreateUpload godoc
+// @Summary      Create a resumable upload
+// @Description  This endpoint is used to start a resumable (tus) upload. The Upload-Metadata header may set the filename, coluuid, colpath and replication of the content, the data is then sent with PATCH requests to the returned location.
+// @Tags         content
+// @Produce      json
+// @Param        Upload-Length    header  int     true   "Total size of the upload in bytes"
+// @Param        Upload-Metadata  header  string  false  "tus upload metadata"
+// @Param        org              query   string  false  "Organization UUID"
+// @Router       /content/uploads [post]
+func (s *Server) handleCreateUpload(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
+		return err
+	}
+
+	if s.CM.localContentAddingDisabled {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: "uploading content to this node is not allowed, use one of the upload endpoints listed by /viewer",
+		}
+	}
+
+	length, err := resumable.ParseLength(c.Request().Header.Get(resumable.HeaderUploadLength))
+	if err != nil {
+		return err
+	}
+
+	md, err := resumable.ParseMetadata(c.Request().Header.Get(resumable.HeaderUploadMetadata))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if org := c.QueryParam("org"); org != "" {
+		md["org"] = org
+	}
+
+	// if splitting is disabled and uploaded content size is greater than content size limit
+	// reject the upload, as it will only get stuck and deals will never be made for it
+	if !u.FlagSplitContent() && length > s.CM.contentSizeLimit {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("content size %d bytes, is over upload size limit of %d bytes, and content splitting is not enabled, please reduce the content size", length, s.CM.contentSizeLimit),
+		}
+	}
+
+	// validate the metadata now rather than after all data was sent
+	target, err := s.resolveUploadTarget(u, &resumable.Upload{Metadata: md})
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkUserQuota(ctx, u, length, target.replication); err != nil {
+		return err
+	}
+
+	up, err := s.Uploads.Create(u.ID, length, md)
+	if err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	c.Response().Header().Set("Location", "/content/uploads/"+up.UUID)
+	return c.JSON(http.StatusCreated, up)
+}
+
+// handleGetUploadStatus godoc
+// @Summary      Get the status of a resumable upload
+// @Description  This endpoint returns the current offset of a resumable upload in the Upload-Offset header.
+// @Tags         content
+// @Param        upload  path  string  true  "Upload UUID"
+// @Router       /content/uploads/{upload} [head]
+func (s *Server) handleGetUploadStatus(c echo.Context, u *User) error {
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	return c.NoContent(http.StatusOK)
+}
+
+// handlePatchUpload godoc
+// @Summary      Send data for a resumable upload
+// @Description  This endpoint appends data to a resumable upload, starting at the offset given in the Upload-Offset header. Once all data has been received the content is added and returned.
+// @Tags         content
+// @Produce      json
+// @Accept       application/offset+octet-stream
+// @Param        upload         path    string  true  "Upload UUID"
+// @Param        Upload-Offset  header  int     true  "Offset the data starts at"
+// @Router       /content/uploads/{upload} [patch]
+func (s *Server) handlePatchUpload(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if ct := c.Request().Header.Get(echo.HeaderContentType); ct != resumable.ContentTypeOffsetOctetStream {
+		return &util.HttpError{
+			Code:    http.StatusUnsupportedMediaType,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content type must be %s", resumable.ContentTypeOffsetOctetStream),
+		}
+	}
+
+	offset, err := resumable.ParseOffset(c.Request().Header.Get(resumable.HeaderUploadOffset))
+	if err != nil {
+		return err
+	}
+
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	defer c.Request().Body.Close()
+	if err := s.Uploads.Write(ctx, up, offset, c.Request().Body); err != nil {
+		return err
+	}
+
+	resumable.SetHeaders(c.Response().Header(), up)
+	if !up.Complete() {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	return s.finishUpload(c, u, up)
+}
+
+func (s *Server) finishUpload(c echo.Context, u *User, up *resumable.Upload) error {
+	ctx := c.Request().Context()
+
+	target, err := s.resolveUploadTarget(u, up)
+	if err != nil {
+		return err
+	}
+
+	var content *Content
+	if err := s.Uploads.Finish(ctx, up, func(r io.Reader, bs blockstore.Blockstore) error {
+		cont, err := s.importUpload(ctx, u, target, r, bs)
+		if err != nil {
+			return err
+		}
+		content = cont
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		s.CM.ToCheck <- content.ID
+	}()
+
+	go func() {
+		if err := s.Node.Provider.Provide(content.Cid.CID); err != nil {
+			log.Warnf("failed to announce providers: %s", err)
+		}
+	}()
+
+	return c.JSON(http.StatusOK, &util.ContentAddResponse{
+		Cid:       content.Cid.CID.String(),
+		EstuaryId: content.ID,
+		Providers: s.CM.pinDelegatesForContent(*content),
+	})
+}
+
+// importUpload goes through the same steps as handleAdd for the data of a
+// completed upload
+func (s *Server) importUpload(ctx context.Context, u *User, target *uploadTarget, r io.Reader, bs blockstore.Blockstore) (*Content, error) {
+	bserv := blockservice.New(bs, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	nd, err := s.importFile(ctx, dserv, r)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.CM.addDatabaseTracking(ctx, target.owner, dserv, nd.Cid(), target.filename, target.replication)
+	if err != nil {
+		return nil, xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if target.col != nil {
+		if err := s.DB.Create(&CollectionRef{
+			Collection: target.col.ID,
+			Content:    content.ID,
+			Path:       target.path,
+		}).Error; err != nil {
+			log.Errorf("failed to add content to requested collection: %s", err)
+		}
+	}
+
+	// the quota was only checked against the usage when the upload was
+	// created, other uploads may have finished since
+	if err := s.checkAddedWithinQuota(ctx, u, []*Content{content}); err != nil {
+		return nil, err
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return nil, xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+	return content, nil
+}
+
+// handleDeleteUpload godoc
+// @Summary      Abort a resumable upload
+// @Description  This endpoint aborts a resumable upload and discards the data received so far.
+// @Tags         content
+// @Param        upload  path  string  true  "Upload UUID"
+// @Router       /content/uploads/{upload} [delete]
+func (s *Server) handleDeleteUpload(c echo.Context, u *User) error {
+	up, err := s.Uploads.Get(c.Param("upload"), u.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Uploads.Delete(up); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(resumable.HeaderTusResumable, resumable.TusVersion)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -22,6 +22,7 @@ type User struct {
 	Flags     int
 
 	StorageDisabled bool
+	Quota           util.UserQuota `gorm:"embedded;embeddedPrefix:quota_"`
 }
 
 func (u *User) FlagSplitContent() bool {
@@ -30,10 +31,32 @@ func (u *User) FlagSplitContent() bool {
 
 type AuthToken struct {
 	gorm.Model
-	Token      string `gorm:"unique"`
-	User       uint
-	UploadOnly bool
-	Expiry     time.Time
+	Token  string `gorm:"unique"`
+	User   uint
+	Scopes util.Scopes
+	Expiry time.Time
+}
+
+// migrateAuthTokenScopes maps keys created before scopes existed onto their
+// equivalent scopes: upload only keys may only add content, every other key
+// keeps full access.
+func migrateAuthTokenScopes(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&AuthToken{}, "upload_only") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&AuthToken{}).Where("upload_only").Update("scopes", util.Scopes{util.ScopeContentAdd}).Error; err != nil {
+			return err
+		}
+
+		// a null upload_only was never upload only
+		if err := tx.Model(&AuthToken{}).Where("upload_only IS NOT TRUE").Update("scopes", util.Scopes{util.ScopeAll}).Error; err != nil {
+			return err
+		}
+
+		return tx.Migrator().DropColumn(&AuthToken{}, "upload_only")
+	})
 }
 
 type InviteCode struct {
@@ -5,7 +5,57 @@ import (
 	"net/http"
 )
 
-func isEntityOwner(uID, entityID uint, entity string) error {
+// Roles a user can hold within an organization, in increasing order of
+// privilege
+const (
+	OrgRoleViewer   = "viewer"
+	OrgRoleUploader = "uploader"
+	OrgRoleAdmin    = "admin"
+	OrgRoleOwner    = "owner"
+)
+
+var orgRoleRanks = map[string]int{
+	OrgRoleViewer:   1,
+	OrgRoleUploader: 2,
+	OrgRoleAdmin:    3,
+	OrgRoleOwner:    4,
+}
+
+func IsValidOrgRole(role string) bool {
+	_, ok := orgRoleRanks[role]
+	return ok
+}
+
+// OrgRoleAtLeast reports whether role grants at least the privileges of
+// required. An empty or unknown role grants nothing.
+func OrgRoleAtLeast(role, required string) bool {
+	r, ok := orgRoleRanks[role]
+	if !ok {
+		return false
+	}
+	return r >= orgRoleRanks[required]
+}
+
+// OrgAccess describes the organization an entity belongs to and the role the
+// requesting user holds within it (empty if they are not a member)
+type OrgAccess struct {
+	OrgID    uint
+	Role     string
+	Required string
+}
+
+func isEntityOwner(uID, entityID uint, entity string, org []OrgAccess) error {
+	if len(org) > 0 && org[0].OrgID != 0 {
+		if !OrgRoleAtLeast(org[0].Role, org[0].Required) {
+			return HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  ERR_NOT_AUTHORIZED,
+				Details: fmt.Sprintf("User (%d) needs the %s role in organization (%d) to access this %s", uID, org[0].Required, org[0].OrgID, entity),
+			}
+		}
+		return nil
+	}
+
 	if uID != entityID {
 		return HttpError{
 			Code:    http.StatusForbidden,
@@ -16,10 +66,22 @@ func isEntityOwner(uID, entityID uint, entity string) error {
 	return nil
 }
 
-func IsCollectionOwner(uID, entityID uint) error {
-	return isEntityOwner(uID, entityID, "collection")
+// IsCollectionOwner checks that user uID may act on a collection owned by
+// entityID. If the collection belongs to an organization, access is granted
+// through membership instead.
+func IsCollectionOwner(uID, entityID uint, org ...OrgAccess) error {
+	return isEntityOwner(uID, entityID, "collection", org)
+}
+
+// IsContentOwner checks that user uID may act on content owned by entityID.
+// If the content belongs to an organization, access is granted through
+// membership instead.
+func IsContentOwner(uID, entityID uint, org ...OrgAccess) error {
+	return isEntityOwner(uID, entityID, "content", org)
 }
 
-func IsContentOwner(uID, entityID uint) error {
-	return isEntityOwner(uID, entityID, "content")
+// IsOrgMember checks that user uID holds at least the required role in the
+// organization.
+func IsOrgMember(uID uint, org OrgAccess) error {
+	return isEntityOwner(uID, 0, "organization", []OrgAccess{org})
 }
@@ -15,3 +15,16 @@ func TestIsContentOwner(t *testing.T) {
 	require.Nil(t, IsContentOwner(290, 290))
 	assert.Equal(t, IsContentOwner(1, 2).Error(), "ERR_NOT_AUTHORIZED: User (1) is not authorized for content (2)")
 }
+
+func TestIsContentOwnerThroughOrg(t *testing.T) {
+	require.Nil(t, IsContentOwner(1, 2, OrgAccess{OrgID: 7, Role: OrgRoleAdmin, Required: OrgRoleUploader}))
+	require.Nil(t, IsCollectionOwner(1, 2, OrgAccess{OrgID: 7, Role: OrgRoleViewer, Required: OrgRoleViewer}))
+	assert.Equal(t, IsContentOwner(1, 1, OrgAccess{OrgID: 7, Role: OrgRoleViewer, Required: OrgRoleAdmin}).Error(), "ERR_NOT_AUTHORIZED: User (1) needs the admin role in organization (7) to access this content")
+	assert.Error(t, IsCollectionOwner(1, 1, OrgAccess{OrgID: 7, Required: OrgRoleViewer}))
+
+	require.Nil(t, IsOrgMember(1, OrgAccess{OrgID: 7, Role: OrgRoleOwner, Required: OrgRoleAdmin}))
+	assert.Error(t, IsOrgMember(1, OrgAccess{OrgID: 7, Role: OrgRoleUploader, Required: OrgRoleAdmin}))
+
+	// no organization, fall back to plain ownership
+	require.Nil(t, IsContentOwner(1, 1, OrgAccess{}))
+}
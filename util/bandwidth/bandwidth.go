@@ -0,0 +1,175 @@
+// Package bandwidth caps the rate at which a node sends the data of its
+// transfers. The cap is shared evenly between the transfers in progress, a
+// new transfer slows the others down and a finished one speeds them up.
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// chunkSize is the most bytes written at once, the writes of a stream take
+// turns with the others at that granularity
+const chunkSize = 64 << 10
+
+// meterWindow is the period over which the measured rate is averaged
+const meterWindow = 5 * time.Second
+
+// Usage is the rate of the streams of a limiter against its limit, in bytes
+// per second
+type Usage struct {
+	Limit   int64 `json:"limit"`
+	Rate    int64 `json:"rate"`
+	Streams int   `json:"streams"`
+	// Share is what each stream may send while all of them are busy
+	Share int64 `json:"share"`
+}
+
+type Limiter struct {
+	limit int64
+
+	lk      sync.Mutex
+	streams map[*Writer]struct{}
+
+	windowStart time.Time
+	windowBytes int64
+	rate        int64
+}
+
+// NewLimiter creates a limiter of the given bytes per second, zero or less
+// only measures the rate
+func NewLimiter(limit int64) *Limiter {
+	if limit < 0 {
+		limit = 0
+	}
+
+	return &Limiter{
+		limit:       limit,
+		streams:     make(map[*Writer]struct{}),
+		windowStart: time.Now(),
+	}
+}
+
+// Writer returns a writer to w sending its share of the limit, it must be
+// closed once the transfer is done
+func (l *Limiter) Writer(ctx context.Context, w io.Writer) *Writer {
+	bw := &Writer{
+		ctx: ctx,
+		w:   w,
+		l:   l,
+	}
+	if l.limit > 0 {
+		bw.rl = rate.NewLimiter(rate.Inf, chunkSize)
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.streams[bw] = struct{}{}
+	l.rebalance()
+	return bw
+}
+
+// rebalance must be called with the lock held
+func (l *Limiter) rebalance() {
+	if l.limit == 0 || len(l.streams) == 0 {
+		return
+	}
+
+	share := rate.Limit(l.share())
+	for s := range l.streams {
+		s.rl.SetLimit(share)
+	}
+}
+
+// share must be called with the lock held
+func (l *Limiter) share() int64 {
+	if l.limit == 0 || len(l.streams) == 0 {
+		return l.limit
+	}
+	// a zero rate would block the streams for good
+	share := l.limit / int64(len(l.streams))
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+func (l *Limiter) remove(w *Writer) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	delete(l.streams, w)
+	l.rebalance()
+}
+
+func (l *Limiter) record(n int) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(l.windowStart); elapsed >= meterWindow {
+		l.rate = l.windowBytes * int64(time.Second) / int64(elapsed)
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+	l.windowBytes += int64(n)
+}
+
+func (l *Limiter) Usage() Usage {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	// nothing was sent in the last window when the current one is this old
+	r := l.rate
+	if time.Since(l.windowStart) >= 2*meterWindow {
+		r = 0
+	}
+
+	return Usage{
+		Limit:   l.limit,
+		Rate:    r,
+		Streams: len(l.streams),
+		Share:   l.share(),
+	}
+}
+
+type Writer struct {
+	ctx context.Context
+	w   io.Writer
+	l   *Limiter
+	rl  *rate.Limiter
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+
+		if w.rl != nil {
+			if err := w.rl.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.w.Write(p[:n])
+		written += n
+		w.l.record(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close gives the share of the writer back to the other streams
+func (w *Writer) Close() error {
+	w.l.remove(w)
+	return nil
+}
@@ -0,0 +1,88 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterShare(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(1 << 20)
+
+	a := l.Writer(ctx, &bytes.Buffer{})
+	assert.Equal(t, Usage{Limit: 1 << 20, Streams: 1, Share: 1 << 20}, l.Usage())
+
+	b := l.Writer(ctx, &bytes.Buffer{})
+	assert.Equal(t, int64(1<<19), l.Usage().Share)
+	assert.Equal(t, float64(1<<19), float64(a.rl.Limit()))
+
+	require.NoError(t, b.Close())
+	assert.Equal(t, 1, l.Usage().Streams)
+	assert.Equal(t, float64(1<<20), float64(a.rl.Limit()))
+	require.NoError(t, a.Close())
+}
+
+func TestLimiterWrite(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{7}, 256<<10)
+
+	var buf bytes.Buffer
+	w := NewLimiter(0).Writer(ctx, &buf)
+	n, err := w.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+
+	// past the first chunk the writes wait for the limit
+	buf.Reset()
+	w = NewLimiter(1<<20).Writer(ctx, &buf)
+	start := time.Now()
+	n, err = w.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	w = NewLimiter(1<<20).Writer(cctx, &buf)
+	_, err = w.Write(data)
+	assert.Error(t, err)
+}
+
+func TestLimiterBlockstore(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	var blks []blocks.Block
+	for i := byte(0); i < 4; i++ {
+		blk := blocks.NewBlock(bytes.Repeat([]byte{i}, 64<<10))
+		require.NoError(t, bs.Put(ctx, blk))
+		blks = append(blks, blk)
+	}
+
+	l := NewLimiter(1 << 20)
+	lbs := l.Blockstore(bs)
+
+	// past the first block the reads wait for the limit, as one stream
+	start := time.Now()
+	for _, blk := range blks {
+		got, err := lbs.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.Equal(t, blk.RawData(), got.RawData())
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, 1, l.Usage().Streams)
+
+	_, err := lbs.Get(ctx, blocks.NewBlock([]byte("missing")).Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+}
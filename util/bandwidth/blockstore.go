@@ -0,0 +1,74 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// Blockstore returns bs with the blocks read from it sent within the limit,
+// for transfers like graphsync that read their data from a blockstore rather
+// than writing it to a Writer. All of their reads count as one stream while
+// blocks were read within the last meterWindow.
+func (l *Limiter) Blockstore(bs blockstore.Blockstore) blockstore.Blockstore {
+	return &limitedBlockstore{
+		Blockstore: bs,
+		l:          l,
+	}
+}
+
+type limitedBlockstore struct {
+	blockstore.Blockstore
+	l *Limiter
+
+	lk      sync.Mutex
+	w       *Writer
+	lastUse time.Time
+}
+
+func (lb *limitedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := lb.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := lb.writer().Write(blk.RawData()); err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+func (lb *limitedBlockstore) writer() *Writer {
+	lb.lk.Lock()
+	defer lb.lk.Unlock()
+
+	lb.lastUse = time.Now()
+	if lb.w == nil {
+		// the reads are not tied to a request, so they are not cancelled
+		lb.w = lb.l.Writer(context.Background(), io.Discard)
+		go lb.closeIdle()
+	}
+	return lb.w
+}
+
+// closeIdle gives the share of the stream back once no blocks were read for
+// meterWindow
+func (lb *limitedBlockstore) closeIdle() {
+	for {
+		time.Sleep(meterWindow)
+
+		lb.lk.Lock()
+		if time.Since(lb.lastUse) >= meterWindow {
+			lb.w.Close()
+			lb.w = nil
+			lb.lk.Unlock()
+			return
+		}
+		lb.lk.Unlock()
+	}
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/application-research/estuary/util/gateway"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/labstack/echo/v4"
+)
+
+const ContentTypeCar = "application/vnd.ipld.car"
+
+// CarExport describes what part of a DAG to export as a CAR, and in which
+// version of the format
+type CarExport struct {
+	Version int
+	// Path is a unixfs path below the root, the export is rooted at the node
+	// it resolves to
+	Path string
+	// Depth limits how many links deep below the root the export goes, -1
+	// exports the whole DAG. Ignored when Selector is set.
+	Depth int64
+	// Selector picks the blocks to export instead of Depth, if set
+	Selector ipld.Node
+}
+
+// ParseCarExport reads the version, path, depth and selector query
+// parameters of a CAR export request
+func ParseCarExport(c echo.Context) (*CarExport, error) {
+	ce := &CarExport{
+		Version: 1,
+		Path:    strings.Trim(c.QueryParam("path"), "/"),
+		Depth:   -1,
+	}
+
+	if v := c.QueryParam("version"); v != "" {
+		ver, err := strconv.Atoi(v)
+		if err != nil || (ver != 1 && ver != 2) {
+			return nil, &HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("unsupported car version %q, must be 1 or 2", v),
+			}
+		}
+		ce.Version = ver
+	}
+
+	depth := c.QueryParam("depth")
+	sel := c.QueryParam("selector")
+	if depth != "" && sel != "" {
+		return nil, &HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  ERR_INVALID_INPUT,
+			Details: "depth and selector cannot be used together",
+		}
+	}
+
+	if depth != "" {
+		d, err := strconv.ParseInt(depth, 10, 64)
+		if err != nil || d < 0 {
+			return nil, &HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid depth %q", depth),
+			}
+		}
+		ce.Depth = d
+	}
+
+	if sel != "" {
+		nd, err := selectorparse.ParseJSONSelector(sel)
+		if err == nil {
+			_, err = selector.CompileSelector(nd)
+		}
+		if err != nil {
+			return nil, &HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid selector: %s", err),
+			}
+		}
+		ce.Selector = nd
+	}
+
+	return ce, nil
+}
+
+// IsFull returns whether the export covers the whole DAG of the content
+func (ce *CarExport) IsFull() bool {
+	return ce.Path == "" && ce.Depth < 0 && ce.Selector == nil
+}
+
+func (ce *CarExport) ContentType() string {
+	return fmt.Sprintf("%s; version=%d", ContentTypeCar, ce.Version)
+}
+
+// Root resolves the path of the export below root
+func (ce *CarExport) Root(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) (cid.Cid, error) {
+	if ce.Path == "" {
+		return root, nil
+	}
+
+	cc, err := gateway.NewGatewayHandler(bs).ResolvePath(ctx, fmt.Sprintf("/ipfs/%s/%s", root, ce.Path))
+	if err != nil {
+		return cid.Undef, &HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("failed to resolve path %q: %s", ce.Path, err),
+		}
+	}
+	return cc, nil
+}
+
+// walkFunc limits the walk of the DAG to Depth links below the root
+func (ce *CarExport) walkFunc(root cid.Cid) car.WalkFunc {
+	if ce.Depth < 0 {
+		return car.DefaultWalkFunc
+	}
+
+	depths := map[cid.Cid]int64{root: 0}
+	return func(nd ipldformat.Node) ([]*ipldformat.Link, error) {
+		depth := depths[nd.Cid()]
+		if depth >= ce.Depth {
+			return nil, nil
+		}
+
+		links := nd.Links()
+		for _, l := range links {
+			if _, ok := depths[l.Cid]; !ok {
+				depths[l.Cid] = depth + 1
+			}
+		}
+		return links, nil
+	}
+}
+
+// Write walks the DAG under root and writes the selected blocks to w as a
+// CAR, in traversal order so that it can be verified as it is read. Version 2
+// CARs carry an index after the data, so they are staged in a temporary file
+// first.
+func (ce *CarExport) Write(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, w io.Writer) error {
+	if ce.Version == 1 {
+		return ce.writeV1(ctx, bs, root, w)
+	}
+
+	fi, err := ioutil.TempFile("", "car-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fi.Name())
+	defer fi.Close()
+
+	if err := ce.writeV1(ctx, bs, root, fi); err != nil {
+		return err
+	}
+
+	if _, err := fi.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return carv2.WrapV1(fi, w)
+}
+
+func (ce *CarExport) writeV1(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, w io.Writer) error {
+	if ce.Selector != nil {
+		return car.NewSelectiveCar(ctx, bs, []car.Dag{{Root: root, Selector: ce.Selector}}).Write(w)
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+	return car.WriteCarWithWalker(ctx, dserv, []cid.Cid{root}, w, ce.walkFunc(root))
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarExport(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	source := io.LimitReader(rand.New(rand.NewSource(7)), 3*1024*1024)
+	nd, err := ImportFile(dserv, source)
+	require.NoError(t, err)
+
+	var objects []Object
+	require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(dserv), nd.Cid(), func(c cid.Cid) bool {
+		blk, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+		objects = append(objects, Object{Cid: c, Size: uint64(len(blk.RawData()))})
+		return true
+	}))
+
+	export := func(ce *CarExport) []byte {
+		buf := new(bytes.Buffer)
+		require.NoError(t, ce.Write(ctx, bs, nd.Cid(), buf))
+		return buf.Bytes()
+	}
+
+	countBlocks := func(data []byte) int {
+		cr, err := car.NewCarReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{nd.Cid()}, cr.Header.Roots)
+
+		var n int
+		for {
+			_, err := cr.Next()
+			if err == io.EOF {
+				return n
+			}
+			require.NoError(t, err)
+			n++
+		}
+	}
+
+	// a full export matches the size computed from the tracked objects
+	full := export(&CarExport{Version: 1, Depth: -1})
+	size, err := CalculateCarSize(nd.Cid(), objects)
+	require.NoError(t, err)
+	require.Equal(t, size, uint64(len(full)))
+	require.Equal(t, len(objects), countBlocks(full))
+
+	require.Equal(t, full, export(&CarExport{Version: 1, Depth: -1, Selector: selectorparse.CommonSelector_ExploreAllRecursively}))
+
+	require.Equal(t, 1, countBlocks(export(&CarExport{Version: 1, Depth: 0})))
+	require.Equal(t, 1+len(nd.Links()), countBlocks(export(&CarExport{Version: 1, Depth: 1})))
+
+	v2 := export(&CarExport{Version: 2, Depth: -1})
+	cr, err := carv2.NewReader(bytes.NewReader(v2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), cr.Version)
+	require.True(t, cr.Header.HasIndex())
+
+	v1, err := io.ReadAll(cr.DataReader())
+	require.NoError(t, err)
+	require.Equal(t, full, v1)
+}
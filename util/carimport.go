@@ -0,0 +1,229 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// max number of offending cids listed in car verification errors
+const maxCarErrorCids = 10
+
+// CarImport is a CAR that was loaded for import, along with the blockstore
+// its blocks can be read from
+type CarImport struct {
+	Version    uint64
+	Roots      []cid.Cid
+	Blockstore blockstore.Blockstore
+	// Size is the number of bytes of the car that were read
+	Size int64
+
+	closer io.Closer
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Close releases the file backing a CARv2 import
+func (ci *CarImport) Close() error {
+	if ci.closer == nil {
+		return nil
+	}
+	return ci.closer.Close()
+}
+
+// LoadCar reads a CARv1 or CARv2 from r. The blocks of a CARv1 are loaded into
+// bs. A CARv2 is written out to the file at spool instead and read in place
+// through its index, so that its blocks are not copied twice before they reach
+// the main blockstore. The blocks of a CARv2 are only checked by Verify.
+func LoadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader, spool string) (*CarImport, error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+
+	pragma, err := br.Peek(carv2.PragmaSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(pragma, carv2.Pragma) {
+		header, err := car.LoadCar(ctx, bs, br)
+		if err != nil {
+			return nil, invalidCarError("failed to load car: %s", err)
+		}
+
+		return &CarImport{
+			Version:    1,
+			Roots:      header.Roots,
+			Blockstore: bs,
+			Size:       cr.n,
+		}, nil
+	}
+
+	fi, err := os.Create(spool)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(fi, br); err != nil {
+		fi.Close()
+		return nil, err
+	}
+
+	if err := fi.Close(); err != nil {
+		return nil, err
+	}
+
+	// uses the index of the car if it has one, or builds one in memory
+	robs, err := carbs.OpenReadOnly(spool)
+	if err != nil {
+		return nil, invalidCarError("failed to open car: %s", err)
+	}
+
+	roots, err := robs.Roots()
+	if err != nil {
+		robs.Close()
+		return nil, invalidCarError("failed to read car roots: %s", err)
+	}
+
+	return &CarImport{
+		Version:    2,
+		Roots:      roots,
+		Blockstore: robs,
+		Size:       cr.n,
+		closer:     robs,
+	}, nil
+}
+
+// Verify walks the DAGs of all roots of the car, checking that every block in
+// them is present and hashes to its cid, and that the car holds no blocks that
+// are not reachable from one of its roots.
+func (ci *CarImport) Verify(ctx context.Context) error {
+	if len(ci.Roots) == 0 {
+		return invalidCarError("car has no roots")
+	}
+
+	// blockstores only key blocks by multihash, so that is what is tracked
+	seen := make(map[string]bool)
+	var dangling []string
+	var ndangling int
+
+	type pending struct {
+		c      cid.Cid
+		parent cid.Cid
+	}
+
+	var stack []pending
+	for i := len(ci.Roots) - 1; i >= 0; i-- {
+		stack = append(stack, pending{c: ci.Roots[i]})
+	}
+
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if seen[string(p.c.Hash())] {
+			continue
+		}
+		seen[string(p.c.Hash())] = true
+
+		blk, err := ci.Blockstore.Get(ctx, p.c)
+		if err != nil {
+			if !xerrors.Is(err, blockstore.ErrNotFound) && !xerrors.Is(err, ipldformat.ErrNotFound) {
+				return err
+			}
+
+			ndangling++
+			if len(dangling) < maxCarErrorCids {
+				if p.parent.Defined() {
+					dangling = append(dangling, fmt.Sprintf("%s (linked from %s)", p.c, p.parent))
+				} else {
+					dangling = append(dangling, fmt.Sprintf("%s (root)", p.c))
+				}
+			}
+			continue
+		}
+
+		if p.c.Prefix().MhType != multihash.IDENTITY {
+			chk, err := p.c.Prefix().Sum(blk.RawData())
+			if err != nil {
+				return invalidCarError("failed to hash block %s: %s", p.c, err)
+			}
+
+			if !chk.Equals(p.c) {
+				return invalidCarError("block %s does not match its hash", p.c)
+			}
+		}
+
+		nd, err := ipldformat.Decode(blk)
+		if err != nil {
+			return invalidCarError("failed to decode block %s: %s", p.c, err)
+		}
+
+		links := nd.Links()
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, pending{c: links[i].Cid, parent: p.c})
+		}
+	}
+
+	if ndangling > 0 {
+		return invalidCarError("car is missing %d blocks linked from its roots: %s", ndangling, strings.Join(dangling, ", "))
+	}
+
+	keys, err := ci.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	var unreachable []string
+	var nunreachable int
+	for k := range keys {
+		if seen[string(k.Hash())] {
+			continue
+		}
+
+		nunreachable++
+		if len(unreachable) < maxCarErrorCids {
+			unreachable = append(unreachable, k.String())
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if nunreachable > 0 {
+		return invalidCarError("car contains %d blocks not reachable from its roots: %s", nunreachable, strings.Join(unreachable, ", "))
+	}
+
+	return nil
+}
+
+func invalidCarError(format string, args ...interface{}) error {
+	return &HttpError{
+		Code:    http.StatusBadRequest,
+		Reason:  ERR_INVALID_CAR,
+		Details: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBlockstore() blockstore.Blockstore {
+	return blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+}
+
+// writeTestCar writes a car of the DAGs of roots in bs, followed by the extra
+// blocks
+func writeTestCar(t *testing.T, bs blockstore.Blockstore, roots []cid.Cid, extra ...blocks.Block) []byte {
+	ctx := context.Background()
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, car.WriteCar(ctx, dserv, roots, buf))
+	for _, blk := range extra {
+		require.NoError(t, carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()))
+	}
+	return buf.Bytes()
+}
+
+func TestLoadCar(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTestBlockstore()
+	dserv := merkledag.NewDAGService(blockservice.New(src, nil))
+
+	var roots []cid.Cid
+	for i := 0; i < 3; i++ {
+		nd, err := ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(int64(i))), 2*1024*1024))
+		require.NoError(t, err)
+		roots = append(roots, nd.Cid())
+	}
+
+	load := func(data []byte) (*CarImport, error) {
+		imp, err := LoadCar(ctx, newTestBlockstore(), bytes.NewReader(data), filepath.Join(t.TempDir(), "import.car"))
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { imp.Close() })
+		return imp, imp.Verify(ctx)
+	}
+
+	v1 := writeTestCar(t, src, roots)
+	imp, err := load(v1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), imp.Version)
+	require.Equal(t, roots, imp.Roots)
+
+	v2 := new(bytes.Buffer)
+	require.NoError(t, carv2.WrapV1(bytes.NewReader(v1), v2))
+	imp, err = load(v2.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), imp.Version)
+	require.Equal(t, roots, imp.Roots)
+
+	// blocks that are not part of any root's DAG
+	_, err = load(writeTestCar(t, src, roots[:2], mustBlock(t, src, roots[2])))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not reachable")
+
+	// a root whose children are missing
+	_, err = load(writeRawCar(t, []cid.Cid{roots[1]}, mustBlock(t, src, roots[1])))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing")
+
+	// a block that does not match its cid
+	blk := blocks.NewBlock([]byte("some data"))
+	forged, err := blocks.NewBlockWithCid([]byte("other data"), blk.Cid())
+	require.NoError(t, err)
+	forgedCar := writeRawCar(t, []cid.Cid{blk.Cid()}, forged)
+	_, err = load(forgedCar)
+	require.Error(t, err)
+
+	// CARv2 blocks are only checked while walking the DAGs
+	v2 = new(bytes.Buffer)
+	require.NoError(t, carv2.WrapV1(bytes.NewReader(forgedCar), v2))
+	_, err = load(v2.Bytes())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match its hash")
+}
+
+// writeRawCar writes a car with exactly the given roots and blocks
+func writeRawCar(t *testing.T, roots []cid.Cid, blks ...blocks.Block) []byte {
+	buf := new(bytes.Buffer)
+	require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, buf))
+	for _, blk := range blks {
+		require.NoError(t, carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()))
+	}
+	return buf.Bytes()
+}
+
+func mustBlock(t *testing.T, bs blockstore.Blockstore, c cid.Cid) blocks.Block {
+	blk, err := bs.Get(context.Background(), c)
+	require.NoError(t, err)
+	return blk
+}
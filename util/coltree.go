@@ -0,0 +1,217 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+)
+
+// CollectionFilePath returns the path of a file in a collection. Collection
+// refs either hold the full path of the file, or only the directory it is in,
+// in which case the file is named after its content.
+func CollectionFilePath(path string, name string) string {
+	if path == "" {
+		return "/" + name
+	}
+
+	dir := filepath.Clean(path)
+	if filepath.Base(dir) == name {
+		return dir
+	}
+	return filepath.Join(dir, name)
+}
+
+// IsUnderPath returns whether p is dir or a path below it
+func IsUnderPath(p, dir string) bool {
+	if dir == "/" || p == dir {
+		return true
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// CollectionTree is the directory tree of a collection. Directories either
+// exist explicitly, or implicitly as the parents of the files in the tree.
+// Files are identified by the ids of the collection refs that put them there.
+type CollectionTree struct {
+	dirs  map[string]bool
+	files map[string][]uint
+}
+
+type CollectionTreeEntry struct {
+	Name string
+	Path string
+	Dir  bool
+	// Refs holds the refs of a file entry. More than one ref may point at the
+	// same path in collections created before paths were validated.
+	Refs []uint
+}
+
+func NewCollectionTree() *CollectionTree {
+	return &CollectionTree{
+		dirs:  map[string]bool{"/": true},
+		files: make(map[string][]uint),
+	}
+}
+
+// AddFile adds the file of ref at p, along with its parent directories
+func (t *CollectionTree) AddFile(p string, ref uint) {
+	t.files[p] = append(t.files[p], ref)
+	t.AddDir(filepath.Dir(p))
+}
+
+// AddDir adds the directory p along with its parents
+func (t *CollectionTree) AddDir(p string) {
+	for !t.dirs[p] {
+		t.dirs[p] = true
+		p = filepath.Dir(p)
+	}
+}
+
+func (t *CollectionTree) IsDir(p string) bool {
+	return t.dirs[p]
+}
+
+// FileRefs returns the refs of the file at p, if there is one
+func (t *CollectionTree) FileRefs(p string) []uint {
+	return t.files[p]
+}
+
+func (t *CollectionTree) Exists(p string) bool {
+	return t.dirs[p] || len(t.files[p]) > 0
+}
+
+// CheckFree returns an error if nothing can be created at p, because it
+// already exists or one of its parents is a file
+func (t *CollectionTree) CheckFree(p string) error {
+	if t.Exists(p) {
+		return pathConflictError("path %q already exists", p)
+	}
+
+	for d := filepath.Dir(p); d != "/"; d = filepath.Dir(d) {
+		if len(t.files[d]) > 0 {
+			return pathConflictError("cannot create %q, %q is a file", p, d)
+		}
+	}
+	return nil
+}
+
+// List returns the entries of the directory dir, sorted by name
+func (t *CollectionTree) List(dir string) ([]CollectionTreeEntry, error) {
+	if !t.dirs[dir] {
+		return nil, &HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  ERR_PATH_NOT_FOUND,
+			Details: fmt.Sprintf("directory %q does not exist", dir),
+		}
+	}
+
+	var out []CollectionTreeEntry
+	for d := range t.dirs {
+		if d != "/" && filepath.Dir(d) == dir {
+			out = append(out, CollectionTreeEntry{Name: filepath.Base(d), Path: d, Dir: true})
+		}
+	}
+
+	for f, refs := range t.files {
+		if filepath.Dir(f) == dir {
+			out = append(out, CollectionTreeEntry{Name: filepath.Base(f), Path: f, Refs: refs})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Dir
+	})
+	return out, nil
+}
+
+// Under returns the directories and files at or below p
+func (t *CollectionTree) Under(p string) (dirs []string, files []string) {
+	for d := range t.dirs {
+		if IsUnderPath(d, p) {
+			dirs = append(dirs, d)
+		}
+	}
+
+	for f := range t.files {
+		if IsUnderPath(f, p) {
+			files = append(files, f)
+		}
+	}
+
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+// Build creates the UnixFS directories of the tree bottom up, adding all of
+// them to dserv, and returns the root directory. links maps the refs of the
+// files in the tree to their content.
+func (t *CollectionTree) Build(ctx context.Context, dserv ipld.DAGService, links map[uint]*ipld.Link) (*merkledag.ProtoNode, error) {
+	return t.buildDir(ctx, dserv, "/", links)
+}
+
+func (t *CollectionTree) buildDir(ctx context.Context, dserv ipld.DAGService, dir string, links map[uint]*ipld.Link) (*merkledag.ProtoNode, error) {
+	ents, err := t.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nd := unixfs.EmptyDirNode()
+	for _, e := range ents {
+		if e.Dir {
+			if len(t.files[e.Path]) > 0 {
+				return nil, pathConflictError("%q is both a file and a directory", e.Path)
+			}
+
+			child, err := t.buildDir(ctx, dserv, e.Path, links)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := nd.AddNodeLink(e.Name, child); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var link *ipld.Link
+		for _, ref := range e.Refs {
+			l, ok := links[ref]
+			if !ok {
+				return nil, fmt.Errorf("no content for collection ref %d", ref)
+			}
+
+			if link != nil && !link.Cid.Equals(l.Cid) {
+				return nil, pathConflictError("%q refers to more than one content", e.Path)
+			}
+			link = l
+		}
+
+		if err := nd.AddRawLink(e.Name, &ipld.Link{Size: link.Size, Cid: link.Cid}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dserv.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+func pathConflictError(format string, args ...interface{}) error {
+	return &HttpError{
+		Code:    http.StatusConflict,
+		Reason:  ERR_PATH_CONFLICT,
+		Details: fmt.Sprintf(format, args...),
+	}
+}
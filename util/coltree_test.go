@@ -0,0 +1,96 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectionFilePath(t *testing.T) {
+	assert.Equal(t, "/a.txt", CollectionFilePath("", "a.txt"))
+	assert.Equal(t, "/a.txt", CollectionFilePath("/", "a.txt"))
+	assert.Equal(t, "/dir/a.txt", CollectionFilePath("/dir", "a.txt"))
+	assert.Equal(t, "/dir/a.txt", CollectionFilePath("/dir/", "a.txt"))
+	assert.Equal(t, "/dir/a.txt", CollectionFilePath("/dir/a.txt", "a.txt"))
+}
+
+func TestCollectionTree(t *testing.T) {
+	ctx := context.Background()
+
+	tree := NewCollectionTree()
+	tree.AddFile("/docs/a.txt", 1)
+	tree.AddFile("/docs/sub/b.txt", 2)
+	tree.AddFile("/c.txt", 3)
+	tree.AddDir("/empty/nested")
+
+	assert.True(t, tree.IsDir("/docs/sub"))
+	assert.True(t, tree.IsDir("/empty"))
+	assert.False(t, tree.IsDir("/c.txt"))
+
+	ents, err := tree.List("/")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"c.txt", "docs", "empty"}, names)
+
+	_, err = tree.List("/missing")
+	var herr *HttpError
+	require.True(t, errors.As(err, &herr))
+	assert.Equal(t, ERR_PATH_NOT_FOUND, herr.Reason)
+
+	assert.NoError(t, tree.CheckFree("/docs/c.txt"))
+	for _, p := range []string{"/docs", "/docs/a.txt", "/c.txt/d", "/docs/a.txt/x/y"} {
+		err := tree.CheckFree(p)
+		require.True(t, errors.As(err, &herr), p)
+		assert.Equal(t, ERR_PATH_CONFLICT, herr.Reason)
+	}
+
+	dirs, files := tree.Under("/docs")
+	assert.Equal(t, []string{"/docs", "/docs/sub"}, dirs)
+	assert.Equal(t, []string{"/docs/a.txt", "/docs/sub/b.txt"}, files)
+
+	dserv := merkledag.NewDAGService(blockservice.New(newTestBlockstore(), nil))
+	links := make(map[uint]*ipld.Link)
+	for i, data := range []string{"a", "b", "c"} {
+		blk := blocks.NewBlock([]byte(data))
+		links[uint(i+1)] = &ipld.Link{Cid: blk.Cid(), Size: uint64(len(data))}
+	}
+
+	root, err := tree.Build(ctx, dserv, links)
+	require.NoError(t, err)
+
+	// every directory, empty ones included, is linked and stored
+	for _, p := range [][]string{{"docs", "sub"}, {"empty", "nested"}} {
+		nd := ipld.Node(root)
+		for _, name := range p {
+			lnk, _, err := nd.ResolveLink([]string{name})
+			require.NoError(t, err)
+			nd, err = dserv.Get(ctx, lnk.Cid)
+			require.NoError(t, err)
+		}
+
+		fsn, err := unixfs.ExtractFSNode(nd)
+		require.NoError(t, err)
+		assert.Equal(t, unixfs.TDirectory, fsn.Type())
+	}
+
+	lnk, _, err := root.ResolveLink([]string{"c.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, links[3].Cid, lnk.Cid)
+
+	// a path used as both a file and a directory can not be committed
+	tree.AddFile("/docs/sub", 3)
+	_, err = tree.Build(ctx, dserv, links)
+	require.True(t, errors.As(err, &herr))
+	assert.Equal(t, ERR_PATH_CONFLICT, herr.Reason)
+}
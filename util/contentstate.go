@@ -0,0 +1,125 @@
+package util
+
+import "fmt"
+
+// ContentState is where a content is in its lifecycle
+type ContentState string
+
+const (
+	// ContentStatePinning is content whose data is being fetched
+	ContentStatePinning ContentState = "pinning"
+	// ContentStateReceiving is content whose data is being uploaded to a
+	// shuttle
+	ContentStateReceiving ContentState = "receiving"
+	// ContentStateStaging is an aggregate that content is still being added to
+	ContentStateStaging ContentState = "staging"
+	// ContentStateActive is content that is stored, and that deals are made
+	// for unless it is the root of a split dag
+	ContentStateActive ContentState = "active"
+	// ContentStateAggregated is stored content that deals are made for as
+	// part of an aggregate
+	ContentStateAggregated ContentState = "aggregated"
+	// ContentStateSplit is the root of a dag that was split into smaller
+	// contents, which deals are made for instead
+	ContentStateSplit ContentState = "split"
+	// ContentStateOffloaded is content whose data was removed from the node,
+	// it can be retrieved again from its deals
+	ContentStateOffloaded ContentState = "offloaded"
+	// ContentStateReplaced is content about to be removed because another
+	// pin replaced it
+	ContentStateReplaced ContentState = "replaced"
+	// ContentStateFailed is content whose data could not be fetched
+	ContentStateFailed ContentState = "failed"
+	// ContentStateRetired is content that is kept in the database but is no
+	// longer stored, like an aggregate that was broken up
+	ContentStateRetired ContentState = "retired"
+	// ContentStateRemoved is content that was deleted
+	ContentStateRemoved ContentState = "removed"
+)
+
+var contentTransitions = map[ContentState][]ContentState{
+	ContentStatePinning:    {ContentStateActive, ContentStateFailed, ContentStateReplaced, ContentStateRemoved},
+	ContentStateReceiving:  {ContentStateActive, ContentStateFailed, ContentStateRemoved},
+	ContentStateStaging:    {ContentStateActive, ContentStateFailed, ContentStateRemoved},
+	ContentStateActive:     {ContentStateAggregated, ContentStateSplit, ContentStateOffloaded, ContentStateReplaced, ContentStateRetired, ContentStateRemoved},
+	ContentStateAggregated: {ContentStateActive, ContentStateOffloaded, ContentStateReplaced, ContentStateRemoved},
+	ContentStateSplit:      {ContentStateRemoved},
+	ContentStateOffloaded:  {ContentStateActive, ContentStateAggregated, ContentStateReplaced, ContentStateRemoved},
+	ContentStateReplaced:   {ContentStateRemoved},
+	ContentStateFailed:     {ContentStatePinning, ContentStateReplaced, ContentStateRemoved},
+	ContentStateRetired:    {ContentStateRemoved},
+	ContentStateRemoved:    {},
+}
+
+func (s ContentState) Valid() bool {
+	_, ok := contentTransitions[s]
+	return ok
+}
+
+// CanTransition returns whether content in state s may move to state to.
+// Staying in the same state is always allowed.
+func (s ContentState) CanTransition(to ContentState) bool {
+	if s == to {
+		return s.Valid()
+	}
+
+	for _, next := range contentTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTransition returns an error if content in state s may not move to
+// state to
+func (s ContentState) CheckTransition(to ContentState) error {
+	if !s.CanTransition(to) {
+		return fmt.Errorf("content cannot move from state %q to %q", s, to)
+	}
+	return nil
+}
+
+// ContentFlags are the columns that recorded the lifecycle of content before
+// it had a state
+type ContentFlags struct {
+	Active       bool
+	Pinning      bool
+	Failed       bool
+	Offloaded    bool
+	Aggregate    bool
+	AggregatedIn uint
+	DagSplit     bool
+	SplitFrom    uint
+	Replace      bool
+	Deleted      bool
+}
+
+// ContentStateFromFlags returns the state of content that only has the
+// flags set
+func ContentStateFromFlags(f ContentFlags) ContentState {
+	switch {
+	case f.Deleted:
+		return ContentStateRemoved
+	case f.Replace:
+		return ContentStateReplaced
+	case f.Failed:
+		return ContentStateFailed
+	case f.DagSplit && f.SplitFrom == 0 && !f.Active:
+		return ContentStateSplit
+	case f.Offloaded:
+		return ContentStateOffloaded
+	case f.Active && f.AggregatedIn > 0:
+		return ContentStateAggregated
+	case f.Active:
+		return ContentStateActive
+	case f.Pinning && f.Aggregate:
+		return ContentStateStaging
+	case f.Pinning:
+		return ContentStatePinning
+	case f.Aggregate:
+		return ContentStateRetired
+	default:
+		return ContentStateReceiving
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentStateTransitions(t *testing.T) {
+	for from, tos := range contentTransitions {
+		assert.True(t, from.CanTransition(from), from)
+		for _, to := range tos {
+			assert.True(t, to.Valid(), "%s -> %s", from, to)
+			assert.NoError(t, from.CheckTransition(to))
+		}
+	}
+
+	assert.Error(t, ContentStateRemoved.CheckTransition(ContentStateActive))
+	assert.Error(t, ContentStateSplit.CheckTransition(ContentStateActive))
+	assert.Error(t, ContentStatePinning.CheckTransition(ContentStateOffloaded))
+	assert.Error(t, ContentState("").CheckTransition(ContentStateActive))
+	assert.False(t, ContentState("bogus").CanTransition("bogus"))
+}
+
+func TestContentStateFromFlags(t *testing.T) {
+	cases := []struct {
+		flags ContentFlags
+		state ContentState
+	}{
+		{ContentFlags{Pinning: true}, ContentStatePinning},
+		{ContentFlags{}, ContentStateReceiving},
+		{ContentFlags{Pinning: true, Aggregate: true}, ContentStateStaging},
+		{ContentFlags{Active: true, Aggregate: true}, ContentStateActive},
+		{ContentFlags{Aggregate: true}, ContentStateRetired},
+		{ContentFlags{Active: true, AggregatedIn: 3}, ContentStateAggregated},
+		{ContentFlags{Active: true, AggregatedIn: 3, Offloaded: true}, ContentStateOffloaded},
+		{ContentFlags{DagSplit: true}, ContentStateSplit},
+		{ContentFlags{Active: true, DagSplit: true, SplitFrom: 2}, ContentStateActive},
+		{ContentFlags{Failed: true}, ContentStateFailed},
+		{ContentFlags{Active: true, Replace: true}, ContentStateReplaced},
+		{ContentFlags{Active: true, Deleted: true}, ContentStateRemoved},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.state, ContentStateFromFlags(c.flags), "%+v", c.flags)
+	}
+}
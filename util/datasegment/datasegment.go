@@ -0,0 +1,461 @@
+// Package datasegment lays out pieces in an aggregate piece following the
+// data segment format of FRC-0058: every sub piece sits at an offset aligned
+// to its size and a segment index describing them is written at the end of
+// the aggregate. Inclusion proofs show, from the aggregate piece commitment
+// alone, that a sub piece is in the aggregate and listed in its index.
+//
+// Offsets and sizes are in padded bytes, so both the sub pieces and the index
+// entries are whole subtrees of the aggregate piece tree.
+package datasegment
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/lotus/extern/sector-storage/fr32"
+	"github.com/ipfs/go-cid"
+)
+
+const nodeSize = 32
+
+// EntrySize is the size of an entry of the segment index
+const EntrySize = 64
+
+// MinPieceSize is the smallest padded piece size
+const MinPieceSize = 128
+
+// Node is a node of a piece commitment tree
+type Node [nodeSize]byte
+
+func (n Node) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(n[:])), nil
+}
+
+func (n *Node) UnmarshalText(b []byte) error {
+	if hex.DecodedLen(len(b)) != nodeSize {
+		return fmt.Errorf("node must be %d bytes", nodeSize)
+	}
+	_, err := hex.Decode(n[:], b)
+	return err
+}
+
+// NodeFromCID returns the root node of a piece commitment CID
+func NodeFromCID(c cid.Cid) (Node, error) {
+	var n Node
+	b, err := commcid.CIDToDataCommitmentV1(c)
+	if err != nil {
+		return n, err
+	}
+	copy(n[:], b)
+	return n, nil
+}
+
+// CID returns the piece commitment CID with n as root
+func (n Node) CID() (cid.Cid, error) {
+	return commcid.DataCommitmentV1ToCID(n[:])
+}
+
+// hashNodes is the sha256 truncated to 254 bits piece commitments are built
+// with
+func hashNodes(a, b Node) Node {
+	h := sha256.New()
+	h.Write(a[:])
+	h.Write(b[:])
+
+	var out Node
+	copy(out[:], h.Sum(nil))
+	out[nodeSize-1] &= 0x3f
+	return out
+}
+
+// zeroComms[l] is the root of a subtree of height l holding only zeroes
+var zeroComms = func() []Node {
+	out := make([]Node, 64)
+	for l := 1; l < len(out); l++ {
+		out[l] = hashNodes(out[l-1], out[l-1])
+	}
+	return out
+}()
+
+// UnpaddedSize is how many bytes of data a piece of the given padded size
+// holds
+func UnpaddedSize(padded uint64) uint64 {
+	return padded - padded/128
+}
+
+func isPieceSize(size uint64) bool {
+	return size >= MinPieceSize && size&(size-1) == 0
+}
+
+// level is the height of the subtree of a piece of the given padded size
+func level(size uint64) int {
+	return bits.TrailingZeros64(size / nodeSize)
+}
+
+// Piece is a sub piece of an aggregate
+type Piece struct {
+	CommP Node
+	// Size is the padded size of the piece
+	Size uint64
+}
+
+// SegmentDesc is an entry of the segment index
+type SegmentDesc struct {
+	CommDs   Node
+	Offset   uint64
+	Size     uint64
+	Checksum [16]byte
+}
+
+func newSegmentDesc(p Piece, offset uint64) SegmentDesc {
+	sd := SegmentDesc{
+		CommDs: p.CommP,
+		Offset: offset,
+		Size:   p.Size,
+	}
+	sd.Checksum = sd.checksum()
+	return sd
+}
+
+func (sd SegmentDesc) Serialize() [EntrySize]byte {
+	var out [EntrySize]byte
+	copy(out[:32], sd.CommDs[:])
+	binary.LittleEndian.PutUint64(out[32:40], sd.Offset)
+	binary.LittleEndian.PutUint64(out[40:48], sd.Size)
+	copy(out[48:], sd.Checksum[:])
+	return out
+}
+
+func (sd SegmentDesc) checksum() [16]byte {
+	b := sd.Serialize()
+	sum := sha256.Sum256(b[:48])
+
+	var out [16]byte
+	copy(out[:], sum[:16])
+	out[15] &= 0x3f
+	return out
+}
+
+// node is the root of the two tree leaves the entry is written as
+func (sd SegmentDesc) node() Node {
+	b := sd.Serialize()
+
+	var l, r Node
+	copy(l[:], b[:32])
+	copy(r[:], b[32:])
+	return hashNodes(l, r)
+}
+
+// MaxIndexEntriesInDeal is how many entries the segment index of an
+// aggregate of the given padded size has room for, 2^ceil(log2(size/2048/64))
+// but at least 4
+func MaxIndexEntriesInDeal(dealSize uint64) uint64 {
+	x := dealSize / 2048 / EntrySize
+	if x <= 1 {
+		return 4
+	}
+
+	n := uint64(1) << uint(bits.Len64(x-1))
+	if n < 4 {
+		n = 4
+	}
+	return n
+}
+
+// IndexStartOffset is the padded offset the segment index starts at
+func IndexStartOffset(dealSize uint64) uint64 {
+	return dealSize - MaxIndexEntriesInDeal(dealSize)*EntrySize
+}
+
+func layout(dealSize uint64, pieces []Piece) ([]uint64, error) {
+	if !isPieceSize(dealSize) {
+		return nil, fmt.Errorf("aggregate size %d is not a valid piece size", dealSize)
+	}
+
+	if uint64(len(pieces)) > MaxIndexEntriesInDeal(dealSize) {
+		return nil, fmt.Errorf("%d pieces do not fit in the index of a %d byte aggregate", len(pieces), dealSize)
+	}
+
+	offsets := make([]uint64, len(pieces))
+	var next uint64
+	for i, p := range pieces {
+		if !isPieceSize(p.Size) {
+			return nil, fmt.Errorf("piece %d size %d is not a valid piece size", i, p.Size)
+		}
+
+		// align to the piece size
+		next = (next + p.Size - 1) &^ (p.Size - 1)
+		offsets[i] = next
+		next += p.Size
+	}
+
+	if next > IndexStartOffset(dealSize) {
+		return nil, fmt.Errorf("pieces do not fit in a %d byte aggregate", dealSize)
+	}
+	return offsets, nil
+}
+
+// DealSize returns the smallest aggregate size the pieces fit in, in the
+// given order
+func DealSize(pieces []Piece) (uint64, error) {
+	var total uint64
+	for i, p := range pieces {
+		if !isPieceSize(p.Size) {
+			return 0, fmt.Errorf("piece %d size %d is not a valid piece size", i, p.Size)
+		}
+		total += p.Size
+	}
+
+	size := uint64(MinPieceSize)
+	for size < total {
+		size <<= 1
+	}
+
+	for ; size != 0; size <<= 1 {
+		if _, err := layout(size, pieces); err == nil {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("pieces are too big to aggregate")
+}
+
+// Aggregate is an aggregate piece with its segment index. Only the subtrees
+// of the pieces and of the index are known, the rest of the tree is zeroes.
+type Aggregate struct {
+	DealSize uint64
+	Index    []SegmentDesc
+
+	// levels[l] holds the known nodes at height l by their index
+	levels []map[uint64]Node
+}
+
+// NewAggregate lays out the pieces, in order, in an aggregate of the given
+// padded size. Pieces in decreasing size order leave no gaps between them.
+func NewAggregate(dealSize uint64, pieces []Piece) (*Aggregate, error) {
+	offsets, err := layout(dealSize, pieces)
+	if err != nil {
+		return nil, err
+	}
+
+	height := level(dealSize)
+	a := &Aggregate{
+		DealSize: dealSize,
+		Index:    make([]SegmentDesc, len(pieces)),
+		levels:   make([]map[uint64]Node, height+1),
+	}
+	for l := range a.levels {
+		a.levels[l] = make(map[uint64]Node)
+	}
+
+	for i, p := range pieces {
+		a.Index[i] = newSegmentDesc(p, offsets[i])
+		a.levels[level(p.Size)][offsets[i]/p.Size] = p.CommP
+	}
+
+	// index entries are two leaves each, so a node one level up
+	first := IndexStartOffset(dealSize) / EntrySize
+	for i, sd := range a.Index {
+		a.levels[1][first+uint64(i)] = sd.node()
+	}
+
+	for l := 0; l < height; l++ {
+		for idx := range a.levels[l] {
+			parent := idx / 2
+			if _, ok := a.levels[l+1][parent]; ok {
+				continue
+			}
+			a.levels[l+1][parent] = hashNodes(a.node(l, parent*2), a.node(l, parent*2+1))
+		}
+	}
+	return a, nil
+}
+
+func (a *Aggregate) node(l int, idx uint64) Node {
+	if n, ok := a.levels[l][idx]; ok {
+		return n
+	}
+	return zeroComms[l]
+}
+
+// CommP is the root of the aggregate piece
+func (a *Aggregate) CommP() Node {
+	return a.node(len(a.levels)-1, 0)
+}
+
+// IndexData is the segment index as it is written in the data of the
+// aggregate, unpadded so that padding the data gives back the index entries
+func (a *Aggregate) IndexData() []byte {
+	padded := make([]byte, MaxIndexEntriesInDeal(a.DealSize)*EntrySize)
+	for i, sd := range a.Index {
+		b := sd.Serialize()
+		copy(padded[i*EntrySize:], b[:])
+	}
+
+	out := make([]byte, UnpaddedSize(uint64(len(padded))))
+	fr32.Unpad(padded, out)
+	return out
+}
+
+// WriteData writes the data of the aggregate, the bytes a provider computes
+// the aggregate piece commitment of: the data of every piece at its offset,
+// written by writePiece, then zeroes up to the segment index at the end. The
+// data of a piece must be what its commitment was computed of, it is zero
+// padded to the piece size.
+func (a *Aggregate) WriteData(w io.Writer, writePiece func(i int, w io.Writer) error) error {
+	zw := &zeroWriter{w: w}
+	for i, sd := range a.Index {
+		if err := zw.zeroes(UnpaddedSize(sd.Offset) - zw.n); err != nil {
+			return err
+		}
+
+		pw := &pieceWriter{zw: zw, left: UnpaddedSize(sd.Size)}
+		if err := writePiece(i, pw); err != nil {
+			return err
+		}
+
+		if err := zw.zeroes(pw.left); err != nil {
+			return err
+		}
+	}
+
+	if err := zw.zeroes(UnpaddedSize(IndexStartOffset(a.DealSize)) - zw.n); err != nil {
+		return err
+	}
+
+	_, err := zw.Write(a.IndexData())
+	return err
+}
+
+// zeroWriter counts the bytes written to w
+type zeroWriter struct {
+	w io.Writer
+	n uint64
+}
+
+var zeroBuf = make([]byte, 64<<10)
+
+func (zw *zeroWriter) Write(p []byte) (int, error) {
+	n, err := zw.w.Write(p)
+	zw.n += uint64(n)
+	return n, err
+}
+
+func (zw *zeroWriter) zeroes(n uint64) error {
+	for n > 0 {
+		chunk := uint64(len(zeroBuf))
+		if n < chunk {
+			chunk = n
+		}
+
+		if _, err := zw.Write(zeroBuf[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// pieceWriter keeps the data of a piece within the piece
+type pieceWriter struct {
+	zw   *zeroWriter
+	left uint64
+}
+
+func (pw *pieceWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) > pw.left {
+		return 0, fmt.Errorf("piece data is larger than the %d bytes left in the piece", pw.left)
+	}
+
+	n, err := pw.zw.Write(p)
+	pw.left -= uint64(n)
+	return n, err
+}
+
+func (a *Aggregate) proof(l int, idx uint64) MerkleProof {
+	mp := MerkleProof{Index: idx}
+	for ; l < len(a.levels)-1; l++ {
+		mp.Path = append(mp.Path, a.node(l, idx^1))
+		idx /= 2
+	}
+	return mp
+}
+
+// ProofForPiece returns the inclusion proof of the i-th piece
+func (a *Aggregate) ProofForPiece(i int) (*InclusionProof, error) {
+	if i < 0 || i >= len(a.Index) {
+		return nil, fmt.Errorf("no piece %d in aggregate", i)
+	}
+
+	sd := a.Index[i]
+	return &InclusionProof{
+		ProofSubtree: a.proof(level(sd.Size), sd.Offset/sd.Size),
+		ProofIndex:   a.proof(1, IndexStartOffset(a.DealSize)/EntrySize+uint64(i)),
+	}, nil
+}
+
+// MerkleProof is the path from a node to the root of a tree
+type MerkleProof struct {
+	// Index is the position of the node at its level of the tree
+	Index uint64 `json:"index"`
+	Path  []Node `json:"path"`
+}
+
+// ComputeRoot returns the root of the tree n is in according to the proof
+func (mp MerkleProof) ComputeRoot(n Node) Node {
+	idx := mp.Index
+	for _, sib := range mp.Path {
+		if idx&1 == 0 {
+			n = hashNodes(n, sib)
+		} else {
+			n = hashNodes(sib, n)
+		}
+		idx /= 2
+	}
+	return n
+}
+
+// InclusionProof proves a piece is in an aggregate and in its segment index
+type InclusionProof struct {
+	// ProofSubtree is the path from the piece to the aggregate root
+	ProofSubtree MerkleProof `json:"proofSubtree"`
+	// ProofIndex is the path from the index entry of the piece to the
+	// aggregate root
+	ProofIndex MerkleProof `json:"proofIndex"`
+}
+
+// Verify checks the proof shows p is in the aggregate with the given root and
+// padded size
+func (ip *InclusionProof) Verify(p Piece, root Node, dealSize uint64) error {
+	if !isPieceSize(p.Size) || !isPieceSize(dealSize) || p.Size > dealSize {
+		return fmt.Errorf("invalid piece or aggregate size")
+	}
+
+	height := level(dealSize)
+	if len(ip.ProofSubtree.Path) != height-level(p.Size) {
+		return fmt.Errorf("subtree proof has the wrong length")
+	}
+
+	if ip.ProofSubtree.ComputeRoot(p.CommP) != root {
+		return fmt.Errorf("piece is not in the aggregate")
+	}
+
+	if len(ip.ProofIndex.Path) != height-1 {
+		return fmt.Errorf("index proof has the wrong length")
+	}
+
+	first := IndexStartOffset(dealSize) / EntrySize
+	if ip.ProofIndex.Index < first || ip.ProofIndex.Index >= first+MaxIndexEntriesInDeal(dealSize) {
+		return fmt.Errorf("index proof is not for an entry of the segment index")
+	}
+
+	sd := newSegmentDesc(p, ip.ProofSubtree.Index*p.Size)
+	if ip.ProofIndex.ComputeRoot(sd.node()) != root {
+		return fmt.Errorf("piece is not in the segment index of the aggregate")
+	}
+	return nil
+}
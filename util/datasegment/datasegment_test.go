@@ -0,0 +1,188 @@
+package datasegment
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randLeaves(rng *rand.Rand, n int) []Node {
+	out := make([]Node, n)
+	for i := range out {
+		rng.Read(out[i][:])
+		out[i][nodeSize-1] &= 0x3f
+	}
+	return out
+}
+
+func naiveRoot(leaves []Node) Node {
+	for len(leaves) > 1 {
+		next := make([]Node, len(leaves)/2)
+		for i := range next {
+			next[i] = hashNodes(leaves[2*i], leaves[2*i+1])
+		}
+		leaves = next
+	}
+	return leaves[0]
+}
+
+func TestAggregateMatchesFullTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	sizes := []uint64{1024, 512, 256, 128}
+	var pieces []Piece
+	var data [][]Node
+	for _, s := range sizes {
+		leaves := randLeaves(rng, int(s/nodeSize))
+		data = append(data, leaves)
+		pieces = append(pieces, Piece{CommP: naiveRoot(leaves), Size: s})
+	}
+
+	dealSize, err := DealSize(pieces)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4096), dealSize)
+
+	agg, err := NewAggregate(dealSize, pieces)
+	require.NoError(t, err)
+
+	// write out the whole aggregate and hash it the slow way
+	full := make([]Node, dealSize/nodeSize)
+	for i, sd := range agg.Index {
+		copy(full[sd.Offset/nodeSize:], data[i])
+	}
+
+	start := IndexStartOffset(dealSize) / nodeSize
+	for i, sd := range agg.Index {
+		b := sd.Serialize()
+		copy(full[start+2*uint64(i)][:], b[:32])
+		copy(full[start+2*uint64(i)+1][:], b[32:])
+	}
+	assert.Equal(t, naiveRoot(full), agg.CommP())
+
+	for i, p := range pieces {
+		proof, err := agg.ProofForPiece(i)
+		require.NoError(t, err)
+		assert.NoError(t, proof.Verify(p, agg.CommP(), dealSize))
+
+		// a proof does not hold for another piece
+		other := pieces[(i+1)%len(pieces)]
+		assert.Error(t, proof.Verify(other, agg.CommP(), dealSize))
+	}
+}
+
+func TestWriteData(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	// pieces of data that does not fill them, as cars are zero padded
+	var pieces []Piece
+	var data [][]byte
+	for _, l := range []int{5000, 1200, 1000, 100} {
+		b := make([]byte, l)
+		rng.Read(b)
+
+		cp := &commp.Calc{}
+		_, err := cp.Write(b)
+		require.NoError(t, err)
+		root, size, err := cp.Digest()
+		require.NoError(t, err)
+
+		var n Node
+		copy(n[:], root)
+		pieces = append(pieces, Piece{CommP: n, Size: size})
+		data = append(data, b)
+	}
+
+	dealSize, err := DealSize(pieces)
+	require.NoError(t, err)
+
+	agg, err := NewAggregate(dealSize, pieces)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, agg.WriteData(&buf, func(i int, w io.Writer) error {
+		_, err := w.Write(data[i])
+		return err
+	}))
+	assert.Equal(t, UnpaddedSize(dealSize), uint64(buf.Len()))
+
+	// providers compute the piece commitment of the data they get
+	cp := &commp.Calc{}
+	_, err = cp.Write(buf.Bytes())
+	require.NoError(t, err)
+	root, size, err := cp.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, dealSize, size)
+
+	var got Node
+	copy(got[:], root)
+	assert.Equal(t, agg.CommP(), got)
+
+	// data larger than its piece is refused
+	assert.Error(t, agg.WriteData(io.Discard, func(i int, w io.Writer) error {
+		_, err := w.Write(make([]byte, UnpaddedSize(pieces[i].Size)+1))
+		return err
+	}))
+}
+
+func TestLayoutAlignment(t *testing.T) {
+	pieces := []Piece{{Size: 128}, {Size: 512}, {Size: 128}}
+
+	agg, err := NewAggregate(4096, pieces)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), agg.Index[0].Offset)
+	assert.Equal(t, uint64(512), agg.Index[1].Offset)
+	assert.Equal(t, uint64(1024), agg.Index[2].Offset)
+
+	_, err = NewAggregate(1024, []Piece{{Size: 1024}})
+	assert.Error(t, err)
+
+	_, err = NewAggregate(4096, []Piece{{Size: 100}})
+	assert.Error(t, err)
+}
+
+func TestMaxIndexEntriesInDeal(t *testing.T) {
+	// values of the FRC-0058 reference implementation
+	for size, entries := range map[uint64]uint64{
+		2 << 10:   4,
+		256 << 10: 4,
+		512 << 10: 4,
+		1 << 20:   8,
+		8 << 20:   64,
+		1 << 30:   8192,
+		32 << 30:  1 << 18,
+		64 << 30:  1 << 19,
+	} {
+		assert.Equal(t, entries, MaxIndexEntriesInDeal(size), "deal size %d", size)
+	}
+
+	assert.Equal(t, uint64(32<<30)-(1<<18)*EntrySize, IndexStartOffset(32<<30))
+}
+
+func TestTamperedProof(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	var pieces []Piece
+	for i := 0; i < 3; i++ {
+		pieces = append(pieces, Piece{CommP: naiveRoot(randLeaves(rng, 8)), Size: 256})
+	}
+
+	agg, err := NewAggregate(2048, pieces)
+	require.NoError(t, err)
+
+	proof, err := agg.ProofForPiece(1)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(pieces[1], agg.CommP(), 2048))
+
+	proof.ProofIndex.Path[0][0] ^= 1
+	assert.Error(t, proof.Verify(pieces[1], agg.CommP(), 2048))
+
+	proof, err = agg.ProofForPiece(1)
+	require.NoError(t, err)
+	proof.ProofSubtree.Index++
+	assert.Error(t, proof.Verify(pieces[1], agg.CommP(), 2048))
+}
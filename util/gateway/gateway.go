@@ -1,36 +1,55 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	gopath "path"
 	"strings"
 	"time"
 
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
-	bsfetcher "github.com/ipfs/go-fetcher/impl/blockservice"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	mdagipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-path"
-	resolver "github.com/ipfs/go-path/resolver"
 	unixfs "github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
-	"github.com/ipfs/go-unixfsnode"
-	dagpb "github.com/ipld/go-codec-dagpb"
-	"github.com/ipld/go-ipld-prime"
-	ipldbasicnode "github.com/ipld/go-ipld-prime/node/basic"
-	"github.com/ipld/go-ipld-prime/schema"
+	car "github.com/ipld/go-car"
 	"golang.org/x/xerrors"
 )
 
+var log = logging.Logger("gateway")
+
+// Response formats the gateway can serve, other than the default unixfs one
+const (
+	FormatRaw = "raw"
+	FormatCar = "car"
+)
+
+const (
+	ContentTypeRaw = "application/vnd.ipld.raw"
+	ContentTypeCar = "application/vnd.ipld.car"
+)
+
+// content under /ipfs/ paths never changes, so it can be cached forever
+const immutableCacheControl = "public, max-age=29030400, immutable"
+
+// maxSymlinks bounds the number of symlinks followed while resolving a path,
+// to avoid looping forever on symlink cycles
+const maxSymlinks = 32
+
 type GatewayHandler struct {
-	bs       blockstore.Blockstore
-	dserv    mdagipld.DAGService
-	resolver *resolver.Resolver
+	bs    blockstore.Blockstore
+	dserv mdagipld.DAGService
 }
 
 type httpError struct {
@@ -38,49 +57,153 @@ type httpError struct {
 	Message string
 }
 
-func NewGatewayHandler(bs blockstore.Blockstore) *GatewayHandler {
+func (he *httpError) Error() string {
+	return he.Message
+}
 
-	bsvc := blockservice.New(bs, nil)
-	ipldFetcher := bsfetcher.NewFetcherConfig(bsvc)
+func newHttpError(code int, format string, args ...interface{}) *httpError {
+	return &httpError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
 
-	ipldFetcher.PrototypeChooser = dagpb.AddSupportToChooser(func(lnk ipld.Link, lnkCtx ipld.LinkContext) (ipld.NodePrototype, error) {
-		if tlnkNd, ok := lnkCtx.LinkNode.(schema.TypedLinkNode); ok {
-			return tlnkNd.LinkTargetNodePrototype(), nil
-		}
-		return ipldbasicnode.Prototype.Any, nil
-	})
+func NewGatewayHandler(bs blockstore.Blockstore) *GatewayHandler {
+	bsvc := blockservice.New(bs, nil)
 
 	return &GatewayHandler{
-		bs:       bs,
-		dserv:    merkledag.NewDAGService(bsvc),
-		resolver: resolver.NewBasicResolver(ipldFetcher.WithReifier(unixfsnode.Reify)),
+		bs:    bs,
+		dserv: merkledag.NewDAGService(bsvc),
 	}
 }
 
 func (gw *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := gw.handleRequest(r.Context(), w, r); err != nil {
-		http.Error(w, "error: "+err.Error(), 500)
+		code := http.StatusInternalServerError
+
+		var herr *httpError
+		if xerrors.As(err, &herr) {
+			code = herr.Code
+		} else if xerrors.Is(err, mdagipld.ErrNotFound) || xerrors.Is(err, blockstore.ErrNotFound) {
+			code = http.StatusNotFound
+		}
+
+		// errors may be temporary, such as a block that was not fetched yet,
+		// so only successful responses are cached for good
+		w.Header().Del("Cache-Control")
+		http.Error(w, "error: "+err.Error(), code)
 		return
 	}
 }
 
 func (gw *GatewayHandler) handleRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	cc, err := gw.resolvePath(ctx, r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return newHttpError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+
+	output, err := responseFormat(r)
+	if err != nil {
+		return err
+	}
+
+	cc, name, err := gw.resolvePath(ctx, r.URL.Path)
 	if err != nil {
 		return fmt.Errorf("path resolution failed: %w", err)
 	}
 
-	output := "unixfs"
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+	w.Header().Set("X-Ipfs-Roots", cc.String())
 
 	switch output {
 	case "unixfs":
-		return gw.serveUnixfs(ctx, cc, w, r)
+		return gw.serveUnixfs(ctx, cc, name, w, r)
+	case FormatRaw:
+		return gw.serveRaw(ctx, cc, w, r)
+	case FormatCar:
+		return gw.serveCar(ctx, cc, w, r)
 	default:
 		return fmt.Errorf("requested output type unsupported")
 	}
 }
 
-func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.ResponseWriter, req *http.Request) error {
+// responseFormat picks the format of the response from the format query
+// parameter, or failing that the Accept header of the request
+func responseFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case FormatRaw, FormatCar:
+		return f, nil
+	default:
+		return "", newHttpError(http.StatusBadRequest, "unsupported format %q", f)
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		switch mt {
+		case ContentTypeRaw:
+			return FormatRaw, nil
+		case ContentTypeCar:
+			return FormatCar, nil
+		}
+	}
+
+	return "unixfs", nil
+}
+
+func (gw *GatewayHandler) serveRaw(ctx context.Context, cc cid.Cid, w http.ResponseWriter, req *http.Request) error {
+	blk, err := gw.bs.Get(ctx, cc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", ContentTypeRaw)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.bin\"", cc))
+	w.Header().Set("Etag", fmt.Sprintf("\"%s.raw\"", cc))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, req, cc.String()+".bin", time.Time{}, bytes.NewReader(blk.RawData()))
+	return nil
+}
+
+func (gw *GatewayHandler) serveCar(ctx context.Context, cc cid.Cid, w http.ResponseWriter, req *http.Request) error {
+	etag := fmt.Sprintf("\"%s.car\"", cc)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	// make sure the root is here before committing to a successful response
+	has, err := gw.bs.Has(ctx, cc)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return newHttpError(http.StatusNotFound, "block %s not found", cc)
+	}
+
+	w.Header().Set("Content-Type", ContentTypeCar+"; version=1")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.car\"", cc))
+	w.Header().Set("Etag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	// the car is streamed, so once it has started all we can do about errors
+	// is cut the response short
+	if err := car.WriteCar(ctx, gw.dserv, []cid.Cid{cc}, w); err != nil {
+		log.Errorf("failed to write car for %s: %s", cc, err)
+	}
+	return nil
+}
+
+func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, name string, w http.ResponseWriter, req *http.Request) error {
 	nd, err := gw.dserv.Get(ctx, cc)
 	if err != nil {
 		return err
@@ -96,7 +219,9 @@ func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.Re
 			return gw.serveUnixfsDir(ctx, nd, w, req)
 		}
 		if n.Type() == unixfs.TSymlink {
-			return fmt.Errorf("symlinks not supported")
+			// symlinks are followed during path resolution, so this can only
+			// happen when the root itself is one
+			return newHttpError(http.StatusBadRequest, "cannot resolve symlink %s outside of a directory", cc)
 		}
 	case *merkledag.RawNode:
 	default:
@@ -108,12 +233,48 @@ func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.Re
 		return err
 	}
 
-	http.ServeContent(w, req, cc.String(), time.Time{}, dr)
+	return serveFile(w, req, cc, name, dr)
+}
+
+// serveFile serves the contents of a file, handling range and conditional
+// requests. The content type is guessed from the extension of name, or by
+// sniffing the start of the file.
+func serveFile(w http.ResponseWriter, req *http.Request, cc cid.Cid, name string, rs io.ReadSeeker) error {
+	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", cc))
+
+	ctype := mime.TypeByExtension(gopath.Ext(name))
+	if ctype == "" {
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(rs, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", ctype)
+
+	http.ServeContent(w, req, name, time.Time{}, rs)
 	return nil
 }
 
 func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w http.ResponseWriter, req *http.Request) error {
-	// TODO: something less ugly
+	// relative links in index pages and listings only work if the directory
+	// path ends with a slash. The redirect is relative since the gateway may
+	// be mounted under a prefix that is not part of the request path.
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		loc := url.PathEscape(gopath.Base(req.URL.Path)) + "/"
+		if req.URL.RawQuery != "" {
+			loc += "?" + req.URL.RawQuery
+		}
+		w.Header().Set("Location", loc)
+		w.WriteHeader(http.StatusMovedPermanently)
+		return nil
+	}
+
 	dir, err := uio.NewDirectoryFromNode(gw.dserv, n)
 	if err != nil {
 		return err
@@ -127,18 +288,23 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 			return err
 		}
 
-		http.ServeContent(w, req, "index.html", time.Time{}, dr)
-		return nil
+		return serveFile(w, req, nd.Cid(), "index.html", dr)
 	default:
 		return err
 	case xerrors.Is(err, os.ErrNotExist):
 
 	}
 
+	w.Header().Set("Etag", fmt.Sprintf("\"DirIndex-%s\"", n.Cid()))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
 	fmt.Fprintf(w, "<html><body><ul>")
 
 	if err := dir.ForEachLink(ctx, func(lnk *mdagipld.Link) error {
-		fmt.Fprintf(w, "<li><a href=\"./%s\">%s</a></li>", lnk.Name, lnk.Name)
+		fmt.Fprintf(w, "<li><a href=\"./%s\">%s</a></li>", url.PathEscape(lnk.Name), html.EscapeString(lnk.Name))
 		return nil
 	}); err != nil {
 		return err
@@ -148,31 +314,141 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 	return nil
 }
 
-func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, error) {
-	proto, _, _, err := ParsePath(p) // a sanity check
+// resolvePath resolves a gateway path to the cid it points at, walking unixfs
+// directories (sharded or not) and following symlinks along the way. It also
+// returns the name of the last path segment, which is used to guess the
+// content type of files.
+func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, string, error) {
+	proto, root, segs, err := ParsePath(p)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
+		return cid.Undef, "", newHttpError(http.StatusBadRequest, "failed to parse request path: %s", err)
+	}
+
+	if proto != "ipfs" {
+		return cid.Undef, "", newHttpError(http.StatusBadRequest, "unsupported protocol: %s", proto)
 	}
 
-	pp, err := path.ParsePath(p)
+	// the cids of the directories walked through, so that '..' can go back up
+	stack := []cid.Cid{root}
+	name := root.String()
+	var symlinks int
+
+	for i := 0; i < len(segs); i++ {
+		seg := segs[i]
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		child, err := gw.findChild(ctx, cur, seg)
+		if err != nil {
+			return cid.Undef, "", err
+		}
+
+		target, ok, err := symlinkTarget(child)
+		if err != nil {
+			return cid.Undef, "", err
+		}
+
+		if !ok {
+			stack = append(stack, child.Cid())
+			name = seg
+			continue
+		}
+
+		symlinks++
+		if symlinks > maxSymlinks {
+			return cid.Undef, "", newHttpError(http.StatusBadRequest, "too many levels of symbolic links")
+		}
+
+		rest := segs[i+1:]
+		if strings.HasPrefix(target, "/") {
+			// absolute symlinks only make sense when they point at another
+			// ipfs path
+			tproto, troot, tsegs, err := ParsePath(target)
+			if err != nil || tproto != "ipfs" {
+				return cid.Undef, "", newHttpError(http.StatusBadRequest, "cannot resolve symlink %q to %q", seg, target)
+			}
+
+			stack = []cid.Cid{troot}
+			name = troot.String()
+			segs = append(tsegs, rest...)
+		} else {
+			// relative symlinks are resolved from the directory containing
+			// them, which is still at the top of the stack
+			segs = append(strings.Split(target, "/"), rest...)
+		}
+		i = -1
+	}
+
+	return stack[len(stack)-1], name, nil
+}
+
+// ResolvePath resolves a /ipfs/ path to the cid it points at
+func (gw *GatewayHandler) ResolvePath(ctx context.Context, p string) (cid.Cid, error) {
+	cc, _, err := gw.resolvePath(ctx, p)
+	return cc, err
+}
+
+func (gw *GatewayHandler) findChild(ctx context.Context, parent cid.Cid, name string) (mdagipld.Node, error) {
+	nd, err := gw.dserv.Get(ctx, parent)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
+		return nil, err
 	}
 
-	cc, segs, err := gw.resolver.ResolveToLastNode(ctx, pp)
+	pbnd, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return nil, newHttpError(http.StatusNotFound, "no link named %q under %s", name, parent)
+	}
+
+	fsn, err := unixfs.FSNodeFromBytes(pbnd.Data())
 	if err != nil {
-		return cid.Undef, err
+		return nil, newHttpError(http.StatusBadRequest, "pathing into non-unixfs node %s not supported", parent)
+	}
+
+	if !fsn.IsDir() {
+		return nil, newHttpError(http.StatusNotFound, "no link named %q under %s", name, parent)
 	}
 
-	switch proto {
-	case "ipfs":
-		if len(segs) > 0 {
-			return cid.Undef, fmt.Errorf("pathing into ipld nodes not supported")
+	dir, err := uio.NewDirectoryFromNode(gw.dserv, pbnd)
+	if err != nil {
+		return nil, err
+	}
+
+	child, err := dir.Find(ctx, name)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return nil, newHttpError(http.StatusNotFound, "no link named %q under %s", name, parent)
 		}
-		return cc, nil
-	default:
-		return cid.Undef, fmt.Errorf("unsupported protocol: %s", proto)
+		return nil, err
+	}
+	return child, nil
+}
+
+// symlinkTarget returns the target of nd if it is a unixfs symlink
+func symlinkTarget(nd mdagipld.Node) (string, bool, error) {
+	pbnd, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return "", false, nil
+	}
+
+	fsn, err := unixfs.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		// not a unixfs node, so not a symlink either
+		return "", false, nil
 	}
+
+	if fsn.Type() != unixfs.TSymlink {
+		return "", false, nil
+	}
+
+	return string(fsn.Data()), true, nil
 }
 
 func ParsePath(p string) (string, cid.Cid, []string, error) {
@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	mdagipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	"github.com/ipfs/go-unixfs/importer"
+	car "github.com/ipld/go-car"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDag struct {
+	gw    *GatewayHandler
+	dserv mdagipld.DAGService
+}
+
+func newTestDag() *testDag {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	gw := NewGatewayHandler(bs)
+	return &testDag{gw: gw, dserv: gw.dserv}
+}
+
+func (td *testDag) file(t *testing.T, data []byte) mdagipld.Node {
+	nd, err := importer.BuildDagFromReader(td.dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 1024))
+	require.NoError(t, err)
+	return nd
+}
+
+func (td *testDag) symlink(t *testing.T, target string) mdagipld.Node {
+	data, err := unixfs.SymlinkData(target)
+	require.NoError(t, err)
+
+	nd := merkledag.NodeWithData(data)
+	require.NoError(t, td.dserv.Add(context.Background(), nd))
+	return nd
+}
+
+func (td *testDag) dir(t *testing.T, links map[string]mdagipld.Node) mdagipld.Node {
+	dir := unixfs.EmptyDirNode()
+	for name, nd := range links {
+		require.NoError(t, dir.AddNodeLink(name, nd))
+	}
+	require.NoError(t, td.dserv.Add(context.Background(), dir))
+	return dir
+}
+
+func (td *testDag) shardedDir(t *testing.T, links map[string]mdagipld.Node) mdagipld.Node {
+	ctx := context.Background()
+
+	shard, err := hamt.NewShard(td.dserv, 256)
+	require.NoError(t, err)
+	for name, nd := range links {
+		require.NoError(t, shard.Set(ctx, name, nd))
+	}
+
+	nd, err := shard.Node()
+	require.NoError(t, err)
+	require.NoError(t, td.dserv.Add(ctx, nd))
+	return nd
+}
+
+func (td *testDag) get(path string, hdrs ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	td.gw.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGatewayPathResolution(t *testing.T) {
+	td := newTestDag()
+
+	hello := td.file(t, []byte("hello world"))
+
+	sharded := map[string]mdagipld.Node{}
+	for i := 0; i < 500; i++ {
+		sharded[fmt.Sprintf("file-%d.txt", i)] = td.file(t, []byte(fmt.Sprintf("file %d", i)))
+	}
+
+	root := td.dir(t, map[string]mdagipld.Node{
+		"sub": td.dir(t, map[string]mdagipld.Node{
+			"hello.txt": hello,
+			"link":      td.symlink(t, "../shard/file-42.txt"),
+		}),
+		"shard":   td.shardedDir(t, sharded),
+		"sublink": td.symlink(t, "sub"),
+		"loop":    td.symlink(t, "loop"),
+	})
+	base := "/ipfs/" + root.Cid().String()
+
+	rec := td.get(base + "/sub/hello.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello world", rec.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf("\"%s\"", hello.Cid()), rec.Header().Get("Etag"))
+	assert.Contains(t, rec.Header().Get("Cache-Control"), "immutable")
+
+	rec = td.get(base + "/shard/file-123.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "file 123", rec.Body.String())
+
+	rec = td.get(base + "/sublink/hello.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello world", rec.Body.String())
+
+	rec = td.get(base + "/sub/link")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "file 42", rec.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, td.get(base+"/sub/missing").Code)
+	assert.Equal(t, http.StatusNotFound, td.get(base+"/shard/missing").Code)
+	assert.Equal(t, http.StatusNotFound, td.get(base+"/sub/hello.txt/more").Code)
+	assert.Equal(t, http.StatusBadRequest, td.get(base+"/loop").Code)
+
+	missing := td.file(t, []byte("not stored"))
+	require.NoError(t, td.dserv.Remove(context.Background(), missing.Cid()))
+	for _, format := range []string{"", "raw", "car"} {
+		rec = td.get("/ipfs/" + missing.Cid().String() + "?format=" + format)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Empty(t, rec.Header().Get("Cache-Control"))
+	}
+
+	rec = td.get(base + "/sub")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "sub/", rec.Header().Get("Location"))
+
+	rec = td.get(base + "/sub/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "hello.txt")
+}
+
+func TestGatewayRanges(t *testing.T) {
+	td := newTestDag()
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	file := td.file(t, data)
+
+	rec := td.get("/ipfs/"+file.Cid().String(), "Range", "bytes=10000-10999")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, data[10000:11000], rec.Body.Bytes())
+	assert.Equal(t, fmt.Sprintf("bytes 10000-10999/%d", len(data)), rec.Header().Get("Content-Range"))
+
+	rec = td.get("/ipfs/"+file.Cid().String(), "If-None-Match", fmt.Sprintf("\"%s\"", file.Cid()))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+}
+
+func TestGatewayFormats(t *testing.T) {
+	td := newTestDag()
+
+	hello := td.file(t, []byte("hello world"))
+	root := td.dir(t, map[string]mdagipld.Node{"hello.txt": hello})
+	base := "/ipfs/" + root.Cid().String()
+
+	rec := td.get(base + "/hello.txt?format=raw")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeRaw, rec.Header().Get("Content-Type"))
+	assert.Equal(t, hello.RawData(), rec.Body.Bytes())
+
+	rec = td.get(base+"/hello.txt", "Accept", ContentTypeRaw)
+	assert.Equal(t, ContentTypeRaw, rec.Header().Get("Content-Type"))
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		td.get(base + "?format=car"),
+		td.get(base, "Accept", "text/html, "+ContentTypeCar+";version=1"),
+	} {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, ContentTypeCar+"; version=1", rec.Header().Get("Content-Type"))
+
+		cr, err := car.NewCarReader(rec.Body)
+		require.NoError(t, err)
+		assert.Equal(t, []cid.Cid{root.Cid()}, cr.Header.Roots)
+
+		var blocks int
+		for {
+			blk, err := cr.Next()
+			if err != nil {
+				break
+			}
+			blocks++
+			assert.Contains(t, []cid.Cid{root.Cid(), hello.Cid()}, blk.Cid())
+		}
+		assert.Equal(t, 2, blocks)
+	}
+
+	rec = td.get(base + "?format=tar")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Contains(t, string(body), "unsupported format")
+}
@@ -39,6 +39,17 @@ const (
 	ERR_PEERING_PEERS_STOP_ERROR   = "ERR_PEERING_PEERS_STOP_ERROR"
 	ERR_CONTENT_NOT_FOUND          = "ERR_CONTENT_NOT_FOUND"
 	ERR_INVALID_PINNING_STATUS     = "ERR_INVALID_PINNING_STATUS"
+	ERR_ORG_NOT_FOUND              = "ERR_ORG_NOT_FOUND"
+	ERR_QUOTA_EXCEEDED             = "ERR_QUOTA_EXCEEDED"
+	ERR_UPLOAD_NOT_FOUND           = "ERR_UPLOAD_NOT_FOUND"
+	ERR_UPLOAD_LOCKED              = "ERR_UPLOAD_LOCKED"
+	ERR_UPLOAD_OFFSET_MISMATCH     = "ERR_UPLOAD_OFFSET_MISMATCH"
+	ERR_WEBHOOK_NOT_FOUND          = "ERR_WEBHOOK_NOT_FOUND"
+	ERR_INVALID_CAR                = "ERR_INVALID_CAR"
+	ERR_PATH_CONFLICT              = "ERR_PATH_CONFLICT"
+	ERR_PATH_NOT_FOUND             = "ERR_PATH_NOT_FOUND"
+	ERR_PROOF_NOT_FOUND            = "ERR_PROOF_NOT_FOUND"
+	ERR_TRANSFER_LIMIT_REACHED     = "ERR_TRANSFER_LIMIT_REACHED"
 )
 
 type HttpError struct {
@@ -136,6 +147,8 @@ type ViewerResponse struct {
 	Address    string       `json:"address,omitempty"`
 	Miners     []string     `json:"miners,omitempty"`
 	AuthExpiry time.Time    `json:"auth_expiry,omitempty"`
+	Scopes     Scopes       `json:"scopes,omitempty"`
+	Quota      *QuotaStatus `json:"quota,omitempty"`
 	Settings   UserSettings `json:"settings"`
 }
 
@@ -0,0 +1,522 @@
+// Package piecetransfer serves the data of storage deals made with the http
+// transfer type of the boost deal protocol.
+//
+// Before the deal proposal is sent the data of the deal is registered with an
+// auth token. The storage provider then downloads the car of the deal payload
+// from /piece/<commP>, authenticating with the token, and resumes interrupted
+// downloads with range requests. The car is streamed from the blockstore the
+// way the piece commitment was computed, so the bytes served always match the
+// piece of the deal. The piece of an aggregate is laid out as data segments
+// instead, with the car of every aggregated content at its offset and the car
+// of the root block of the aggregate dag in a segment of its own. Prepared
+// transfers are kept in the database so that providers can resume downloads
+// across restarts.
+package piecetransfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bandwidth"
+	"github.com/application-research/estuary/util/datasegment"
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var log = logging.Logger("piecetransfer")
+
+// TransferType is the boost transfer type of deals served by this package
+const TransferType = "http"
+
+// TransferIDPrefix starts the transfer IDs of http transfers, telling them
+// apart from data transfer channel IDs
+const TransferIDPrefix = "http-"
+
+// same limit filclient computes piece commitments with
+const maxTraversalLinks = 32 * (1 << 20)
+
+// progressInterval is how often progress is reported while a request is
+// being served
+const progressInterval = time.Second * 10
+
+// TransferID is the ID of the http transfer of the deal with the given
+// database ID
+func TransferID(dbid uint) string {
+	return fmt.Sprintf("%s%d", TransferIDPrefix, dbid)
+}
+
+// PiecePath is the path the piece with the given commP is served at
+func PiecePath(piece cid.Cid) string {
+	return "/piece/" + piece.String()
+}
+
+// PieceTransfer is the data of a deal prepared for download by its provider
+type PieceTransfer struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	DealDBID uint   `gorm:"uniqueIndex"`
+	Token    string `gorm:"index"`
+	Piece    util.DbCID
+	Payload  util.DbCID
+	Size     uint64
+	// Segments is the json encoded layout of the data segment aggregate the
+	// piece is, empty when the piece is the car of the payload
+	Segments string
+
+	// Sent is the highest offset of the car sent to the provider
+	Sent      uint64
+	Started   time.Time
+	Completed time.Time
+}
+
+func (pt *PieceTransfer) state(msg string) filclient.ChannelState {
+	status := datatransfer.Requested
+	switch {
+	case !pt.Completed.IsZero():
+		status = datatransfer.Completed
+	case !pt.Started.IsZero():
+		status = datatransfer.Ongoing
+	}
+
+	return filclient.ChannelState{
+		Status:     status,
+		StatusStr:  datatransfer.Statuses[status],
+		Sent:       pt.Sent,
+		Message:    msg,
+		BaseCid:    pt.Payload.CID.String(),
+		TransferID: TransferID(pt.DealDBID),
+	}
+}
+
+// Segment is a piece of a data segment aggregate, the car of Payload whose
+// commitment is Piece
+type Segment struct {
+	Payload cid.Cid `json:"payload"`
+	Piece   cid.Cid `json:"piece"`
+	// Size is the padded size of the piece
+	Size uint64 `json:"size"`
+	// RootOnly makes the car hold the root block of Payload alone
+	RootOnly bool `json:"rootOnly,omitempty"`
+}
+
+// Server keeps the transfers prepared for deals and serves their data
+type Server struct {
+	db *gorm.DB
+	bs blockstore.Blockstore
+	bw *bandwidth.Limiter
+
+	lk        sync.Mutex
+	messages  map[uint]string
+	listeners []func(dbid uint, st filclient.ChannelState)
+}
+
+// NewServer creates a piece server sending the pieces within the bandwidth
+// of bw, shared with the other transfers of the node
+func NewServer(db *gorm.DB, bs blockstore.Blockstore, bw *bandwidth.Limiter) *Server {
+	return &Server{
+		db:       db,
+		bs:       bs,
+		bw:       bw,
+		messages: make(map[uint]string),
+	}
+}
+
+// Subscribe registers a function called with the state of a transfer when
+// the provider starts downloading, periodically while it does and when the
+// whole car has been sent
+func (s *Server) Subscribe(listener func(dbid uint, st filclient.ChannelState)) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Prepare allows a provider holding authToken to download the car of
+// payload, of the given size, as the piece of the deal with the given
+// database ID. When segments are given the piece is the data segment
+// aggregate of them, in that order, and size is its unpadded size.
+func (s *Server) Prepare(dbid uint, authToken string, piece cid.Cid, payload cid.Cid, size uint64, segments []Segment) error {
+	if authToken == "" {
+		return fmt.Errorf("cannot prepare transfer for deal %d without an auth token", dbid)
+	}
+
+	pt := &PieceTransfer{
+		DealDBID: dbid,
+		Token:    authToken,
+		Piece:    util.DbCID{CID: piece},
+		Payload:  util.DbCID{CID: payload},
+		Size:     size,
+	}
+
+	if len(segments) > 0 {
+		b, err := json.Marshal(segments)
+		if err != nil {
+			return err
+		}
+		pt.Segments = string(b)
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "deal_db_id"}},
+		UpdateAll: true,
+	}).Create(pt).Error
+}
+
+// Cleanup removes the transfer of a deal, it returns false if there was no
+// transfer prepared for the deal with that token
+func (s *Server) Cleanup(dbid uint, authToken string) (bool, error) {
+	res := s.db.Where("deal_db_id = ? and token = ?", dbid, authToken).Delete(&PieceTransfer{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	s.lk.Lock()
+	delete(s.messages, dbid)
+	s.lk.Unlock()
+	return res.RowsAffected > 0, nil
+}
+
+// TransferStatus returns the state of the transfer of a deal, or nil if no
+// transfer is prepared for it
+func (s *Server) TransferStatus(dbid uint) (*filclient.ChannelState, error) {
+	var pt PieceTransfer
+	if err := s.db.First(&pt, "deal_db_id = ?", dbid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	s.lk.Lock()
+	msg := s.messages[dbid]
+	s.lk.Unlock()
+
+	st := pt.state(msg)
+	return &st, nil
+}
+
+// update saves the progress of a transfer and tells the listeners about it
+func (s *Server) update(pt *PieceTransfer, msg string) {
+	s.save(pt, msg)
+	s.publish(pt.DealDBID, pt.state(msg))
+}
+
+// start records the first request of a transfer. Listeners get it as
+// requested, once, which is what tells them the transfer started.
+func (s *Server) start(pt *PieceTransfer, msg string) {
+	pt.Started = time.Now()
+	s.save(pt, msg)
+
+	st := pt.state(msg)
+	st.Status = datatransfer.Requested
+	st.StatusStr = datatransfer.Statuses[st.Status]
+	s.publish(pt.DealDBID, st)
+}
+
+func (s *Server) save(pt *PieceTransfer, msg string) {
+	if err := s.db.Model(PieceTransfer{}).Where("id = ?", pt.ID).UpdateColumns(map[string]interface{}{
+		"sent":      pt.Sent,
+		"started":   pt.Started,
+		"completed": pt.Completed,
+	}).Error; err != nil {
+		log.Errorw("failed to save piece transfer progress", "deal", pt.DealDBID, "err", err)
+	}
+
+	s.lk.Lock()
+	s.messages[pt.DealDBID] = msg
+	s.lk.Unlock()
+}
+
+func (s *Server) publish(dbid uint, st filclient.ChannelState) {
+	s.lk.Lock()
+	listeners := s.listeners
+	s.lk.Unlock()
+
+	for _, l := range listeners {
+		l(dbid, st)
+	}
+}
+
+// ServeHTTP serves GET and HEAD requests for /piece/<commP>, the token of
+// the transfer is the password of a basic authorization header
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	piece, err := cid.Decode(path.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid piece cid: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	_, token, ok := r.BasicAuth()
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="piece"`)
+		http.Error(w, "missing auth token", http.StatusUnauthorized)
+		return
+	}
+
+	var pt PieceTransfer
+	if err := s.db.First(&pt, "token = ? and piece = ?", token, piece.Bytes()).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			// do not tell apart unknown pieces and wrong tokens
+			http.Error(w, "no transfer found for piece", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to look up transfer", http.StatusInternalServerError)
+		return
+	}
+
+	start, end, err := parseRange(r.Header.Get("Range"), pt.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", pt.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if pt.Segments == "" {
+		w.Header().Set("Content-Type", util.ContentTypeCar)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Length", strconv.FormatUint(end-start, 10))
+	status := http.StatusOK
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, pt.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	s.serve(r.Context(), w, r.RemoteAddr, &pt, start, end)
+}
+
+func (s *Server) serve(ctx context.Context, w io.Writer, remote string, pt *PieceTransfer, start, end uint64) {
+	// the first request starts the transfer, the others resume it
+	if pt.Started.IsZero() {
+		s.start(pt, fmt.Sprintf("serving bytes %d-%d to %s", start, end, remote))
+	} else {
+		s.update(pt, fmt.Sprintf("serving bytes %d-%d to %s", start, end, remote))
+	}
+
+	bw := s.bw.Writer(ctx, w)
+	defer bw.Close()
+
+	rw := &rangeWriter{
+		w:    bw,
+		skip: start,
+		left: end - start,
+		progress: func(n uint64) {
+			if start+n > pt.Sent {
+				pt.Sent = start + n
+			}
+			s.update(pt, fmt.Sprintf("serving bytes %d-%d to %s", start, end, remote))
+		},
+	}
+
+	// the traversal does not keep the error of the writer, a complete range
+	// is what tells a stop after the range from a failure
+	err := s.writeData(ctx, pt, rw)
+	if rw.left == 0 {
+		err = nil
+	} else if err == nil {
+		err = fmt.Errorf("data of %s ended %d bytes short of the transfer size", pt.Payload.CID, rw.left)
+	}
+
+	if sent := start + rw.written; sent > pt.Sent {
+		pt.Sent = sent
+	}
+
+	var msg string
+	switch {
+	case err != nil:
+		msg = fmt.Sprintf("serving bytes %d-%d to %s failed: %s", start, end, remote, err)
+		log.Warnw("failed to serve piece", "deal", pt.DealDBID, "piece", pt.Piece.CID, "remote", remote, "err", err)
+	case pt.Sent >= pt.Size:
+		if pt.Completed.IsZero() {
+			pt.Completed = time.Now()
+		}
+		msg = fmt.Sprintf("all %d bytes sent", pt.Size)
+	default:
+		msg = fmt.Sprintf("sent bytes %d-%d to %s", start, end, remote)
+	}
+	s.update(pt, msg)
+}
+
+// writeData writes the car of the payload of a transfer, or the data of the
+// data segment aggregate it is
+func (s *Server) writeData(ctx context.Context, pt *PieceTransfer, w io.Writer) error {
+	if pt.Segments == "" {
+		return s.writeCar(ctx, pt.Payload.CID, w)
+	}
+
+	var segs []Segment
+	if err := json.Unmarshal([]byte(pt.Segments), &segs); err != nil {
+		return fmt.Errorf("invalid segments of transfer: %w", err)
+	}
+
+	pieces := make([]datasegment.Piece, len(segs))
+	for i, sg := range segs {
+		n, err := datasegment.NodeFromCID(sg.Piece)
+		if err != nil {
+			return err
+		}
+		pieces[i] = datasegment.Piece{CommP: n, Size: sg.Size}
+	}
+
+	// the transfer size is the unpadded size of the aggregate
+	agg, err := datasegment.NewAggregate(pt.Size/127*128, pieces)
+	if err != nil {
+		return err
+	}
+
+	return agg.WriteData(w, func(i int, w io.Writer) error {
+		if segs[i].RootOnly {
+			return WriteRootCar(ctx, s.bs, segs[i].Payload, w)
+		}
+		return s.writeCar(ctx, segs[i].Payload, w)
+	})
+}
+
+// rootSelector matches the root node of a dag without following its links
+var rootSelector = builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+
+// WriteRootCar writes a car of the root block of payload alone. The blocks
+// below the root of an aggregate are in the segments of the aggregated
+// contents, this car puts the root in the aggregate too.
+func WriteRootCar(ctx context.Context, bs blockstore.Blockstore, payload cid.Cid, w io.Writer) error {
+	scar := car.NewSelectiveCar(ctx, bs, []car.Dag{{Root: payload, Selector: rootSelector}})
+	return scar.Write(w)
+}
+
+func (s *Server) writeCar(ctx context.Context, payload cid.Cid, w io.Writer) error {
+	scar := car.NewSelectiveCar(ctx, s.bs,
+		[]car.Dag{{Root: payload, Selector: shared.AllSelector()}},
+		car.MaxTraversalLinks(maxTraversalLinks),
+		car.TraverseLinksOnlyOnce(),
+	)
+	return scar.Write(w)
+}
+
+var errRangeDone = errors.New("requested range written")
+
+// rangeWriter drops the bytes before the range and stops the car traversal
+// once the range is written
+type rangeWriter struct {
+	w       io.Writer
+	skip    uint64
+	left    uint64
+	written uint64
+
+	progress     func(n uint64)
+	lastProgress time.Time
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.skip > 0 {
+		if uint64(len(p)) <= rw.skip {
+			rw.skip -= uint64(len(p))
+			return n, nil
+		}
+		p = p[rw.skip:]
+		rw.skip = 0
+	}
+
+	if rw.left == 0 {
+		return 0, errRangeDone
+	}
+	if uint64(len(p)) > rw.left {
+		p = p[:rw.left]
+	}
+
+	w, err := rw.w.Write(p)
+	rw.written += uint64(w)
+	rw.left -= uint64(w)
+	if err != nil {
+		return 0, err
+	}
+
+	if rw.progress != nil && time.Since(rw.lastProgress) > progressInterval {
+		rw.lastProgress = time.Now()
+		rw.progress(rw.written)
+	}
+	return n, nil
+}
+
+// parseRange parses a single "bytes=" range of a Range header, returning the
+// whole content when it is empty. end is exclusive.
+func parseRange(hdr string, size uint64) (uint64, uint64, error) {
+	if hdr == "" {
+		return 0, size, nil
+	}
+
+	spec := strings.TrimPrefix(hdr, "bytes=")
+	if spec == hdr || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q, only a single byte range is supported", hdr)
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q", hdr)
+	}
+
+	if parts[0] == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", hdr)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, nil
+	}
+
+	start, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q", hdr)
+	}
+
+	end := size
+	if parts[1] != "" {
+		last, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, fmt.Errorf("invalid range %q", hdr)
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+
+	if start >= size {
+		return 0, 0, fmt.Errorf("range %q starts past the end of the %d bytes", hdr, size)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,134 @@
+package piecetransfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bandwidth"
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		hdr        string
+		start, end uint64
+		fail       bool
+	}{
+		{hdr: "", start: 0, end: 100},
+		{hdr: "bytes=0-", start: 0, end: 100},
+		{hdr: "bytes=10-", start: 10, end: 100},
+		{hdr: "bytes=10-19", start: 10, end: 20},
+		{hdr: "bytes=10-1000", start: 10, end: 100},
+		{hdr: "bytes=-30", start: 70, end: 100},
+		{hdr: "bytes=100-", fail: true},
+		{hdr: "bytes=20-10", fail: true},
+		{hdr: "bytes=0-1,5-6", fail: true},
+		{hdr: "items=0-1", fail: true},
+	}
+
+	for _, c := range cases {
+		start, end, err := parseRange(c.hdr, 100)
+		if c.fail {
+			assert.Error(t, err, c.hdr)
+			continue
+		}
+		require.NoError(t, err, c.hdr)
+		assert.Equal(t, c.start, start, c.hdr)
+		assert.Equal(t, c.end, end, c.hdr)
+	}
+}
+
+func TestServePiece(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	nd, err := util.ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(7)), 3*1024*1024))
+	require.NoError(t, err)
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&PieceTransfer{}))
+
+	srv := NewServer(db, bs, bandwidth.NewLimiter(0))
+
+	var full bytes.Buffer
+	require.NoError(t, srv.writeCar(ctx, nd.Cid(), &full))
+
+	// the piece cid only has to match between the deal and the request
+	piece := nd.Cid()
+	require.NoError(t, srv.Prepare(1, "token", piece, nd.Cid(), uint64(full.Len()), nil))
+
+	var states []filclient.ChannelState
+	srv.Subscribe(func(dbid uint, st filclient.ChannelState) {
+		assert.Equal(t, uint(1), dbid)
+		states = append(states, st)
+	})
+
+	get := func(token string, piece cid.Cid, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, PiecePath(piece), nil)
+		req.SetBasicAuth("", token)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("wrong", piece, "").Code)
+
+	rec := get("token", piece, "bytes=1000-4999")
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, full.Bytes()[1000:5000], rec.Body.Bytes())
+	assert.Equal(t, datatransfer.Requested, states[0].Status)
+	assert.Equal(t, datatransfer.Ongoing, states[len(states)-1].Status)
+
+	st, err := srv.TransferStatus(1)
+	require.NoError(t, err)
+	assert.Equal(t, datatransfer.Ongoing, st.Status)
+
+	rec = get("token", piece, "bytes=5000-")
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, full.Bytes()[5000:], rec.Body.Bytes())
+	assert.Equal(t, datatransfer.Completed, states[len(states)-1].Status)
+	for _, st := range states[1:] {
+		assert.NotEqual(t, datatransfer.Requested, st.Status)
+	}
+	assert.Equal(t, uint64(full.Len()), states[len(states)-1].Sent)
+
+	rec = get("token", piece, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, full.Bytes(), rec.Body.Bytes())
+
+	st, err = srv.TransferStatus(1)
+	require.NoError(t, err)
+	assert.Equal(t, datatransfer.Completed, st.Status)
+
+	removed, err := srv.Cleanup(1, "token")
+	require.NoError(t, err)
+	assert.True(t, removed)
+
+	st, err = srv.TransferStatus(1)
+	require.NoError(t, err)
+	assert.Nil(t, st)
+	assert.Equal(t, http.StatusNotFound, get("token", piece, "").Code)
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// UserQuota limits how much a user may store. A zero limit means the
+// corresponding resource is unlimited.
+type UserQuota struct {
+	// MaxBytes is the total size of the content a user may have pinned
+	MaxBytes int64 `json:"maxBytes" gorm:"default:0"`
+	// MaxObjects is the number of pins (contents) a user may have
+	MaxObjects int64 `json:"maxObjects" gorm:"default:0"`
+	// MaxDealBytes is the total size of a user's content multiplied by its
+	// replication factor, i.e. how much deal capacity the user may consume
+	MaxDealBytes int64 `json:"maxDealBytes" gorm:"default:0"`
+}
+
+// QuotaUsage is what a user currently consumes of each quota
+type QuotaUsage struct {
+	Bytes     int64 `json:"bytes"`
+	Objects   int64 `json:"objects"`
+	DealBytes int64 `json:"dealBytes"`
+}
+
+type QuotaStatus struct {
+	Quota UserQuota  `json:"quota"`
+	Usage QuotaUsage `json:"usage"`
+}
+
+func (q UserQuota) IsUnlimited() bool {
+	return q.MaxBytes == 0 && q.MaxObjects == 0 && q.MaxDealBytes == 0
+}
+
+func (q UserQuota) Validate() error {
+	if q.MaxBytes < 0 || q.MaxObjects < 0 || q.MaxDealBytes < 0 {
+		return &HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  ERR_INVALID_INPUT,
+			Details: "quota limits must not be negative",
+		}
+	}
+	return nil
+}
+
+// Check returns an error if adding one more object of size bytes, replicated
+// replication times, would take usage over the quota. The size of content
+// being pinned from the network is not known upfront and may be passed as
+// zero, in which case only the current usage is checked.
+func (q UserQuota) Check(usage QuotaUsage, size int64, replication int) error {
+	if q.MaxObjects > 0 && usage.Objects+1 > q.MaxObjects {
+		return quotaExceeded("object count", usage.Objects, 1, q.MaxObjects)
+	}
+
+	if q.MaxBytes > 0 && (usage.Bytes+size > q.MaxBytes || usage.Bytes >= q.MaxBytes) {
+		return quotaExceeded("storage bytes", usage.Bytes, size, q.MaxBytes)
+	}
+
+	dealSize := size * int64(replication)
+	if q.MaxDealBytes > 0 && (usage.DealBytes+dealSize > q.MaxDealBytes || usage.DealBytes >= q.MaxDealBytes) {
+		return quotaExceeded("deal replication bytes", usage.DealBytes, dealSize, q.MaxDealBytes)
+	}
+	return nil
+}
+
+// CheckUsage returns an error if usage, which includes objects that were just
+// added, is over the quota
+func (q UserQuota) CheckUsage(usage QuotaUsage) error {
+	if q.MaxObjects > 0 && usage.Objects > q.MaxObjects {
+		return quotaExceeded("object count", usage.Objects, 0, q.MaxObjects)
+	}
+
+	if q.MaxBytes > 0 && usage.Bytes > q.MaxBytes {
+		return quotaExceeded("storage bytes", usage.Bytes, 0, q.MaxBytes)
+	}
+
+	if q.MaxDealBytes > 0 && usage.DealBytes > q.MaxDealBytes {
+		return quotaExceeded("deal replication bytes", usage.DealBytes, 0, q.MaxDealBytes)
+	}
+	return nil
+}
+
+// Check is a shorthand for checking against the quota and usage of the status
+func (qs *QuotaStatus) Check(size int64, replication int) error {
+	if qs == nil {
+		return nil
+	}
+	return qs.Quota.Check(qs.Usage, size, replication)
+}
+
+func quotaExceeded(what string, used, adding, limit int64) error {
+	return &HttpError{
+		Code:    http.StatusForbidden,
+		Reason:  ERR_QUOTA_EXCEEDED,
+		Details: fmt.Sprintf("%s quota exceeded: using %d, adding %d, limit is %d", what, used, adding, limit),
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserQuotaCheck(t *testing.T) {
+	var unlimited UserQuota
+	assert.True(t, unlimited.IsUnlimited())
+	require.NoError(t, unlimited.Check(QuotaUsage{Bytes: 1 << 40, Objects: 1 << 20}, 1<<30, 6))
+
+	q := UserQuota{MaxBytes: 1000, MaxObjects: 10, MaxDealBytes: 3000}
+	require.NoError(t, q.Check(QuotaUsage{Bytes: 400, Objects: 5, DealBytes: 1200}, 500, 3))
+
+	err := q.Check(QuotaUsage{Bytes: 400, Objects: 5}, 700, 1)
+	var herr *HttpError
+	require.True(t, errors.As(err, &herr))
+	assert.Equal(t, ERR_QUOTA_EXCEEDED, herr.Reason)
+
+	assert.Error(t, q.Check(QuotaUsage{Objects: 10}, 0, 1))
+	assert.Error(t, q.Check(QuotaUsage{Bytes: 1000}, 0, 1))
+	assert.Error(t, q.Check(QuotaUsage{DealBytes: 1500}, 600, 3))
+
+	var qs *QuotaStatus
+	assert.NoError(t, qs.Check(1<<40, 6))
+
+	assert.Error(t, (&UserQuota{MaxBytes: -1}).Validate())
+}
@@ -0,0 +1,189 @@
+package util
+
+import (
+	"math"
+	"time"
+)
+
+// ReputationHalfLife is how long it takes for an event to count half as much
+// towards the reputation of a miner
+const ReputationHalfLife = 30 * 24 * time.Hour
+
+// reference values at which the corresponding signal scores 0.5
+const (
+	refPublishTime = 24 * time.Hour
+	refSealTime    = 72 * time.Hour
+	refThroughput  = 1 << 20 // bytes per second
+)
+
+// weights of the signals in the score, they add up to 1
+const (
+	weightDealSuccess      = 0.4
+	weightPublishTime      = 0.1
+	weightSealTime         = 0.1
+	weightThroughput       = 0.15
+	weightRetrievalSuccess = 0.25
+)
+
+// DecayWeight returns how much an event that happened at t counts as of now
+func DecayWeight(now, t time.Time) float64 {
+	age := now.Sub(t)
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, float64(age)/float64(ReputationHalfLife))
+}
+
+type weightedMean struct {
+	sum    float64
+	weight float64
+}
+
+func (wm *weightedMean) add(v, w float64) {
+	wm.sum += v * w
+	wm.weight += w
+}
+
+func (wm *weightedMean) mean() (float64, bool) {
+	if wm.weight == 0 {
+		return 0, false
+	}
+	return wm.sum / wm.weight, true
+}
+
+// DealSignal is what a deal tells about the miner it was made with
+type DealSignal struct {
+	CreatedAt        time.Time
+	OnChainAt        time.Time
+	SealedAt         time.Time
+	TransferStarted  time.Time
+	TransferFinished time.Time
+	Size             int64
+	// Succeeded is set once the deal is on chain, Failed if it failed before
+	// or after that
+	Succeeded bool
+	Failed    bool
+	Slashed   bool
+	// FailedAt and SlashedAt are when the deal failed or was found slashed,
+	// zero for deals recorded before they were tracked
+	FailedAt  time.Time
+	SlashedAt time.Time
+}
+
+// MinerReputation accumulates the time decayed signals the reputation of a
+// miner is computed from
+type MinerReputation struct {
+	now time.Time
+
+	dealSuccesses      float64
+	dealFailures       float64
+	slashed            float64
+	retrievalSuccesses float64
+	retrievalFailures  float64
+
+	publishTime weightedMean
+	sealTime    weightedMean
+	throughput  weightedMean
+}
+
+func NewMinerReputation(now time.Time) *MinerReputation {
+	return &MinerReputation{now: now}
+}
+
+func (mr *MinerReputation) AddDeal(d DealSignal) {
+	w := DecayWeight(mr.now, d.CreatedAt)
+
+	// penalties decay from when they happened, a deal can fail or be
+	// slashed long after it was made
+	if d.Slashed {
+		mr.slashed += DecayWeight(mr.now, orTime(d.SlashedAt, d.CreatedAt))
+	}
+
+	if d.Failed {
+		mr.dealFailures += DecayWeight(mr.now, orTime(d.FailedAt, d.CreatedAt))
+	} else if d.Succeeded {
+		mr.dealSuccesses += w
+	}
+
+	if !d.OnChainAt.IsZero() && d.OnChainAt.After(d.CreatedAt) {
+		mr.publishTime.add(d.OnChainAt.Sub(d.CreatedAt).Hours(), w)
+
+		if !d.SealedAt.IsZero() && d.SealedAt.After(d.OnChainAt) {
+			mr.sealTime.add(d.SealedAt.Sub(d.OnChainAt).Hours(), w)
+		}
+	}
+
+	if d.Size > 0 && !d.TransferStarted.IsZero() && d.TransferFinished.After(d.TransferStarted) {
+		mr.throughput.add(float64(d.Size)/d.TransferFinished.Sub(d.TransferStarted).Seconds(), w)
+	}
+}
+
+func orTime(t, fallback time.Time) time.Time {
+	if t.IsZero() {
+		return fallback
+	}
+	return t
+}
+
+func (mr *MinerReputation) AddRetrieval(at time.Time, success bool) {
+	w := DecayWeight(mr.now, at)
+	if success {
+		mr.retrievalSuccesses += w
+	} else {
+		mr.retrievalFailures += w
+	}
+}
+
+// ReputationScore is the reputation of a miner, along with the score of each
+// signal it was computed from. All scores are between 0 and 1, signals that
+// there is no data for score 0.5.
+type ReputationScore struct {
+	Score float64 `json:"score"`
+
+	DealSuccess      float64 `json:"dealSuccess"`
+	PublishTime      float64 `json:"publishTime"`
+	SealTime         float64 `json:"sealTime"`
+	Throughput       float64 `json:"throughput"`
+	RetrievalSuccess float64 `json:"retrievalSuccess"`
+	// SlashPenalty multiplies the score, it halves with each recent slashing
+	SlashPenalty float64 `json:"slashPenalty"`
+
+	AvgPublishHours float64 `json:"avgPublishHours,omitempty"`
+	AvgSealHours    float64 `json:"avgSealHours,omitempty"`
+	AvgThroughput   float64 `json:"avgThroughput,omitempty"`
+}
+
+func (mr *MinerReputation) Score() ReputationScore {
+	rs := ReputationScore{
+		// add one success and one failure so that a miner with little
+		// history doesn't rank at either extreme
+		DealSuccess:      (mr.dealSuccesses + 1) / (mr.dealSuccesses + mr.dealFailures + 2),
+		RetrievalSuccess: (mr.retrievalSuccesses + 1) / (mr.retrievalSuccesses + mr.retrievalFailures + 2),
+		PublishTime:      0.5,
+		SealTime:         0.5,
+		Throughput:       0.5,
+		SlashPenalty:     math.Pow(0.5, mr.slashed),
+	}
+
+	if h, ok := mr.publishTime.mean(); ok {
+		rs.AvgPublishHours = h
+		rs.PublishTime = math.Pow(0.5, h/refPublishTime.Hours())
+	}
+
+	if h, ok := mr.sealTime.mean(); ok {
+		rs.AvgSealHours = h
+		rs.SealTime = math.Pow(0.5, h/refSealTime.Hours())
+	}
+
+	if tp, ok := mr.throughput.mean(); ok {
+		rs.AvgThroughput = tp
+		rs.Throughput = tp / (tp + refThroughput)
+	}
+
+	rs.Score = rs.SlashPenalty * (weightDealSuccess*rs.DealSuccess +
+		weightPublishTime*rs.PublishTime +
+		weightSealTime*rs.SealTime +
+		weightThroughput*rs.Throughput +
+		weightRetrievalSuccess*rs.RetrievalSuccess)
+	return rs
+}
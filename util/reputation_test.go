@@ -0,0 +1,68 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerReputation(t *testing.T) {
+	now := time.Now()
+
+	assert.InDelta(t, 1, DecayWeight(now, now), 1e-9)
+	assert.InDelta(t, 0.5, DecayWeight(now, now.Add(-ReputationHalfLife)), 1e-9)
+
+	empty := NewMinerReputation(now).Score()
+	assert.InDelta(t, 0.5, empty.Score, 1e-9)
+
+	deal := func(age time.Duration, ok bool) DealSignal {
+		created := now.Add(-age)
+		return DealSignal{
+			CreatedAt:        created,
+			TransferStarted:  created,
+			TransferFinished: created.Add(time.Minute),
+			OnChainAt:        created.Add(time.Hour),
+			SealedAt:         created.Add(24 * time.Hour),
+			Size:             1 << 30,
+			Succeeded:        ok,
+			Failed:           !ok,
+		}
+	}
+
+	// a miner that recently got better beats one that recently got worse
+	improving := NewMinerReputation(now)
+	declining := NewMinerReputation(now)
+	for i := 0; i < 10; i++ {
+		improving.AddDeal(deal(time.Hour, true))
+		improving.AddDeal(deal(4*ReputationHalfLife, false))
+		declining.AddDeal(deal(time.Hour, false))
+		declining.AddDeal(deal(4*ReputationHalfLife, true))
+	}
+	assert.Greater(t, improving.Score().Score, declining.Score().Score)
+	assert.Greater(t, improving.Score().Score, empty.Score)
+
+	sc := improving.Score()
+	assert.InDelta(t, 1, sc.AvgPublishHours, 1e-9)
+	assert.InDelta(t, 23, sc.AvgSealHours, 1e-9)
+	assert.Greater(t, sc.Throughput, 0.5)
+
+	retrieving := NewMinerReputation(now)
+	retrieving.AddRetrieval(now, false)
+	assert.Less(t, retrieving.Score().Score, empty.Score)
+
+	slashed := NewMinerReputation(now)
+	slashed.AddDeal(DealSignal{CreatedAt: now, Succeeded: true, Slashed: true})
+	assert.InDelta(t, 0.5, slashed.Score().SlashPenalty, 1e-9)
+	assert.Less(t, slashed.Score().Score, empty.Score)
+
+	// an old deal slashed now is penalized in full
+	old := now.Add(-4 * ReputationHalfLife)
+	slashedLate := NewMinerReputation(now)
+	slashedLate.AddDeal(DealSignal{CreatedAt: old, Succeeded: true, Slashed: true, SlashedAt: now})
+	assert.InDelta(t, 0.5, slashedLate.Score().SlashPenalty, 1e-9)
+
+	failedLate := NewMinerReputation(now)
+	failedLate.AddDeal(DealSignal{CreatedAt: old, Failed: true, FailedAt: now})
+	assert.InDelta(t, 1.0/3, failedLate.Score().DealSuccess, 1e-9)
+}
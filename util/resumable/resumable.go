@@ -0,0 +1,415 @@
+// Package resumable implements the server side of a tus style resumable
+// upload protocol (https://tus.io/protocols/resumable-upload.html).
+//
+// An upload is created with its total length, after which the client appends
+// data with PATCH requests at the offset reported by HEAD. Partial data is
+// kept in a staging area allocated from a stagingbs.StagingBSMgr so that an
+// interrupted upload can be resumed, even across restarts. Once all data has
+// been received the caller imports it into the staging blockstore and the
+// upload is cleaned up.
+package resumable
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/stagingbs"
+	"github.com/application-research/estuary/util"
+	"github.com/google/uuid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+var log = logging.Logger("resumable")
+
+// TusVersion is the version of the tus protocol implemented
+const TusVersion = "1.0.0"
+
+const (
+	HeaderTusResumable   = "Tus-Resumable"
+	HeaderUploadOffset   = "Upload-Offset"
+	HeaderUploadLength   = "Upload-Length"
+	HeaderUploadMetadata = "Upload-Metadata"
+	HeaderUploadExpires  = "Upload-Expires"
+
+	ContentTypeOffsetOctetStream = "application/offset+octet-stream"
+)
+
+// DefaultExpiry is how long an upload may go without receiving data before
+// it is expired
+const DefaultExpiry = time.Hour * 24
+
+// Upload tracks the state of a resumable upload
+type Upload struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	UUID      string    `gorm:"unique" json:"uuid"`
+	UserID    uint      `gorm:"index" json:"userId"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Metadata  Metadata  `json:"metadata"`
+	StagingID string    `json:"-"`
+	ExpiresAt time.Time `gorm:"index" json:"expiresAt"`
+}
+
+func (up *Upload) Complete() bool {
+	return up.Offset == up.Length
+}
+
+// Metadata holds the decoded key value pairs of the Upload-Metadata header
+type Metadata map[string]string
+
+// ParseMetadata decodes an Upload-Metadata header: a comma separated list of
+// keys, each followed by a space and its base64 encoded value (if any)
+func ParseMetadata(hdr string) (Metadata, error) {
+	md := make(Metadata)
+	if strings.TrimSpace(hdr) == "" {
+		return md, nil
+	}
+
+	for _, pair := range strings.Split(hdr, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 1:
+			md[kv[0]] = ""
+		case 2:
+			val, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for metadata key %q: %w", kv[0], err)
+			}
+			md[kv[0]] = string(val)
+		default:
+			return nil, fmt.Errorf("invalid metadata pair: %q", pair)
+		}
+	}
+	return md, nil
+}
+
+func (md *Metadata) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case nil:
+		*md = nil
+		return nil
+	default:
+		return fmt.Errorf("upload metadata must be a string")
+	}
+
+	return json.Unmarshal(b, md)
+}
+
+func (md Metadata) Value() (driver.Value, error) {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// ParseLength parses an Upload-Length header
+func ParseLength(hdr string) (int64, error) {
+	return parseNonNegative(HeaderUploadLength, hdr)
+}
+
+// ParseOffset parses an Upload-Offset header
+func ParseOffset(hdr string) (int64, error) {
+	return parseNonNegative(HeaderUploadOffset, hdr)
+}
+
+func parseNonNegative(name, hdr string) (int64, error) {
+	v, err := strconv.ParseInt(hdr, 10, 64)
+	if err != nil || v < 0 {
+		return 0, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid %s header: %q", name, hdr),
+		}
+	}
+	return v, nil
+}
+
+// SetHeaders writes the headers describing the state of an upload, as
+// returned by HEAD and PATCH requests
+func SetHeaders(h http.Header, up *Upload) {
+	h.Set(HeaderTusResumable, TusVersion)
+	h.Set(HeaderUploadOffset, strconv.FormatInt(up.Offset, 10))
+	h.Set(HeaderUploadLength, strconv.FormatInt(up.Length, 10))
+	h.Set(HeaderUploadExpires, up.ExpiresAt.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+}
+
+// Manager keeps track of resumable uploads and their staging data
+type Manager struct {
+	db      *gorm.DB
+	staging *stagingbs.StagingBSMgr
+	expiry  time.Duration
+
+	lk   sync.Mutex
+	busy map[string]bool
+}
+
+func NewManager(db *gorm.DB, staging *stagingbs.StagingBSMgr, expiry time.Duration) *Manager {
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+
+	return &Manager{
+		db:      db,
+		staging: staging,
+		expiry:  expiry,
+		busy:    make(map[string]bool),
+	}
+}
+
+// Create starts a new upload of length bytes for the given user
+func (m *Manager) Create(user uint, length int64, md Metadata) (*Upload, error) {
+	bsid, err := m.staging.AllocUpload()
+	if err != nil {
+		return nil, err
+	}
+
+	up := &Upload{
+		UUID:      uuid.New().String(),
+		UserID:    user,
+		Length:    length,
+		Metadata:  md,
+		StagingID: string(bsid),
+		ExpiresAt: time.Now().Add(m.expiry),
+	}
+
+	if err := m.db.Create(up).Error; err != nil {
+		if err := m.staging.CleanUp(bsid); err != nil {
+			log.Errorf("failed to clean up staging area of upload: %s", err)
+		}
+		return nil, err
+	}
+	return up, nil
+}
+
+// Get returns the upload with the given uuid if it belongs to user
+func (m *Manager) Get(upuuid string, user uint) (*Upload, error) {
+	var up Upload
+	if err := m.db.First(&up, "uuid = ? and user_id = ?", upuuid, user).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_UPLOAD_NOT_FOUND,
+				Details: fmt.Sprintf("upload %s not found", upuuid),
+			}
+		}
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (m *Manager) acquire(up *Upload) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.busy[up.UUID] {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_UPLOAD_LOCKED,
+			Details: fmt.Sprintf("upload %s is already being written to", up.UUID),
+		}
+	}
+	m.busy[up.UUID] = true
+	return nil
+}
+
+// refresh reloads an upload after acquiring it, in case another request
+// changed it in the meantime
+func (m *Manager) refresh(up *Upload) error {
+	fresh, err := m.Get(up.UUID, up.UserID)
+	if err != nil {
+		return err
+	}
+	*up = *fresh
+	return nil
+}
+
+func (m *Manager) release(up *Upload) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.busy, up.UUID)
+}
+
+// Write appends the data read from r to the upload. offset must match the
+// current offset of the upload. Whatever was received before r fails is kept,
+// so the client can resume from the offset reported afterwards.
+func (m *Manager) Write(ctx context.Context, up *Upload, offset int64, r io.Reader) error {
+	if err := m.acquire(up); err != nil {
+		return err
+	}
+	defer m.release(up)
+
+	if err := m.refresh(up); err != nil {
+		return err
+	}
+
+	if offset != up.Offset {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_UPLOAD_OFFSET_MISMATCH,
+			Details: fmt.Sprintf("upload is at offset %d, got %d", up.Offset, offset),
+		}
+	}
+
+	path, err := m.staging.UploadPath(stagingbs.BSID(up.StagingID))
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	// anything past the recorded offset was not acknowledged, drop it
+	if err := fi.Truncate(up.Offset); err != nil {
+		return err
+	}
+
+	if _, err := fi.Seek(up.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, cerr := io.Copy(fi, io.LimitReader(r, up.Length-up.Offset))
+	if err := fi.Sync(); err != nil {
+		return err
+	}
+
+	up.Offset += n
+	up.ExpiresAt = time.Now().Add(m.expiry)
+	if err := m.db.Model(Upload{}).Where("id = ?", up.ID).Updates(map[string]interface{}{
+		"offset":     up.Offset,
+		"expires_at": up.ExpiresAt,
+	}).Error; err != nil {
+		return err
+	}
+
+	if cerr != nil {
+		return xerrors.Errorf("upload interrupted at offset %d: %w", up.Offset, cerr)
+	}
+	return nil
+}
+
+// Finish hands the data of a complete upload to importFn along with the
+// staging blockstore to import it into. If importFn succeeds the upload is
+// removed, if it fails the upload is kept so that finishing can be retried.
+// The staging blockstore is cleaned up along with the upload, so importFn
+// must have moved the imported blocks elsewhere by the time it returns.
+func (m *Manager) Finish(ctx context.Context, up *Upload, importFn func(r io.Reader, bs blockstore.Blockstore) error) error {
+	if err := m.acquire(up); err != nil {
+		return err
+	}
+	defer m.release(up)
+
+	if err := m.refresh(up); err != nil {
+		return err
+	}
+
+	if !up.Complete() {
+		return fmt.Errorf("upload %s is incomplete (%d/%d)", up.UUID, up.Offset, up.Length)
+	}
+
+	bsid := stagingbs.BSID(up.StagingID)
+	path, err := m.staging.UploadPath(bsid)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	bs, err := m.staging.Open(bsid)
+	if err != nil {
+		return err
+	}
+
+	if err := importFn(io.LimitReader(fi, up.Length), bs); err != nil {
+		return err
+	}
+
+	return m.remove(up)
+}
+
+// Delete aborts an upload and discards its data
+func (m *Manager) Delete(up *Upload) error {
+	if err := m.acquire(up); err != nil {
+		return err
+	}
+	defer m.release(up)
+
+	return m.remove(up)
+}
+
+func (m *Manager) remove(up *Upload) error {
+	if err := m.db.Delete(&Upload{}, up.ID).Error; err != nil {
+		return err
+	}
+
+	if err := m.staging.CleanUp(stagingbs.BSID(up.StagingID)); err != nil {
+		log.Errorf("failed to clean up staging area of upload %s: %s", up.UUID, err)
+	}
+	return nil
+}
+
+// ExpireStale removes uploads that have not received data within the expiry
+// period
+func (m *Manager) ExpireStale(ctx context.Context) error {
+	var stale []*Upload
+	if err := m.db.WithContext(ctx).Find(&stale, "expires_at < ?", time.Now()).Error; err != nil {
+		return err
+	}
+
+	for _, up := range stale {
+		if err := m.Delete(up); err != nil {
+			// uploads that are being written to are picked up next time
+			log.Warnf("failed to expire upload %s: %s", up.UUID, err)
+			continue
+		}
+		log.Infof("expired stale upload %s (%d/%d bytes)", up.UUID, up.Offset, up.Length)
+	}
+	return nil
+}
+
+// Run periodically expires stale uploads until ctx is cancelled
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.ExpireStale(ctx); err != nil {
+			log.Errorf("failed to expire stale uploads: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package resumable
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/stagingbs"
+	"github.com/application-research/estuary/util"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestParseMetadata(t *testing.T) {
+	md, err := ParseMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,coluuid,colpath Lw==")
+	require.NoError(t, err)
+	assert.Equal(t, Metadata{
+		"filename": "world_domination_plan.pdf",
+		"coluuid":  "",
+		"colpath":  "/",
+	}, md)
+
+	md, err = ParseMetadata("")
+	require.NoError(t, err)
+	assert.Empty(t, md)
+
+	_, err = ParseMetadata("filename not-base64!")
+	assert.Error(t, err)
+}
+
+func TestParseOffset(t *testing.T) {
+	off, err := ParseOffset("1024")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), off)
+
+	_, err = ParseOffset("-1")
+	assert.Error(t, err)
+
+	_, err = ParseLength("")
+	assert.Error(t, err)
+}
+
+func TestMetadataValue(t *testing.T) {
+	md := Metadata{"filename": "a.txt"}
+	v, err := md.Value()
+	require.NoError(t, err)
+
+	var out Metadata
+	require.NoError(t, out.Scan(v))
+	assert.Equal(t, md, out)
+}
+
+func newTestManager(t *testing.T, expiry time.Duration) (*Manager, *gorm.DB) {
+	dir := t.TempDir()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "uploads.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&Upload{}))
+
+	staging, err := stagingbs.NewStagingBSMgr(filepath.Join(dir, "staging"))
+	require.NoError(t, err)
+
+	return NewManager(db, staging, expiry), db
+}
+
+func requireHttpError(t *testing.T, err error, reason string) {
+	var herr *util.HttpError
+	require.True(t, errors.As(err, &herr), "expected an http error, got %v", err)
+	assert.Equal(t, reason, herr.Reason)
+}
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, time.Hour)
+
+	up, err := m.Create(1, 8, Metadata{})
+	require.NoError(t, err)
+
+	require.NoError(t, m.Write(ctx, up, 0, bytes.NewReader([]byte("abc"))))
+	assert.Equal(t, int64(3), up.Offset)
+
+	// a client that missed the last acknowledgement has to resume from the
+	// recorded offset
+	err = m.Write(ctx, up, 0, bytes.NewReader([]byte("abc")))
+	requireHttpError(t, err, util.ERR_UPLOAD_OFFSET_MISMATCH)
+
+	err = m.Write(ctx, up, 5, bytes.NewReader([]byte("fgh")))
+	requireHttpError(t, err, util.ERR_UPLOAD_OFFSET_MISMATCH)
+
+	// anything past the length of the upload is dropped
+	require.NoError(t, m.Write(ctx, up, 3, bytes.NewReader([]byte("defghijk"))))
+	assert.Equal(t, int64(8), up.Offset)
+	assert.True(t, up.Complete())
+
+	stored, err := m.Get(up.UUID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), stored.Offset)
+
+	_, err = m.Get(up.UUID, 2)
+	requireHttpError(t, err, util.ERR_UPLOAD_NOT_FOUND)
+}
+
+func TestFinish(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, time.Hour)
+
+	up, err := m.Create(1, 6, Metadata{})
+	require.NoError(t, err)
+
+	noop := func(io.Reader, blockstore.Blockstore) error { return nil }
+
+	require.NoError(t, m.Write(ctx, up, 0, bytes.NewReader([]byte("abc"))))
+	assert.Error(t, m.Finish(ctx, up, noop))
+
+	require.NoError(t, m.Write(ctx, up, 3, bytes.NewReader([]byte("def"))))
+
+	// a failed import keeps the upload so that finishing can be retried
+	importErr := errors.New("import failed")
+	err = m.Finish(ctx, up, func(io.Reader, blockstore.Blockstore) error { return importErr })
+	assert.ErrorIs(t, err, importErr)
+
+	_, err = m.Get(up.UUID, 1)
+	require.NoError(t, err)
+
+	var data []byte
+	require.NoError(t, m.Finish(ctx, up, func(r io.Reader, bs blockstore.Blockstore) error {
+		assert.NotNil(t, bs)
+		data, err = ioutil.ReadAll(r)
+		return err
+	}))
+	assert.Equal(t, "abcdef", string(data))
+
+	_, err = m.Get(up.UUID, 1)
+	requireHttpError(t, err, util.ERR_UPLOAD_NOT_FOUND)
+}
+
+func TestExpireStale(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestManager(t, time.Hour)
+
+	stale, err := m.Create(1, 4, Metadata{})
+	require.NoError(t, err)
+
+	fresh, err := m.Create(1, 4, Metadata{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Model(Upload{}).Where("id = ?", stale.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+	// uploads being written to are left for the next run
+	require.NoError(t, m.acquire(stale))
+	require.NoError(t, m.ExpireStale(ctx))
+	_, err = m.Get(stale.UUID, 1)
+	require.NoError(t, err)
+	m.release(stale)
+
+	require.NoError(t, m.ExpireStale(ctx))
+
+	_, err = m.Get(stale.UUID, 1)
+	requireHttpError(t, err, util.ERR_UPLOAD_NOT_FOUND)
+
+	_, err = m.Get(fresh.UUID, 1)
+	require.NoError(t, err)
+}
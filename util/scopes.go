@@ -0,0 +1,239 @@
+package util
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Scopes granted to an api key. A key holding ScopeAll can do anything its
+// user can, every other key is limited to the endpoints that declare one of
+// the scopes it holds.
+const (
+	ScopeAll = "*"
+
+	ScopeContentAdd  = "content:add"
+	ScopeContentRead = "content:read"
+
+	ScopePinsRead  = "pins:read"
+	ScopePinsWrite = "pins:write"
+
+	ScopeCollectionsRead  = "collections:read"
+	ScopeCollectionsWrite = "collections:write"
+
+	ScopeDealsRead  = "deals:read"
+	ScopeDealsWrite = "deals:write"
+)
+
+const (
+	ScopeActionRead  = "read"
+	ScopeActionWrite = "write"
+)
+
+var knownScopes = map[string]bool{
+	ScopeAll:              true,
+	ScopeContentAdd:       true,
+	ScopeContentRead:      true,
+	ScopePinsRead:         true,
+	ScopePinsWrite:        true,
+	ScopeCollectionsRead:  true,
+	ScopeCollectionsWrite: true,
+	ScopeDealsRead:        true,
+	ScopeDealsWrite:       true,
+}
+
+// CollectionScope returns the scope granting action on a single collection,
+// e.g. collections:<uuid>:write
+func CollectionScope(coluuid, action string) string {
+	return fmt.Sprintf("collections:%s:%s", coluuid, action)
+}
+
+// Scopes is the set of permissions attached to an api key. It is stored in
+// the database as a comma separated list.
+type Scopes []string
+
+// ParseScopes parses and validates a list of scopes. The legacy "all" and
+// "upload" permissions are accepted and mapped onto their equivalent scopes.
+func ParseScopes(perms []string) (Scopes, error) {
+	if len(perms) == 0 {
+		return Scopes{ScopeAll}, nil
+	}
+
+	var out Scopes
+	for _, p := range perms {
+		p = strings.TrimSpace(p)
+		switch p {
+		case "all":
+			p = ScopeAll
+		case "upload":
+			p = ScopeContentAdd
+		}
+
+		if !knownScopes[p] {
+			if _, _, ok := parseCollectionScope(p); !ok {
+				return nil, fmt.Errorf("invalid scope: %q", p)
+			}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func parseCollectionScope(s string) (string, string, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != "collections" {
+		return "", "", false
+	}
+
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return "", "", false
+	}
+
+	if parts[2] != ScopeActionRead && parts[2] != ScopeActionWrite {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// IsFull reports whether the scopes grant unrestricted access.
+func (s Scopes) IsFull() bool {
+	for _, sc := range s {
+		if sc == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the scopes grant the given (non collection specific)
+// scope. A write scope implies the matching read scope, and a scope on a
+// single collection satisfies the coarse collections scope of the same action,
+// handlers are expected to narrow that down with AllowsCollection.
+func (s Scopes) Allows(scope string) bool {
+	for _, sc := range s {
+		if sc == ScopeAll || sc == scope || impliesRead(sc, scope) {
+			return true
+		}
+
+		if _, action, ok := parseCollectionScope(sc); ok {
+			if scope == "collections:"+action || impliesRead("collections:"+action, scope) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AllowsCollection reports whether the scopes grant action on the given
+// collection. An empty coluuid only matches scopes covering all collections.
+func (s Scopes) AllowsCollection(coluuid, action string) bool {
+	if s.allowsAllCollections(action) {
+		return true
+	}
+
+	if coluuid == "" {
+		return false
+	}
+
+	for _, sc := range s {
+		id, a, ok := parseCollectionScope(sc)
+		if !ok || id != coluuid {
+			continue
+		}
+
+		if a == action || a == ScopeActionWrite {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scopes) allowsAllCollections(action string) bool {
+	for _, sc := range s {
+		if sc == ScopeAll || sc == "collections:"+action || impliesRead(sc, "collections:"+action) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCollection is like AllowsCollection but returns an HttpError suitable
+// for handlers.
+func (s Scopes) CheckCollection(coluuid, action string) error {
+	if s.AllowsCollection(coluuid, action) {
+		return nil
+	}
+
+	return &HttpError{
+		Code:    http.StatusForbidden,
+		Reason:  ERR_NOT_AUTHORIZED,
+		Details: fmt.Sprintf("api key is not allowed to %s collection %q", action, coluuid),
+	}
+}
+
+func impliesRead(have, want string) bool {
+	if !strings.HasSuffix(want, ":"+ScopeActionRead) {
+		return false
+	}
+	return have == strings.TrimSuffix(want, ScopeActionRead)+ScopeActionWrite
+}
+
+// CheckScopes verifies that an api key holding scopes may access an endpoint
+// requiring the given permission level and any one of required. Endpoints that
+// declare no scopes are limited to unrestricted keys, with the exception of
+// upload level endpoints (i.e. the viewer) which every valid key may use.
+func CheckScopes(scopes Scopes, level int, required ...string) error {
+	if scopes.IsFull() {
+		return nil
+	}
+
+	if len(required) == 0 && level <= PermLevelUpload {
+		return nil
+	}
+
+	if level < PermLevelAdmin {
+		for _, r := range required {
+			if scopes.Allows(r) {
+				return nil
+			}
+		}
+	}
+
+	return &HttpError{
+		Code:    http.StatusForbidden,
+		Reason:  ERR_NOT_AUTHORIZED,
+		Details: fmt.Sprintf("api key scopes (%s) do not grant access to this endpoint", strings.Join(scopes, ",")),
+	}
+}
+
+func (s Scopes) String() string {
+	return strings.Join(s, ",")
+}
+
+func (s *Scopes) Scan(v interface{}) error {
+	var str string
+	switch v := v.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("scopes must be strings")
+	}
+
+	*s = nil
+	if str == "" {
+		return nil
+	}
+
+	*s = strings.Split(str, ",")
+	return nil
+}
+
+func (s Scopes) Value() (driver.Value, error) {
+	return s.String(), nil
+}
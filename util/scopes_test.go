@@ -0,0 +1,65 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testColUUID = "8b8e1f4c-3e2b-4a5d-9c1e-0f2a3b4c5d6e"
+
+func TestParseScopes(t *testing.T) {
+	s, err := ParseScopes(nil)
+	require.NoError(t, err)
+	assert.True(t, s.IsFull())
+
+	s, err = ParseScopes([]string{"upload"})
+	require.NoError(t, err)
+	assert.Equal(t, Scopes{ScopeContentAdd}, s)
+
+	s, err = ParseScopes([]string{ScopeContentAdd, CollectionScope(testColUUID, ScopeActionWrite)})
+	require.NoError(t, err)
+	assert.False(t, s.IsFull())
+
+	_, err = ParseScopes([]string{"content:delete"})
+	require.Error(t, err)
+
+	_, err = ParseScopes([]string{"collections:not-a-uuid:write"})
+	require.Error(t, err)
+}
+
+func TestScopesAllows(t *testing.T) {
+	s := Scopes{ScopePinsWrite, CollectionScope(testColUUID, ScopeActionWrite)}
+
+	assert.True(t, s.Allows(ScopePinsWrite))
+	assert.True(t, s.Allows(ScopePinsRead))
+	assert.False(t, s.Allows(ScopeContentAdd))
+	assert.True(t, s.Allows(ScopeCollectionsRead))
+
+	assert.True(t, s.AllowsCollection(testColUUID, ScopeActionWrite))
+	assert.True(t, s.AllowsCollection(testColUUID, ScopeActionRead))
+	assert.False(t, s.AllowsCollection("", ScopeActionWrite))
+	assert.Error(t, s.CheckCollection("0b8e1f4c-3e2b-4a5d-9c1e-0f2a3b4c5d6e", ScopeActionWrite))
+}
+
+func TestCheckScopes(t *testing.T) {
+	upload := Scopes{ScopeContentAdd}
+	require.Nil(t, CheckScopes(upload, PermLevelUpload))
+	require.Nil(t, CheckScopes(upload, PermLevelUpload, ScopeContentAdd))
+	assert.Error(t, CheckScopes(upload, PermLevelUser))
+	assert.Error(t, CheckScopes(upload, PermLevelUser, ScopeContentRead))
+	assert.Error(t, CheckScopes(Scopes{ScopeDealsRead}, PermLevelAdmin, ScopeDealsRead))
+
+	require.Nil(t, CheckScopes(Scopes{ScopeAll}, PermLevelAdmin))
+}
+
+func TestScopesScan(t *testing.T) {
+	var s Scopes
+	require.NoError(t, s.Scan("content:add,pins:read"))
+	assert.Equal(t, Scopes{ScopeContentAdd, ScopePinsRead}, s)
+
+	v, err := s.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "content:add,pins:read", v)
+}
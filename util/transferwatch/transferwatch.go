@@ -0,0 +1,371 @@
+// Package transferwatch detects data transfers that stopped making progress.
+// The bytes sent on every tracked channel are compared over time, stalled
+// channels are restarted with an exponential backoff and given up on after a
+// configured number of restarts so that their deals can be made elsewhere.
+// Channels the other side restarts, like pulls by storage providers, are only
+// reported as stalled.
+package transferwatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("transferwatch")
+
+type Event string
+
+const (
+	// EventStalled is sent when a channel is first found without progress
+	EventStalled Event = "stalled"
+	// EventRestarted is sent after every restart of a stalled channel
+	EventRestarted Event = "restarted"
+	// EventRecovered is sent when a restarted channel makes progress again
+	EventRecovered Event = "recovered"
+	// EventFailed is sent when a channel is still stalled after the max
+	// number of restarts, it is no longer tracked afterwards
+	EventFailed Event = "failed"
+)
+
+// Channel is the progress of a tracked transfer
+type Channel struct {
+	ID           string          `json:"id"`
+	DealDBID     uint            `json:"dealDbId"`
+	Miner        address.Address `json:"miner"`
+	Sent         uint64          `json:"sent"`
+	LastProgress time.Time       `json:"lastProgress"`
+	Restarts     int             `json:"restarts"`
+	LastRestart  time.Time       `json:"lastRestart,omitempty"`
+	StalledSince time.Time       `json:"stalledSince,omitempty"`
+	// NotRestartable is set once restarting the channel was refused, it is
+	// left to the other side then, and failed if it does not recover within
+	// the time restarting it would have taken
+	NotRestartable bool `json:"notRestartable,omitempty"`
+}
+
+// MinerStats counts the stalls of the transfers to a miner
+type MinerStats struct {
+	Stalls    int64     `json:"stalls"`
+	Restarts  int64     `json:"restarts"`
+	Recovered int64     `json:"recovered"`
+	Failed    int64     `json:"failed"`
+	LastStall time.Time `json:"lastStall,omitempty"`
+}
+
+// ErrNotRestartable is returned by a RestartFunc for channels that can not be
+// restarted from this side, they are not counted as restarted
+var ErrNotRestartable = errors.New("transfer can not be restarted from this side")
+
+type RestartFunc func(ctx context.Context, ch Channel) error
+
+type EventFunc func(ch Channel, ev Event)
+
+type Supervisor struct {
+	cfg     config.TransferSupervisor
+	restart RestartFunc
+	onEvent EventFunc
+	now     func() time.Time
+
+	lk       sync.Mutex
+	channels map[string]*Channel
+	miners   map[address.Address]*MinerStats
+}
+
+// New creates a supervisor restarting stalled channels with restart, onEvent
+// is told about every stall, restart, recovery and failure and may be nil
+func New(cfg config.TransferSupervisor, restart RestartFunc, onEvent EventFunc) *Supervisor {
+	return &Supervisor{
+		cfg:      cfg,
+		restart:  restart,
+		onEvent:  onEvent,
+		now:      time.Now,
+		channels: make(map[string]*Channel),
+		miners:   make(map[address.Address]*MinerStats),
+	}
+}
+
+// sending tells whether bytes are still expected to be sent on a channel in
+// the given status
+func sending(st *filclient.ChannelState) bool {
+	if util.TransferTerminated(st) {
+		return false
+	}
+
+	switch st.Status {
+	case datatransfer.TransferFinished,
+		datatransfer.ResponderCompleted,
+		datatransfer.Completing,
+		datatransfer.Finalizing,
+		datatransfer.ResponderFinalizing,
+		datatransfer.ResponderFinalizingTransferFinished,
+		datatransfer.Failing,
+		datatransfer.Cancelling:
+		return false
+	default:
+		return true
+	}
+}
+
+// Update records the latest state of a channel, channels not seen before
+// start being tracked and channels done sending are dropped
+func (s *Supervisor) Update(id string, dbid uint, miner address.Address, st *filclient.ChannelState) {
+	if !s.cfg.Enabled || st == nil {
+		return
+	}
+
+	now := s.now()
+
+	s.lk.Lock()
+	ch, ok := s.channels[id]
+	if !sending(st) {
+		delete(s.channels, id)
+		s.lk.Unlock()
+		return
+	}
+
+	if !ok {
+		s.channels[id] = &Channel{
+			ID:           id,
+			DealDBID:     dbid,
+			Miner:        miner,
+			Sent:         st.Sent,
+			LastProgress: now,
+		}
+		s.lk.Unlock()
+		return
+	}
+
+	if st.Sent == ch.Sent {
+		s.lk.Unlock()
+		return
+	}
+
+	ch.Sent = st.Sent
+	ch.LastProgress = now
+	recovered := !ch.StalledSince.IsZero()
+	ch.Restarts = 0
+	ch.StalledSince = time.Time{}
+	if recovered {
+		s.record(ch.Miner, EventRecovered, now)
+	}
+	out := *ch
+	s.lk.Unlock()
+
+	if recovered {
+		s.emit(out, EventRecovered)
+	}
+}
+
+// Remove stops tracking a channel
+func (s *Supervisor) Remove(id string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	delete(s.channels, id)
+}
+
+// backoff is the wait after the nth restart of a channel before the next one
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	d := s.cfg.RestartBackoff
+	for i := 1; i < restarts && d < s.cfg.MaxRestartBackoff; i++ {
+		d *= 2
+	}
+
+	if d > s.cfg.MaxRestartBackoff {
+		d = s.cfg.MaxRestartBackoff
+	}
+	return d
+}
+
+// restartWindow is how long a stalled channel is restarted for before it is
+// failed
+func (s *Supervisor) restartWindow() time.Duration {
+	var d time.Duration
+	for i := 0; i < s.cfg.MaxRestarts; i++ {
+		d += s.backoff(i)
+	}
+	return d
+}
+
+// Check restarts the channels that made no progress for longer than the stall
+// timeout once their backoff elapsed, and fails those out of restarts
+func (s *Supervisor) Check(ctx context.Context) {
+	now := s.now()
+
+	type action struct {
+		ch Channel
+		ev Event
+	}
+	var actions []action
+
+	s.lk.Lock()
+	for id, ch := range s.channels {
+		if now.Sub(ch.LastProgress) < s.cfg.StallTimeout {
+			continue
+		}
+
+		if ch.StalledSince.IsZero() {
+			ch.StalledSince = now
+			s.record(ch.Miner, EventStalled, now)
+			actions = append(actions, action{ch: *ch, ev: EventStalled})
+		} else if ch.NotRestartable {
+			if now.Sub(ch.StalledSince) < s.restartWindow() {
+				continue
+			}
+		} else if now.Sub(ch.LastRestart) < s.backoff(ch.Restarts) {
+			continue
+		}
+
+		if ch.Restarts >= s.cfg.MaxRestarts || (ch.NotRestartable && now.Sub(ch.StalledSince) >= s.restartWindow()) {
+			delete(s.channels, id)
+			s.record(ch.Miner, EventFailed, now)
+			actions = append(actions, action{ch: *ch, ev: EventFailed})
+			continue
+		}
+
+		if ch.NotRestartable {
+			continue
+		}
+
+		actions = append(actions, action{ch: *ch, ev: EventRestarted})
+	}
+	s.lk.Unlock()
+
+	for _, a := range actions {
+		if a.ev == EventRestarted {
+			ch, ok := s.restartChannel(ctx, a.ch, now)
+			if !ok {
+				continue
+			}
+			a.ch = ch
+		}
+
+		if a.ev == EventFailed {
+			log.Warnw("giving up on stalled transfer", "chanid", a.ch.ID, "deal", a.ch.DealDBID, "miner", a.ch.Miner, "sent", a.ch.Sent)
+		}
+		s.emit(a.ch, a.ev)
+	}
+}
+
+// restartChannel restarts a stalled channel and counts the restart, unless
+// the channel can not be restarted from this side
+func (s *Supervisor) restartChannel(ctx context.Context, ch Channel, now time.Time) (Channel, bool) {
+	log.Warnw("restarting stalled transfer", "chanid", ch.ID, "deal", ch.DealDBID, "miner", ch.Miner, "sent", ch.Sent, "restarts", ch.Restarts)
+	err := s.restart(ctx, ch)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	tracked, ok := s.channels[ch.ID]
+	if errors.Is(err, ErrNotRestartable) {
+		log.Infow("stalled transfer is left to the other side", "chanid", ch.ID, "deal", ch.DealDBID, "miner", ch.Miner, "err", err)
+		if ok {
+			tracked.NotRestartable = true
+		}
+		return ch, false
+	}
+	if err != nil {
+		log.Errorf("failed to restart stalled transfer %s: %s", ch.ID, err)
+	}
+
+	// the attempt counts even when it failed, the channel is given up on
+	// after the max restarts either way
+	if !ok {
+		return ch, false
+	}
+	tracked.Restarts++
+	tracked.LastRestart = now
+	s.record(tracked.Miner, EventRestarted, now)
+	return *tracked, true
+}
+
+// Run checks the tracked channels every interval until ctx is done
+func (s *Supervisor) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe counts an event that happened elsewhere, like on a shuttle, in the
+// stats of a miner
+func (s *Supervisor) Observe(miner address.Address, ev Event) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.record(miner, ev, s.now())
+}
+
+// record must be called with the lock held
+func (s *Supervisor) record(miner address.Address, ev Event, now time.Time) {
+	if miner == address.Undef {
+		return
+	}
+
+	ms, ok := s.miners[miner]
+	if !ok {
+		ms = &MinerStats{}
+		s.miners[miner] = ms
+	}
+
+	switch ev {
+	case EventStalled:
+		ms.Stalls++
+		ms.LastStall = now
+	case EventRestarted:
+		ms.Restarts++
+	case EventRecovered:
+		ms.Recovered++
+	case EventFailed:
+		ms.Failed++
+	}
+}
+
+func (s *Supervisor) emit(ch Channel, ev Event) {
+	if s.onEvent != nil {
+		s.onEvent(ch, ev)
+	}
+}
+
+// MinerStats returns the stall counts of the transfers to a miner
+func (s *Supervisor) MinerStats(miner address.Address) MinerStats {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if ms, ok := s.miners[miner]; ok {
+		return *ms
+	}
+	return MinerStats{}
+}
+
+// Stalled returns the channels to a miner that are stalled
+func (s *Supervisor) Stalled(miner address.Address) []Channel {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	out := []Channel{}
+	for _, ch := range s.channels {
+		if ch.Miner == miner && !ch.StalledSince.IsZero() {
+			out = append(out, *ch)
+		}
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package transferwatch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisor(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := config.TransferSupervisor{
+		Enabled:           true,
+		Interval:          time.Minute,
+		StallTimeout:      time.Minute * 10,
+		RestartBackoff:    time.Minute * 5,
+		MaxRestartBackoff: time.Minute * 8,
+		MaxRestarts:       3,
+	}
+
+	var restarted []Channel
+	var events []Event
+	s := New(cfg, func(ctx context.Context, ch Channel) error {
+		restarted = append(restarted, ch)
+		return nil
+	}, func(ch Channel, ev Event) {
+		events = append(events, ev)
+	})
+
+	now := time.Unix(1000000, 0)
+	s.now = func() time.Time { return now }
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		s.Check(ctx)
+	}
+
+	miner, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	ongoing := func(sent uint64) *filclient.ChannelState {
+		return &filclient.ChannelState{Status: datatransfer.Ongoing, Sent: sent}
+	}
+
+	s.Update("chan", 1, miner, ongoing(100))
+	advance(time.Minute * 9)
+	assert.Empty(t, restarted)
+
+	// the first stall restarts the channel right away
+	advance(time.Minute * 2)
+	require.Len(t, restarted, 1)
+	assert.Equal(t, uint(1), restarted[0].DealDBID)
+	assert.Equal(t, []Event{EventStalled, EventRestarted}, events)
+	assert.Len(t, s.Stalled(miner), 1)
+
+	// the next restart waits for the backoff
+	advance(time.Minute * 4)
+	assert.Len(t, restarted, 1)
+	advance(time.Minute)
+	assert.Len(t, restarted, 2)
+
+	// progress resets the restarts
+	s.Update("chan", 1, miner, ongoing(200))
+	assert.Equal(t, EventRecovered, events[len(events)-1])
+	assert.Empty(t, s.Stalled(miner))
+
+	// the backoff doubles up to the max and the channel fails once out of
+	// restarts
+	events = nil
+	advance(time.Minute * 10)
+	advance(time.Minute * 5)
+	advance(time.Minute * 8)
+	assert.Len(t, restarted, 5)
+	advance(time.Minute * 7)
+	assert.Len(t, restarted, 5)
+	advance(time.Minute)
+	assert.Equal(t, []Event{EventStalled, EventRestarted, EventRestarted, EventRestarted, EventFailed}, events)
+	assert.Empty(t, s.Stalled(miner))
+
+	assert.Equal(t, MinerStats{
+		Stalls:    2,
+		Restarts:  5,
+		Recovered: 1,
+		Failed:    1,
+		LastStall: now.Add(-time.Minute * 21),
+	}, s.MinerStats(miner))
+
+	// channels done sending are no longer tracked
+	s.Update("done", 2, miner, ongoing(10))
+	s.Update("done", 2, miner, &filclient.ChannelState{Status: datatransfer.TransferFinished, Sent: 10})
+	advance(time.Hour)
+	assert.Len(t, restarted, 5)
+
+	s.Observe(miner, EventFailed)
+	assert.Equal(t, int64(2), s.MinerStats(miner).Failed)
+}
+
+func TestSupervisorNotRestartable(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := config.TransferSupervisor{
+		Enabled:           true,
+		Interval:          time.Minute,
+		StallTimeout:      time.Minute * 10,
+		RestartBackoff:    time.Minute * 5,
+		MaxRestartBackoff: time.Minute * 8,
+		MaxRestarts:       3,
+	}
+
+	var attempts int
+	var events []Event
+	s := New(cfg, func(ctx context.Context, ch Channel) error {
+		attempts++
+		return fmt.Errorf("%w: pulled by the provider", ErrNotRestartable)
+	}, func(ch Channel, ev Event) {
+		events = append(events, ev)
+	})
+
+	now := time.Unix(1000000, 0)
+	s.now = func() time.Time { return now }
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		s.Check(ctx)
+	}
+
+	miner, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	s.Update("pull", 1, miner, &filclient.ChannelState{Status: datatransfer.Ongoing, Sent: 100})
+
+	// the stall is reported once and the channel is not counted as restarted
+	advance(time.Minute * 11)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, []Event{EventStalled}, events)
+
+	stalled := s.Stalled(miner)
+	require.Len(t, stalled, 1)
+	assert.Equal(t, 0, stalled[0].Restarts)
+	assert.True(t, stalled[0].NotRestartable)
+
+	s.Update("pull", 1, miner, &filclient.ChannelState{Status: datatransfer.Ongoing, Sent: 200})
+	assert.Equal(t, EventRecovered, events[len(events)-1])
+	assert.Empty(t, s.Stalled(miner))
+
+	// later stalls are reported without trying to restart again
+	advance(time.Minute * 11)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, EventStalled, events[len(events)-1])
+	assert.Len(t, s.Stalled(miner), 1)
+
+	// the channel gets as long to recover as the 5+5+8 minutes of restarts
+	// would have taken, then it is failed and dropped
+	advance(time.Minute * 11)
+	assert.Equal(t, EventStalled, events[len(events)-1])
+	assert.Len(t, s.Stalled(miner), 1)
+
+	advance(time.Minute * 11)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, EventFailed, events[len(events)-1])
+	assert.Empty(t, s.Stalled(miner))
+
+	st := s.MinerStats(miner)
+	assert.Equal(t, int64(2), st.Stalls)
+	assert.Equal(t, int64(0), st.Restarts)
+	assert.Equal(t, int64(1), st.Recovered)
+	assert.Equal(t, int64(1), st.Failed)
+
+	n := len(events)
+	advance(time.Hour)
+	assert.Len(t, events, n)
+}
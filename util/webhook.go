@@ -0,0 +1,72 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Events webhooks can subscribe to
+const (
+	EventPinQueued         = "pin.queued"
+	EventPinPinned         = "pin.pinned"
+	EventPinFailed         = "pin.failed"
+	EventContentAggregated = "content.aggregated"
+	EventContentOffloaded  = "content.offloaded"
+	EventDealProposed      = "deal.proposed"
+	EventDealAccepted      = "deal.accepted"
+	EventDealOnChain       = "deal.on_chain"
+	EventDealSealed        = "deal.sealed"
+	EventDealFailed        = "deal.failed"
+	EventDealRenewed       = "deal.renewed"
+)
+
+var WebhookEvents = []string{
+	EventPinQueued,
+	EventPinPinned,
+	EventPinFailed,
+	EventContentAggregated,
+	EventContentOffloaded,
+	EventDealProposed,
+	EventDealAccepted,
+	EventDealOnChain,
+	EventDealSealed,
+	EventDealFailed,
+	EventDealRenewed,
+}
+
+func IsValidWebhookEvent(ev string) bool {
+	for _, e := range WebhookEvents {
+		if e == ev {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers sent along with every webhook delivery
+const (
+	WebhookHeaderEvent     = "X-Estuary-Event"
+	WebhookHeaderDelivery  = "X-Estuary-Delivery"
+	WebhookHeaderTimestamp = "X-Estuary-Timestamp"
+	WebhookHeaderSignature = "X-Estuary-Signature"
+)
+
+// SignWebhookPayload computes the value of the signature header for a
+// delivery: a hex encoded HMAC-SHA256, keyed with the webhook secret, of the
+// timestamp header and the request body joined by a dot. Receivers should
+// recompute it and reject deliveries with old timestamps to prevent replays.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhookSignature checks a signature produced by SignWebhookPayload
+func VerifyWebhookSignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"event":"pin.pinned","content":1}`)
+
+	sig := SignWebhookPayload("secret", 1660000000, body)
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", sig)
+
+	assert.True(t, VerifyWebhookSignature("secret", 1660000000, body, sig))
+	assert.False(t, VerifyWebhookSignature("other", 1660000000, body, sig))
+	assert.False(t, VerifyWebhookSignature("secret", 1660000001, body, sig))
+	assert.False(t, VerifyWebhookSignature("secret", 1660000000, []byte(`{}`), sig))
+}
+
+func TestIsValidWebhookEvent(t *testing.T) {
+	assert.True(t, IsValidWebhookEvent(EventDealSealed))
+	assert.False(t, IsValidWebhookEvent("deal.exploded"))
+}
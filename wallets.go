@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// userWallet is the wallet the deals for the content of a user are made from
+// with the per-user wallet policy
+type userWallet struct {
+	gorm.Model
+	UserID  uint `gorm:"uniqueIndex"`
+	Address string
+}
+
+// balances are only refreshed this often, most-datacap and the datacap
+// checks would otherwise query the chain for every wallet on every deal
+const walletBalanceCacheAge = time.Minute
+
+type cachedBalance struct {
+	balance *filclient.Balance
+	fetched time.Time
+}
+
+// walletPool is the client addresses deals are made from, each with its own
+// market escrow and datacap. The client of the primary wallet also does
+// everything not tied to a wallet, like transfers, asks and retrievals.
+type walletPool struct {
+	db      *gorm.DB
+	policy  string
+	addrs   []address.Address
+	clients map[address.Address]dealClient
+
+	lk       sync.Mutex
+	next     int
+	balances map[address.Address]cachedBalance
+	// paused wallets make no new deals, by the reason they were paused for
+	paused map[address.Address]string
+}
+
+// newWalletPool sets up the pool with the primary client and a client from
+// forWallet for each configured address
+func newWalletPool(db *gorm.DB, primary dealClient, cfg config.Wallets, forWallet func(address.Address) (dealClient, error)) (*walletPool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	wp := &walletPool{
+		db:       db,
+		policy:   cfg.Policy,
+		addrs:    []address.Address{primary.ClientAddress()},
+		clients:  map[address.Address]dealClient{primary.ClientAddress(): primary},
+		balances: make(map[address.Address]cachedBalance),
+		paused:   make(map[address.Address]string),
+	}
+	if wp.policy == "" {
+		wp.policy = config.WalletPolicyRoundRobin
+	}
+
+	for _, a := range cfg.Addresses {
+		addr, err := address.NewFromString(a)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := wp.clients[addr]; ok {
+			continue
+		}
+
+		fc, err := forWallet(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up wallet %s: %w", addr, err)
+		}
+
+		wp.addrs = append(wp.addrs, addr)
+		wp.clients[addr] = fc
+	}
+	return wp, nil
+}
+
+func (wp *walletPool) Primary() dealClient {
+	return wp.clients[wp.addrs[0]]
+}
+
+func (wp *walletPool) SetPieceCommFunc(pcf filclient.GetPieceCommFunc) {
+	for _, fc := range wp.clients {
+		fc.SetPieceCommFunc(pcf)
+	}
+}
+
+// clientFor returns the client of the wallet a deal was made from, deals
+// from before the pool have no wallet recorded and are from the primary one
+func (wp *walletPool) clientFor(wallet string) (dealClient, error) {
+	if wallet == "" {
+		return wp.Primary(), nil
+	}
+
+	addr, err := address.NewFromString(wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	fc, ok := wp.clients[addr]
+	if !ok {
+		return nil, fmt.Errorf("wallet %s is not in the wallet pool", wallet)
+	}
+	return fc, nil
+}
+
+// setPaused stops deal making from a wallet, an empty reason resumes it
+func (wp *walletPool) setPaused(addr address.Address, reason string) {
+	wp.lk.Lock()
+	defer wp.lk.Unlock()
+
+	if reason == "" {
+		delete(wp.paused, addr)
+		return
+	}
+	wp.paused[addr] = reason
+}
+
+func (wp *walletPool) pausedReason(addr address.Address) string {
+	wp.lk.Lock()
+	defer wp.lk.Unlock()
+	return wp.paused[addr]
+}
+
+// usable returns the wallets deals can be made from
+func (wp *walletPool) usable() []address.Address {
+	wp.lk.Lock()
+	defer wp.lk.Unlock()
+
+	out := make([]address.Address, 0, len(wp.addrs))
+	for _, addr := range wp.addrs {
+		if _, ok := wp.paused[addr]; !ok {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+func (wp *walletPool) balance(ctx context.Context, addr address.Address) (*filclient.Balance, error) {
+	return wp.balanceNoOlderThan(ctx, addr, walletBalanceCacheAge)
+}
+
+func (wp *walletPool) balanceNoOlderThan(ctx context.Context, addr address.Address, maxAge time.Duration) (*filclient.Balance, error) {
+	wp.lk.Lock()
+	cb, ok := wp.balances[addr]
+	wp.lk.Unlock()
+	if ok && time.Since(cb.fetched) < maxAge {
+		return cb.balance, nil
+	}
+
+	bl, err := wp.clients[addr].Balance(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("could not retrieve balance of wallet %s: %w", addr, err)
+	}
+
+	wp.lk.Lock()
+	wp.balances[addr] = cachedBalance{balance: bl, fetched: time.Now()}
+	wp.lk.Unlock()
+	return bl, nil
+}
+
+// Balances returns the balance of every wallet, the primary one first
+func (wp *walletPool) Balances(ctx context.Context) ([]*filclient.Balance, error) {
+	out := make([]*filclient.Balance, 0, len(wp.addrs))
+	for _, addr := range wp.addrs {
+		bl, err := wp.balance(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bl)
+	}
+	return out, nil
+}
+
+func datacapOf(bl *filclient.Balance) abi.StoragePower {
+	if bl.VerifiedClientBalance == nil {
+		return big.Zero()
+	}
+	return *bl.VerifiedClientBalance
+}
+
+// datacap returns the largest datacap a single wallet has, which bounds the
+// size of a verified deal, and the datacap of the whole pool. Paused wallets
+// are left out, no deals are made from them.
+func (wp *walletPool) datacap(ctx context.Context) (abi.StoragePower, abi.StoragePower, error) {
+	largest := big.Zero()
+	total := big.Zero()
+	for _, addr := range wp.usable() {
+		bl, err := wp.balance(ctx, addr)
+		if err != nil {
+			return big.Zero(), big.Zero(), err
+		}
+
+		dc := datacapOf(bl)
+		if dc.GreaterThan(largest) {
+			largest = dc
+		}
+		total = big.Add(total, dc)
+	}
+	return largest, total, nil
+}
+
+// pick returns the client of the wallet to make deals for a content from,
+// according to the wallet policy. Verified deals are only assigned to wallets
+// with enough datacap, except with the per-user policy, and paused wallets
+// are never picked.
+func (wp *walletPool) pick(ctx context.Context, content Content, size abi.PaddedPieceSize, verified bool) (dealClient, error) {
+	usable := wp.usable()
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("deal making is paused for every wallet")
+	}
+
+	switch wp.policy {
+	case config.WalletPolicyPerUser:
+		addr, err := wp.userWallet(content.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		if reason := wp.pausedReason(addr); reason != "" {
+			return nil, fmt.Errorf("deal making from wallet %s of user %d is paused: %s", addr, content.UserID, reason)
+		}
+		return wp.clients[addr], nil
+	case config.WalletPolicyMostDatacap:
+		return wp.pickMostFunded(ctx, usable, verified)
+	default:
+		return wp.pickRoundRobin(ctx, usable, size, verified)
+	}
+}
+
+func (wp *walletPool) pickRoundRobin(ctx context.Context, addrs []address.Address, size abi.PaddedPieceSize, verified bool) (dealClient, error) {
+	wp.lk.Lock()
+	start := wp.next
+	wp.next++
+	wp.lk.Unlock()
+
+	for i := range addrs {
+		addr := addrs[(start+i)%len(addrs)]
+		if !verified {
+			return wp.clients[addr], nil
+		}
+
+		bl, err := wp.balance(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if datacapOf(bl).GreaterThanEqual(big.NewIntUnsigned(uint64(size))) {
+			return wp.clients[addr], nil
+		}
+	}
+	return nil, fmt.Errorf("no wallet has %d bytes of datacap left", size)
+}
+
+func (wp *walletPool) pickMostFunded(ctx context.Context, addrs []address.Address, verified bool) (dealClient, error) {
+	var best address.Address
+	most := big.NewInt(-1)
+	for _, addr := range addrs {
+		bl, err := wp.balance(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		funds := types.BigInt(bl.MarketAvailable)
+		if verified {
+			funds = datacapOf(bl)
+		}
+
+		if funds.GreaterThan(most) {
+			best = addr
+			most = funds
+		}
+	}
+	return wp.clients[best], nil
+}
+
+// userWallet returns the wallet assigned to a user, users without one are
+// spread over the pool by their ID
+func (wp *walletPool) userWallet(user uint) (address.Address, error) {
+	var uws []userWallet
+	if err := wp.db.Where("user_id = ?", user).Limit(1).Find(&uws).Error; err != nil {
+		return address.Undef, err
+	}
+
+	if len(uws) > 0 {
+		addr, err := address.NewFromString(uws[0].Address)
+		if err != nil {
+			return address.Undef, err
+		}
+
+		if _, ok := wp.clients[addr]; ok {
+			return addr, nil
+		}
+		log.Warnw("wallet assigned to user is not in the wallet pool", "user", user, "wallet", addr)
+	}
+	return wp.addrs[int(user)%len(wp.addrs)], nil
+}
+
+// dealStatus asks the miner for the state of a deal, as the wallet the deal
+// was made from since miners only answer the client of a deal
+func (cm *ContentManager) dealStatus(ctx context.Context, d contentDeal, maddr address.Address, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, error) {
+	fc, err := cm.Wallets.clientFor(d.Wallet)
+	if err != nil {
+		return nil, err
+	}
+	return fc.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+}
+
+type walletBalances struct {
+	Policy  string               `json:"policy"`
+	Wallets []*filclient.Balance `json:"wallets"`
+}
+
+// handleAdminBalance godoc
+// @Summary      Get the balances of the wallets
+// @Description  This endpoint returns the balance, market escrow and datacap of every wallet deals are made from, the primary wallet first.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  walletBalances
+// @Router       /admin/balance [get]
+func (s *Server) handleAdminBalance(c echo.Context) error {
+	bls, err := s.CM.Wallets.Balances(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &walletBalances{
+		Policy:  s.CM.Wallets.policy,
+		Wallets: bls,
+	})
+}
+
+// handleAdminAddEscrow godoc
+// @Summary      Add funds to the market escrow of a wallet
+// @Description  This endpoint locks funds in the market escrow of a wallet, the primary wallet when none is given.
+// @Tags         admin
+// @Produce      json
+// @Param        amt     path   string  true   "Amount of FIL"
+// @Param        wallet  query  string  false  "Wallet address"
+// @Router       /admin/add-escrow/{amt} [post]
+func (s *Server) handleAdminAddEscrow(c echo.Context) error {
+	amt, err := types.ParseFIL(c.Param("amt"))
+	if err != nil {
+		return err
+	}
+
+	fc, err := s.CM.Wallets.clientFor(c.QueryParam("wallet"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	resp, err := fc.LockMarketFunds(c.Request().Context(), amt)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type userWalletBody struct {
+	Address string `json:"address"`
+}
+
+// handleAdminGetUserWallet godoc
+// @Summary      Get the wallet of a user
+// @Description  This endpoint returns the wallet assigned to a user for the per-user wallet policy. An empty address means the user is assigned a wallet by its ID.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int  true  "User ID"
+// @Success      200     {object}  userWalletBody
+// @Router       /admin/users/{userid}/wallet [get]
+func (s *Server) handleAdminGetUserWallet(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	var uws []userWallet
+	if err := s.DB.Where("user_id = ?", user.ID).Limit(1).Find(&uws).Error; err != nil {
+		return err
+	}
+
+	var out userWalletBody
+	if len(uws) > 0 {
+		out.Address = uws[0].Address
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAdminSetUserWallet godoc
+// @Summary      Set the wallet of a user
+// @Description  This endpoint assigns a wallet of the pool to a user, deals for the content of the user are made from it with the per-user wallet policy. An empty address removes the assignment.
+// @Tags         admin
+// @Produce      json
+// @Param        userid  path      int             true  "User ID"
+// @Param        body    body      userWalletBody  true  "Wallet address"
+// @Success      200     {object}  userWalletBody
+// @Router       /admin/users/{userid}/wallet [put]
+func (s *Server) handleAdminSetUserWallet(c echo.Context) error {
+	user, err := s.getUserByParam(c)
+	if err != nil {
+		return err
+	}
+
+	var body userWalletBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.Address != "" {
+		fc, err := s.CM.Wallets.clientFor(body.Address)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		body.Address = fc.ClientAddress().String()
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&userWallet{}).Error; err != nil {
+			return err
+		}
+
+		if body.Address == "" {
+			return nil
+		}
+
+		return tx.Create(&userWallet{
+			UserID:  user.ID,
+			Address: body.Address,
+		}).Error
+	}); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, body)
+}
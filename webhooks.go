@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	webhookMaxAttempts    = 8
+	webhookInitialBackoff = time.Second * 30
+	webhookMaxBackoff     = time.Hour * 6
+	webhookRequestTimeout = time.Second * 15
+	webhookPollInterval   = time.Second * 10
+	webhookMaxConcurrent  = 8
+	webhookEventQueueSize = 1024
+)
+
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint a user registered to be notified of events on their
+// content, pins and deals
+type Webhook struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	UUID      string    `gorm:"unique" json:"uuid"`
+	UserID    uint      `gorm:"index" json:"-"`
+	URL       string    `json:"url"`
+	Events    string    `json:"-"` // comma separated list of subscribed events
+	Secret    string    `json:"-"`
+}
+
+func (wh *Webhook) subscribedTo(event string) bool {
+	for _, ev := range strings.Split(wh.Events, ",") {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records every attempt at delivering an event to a webhook
+type WebhookDelivery struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	Webhook     uint       `gorm:"index" json:"-"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload"`
+	Status      string     `gorm:"index" json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `gorm:"index" json:"nextAttempt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// lifecycleEvent describes a change to a users content, pins or deals. It is
+// the body of webhook deliveries and of the messages on the event stream.
+type lifecycleEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Content uint      `json:"content,omitempty"`
+	Cid     string    `json:"cid,omitempty"`
+	Deal    uint      `json:"deal,omitempty"`
+	DealID  int64     `json:"dealId,omitempty"`
+	Miner   string    `json:"miner,omitempty"`
+	Message string    `json:"message,omitempty"`
+
+	Transfer *filclient.ChannelState `json:"transfer,omitempty"`
+}
+
+// webhookDispatcher queues events for the webhooks subscribed to them and
+// delivers them in the background, retrying with exponential backoff
+type webhookDispatcher struct {
+	DB     *gorm.DB
+	client *http.Client
+	kick   chan struct{}
+	events chan userEvent
+}
+
+type userEvent struct {
+	user uint
+	ev   *lifecycleEvent
+}
+
+func newWebhookDispatcher(db *gorm.DB) *webhookDispatcher {
+	return &webhookDispatcher{
+		DB:     db,
+		client: newWebhookClient(),
+		kick:   make(chan struct{}, 1),
+		events: make(chan userEvent, webhookEventQueueSize),
+	}
+}
+
+// newWebhookClient returns a client that refuses to connect to addresses
+// that are not public. The check is made on the address being dialed, so a
+// hostname that resolved to a public address when the webhook was registered
+// cannot be pointed at an internal one later, nor can a redirect.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: webhookRequestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookRequestTimeout,
+			MaxIdleConns:        webhookMaxConcurrent,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// emit hands ev to Run to be queued for every webhook of user subscribed to
+// it. It is called from the content and deal paths, so it never blocks on the
+// database: if Run falls too far behind the event is dropped.
+func (wd *webhookDispatcher) emit(user uint, ev *lifecycleEvent) {
+	if user == 0 {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	select {
+	case wd.events <- userEvent{user: user, ev: ev}:
+	default:
+		log.Warnf("webhook event queue is full, dropping %s event for user %d", ev.Event, user)
+	}
+}
+
+// queue records a delivery of ev for every webhook of user subscribed to it.
+// Failing to queue an event must not interfere with whatever triggered it, so
+// errors are only logged.
+func (wd *webhookDispatcher) queue(user uint, ev *lifecycleEvent) {
+	var hooks []Webhook
+	if err := wd.DB.Find(&hooks, "user_id = ?", user).Error; err != nil {
+		log.Errorf("failed to look up webhooks for user %d: %s", user, err)
+		return
+	}
+
+	var queued bool
+	for _, wh := range hooks {
+		if !wh.subscribedTo(ev.Event) {
+			continue
+		}
+
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Errorf("failed to marshal webhook event: %s", err)
+			return
+		}
+
+		if err := wd.DB.Create(&WebhookDelivery{
+			Webhook:     wh.ID,
+			Event:       ev.Event,
+			Payload:     string(payload),
+			Status:      webhookDeliveryPending,
+			NextAttempt: time.Now(),
+		}).Error; err != nil {
+			log.Errorf("failed to queue webhook delivery for webhook %d: %s", wh.ID, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case wd.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run queues emitted events and delivers them until ctx is cancelled
+func (wd *webhookDispatcher) Run(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case ue := <-wd.events:
+				wd.queue(ue.user, ue.ev)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := wd.deliverPending(ctx); err != nil {
+			log.Errorf("failed to deliver webhooks: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-wd.kick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (wd *webhookDispatcher) deliverPending(ctx context.Context) error {
+	var pending []*WebhookDelivery
+	if err := wd.DB.Where("status = ? AND next_attempt <= ?", webhookDeliveryPending, time.Now()).
+		Order("next_attempt asc").Limit(100).Find(&pending).Error; err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, webhookMaxConcurrent)
+	for _, d := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d *WebhookDelivery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := wd.attempt(ctx, d); err != nil {
+				log.Errorf("failed to record webhook delivery %d: %s", d.ID, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (wd *webhookDispatcher) attempt(ctx context.Context, d *WebhookDelivery) error {
+	var wh Webhook
+	if err := wd.DB.First(&wh, "id = ?", d.Webhook).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			// the webhook was deleted, nothing left to deliver to
+			return wd.DB.Model(d).Updates(map[string]interface{}{
+				"status":     webhookDeliveryFailed,
+				"last_error": "webhook was deleted",
+			}).Error
+		}
+		return err
+	}
+
+	code, err := wd.send(ctx, &wh, d)
+
+	updates := map[string]interface{}{
+		"attempts":    d.Attempts + 1,
+		"status_code": code,
+		"last_error":  "",
+	}
+
+	switch {
+	case err == nil:
+		updates["status"] = webhookDeliveryDelivered
+		updates["delivered_at"] = time.Now()
+	case d.Attempts+1 >= webhookMaxAttempts:
+		updates["status"] = webhookDeliveryFailed
+		updates["last_error"] = err.Error()
+	default:
+		updates["next_attempt"] = time.Now().Add(webhookBackoff(d.Attempts + 1))
+		updates["last_error"] = err.Error()
+	}
+
+	return wd.DB.Model(d).Updates(updates).Error
+}
+
+func (wd *webhookDispatcher) send(ctx context.Context, wh *Webhook, d *WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	ts := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(util.WebhookHeaderEvent, d.Event)
+	req.Header.Set(util.WebhookHeaderDelivery, strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set(util.WebhookHeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(util.WebhookHeaderSignature, util.SignWebhookPayload(wh.Secret, ts, body))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the response body is not recorded, it is shown to the user and could
+	// leak what the endpoint serves
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func (cm *ContentManager) notifyContentEvent(event string, cont *Content, msg string) {
+	cm.notifyUser(cont.UserID, &lifecycleEvent{
+		Event:   event,
+		Content: cont.ID,
+		Cid:     cont.Cid.CID.String(),
+		Message: msg,
+	})
+}
+
+func (cm *ContentManager) notifyDealEvent(event string, d *contentDeal, msg string) {
+	ev := &lifecycleEvent{
+		Event:   event,
+		Content: d.Content,
+		Deal:    d.ID,
+		DealID:  d.DealID,
+		Miner:   d.Miner,
+		Message: msg,
+	}
+
+	if cont, err := cm.getContent(d.Content); err == nil {
+		ev.Cid = cont.Cid.CID.String()
+	}
+
+	cm.notifyUser(d.UserID, ev)
+}
+
+func (cm *ContentManager) notifyDealFailure(dfe *DealFailureError) {
+	ev := &lifecycleEvent{
+		Event:   util.EventDealFailed,
+		Content: dfe.Content,
+		Message: fmt.Sprintf("%s: %s", dfe.Phase, dfe.Message),
+	}
+
+	if dfe.Miner != address.Undef {
+		ev.Miner = dfe.Miner.String()
+	}
+
+	if cont, err := cm.getContent(dfe.Content); err == nil {
+		ev.Cid = cont.Cid.CID.String()
+	}
+
+	cm.notifyUser(dfe.UserID, ev)
+}
+
+func (cm *ContentManager) notifyPinStatus(location string, contID uint, status types.PinningStatus) {
+	var event string
+	switch status {
+	case types.PinningStatusQueued:
+		event = util.EventPinQueued
+	case types.PinningStatusPinning:
+		event = eventPinPinning
+	case types.PinningStatusFailed:
+		event = util.EventPinFailed
+	case types.PinningStatusPinned:
+		// pins on shuttles are reported through handlePinningComplete
+		if location != util.ContentLocationLocal {
+			return
+		}
+		event = util.EventPinPinned
+	default:
+		return
+	}
+
+	cont, err := cm.getContent(contID)
+	if err != nil {
+		log.Errorf("failed to look up content %d for pin status webhook: %s", contID, err)
+		return
+	}
+
+	cm.notifyContentEvent(event, cont, "")
+}
+
+func (cm *ContentManager) notifyAggregated(b *contentStagingZone) {
+	for i := range b.Contents {
+		cm.notifyContentEvent(util.EventContentAggregated, &b.Contents[i], fmt.Sprintf("aggregated into content %d", b.ContID))
+	}
+}
+
+type createWebhookBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type webhookResponse struct {
+	*Webhook
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+func newWebhookResponse(wh *Webhook) *webhookResponse {
+	return &webhookResponse{
+		Webhook: wh,
+		Events:  strings.Split(wh.Events, ","),
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// handleCreateWebhook godoc
+// @Summary      Register a webhook
+// @Description  This endpoint registers a webhook that is called for the given events. Deliveries are signed with the returned secret, which is only shown once.
+// @Tags         User
+// @Produce      json
+// @Param        body  body      createWebhookBody  true  "Webhook"
+// @Success      200   {object}  webhookResponse
+// @Router       /user/webhooks [post]
+func (s *Server) handleCreateWebhook(c echo.Context, u *User) error {
+	var body createWebhookBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := validateWebhookURL(c.Request().Context(), body.URL); err != nil {
+		return err
+	}
+
+	if len(body.Events) == 0 {
+		body.Events = util.WebhookEvents
+	}
+
+	for _, ev := range body.Events {
+		if !util.IsValidWebhookEvent(ev) {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("unknown event: %q", ev),
+			}
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+
+	wh := &Webhook{
+		UUID:   uuid.New().String(),
+		UserID: u.ID,
+		URL:    body.URL,
+		Events: strings.Join(body.Events, ","),
+		Secret: secret,
+	}
+
+	if err := s.DB.Create(wh).Error; err != nil {
+		return err
+	}
+
+	resp := newWebhookResponse(wh)
+	resp.Secret = wh.Secret
+	return c.JSON(http.StatusOK, resp)
+}
+
+// validateWebhookURL rejects urls that are not http(s) or whose host resolves
+// to an address that is not public, such as a loopback, private or link-local
+// one. The client checks again on every connection, see newWebhookClient.
+func validateWebhookURL(ctx context.Context, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid webhook url: %q", u),
+		}
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("failed to resolve webhook host %q: %s", parsed.Hostname(), err),
+		}
+	}
+
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("webhook host %q resolves to %s, which is not a public address", parsed.Hostname(), ip.IP),
+			}
+		}
+	}
+	return nil
+}
+
+// handleListWebhooks godoc
+// @Summary      List webhooks
+// @Description  This endpoint lists the webhooks registered by the user.
+// @Tags         User
+// @Produce      json
+// @Success      200  {array}  webhookResponse
+// @Router       /user/webhooks [get]
+func (s *Server) handleListWebhooks(c echo.Context, u *User) error {
+	var hooks []*Webhook
+	if err := s.DB.Find(&hooks, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	out := make([]*webhookResponse, 0, len(hooks))
+	for _, wh := range hooks {
+		out = append(out, newWebhookResponse(wh))
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func (s *Server) getWebhookForUser(whuuid string, u *User) (*Webhook, error) {
+	var wh Webhook
+	if err := s.DB.First(&wh, "uuid = ? AND user_id = ?", whuuid, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_WEBHOOK_NOT_FOUND,
+				Details: fmt.Sprintf("webhook %s not found", whuuid),
+			}
+		}
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// handleDeleteWebhook godoc
+// @Summary      Delete a webhook
+// @Description  This endpoint deletes a webhook, pending deliveries are dropped.
+// @Tags         User
+// @Param        webhook  path  string  true  "Webhook UUID"
+// @Router       /user/webhooks/{webhook} [delete]
+func (s *Server) handleDeleteWebhook(c echo.Context, u *User) error {
+	wh, err := s.getWebhookForUser(c.Param("webhook"), u)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Delete(wh).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleGetWebhookDeliveries godoc
+// @Summary      List webhook deliveries
+// @Description  This endpoint lists the most recent deliveries of a webhook along with their status.
+// @Tags         User
+// @Produce      json
+// @Param        webhook  path      string  true   "Webhook UUID"
+// @Param        limit    query     int     false  "Limit"
+// @Success      200      {array}   WebhookDelivery
+// @Router       /user/webhooks/{webhook}/deliveries [get]
+func (s *Server) handleGetWebhookDeliveries(c echo.Context, u *User) error {
+	wh, err := s.getWebhookForUser(c.Param("webhook"), u)
+	if err != nil {
+		return err
+	}
+
+	limit := 100
+	if limstr := c.QueryParam("limit"); limstr != "" {
+		nlim, err := strconv.Atoi(limstr)
+		if err != nil {
+			return err
+		}
+
+		if nlim > 0 && nlim < limit {
+			limit = nlim
+		}
+	}
+
+	var deliveries []*WebhookDelivery
+	if err := s.DB.Order("created_at desc").Limit(limit).Find(&deliveries, "webhook = ?", wh.ID).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}